@@ -0,0 +1,326 @@
+/*
+Copyright 2022. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/go-logr/logr"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	libsveltosv1beta1 "github.com/projectsveltos/libsveltos/api/v1beta1"
+	logs "github.com/projectsveltos/libsveltos/lib/logsettings"
+)
+
+const (
+	// accessRequestClassifiersAnnotation is set on AccessRequests created for sveltos-agents.
+	// There is one AccessRequest per cluster (two while sveltos-agent kubeconfig is being rotated),
+	// shared by all Classifiers deployed in such cluster.
+	// Value is a JSON list with the names of those Classifiers. AccessRequest is removed once
+	// the list is empty or the cluster is gone.
+	accessRequestClassifiersAnnotation = "classifier.projectsveltos.io/classifiers"
+)
+
+// getAccessRequestNames returns the names an AccessRequest created for sveltos-agents in a cluster can have.
+// Rotating sveltos-agent kubeconfig issues a new AccessRequest using the name not currently in use.
+func getAccessRequestNames(clusterName string, clusterType libsveltosv1beta1.ClusterType) []string {
+	name := getAccessRequestName(clusterName, clusterType)
+	return []string{name, name + rotatedAccessRequestSuffix}
+}
+
+// getClusterAccessRequests returns the AccessRequest created for sveltos-agents in a cluster. While
+// sveltos-agent kubeconfig is being rotated, previous is the AccessRequest being replaced, whose kubeconfig
+// sveltos-agent might still use. AccessRequests being deleted are ignored.
+// Returns nil if no AccessRequest exists for the cluster.
+func getClusterAccessRequests(ctx context.Context, c client.Client, clusterNamespace, clusterName string,
+	clusterType libsveltosv1beta1.ClusterType) (current, previous *libsveltosv1beta1.AccessRequest, err error) {
+
+	accessRequests := make([]*libsveltosv1beta1.AccessRequest, 0, 2)
+	for _, name := range getAccessRequestNames(clusterName, clusterType) {
+		accessRequest := &libsveltosv1beta1.AccessRequest{}
+		err = c.Get(ctx, types.NamespacedName{Namespace: clusterNamespace, Name: name}, accessRequest)
+		if err != nil {
+			if apierrors.IsNotFound(err) {
+				continue
+			}
+			return nil, nil, err
+		}
+		if !accessRequest.DeletionTimestamp.IsZero() {
+			continue
+		}
+		accessRequests = append(accessRequests, accessRequest)
+	}
+
+	switch len(accessRequests) {
+	case 0:
+		return nil, nil, nil
+	case 1:
+		return accessRequests[0], nil, nil
+	}
+
+	current, previous = accessRequests[0], accessRequests[1]
+	switch {
+	case current.Annotations[accessRequestReplacesAnnotation] == previous.Name:
+	case previous.Annotations[accessRequestReplacesAnnotation] == current.Name,
+		previous.CreationTimestamp.After(current.CreationTimestamp.Time):
+
+		current, previous = previous, current
+	}
+
+	return current, previous, nil
+}
+
+// getAccessRequestClassifiers returns the names of the Classifiers referencing an AccessRequest.
+// Returns nil if AccessRequest does not track Classifiers (created by a previous version).
+func getAccessRequestClassifiers(accessRequest *libsveltosv1beta1.AccessRequest) ([]string, error) {
+	value, ok := accessRequest.Annotations[accessRequestClassifiersAnnotation]
+	if !ok {
+		return nil, nil
+	}
+
+	classifiers := make([]string, 0)
+	if err := json.Unmarshal([]byte(value), &classifiers); err != nil {
+		return nil, fmt.Errorf("invalid annotation %s: %w", accessRequestClassifiersAnnotation, err)
+	}
+
+	return classifiers, nil
+}
+
+// setAccessRequestClassifiers stores on the AccessRequest the names of the Classifiers referencing it
+func setAccessRequestClassifiers(accessRequest *libsveltosv1beta1.AccessRequest, classifiers []string) error {
+	sort.Strings(classifiers)
+	value, err := json.Marshal(classifiers)
+	if err != nil {
+		return err
+	}
+
+	if accessRequest.Annotations == nil {
+		accessRequest.Annotations = make(map[string]string)
+	}
+	accessRequest.Annotations[accessRequestClassifiersAnnotation] = string(value)
+	return nil
+}
+
+// trackAccessRequestClassifiers starts tracking the Classifiers referencing an AccessRequest created by a
+// previous version (or whose annotation is corrupted). Those are all the Classifiers deployed in the cluster
+// (clusterClassifiers).
+// Returns true if AccessRequest was modified.
+func trackAccessRequestClassifiers(accessRequest *libsveltosv1beta1.AccessRequest, clusterClassifiers []string,
+) (bool, error) {
+
+	classifiers, err := getAccessRequestClassifiers(accessRequest)
+	if err == nil && classifiers != nil {
+		return false, nil
+	}
+
+	return true, setAccessRequestClassifiers(accessRequest, append([]string{}, clusterClassifiers...))
+}
+
+// getAccessRequestOwner returns the Classifier in charge of the AccessRequest kubeconfig: the first one, in
+// alphabetical order, of the Classifiers referencing it. AccessRequest created by a previous version starts
+// tracking Classifiers first. Returns an empty string if no Classifier references the AccessRequest.
+func getAccessRequestOwner(ctx context.Context, c client.Client, accessRequest *libsveltosv1beta1.AccessRequest,
+	clusterClassifiers []string) (string, error) {
+
+	tracked, err := trackAccessRequestClassifiers(accessRequest, clusterClassifiers)
+	if err != nil {
+		return "", err
+	}
+	if tracked {
+		if err := c.Update(ctx, accessRequest); err != nil {
+			return "", err
+		}
+	}
+
+	classifiers, err := getAccessRequestClassifiers(accessRequest)
+	if err != nil || len(classifiers) == 0 {
+		return "", err
+	}
+	return classifiers[0], nil
+}
+
+// addAccessRequestClassifier adds a Classifier to the ones referencing the AccessRequest.
+// Returns true if AccessRequest was modified.
+func addAccessRequestClassifier(accessRequest *libsveltosv1beta1.AccessRequest, classifierName string,
+) (bool, error) {
+
+	classifiers, err := getAccessRequestClassifiers(accessRequest)
+	if err != nil {
+		// Annotation is corrupted. Start tracking Classifiers again.
+		classifiers = nil
+	}
+
+	for i := range classifiers {
+		if classifiers[i] == classifierName {
+			return false, nil
+		}
+	}
+
+	return true, setAccessRequestClassifiers(accessRequest, append(classifiers, classifierName))
+}
+
+// releaseAccessRequest removes a Classifier from the ones referencing the AccessRequest.
+// AccessRequest is deleted once no Classifier references it anymore.
+// AccessRequests not tracking Classifiers are left untouched: those are removed when cluster is gone.
+func releaseAccessRequest(ctx context.Context, c client.Client, accessRequest *libsveltosv1beta1.AccessRequest,
+	classifierName string, logger logr.Logger) error {
+
+	classifiers, err := getAccessRequestClassifiers(accessRequest)
+	if err != nil {
+		logger.V(logs.LogInfo).Info(fmt.Sprintf("failed to get Classifiers using AccessRequest %s/%s: %v",
+			accessRequest.Namespace, accessRequest.Name, err))
+		return nil
+	}
+	if classifiers == nil {
+		return nil
+	}
+
+	remaining := make([]string, 0, len(classifiers))
+	for i := range classifiers {
+		if classifiers[i] != classifierName {
+			remaining = append(remaining, classifiers[i])
+		}
+	}
+
+	if len(remaining) == len(classifiers) {
+		return nil
+	}
+
+	if len(remaining) == 0 {
+		logger.V(logs.LogDebug).Info(fmt.Sprintf("no Classifier is using AccessRequest %s/%s anymore. Removing it",
+			accessRequest.Namespace, accessRequest.Name))
+		err = c.Delete(ctx, accessRequest)
+		if err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+		// AccessRequest being replaced by a kubeconfig rotation is not needed anymore either
+		return deleteReplacedAccessRequest(ctx, c, accessRequest)
+	}
+
+	if err := setAccessRequestClassifiers(accessRequest, remaining); err != nil {
+		return err
+	}
+	return c.Update(ctx, accessRequest)
+}
+
+// deleteReplacedAccessRequest deletes, if any, the AccessRequest replaced by accessRequest
+func deleteReplacedAccessRequest(ctx context.Context, c client.Client, accessRequest *libsveltosv1beta1.AccessRequest,
+) error {
+
+	replaced, ok := accessRequest.Annotations[accessRequestReplacesAnnotation]
+	if !ok {
+		return nil
+	}
+
+	previous := &libsveltosv1beta1.AccessRequest{}
+	previous.Namespace = accessRequest.Namespace
+	previous.Name = replaced
+	err := c.Delete(ctx, previous)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// releaseClusterAccessRequest removes a Classifier from the ones referencing the AccessRequest
+// created for a cluster. AccessRequest is deleted once no Classifier references it anymore.
+func releaseClusterAccessRequest(ctx context.Context, c client.Client, clusterNamespace, clusterName string,
+	clusterType libsveltosv1beta1.ClusterType, classifierName string, logger logr.Logger) error {
+
+	accessRequest, _, err := getClusterAccessRequests(ctx, c, clusterNamespace, clusterName, clusterType)
+	if err != nil || accessRequest == nil {
+		return err
+	}
+
+	return releaseAccessRequest(ctx, c, accessRequest, classifierName, logger)
+}
+
+// releaseAccessRequests removes a Classifier from the ones referencing any AccessRequest generated
+// for sveltos-agents. Invoked when Classifier is deleted.
+func releaseAccessRequests(ctx context.Context, c client.Client, classifierName string,
+	logger logr.Logger) error {
+
+	accessRequestList := &libsveltosv1beta1.AccessRequestList{}
+
+	listOptions := []client.ListOption{
+		client.MatchingLabels{
+			accessRequestClassifierLabel: "ok",
+		},
+	}
+
+	err := c.List(ctx, accessRequestList, listOptions...)
+	if err != nil {
+		return err
+	}
+
+	// AccessRequests being replaced by a kubeconfig rotation are removed along with their replacement
+	replaced := make(map[types.NamespacedName]bool)
+	for i := range accessRequestList.Items {
+		accessRequest := &accessRequestList.Items[i]
+		if name, ok := accessRequest.Annotations[accessRequestReplacesAnnotation]; ok {
+			replaced[types.NamespacedName{Namespace: accessRequest.Namespace, Name: name}] = true
+		}
+	}
+
+	for i := range accessRequestList.Items {
+		if replaced[client.ObjectKeyFromObject(&accessRequestList.Items[i])] {
+			continue
+		}
+		err = releaseAccessRequest(ctx, c, &accessRequestList.Items[i], classifierName, logger)
+		if err != nil {
+			return err
+		}
+	}
+
+	logger.V(logs.LogDebug).Info("released AccessRequests for SveltosAgents")
+	return nil
+}
+
+// removeClusterAccessRequest removes the AccessRequests generated for sveltos-agents in a cluster.
+// Invoked when cluster is gone.
+func removeClusterAccessRequest(ctx context.Context, c client.Client, clusterNamespace, clusterName string,
+	clusterType libsveltosv1beta1.ClusterType, logger logr.Logger) error {
+
+	for _, name := range getAccessRequestNames(clusterName, clusterType) {
+		accessRequest := &libsveltosv1beta1.AccessRequest{}
+		err := c.Get(ctx, types.NamespacedName{Namespace: clusterNamespace, Name: name}, accessRequest)
+		if err != nil {
+			if apierrors.IsNotFound(err) {
+				continue
+			}
+			return err
+		}
+
+		if accessRequest.Labels[accessRequestClassifierLabel] != "ok" {
+			// Not created by classifier
+			continue
+		}
+
+		logger.V(logs.LogDebug).Info(fmt.Sprintf("remove AccessRequest %s for SveltosAgents", name))
+		err = c.Delete(ctx, accessRequest)
+		if err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,181 @@
+/*
+Copyright 2022. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers_test
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog/v2/textlogger"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/projectsveltos/classifier/controllers"
+	libsveltosv1beta1 "github.com/projectsveltos/libsveltos/api/v1beta1"
+	"github.com/projectsveltos/libsveltos/lib/deployer"
+)
+
+var _ = Describe("AccessRequest lifecycle", func() {
+	var clusterNamespace, clusterName string
+	var options deployer.Options
+
+	BeforeEach(func() {
+		clusterNamespace = randomString()
+		clusterName = randomString()
+		options = deployer.Options{
+			HandlerOptions: map[string]string{controllers.Controlplaneendpoint: "https://192.168.10.1:443"},
+		}
+	})
+
+	getAccessRequest := func(c client.Client) (*libsveltosv1beta1.AccessRequest, error) {
+		accessRequest := &libsveltosv1beta1.AccessRequest{}
+		err := c.Get(context.TODO(), types.NamespacedName{
+			Namespace: clusterNamespace,
+			Name:      controllers.GetAccessRequestName(clusterName, libsveltosv1beta1.ClusterTypeSveltos),
+		}, accessRequest)
+		return accessRequest, err
+	}
+
+	It("AccessRequest is removed only once no Classifier uses it anymore", func() {
+		c := fake.NewClientBuilder().WithScheme(scheme).Build()
+		logger := textlogger.NewLogger(textlogger.NewConfig(textlogger.Verbosity(1)))
+
+		classifier1 := randomString()
+		classifier2 := randomString()
+		Expect(controllers.CreateAccessRequest(context.TODO(), c, clusterNamespace, clusterName, classifier1,
+			libsveltosv1beta1.ClusterTypeSveltos, options)).To(Succeed())
+		Expect(controllers.CreateAccessRequest(context.TODO(), c, clusterNamespace, clusterName, classifier2,
+			libsveltosv1beta1.ClusterTypeSveltos, options)).To(Succeed())
+
+		Expect(controllers.ReleaseClusterAccessRequest(context.TODO(), c, clusterNamespace, clusterName,
+			libsveltosv1beta1.ClusterTypeSveltos, classifier1, logger)).To(Succeed())
+		_, err := getAccessRequest(c)
+		Expect(err).To(BeNil())
+
+		// Deleting a Classifier only releases AccessRequests it uses
+		Expect(controllers.ReleaseAccessRequests(context.TODO(), c, classifier1, logger)).To(Succeed())
+		_, err = getAccessRequest(c)
+		Expect(err).To(BeNil())
+
+		Expect(controllers.ReleaseAccessRequests(context.TODO(), c, classifier2, logger)).To(Succeed())
+		_, err = getAccessRequest(c)
+		Expect(apierrors.IsNotFound(err)).To(BeTrue())
+	})
+
+	It("AccessRequest created by a previous version tracks Classifiers already deployed in the cluster", func() {
+		accessRequest := &libsveltosv1beta1.AccessRequest{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: clusterNamespace,
+				Name:      controllers.GetAccessRequestName(clusterName, libsveltosv1beta1.ClusterTypeSveltos),
+				Labels:    map[string]string{"projectsveltos.io/classifierrequest": "ok"},
+			},
+		}
+
+		// Classifiers deployed in the cluster are passed by the reconciler
+		deployedClassifier := randomString()
+		options.HandlerOptions[controllers.Clusterclassifiers] = deployedClassifier
+
+		c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(accessRequest).Build()
+		logger := textlogger.NewLogger(textlogger.NewConfig(textlogger.Verbosity(1)))
+
+		classifier := randomString()
+		Expect(controllers.CreateAccessRequest(context.TODO(), c, clusterNamespace, clusterName, classifier,
+			libsveltosv1beta1.ClusterTypeSveltos, options)).To(Succeed())
+
+		currentAccessRequest, err := getAccessRequest(c)
+		Expect(err).To(BeNil())
+		classifiers, err := controllers.GetAccessRequestClassifiers(currentAccessRequest)
+		Expect(err).To(BeNil())
+		Expect(classifiers).To(ConsistOf(classifier, deployedClassifier))
+
+		// AccessRequest is still used by the Classifier deployed before tracking started
+		Expect(controllers.ReleaseAccessRequests(context.TODO(), c, classifier, logger)).To(Succeed())
+		_, err = getAccessRequest(c)
+		Expect(err).To(BeNil())
+
+		Expect(controllers.ReleaseAccessRequests(context.TODO(), c, deployedClassifier, logger)).To(Succeed())
+		_, err = getAccessRequest(c)
+		Expect(apierrors.IsNotFound(err)).To(BeTrue())
+	})
+
+	It("AccessRequest being replaced by a kubeconfig rotation is removed along with its replacement", func() {
+		c := fake.NewClientBuilder().WithScheme(scheme).Build()
+		logger := textlogger.NewLogger(textlogger.NewConfig(textlogger.Verbosity(1)))
+
+		classifier := randomString()
+		Expect(controllers.CreateAccessRequest(context.TODO(), c, clusterNamespace, clusterName, classifier,
+			libsveltosv1beta1.ClusterTypeSveltos, options)).To(Succeed())
+
+		accessRequest, err := getAccessRequest(c)
+		Expect(err).To(BeNil())
+		rotatedAccessRequest := &libsveltosv1beta1.AccessRequest{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:   accessRequest.Namespace,
+				Name:        accessRequest.Name + "-rotated",
+				Labels:      accessRequest.Labels,
+				Annotations: map[string]string{controllers.AccessRequestReplacesAnnotation: accessRequest.Name},
+			},
+			Spec: accessRequest.Spec,
+		}
+		Expect(controllers.SetAccessRequestClassifiers(rotatedAccessRequest, []string{classifier})).To(Succeed())
+		Expect(c.Create(context.TODO(), rotatedAccessRequest)).To(Succeed())
+
+		// New Classifiers are tracked by the AccessRequest replacing the old one
+		otherClassifier := randomString()
+		Expect(controllers.CreateAccessRequest(context.TODO(), c, clusterNamespace, clusterName, otherClassifier,
+			libsveltosv1beta1.ClusterTypeSveltos, options)).To(Succeed())
+		Expect(c.Get(context.TODO(), client.ObjectKeyFromObject(rotatedAccessRequest), rotatedAccessRequest)).To(Succeed())
+		Expect(controllers.GetAccessRequestClassifiers(rotatedAccessRequest)).To(ConsistOf(classifier, otherClassifier))
+
+		Expect(controllers.ReleaseAccessRequests(context.TODO(), c, classifier, logger)).To(Succeed())
+		_, err = getAccessRequest(c)
+		Expect(err).To(BeNil())
+
+		Expect(controllers.ReleaseAccessRequests(context.TODO(), c, otherClassifier, logger)).To(Succeed())
+		_, err = getAccessRequest(c)
+		Expect(apierrors.IsNotFound(err)).To(BeTrue())
+		err = c.Get(context.TODO(), client.ObjectKeyFromObject(rotatedAccessRequest), rotatedAccessRequest)
+		Expect(apierrors.IsNotFound(err)).To(BeTrue())
+	})
+
+	It("AccessRequest not tracking Classifiers is removed only when cluster is gone", func() {
+		accessRequest := &libsveltosv1beta1.AccessRequest{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: clusterNamespace,
+				Name:      controllers.GetAccessRequestName(clusterName, libsveltosv1beta1.ClusterTypeSveltos),
+				Labels:    map[string]string{"projectsveltos.io/classifierrequest": "ok"},
+			},
+		}
+
+		c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(accessRequest).Build()
+		logger := textlogger.NewLogger(textlogger.NewConfig(textlogger.Verbosity(1)))
+
+		Expect(controllers.ReleaseAccessRequests(context.TODO(), c, randomString(), logger)).To(Succeed())
+		_, err := getAccessRequest(c)
+		Expect(err).To(BeNil())
+
+		Expect(controllers.RemoveClusterAccessRequest(context.TODO(), c, clusterNamespace, clusterName,
+			libsveltosv1beta1.ClusterTypeSveltos, logger)).To(Succeed())
+		_, err = getAccessRequest(c)
+		Expect(apierrors.IsNotFound(err)).To(BeTrue())
+	})
+})
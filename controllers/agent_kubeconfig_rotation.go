@@ -0,0 +1,357 @@
+/*
+Copyright 2022. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-logr/logr"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/projectsveltos/classifier/pkg/scope"
+	libsveltosv1beta1 "github.com/projectsveltos/libsveltos/api/v1beta1"
+	"github.com/projectsveltos/libsveltos/lib/clusterproxy"
+	logs "github.com/projectsveltos/libsveltos/lib/logsettings"
+)
+
+// In AgentSendReportsNoGateway mode sveltos-agent reaches the management cluster using the kubeconfig
+// generated for the cluster AccessRequest. When a maximum age is configured, such kubeconfig is rotated:
+// - once the AccessRequest is older than agentKubeconfigRotationThreshold of the maximum age, a new
+// AccessRequest (using the other of the names returned by getAccessRequestNames) is issued so that a new
+// kubeconfig is generated. The AccessRequest being replaced, and so the kubeconfig sveltos-agent uses,
+// is left untouched;
+// - Classifier hash includes the kubeconfig, so the new kubeconfig is copied to the managed cluster and
+// sveltos-agent, whose pod template carries the kubeconfig hash, is restarted;
+// - rotation completes once sveltos-agent Deployment has rolled out with the new kubeconfig. Only then
+// the replaced AccessRequest is deleted, revoking the old kubeconfig.
+
+const (
+	// accessRequestReplacesAnnotation is set on an AccessRequest issued to rotate the kubeconfig used by
+	// sveltos-agent. Value is the name of the AccessRequest being replaced. Annotation is removed once
+	// sveltos-agent runs with the new kubeconfig and the replaced AccessRequest is deleted.
+	accessRequestReplacesAnnotation = "classifier.projectsveltos.io/replaces"
+
+	// accessRequestExpirationAnnotation is set on the AccessRequest whose kubeconfig sveltos-agent uses once
+	// such kubeconfig is about to expire (or has expired), so that an Event is emitted only when the
+	// expiration state changes.
+	accessRequestExpirationAnnotation = "classifier.projectsveltos.io/kubeconfig-expiration"
+
+	// rotatedAccessRequestSuffix is appended to the AccessRequest name to get the alternate name
+	// used when rotating the kubeconfig
+	rotatedAccessRequestSuffix = "-rotated"
+
+	// agentKubeconfigHashAnnotation is set on sveltos-agent pod template. Value is the hash of the
+	// kubeconfig sveltos-agent is expected to use, so sveltos-agent restarts when kubeconfig changes.
+	agentKubeconfigHashAnnotation = "classifier.projectsveltos.io/kubeconfig-hash"
+
+	sveltosAgentDeploymentName = "sveltos-agent-manager"
+)
+
+const (
+	// agentKubeconfigRotationThreshold is the fraction of the maximum age after which kubeconfig is rotated
+	agentKubeconfigRotationThreshold = 0.8
+
+	// agentKubeconfigExpiringThreshold is the fraction of the maximum age after which a kubeconfig still
+	// used by sveltos-agent is reported as about to expire
+	agentKubeconfigExpiringThreshold = 0.9
+)
+
+const (
+	agentKubeconfigExpiring = "expiring"
+	agentKubeconfigExpired  = "expired"
+)
+
+// getAgentKubeconfigHash returns the value for the agentKubeconfigHashAnnotation
+func getAgentKubeconfigHash(kubeconfig []byte) string {
+	return fmt.Sprintf("%x", sha256.Sum256(kubeconfig))
+}
+
+// getAgentKubeconfigPatch returns the patch setting the kubeconfig hash on sveltos-agent pod template
+func getAgentKubeconfigPatch(kubeconfig []byte) libsveltosv1beta1.Patch {
+	return libsveltosv1beta1.Patch{
+		Patch: fmt.Sprintf(`apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: %s
+spec:
+  template:
+    metadata:
+      annotations:
+        %s: %q`, sveltosAgentDeploymentName, agentKubeconfigHashAnnotation, getAgentKubeconfigHash(kubeconfig)),
+		Target: &libsveltosv1beta1.PatchSelector{
+			Kind:  "Deployment",
+			Group: "apps",
+			Name:  sveltosAgentDeploymentName,
+		},
+	}
+}
+
+// reissueAccessRequest creates a new AccessRequest, replacing accessRequest, so that a new kubeconfig is
+// generated. Labels, annotations and spec are preserved. accessRequest is not modified: kubeconfig
+// sveltos-agent currently uses stays valid till sveltos-agent runs with the new one.
+func reissueAccessRequest(ctx context.Context, c client.Client, accessRequest *libsveltosv1beta1.AccessRequest,
+	clusterName string, clusterType libsveltosv1beta1.ClusterType, logger logr.Logger) error {
+
+	newAccessRequest := &libsveltosv1beta1.AccessRequest{}
+	newAccessRequest.Namespace = accessRequest.Namespace
+	names := getAccessRequestNames(clusterName, clusterType)
+	newAccessRequest.Name = names[0]
+	if accessRequest.Name == names[0] {
+		newAccessRequest.Name = names[1]
+	}
+	newAccessRequest.Labels = accessRequest.Labels
+	newAccessRequest.Annotations = make(map[string]string)
+	for k := range accessRequest.Annotations {
+		newAccessRequest.Annotations[k] = accessRequest.Annotations[k]
+	}
+	delete(newAccessRequest.Annotations, accessRequestExpirationAnnotation)
+	newAccessRequest.Annotations[accessRequestReplacesAnnotation] = accessRequest.Name
+	newAccessRequest.Spec = accessRequest.Spec
+
+	logger.V(logs.LogInfo).Info(fmt.Sprintf("issuing AccessRequest %s/%s to rotate sveltos-agent kubeconfig",
+		newAccessRequest.Namespace, newAccessRequest.Name))
+	// If an AccessRequest with that name is still being deleted, rotation is retried later on
+	return c.Create(ctx, newAccessRequest)
+}
+
+// isAgentKubeconfigRolledOut returns nil if sveltos-agent Deployment in the managed cluster has
+// completely rolled out pods using the kubeconfig with the given hash
+func isAgentKubeconfigRolledOut(ctx context.Context, remoteClient client.Client, kubeconfigHash string) error {
+	deployment := &appsv1.Deployment{}
+	err := remoteClient.Get(ctx,
+		types.NamespacedName{Namespace: projectsveltos, Name: sveltosAgentDeploymentName}, deployment)
+	if err != nil {
+		return err
+	}
+
+	if deployment.Spec.Template.Annotations[agentKubeconfigHashAnnotation] != kubeconfigHash {
+		return fmt.Errorf("sveltos-agent deployment does not reference current kubeconfig yet")
+	}
+
+	replicas := int32(1)
+	if deployment.Spec.Replicas != nil {
+		replicas = *deployment.Spec.Replicas
+	}
+
+	if deployment.Status.ObservedGeneration < deployment.Generation ||
+		deployment.Status.UpdatedReplicas != replicas ||
+		deployment.Status.Replicas != replicas ||
+		deployment.Status.AvailableReplicas != replicas {
+
+		return fmt.Errorf("sveltos-agent deployment is still rolling out with new kubeconfig")
+	}
+
+	return nil
+}
+
+// completeAgentKubeconfigRotation verifies, if a kubeconfig rotation is in progress for the cluster,
+// that sveltos-agent picked up the new kubeconfig. If so the replaced AccessRequest is deleted and rotation
+// is marked as completed. kubeconfig is the one deployed in the managed cluster.
+// Returns an error if sveltos-agent is still not using the new kubeconfig.
+func completeAgentKubeconfigRotation(ctx context.Context, c, remoteClient client.Client,
+	clusterNamespace, clusterName string, clusterType libsveltosv1beta1.ClusterType,
+	kubeconfig []byte, logger logr.Logger) error {
+
+	accessRequest, previous, err := getClusterAccessRequests(ctx, c, clusterNamespace, clusterName, clusterType)
+	if err != nil {
+		return err
+	}
+
+	if previous == nil {
+		return nil
+	}
+
+	newKubeconfig, err := getAccessRequestKubeconfig(ctx, c, accessRequest, logger)
+	if err != nil {
+		return err
+	}
+	if newKubeconfig == nil || !bytes.Equal(newKubeconfig, kubeconfig) {
+		msg := "kubeconfig rotation not completed yet: new kubeconfig is not deployed"
+		logger.V(logs.LogDebug).Info(msg)
+		return errors.New(msg)
+	}
+
+	if err := isAgentKubeconfigRolledOut(ctx, remoteClient, getAgentKubeconfigHash(kubeconfig)); err != nil {
+		logger.V(logs.LogDebug).Info(fmt.Sprintf("kubeconfig rotation not completed yet: %v", err))
+		return err
+	}
+
+	logger.V(logs.LogInfo).Info(fmt.Sprintf("sveltos-agent is using rotated kubeconfig. Deleting AccessRequest %s/%s",
+		previous.Namespace, previous.Name))
+	uid := previous.UID
+	err = c.Delete(ctx, previous, client.Preconditions{UID: &uid})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+
+	delete(accessRequest.Annotations, accessRequestReplacesAnnotation)
+	return c.Update(ctx, accessRequest)
+}
+
+// rotateAgentKubeconfigs re-issues, for each cluster in AgentSendReportsNoGateway mode Classifier is
+// deployed to, the AccessRequest whose kubeconfig is due for rotation. It also records kubeconfig expiration
+// metrics and emits Events for clusters where sveltos-agent uses a kubeconfig close to or past the maximum age.
+// Returns how long to wait before next rotation is due. Zero if nothing needs to be rotated.
+func (r *ClassifierReconciler) rotateAgentKubeconfigs(ctx context.Context, classifierScope *scope.ClassifierScope,
+	logger logr.Logger) (time.Duration, error) {
+
+	if r.AgentKubeconfigMaxAge <= 0 {
+		return 0, nil
+	}
+
+	var requeueAfter time.Duration
+	clusterInfo := classifierScope.Classifier.Status.ClusterInfo
+	for i := range clusterInfo {
+		if clusterInfo[i].Status == libsveltosv1beta1.SveltosStatusRemoving ||
+			clusterInfo[i].Status == libsveltosv1beta1.SveltosStatusRemoved {
+
+			continue
+		}
+
+		reportMode, err := r.getClusterReportMode(ctx, &clusterInfo[i].Cluster, logger)
+		if err != nil {
+			return 0, err
+		}
+		if reportMode != AgentSendReportsNoGateway {
+			continue
+		}
+
+		nextRotation, err := r.rotateAgentKubeconfig(ctx, classifierScope.Classifier, &clusterInfo[i].Cluster,
+			time.Now(), logger)
+		if err != nil {
+			return 0, err
+		}
+		if nextRotation != 0 && (requeueAfter == 0 || nextRotation < requeueAfter) {
+			requeueAfter = nextRotation
+		}
+	}
+
+	return requeueAfter, nil
+}
+
+// rotateAgentKubeconfig re-issues the AccessRequest of a cluster if its kubeconfig is due for rotation.
+// Nothing is done unless classifier is the AccessRequest owner, so each cluster is processed once.
+// Returns how long to wait before next rotation is due.
+func (r *ClassifierReconciler) rotateAgentKubeconfig(ctx context.Context, classifier *libsveltosv1beta1.Classifier,
+	cluster *corev1.ObjectReference, now time.Time, logger logr.Logger) (time.Duration, error) {
+
+	clusterType := clusterproxy.GetClusterType(cluster)
+	accessRequest, previous, err := getClusterAccessRequests(ctx, r.Client, cluster.Namespace, cluster.Name, clusterType)
+	if err != nil || accessRequest == nil {
+		return 0, err
+	}
+
+	// AccessRequest is shared by all Classifiers deployed in the cluster. Only one of them checks
+	// kubeconfig expiration and rotates it.
+	owner, err := getAccessRequestOwner(ctx, r.Client, accessRequest, r.getClusterClassifiers(cluster))
+	if err != nil {
+		return 0, err
+	}
+	if owner != classifier.Name {
+		return 0, nil
+	}
+
+	// Till rotation completes, sveltos-agent might still use the kubeconfig of the replaced AccessRequest
+	inUse := accessRequest
+	if previous != nil {
+		inUse = previous
+	}
+
+	maxAge := r.AgentKubeconfigMaxAge
+	expiresAt := inUse.CreationTimestamp.Add(maxAge)
+	agentKubeconfigExpiration(cluster, expiresAt)
+	if err := r.reportAgentKubeconfigExpiration(ctx, classifier, cluster, inUse, now); err != nil {
+		return 0, err
+	}
+
+	if previous != nil {
+		// Rotation in progress
+		return 0, nil
+	}
+
+	rotationAt := accessRequest.CreationTimestamp.Add(time.Duration(float64(maxAge) * agentKubeconfigRotationThreshold))
+	if now.Before(rotationAt) {
+		return rotationAt.Sub(now), nil
+	}
+
+	logger.V(logs.LogInfo).Info(fmt.Sprintf("kubeconfig for sveltos-agent in cluster %s is due for rotation",
+		getClusterDescription(cluster)))
+	if err := reissueAccessRequest(ctx, r.Client, accessRequest, cluster.Name, clusterType, logger); err != nil {
+		return 0, err
+	}
+	r.recordEvent(classifier, corev1.EventTypeNormal, agentKubeconfigRotatedReason,
+		"rotating kubeconfig used by sveltos-agent in cluster %s", getClusterDescription(cluster))
+
+	return 0, nil
+}
+
+// reportAgentKubeconfigExpiration emits an Event when the kubeconfig sveltos-agent uses, generated for
+// accessRequest, becomes about to expire or expires. State is recorded on the AccessRequest, so an Event
+// is emitted only once per state change.
+func (r *ClassifierReconciler) reportAgentKubeconfigExpiration(ctx context.Context,
+	classifier *libsveltosv1beta1.Classifier, cluster *corev1.ObjectReference,
+	accessRequest *libsveltosv1beta1.AccessRequest, now time.Time) error {
+
+	maxAge := r.AgentKubeconfigMaxAge
+	expiresAt := accessRequest.CreationTimestamp.Add(maxAge)
+	age := now.Sub(accessRequest.CreationTimestamp.Time)
+
+	state := ""
+	switch {
+	case age >= maxAge:
+		state = agentKubeconfigExpired
+	case age >= time.Duration(float64(maxAge)*agentKubeconfigExpiringThreshold):
+		state = agentKubeconfigExpiring
+	}
+
+	if accessRequest.Annotations[accessRequestExpirationAnnotation] == state {
+		return nil
+	}
+
+	if state == "" {
+		delete(accessRequest.Annotations, accessRequestExpirationAnnotation)
+	} else {
+		if accessRequest.Annotations == nil {
+			accessRequest.Annotations = make(map[string]string)
+		}
+		accessRequest.Annotations[accessRequestExpirationAnnotation] = state
+	}
+	if err := r.Update(ctx, accessRequest); err != nil {
+		return err
+	}
+
+	switch state {
+	case agentKubeconfigExpired:
+		r.recordEvent(classifier, corev1.EventTypeWarning, agentKubeconfigExpiredReason,
+			"sveltos-agent in cluster %s uses a kubeconfig older than %s", getClusterDescription(cluster), maxAge)
+	case agentKubeconfigExpiring:
+		r.recordEvent(classifier, corev1.EventTypeWarning, agentKubeconfigExpiringReason,
+			"sveltos-agent in cluster %s uses a kubeconfig expiring in %s", getClusterDescription(cluster),
+			expiresAt.Sub(now).Round(time.Second))
+	}
+
+	return nil
+}
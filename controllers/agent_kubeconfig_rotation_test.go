@@ -0,0 +1,278 @@
+/*
+Copyright 2022. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers_test
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog/v2/textlogger"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/projectsveltos/classifier/controllers"
+	libsveltosv1beta1 "github.com/projectsveltos/libsveltos/api/v1beta1"
+	"github.com/projectsveltos/libsveltos/lib/k8s_utils"
+	"github.com/projectsveltos/libsveltos/lib/patcher"
+)
+
+var _ = Describe("sveltos-agent kubeconfig rotation", func() {
+	var cluster *libsveltosv1beta1.SveltosCluster
+	var accessRequest *libsveltosv1beta1.AccessRequest
+
+	BeforeEach(func() {
+		cluster = &libsveltosv1beta1.SveltosCluster{
+			ObjectMeta: metav1.ObjectMeta{Namespace: randomString(), Name: randomString()},
+		}
+		accessRequest = &libsveltosv1beta1.AccessRequest{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: cluster.Namespace,
+				Name:      controllers.GetAccessRequestName(cluster.Name, libsveltosv1beta1.ClusterTypeSveltos),
+				Labels:    map[string]string{randomString(): randomString()},
+				Annotations: map[string]string{
+					"classifier.projectsveltos.io/classifiers": `["a","b"]`,
+				},
+			},
+			Spec: libsveltosv1beta1.AccessRequestSpec{
+				Namespace: cluster.Namespace,
+				Name:      cluster.Name,
+				Type:      libsveltosv1beta1.SveltosAgentRequest,
+			},
+		}
+	})
+
+	getAccessRequest := func(c client.Client) *libsveltosv1beta1.AccessRequest {
+		currentAccessRequest := &libsveltosv1beta1.AccessRequest{}
+		Expect(c.Get(context.TODO(), types.NamespacedName{Namespace: accessRequest.Namespace, Name: accessRequest.Name},
+			currentAccessRequest)).To(Succeed())
+		return currentAccessRequest
+	}
+
+	// getRotatedAccessRequest returns the AccessRequest issued to replace accessRequest, if any
+	getRotatedAccessRequest := func(c client.Client) *libsveltosv1beta1.AccessRequest {
+		accessRequests := &libsveltosv1beta1.AccessRequestList{}
+		Expect(c.List(context.TODO(), accessRequests, client.InNamespace(accessRequest.Namespace))).To(Succeed())
+		for i := range accessRequests.Items {
+			if accessRequests.Items[i].Name != accessRequest.Name {
+				return &accessRequests.Items[i]
+			}
+		}
+		return nil
+	}
+
+	It("rotateAgentKubeconfigs re-issues AccessRequests due for rotation", func() {
+		const maxAge = 10 * time.Hour
+		issuedAt := time.Now().Add(-9 * time.Hour).UTC().Truncate(time.Second)
+		accessRequest.CreationTimestamp = metav1.NewTime(issuedAt)
+
+		clusterInfo := []libsveltosv1beta1.ClusterInfo{
+			{
+				Cluster: corev1.ObjectReference{
+					Namespace: cluster.Namespace, Name: cluster.Name,
+					Kind: libsveltosv1beta1.SveltosClusterKind, APIVersion: libsveltosv1beta1.GroupVersion.String(),
+				},
+				Status: libsveltosv1beta1.SveltosStatusProvisioned,
+			},
+		}
+		// Classifiers sharing the AccessRequest. Only the first one rotates the kubeconfig.
+		classifier := getClassifierInstance("a" + randomString())
+		classifier.Status.ClusterInfo = clusterInfo
+		otherClassifier := getClassifierInstance("b" + randomString())
+		otherClassifier.Status.ClusterInfo = clusterInfo
+		accessRequest.Annotations["classifier.projectsveltos.io/classifiers"] =
+			fmt.Sprintf("[%q,%q]", classifier.Name, otherClassifier.Name)
+
+		initObjects := []client.Object{classifier, otherClassifier, cluster, accessRequest}
+		c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(initObjects...).Build()
+
+		logger := textlogger.NewLogger(textlogger.NewConfig(textlogger.Verbosity(1)))
+		reconciler := getClassifierReconciler(c, nil)
+		recorder := record.NewFakeRecorder(10)
+		reconciler.EventRecorder = recorder
+		classifierScope := getClassifierScope(c, logger, classifier)
+
+		// Rotation is disabled by default
+		requeueAfter, err := controllers.RotateAgentKubeconfigs(reconciler, context.TODO(), classifierScope, logger)
+		Expect(err).To(BeNil())
+		Expect(requeueAfter).To(BeZero())
+		Expect(getRotatedAccessRequest(c)).To(BeNil())
+
+		reconciler.ClassifierReportMode = controllers.AgentSendReportsNoGateway
+		reconciler.AgentKubeconfigMaxAge = 2 * maxAge
+		requeueAfter, err = controllers.RotateAgentKubeconfigs(reconciler, context.TODO(), classifierScope, logger)
+		Expect(err).To(BeNil())
+		Expect(requeueAfter).To(BeNumerically(">", 6*time.Hour))
+		Expect(getRotatedAccessRequest(c)).To(BeNil())
+
+		reconciler.AgentKubeconfigMaxAge = maxAge
+		otherClassifierScope := getClassifierScope(c, logger, otherClassifier)
+		requeueAfter, err = controllers.RotateAgentKubeconfigs(reconciler, context.TODO(), otherClassifierScope, logger)
+		Expect(err).To(BeNil())
+		Expect(requeueAfter).To(BeZero())
+		Expect(getRotatedAccessRequest(c)).To(BeNil())
+		Expect(recorder.Events).To(BeEmpty())
+
+		_, err = controllers.RotateAgentKubeconfigs(reconciler, context.TODO(), classifierScope, logger)
+		Expect(err).To(BeNil())
+		Expect(recorder.Events).To(Receive(ContainSubstring("AgentKubeconfigExpiring")))
+		Expect(recorder.Events).To(Receive(ContainSubstring("AgentKubeconfigRotated")))
+
+		// Replaced AccessRequest is left untouched, so sveltos-agent can keep using its kubeconfig
+		Expect(getAccessRequest(c).Spec).To(Equal(accessRequest.Spec))
+		Expect(getAccessRequest(c).Annotations).To(HaveKeyWithValue(controllers.AccessRequestExpirationAnnotation,
+			"expiring"))
+
+		// New AccessRequest keeps labels and Classifiers and records the AccessRequest it replaces
+		rotatedAccessRequest := getRotatedAccessRequest(c)
+		Expect(rotatedAccessRequest).ToNot(BeNil())
+		Expect(rotatedAccessRequest.Labels).To(Equal(accessRequest.Labels))
+		Expect(rotatedAccessRequest.Annotations).To(HaveKeyWithValue("classifier.projectsveltos.io/classifiers",
+			fmt.Sprintf("[%q,%q]", classifier.Name, otherClassifier.Name)))
+		Expect(rotatedAccessRequest.Annotations).To(HaveKeyWithValue(controllers.AccessRequestReplacesAnnotation,
+			accessRequest.Name))
+		Expect(rotatedAccessRequest.Annotations).ToNot(HaveKey(controllers.AccessRequestExpirationAnnotation))
+		Expect(rotatedAccessRequest.Spec).To(Equal(accessRequest.Spec))
+
+		// While rotation is in progress, AccessRequest is not re-issued again and Events are not repeated
+		_, err = controllers.RotateAgentKubeconfigs(reconciler, context.TODO(), classifierScope, logger)
+		Expect(err).To(BeNil())
+		Expect(recorder.Events).To(BeEmpty())
+		accessRequests := &libsveltosv1beta1.AccessRequestList{}
+		Expect(c.List(context.TODO(), accessRequests)).To(Succeed())
+		Expect(accessRequests.Items).To(HaveLen(2))
+	})
+
+	It("completeAgentKubeconfigRotation waits for sveltos-agent to roll out with the new kubeconfig", func() {
+		kubeconfig := []byte(randomString())
+
+		secret := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: cluster.Namespace, Name: randomString()},
+			Data:       map[string][]byte{"kubeconfig": kubeconfig},
+		}
+		rotatedAccessRequest := accessRequest.DeepCopy()
+		rotatedAccessRequest.Name = accessRequest.Name + "-rotated"
+		rotatedAccessRequest.Annotations[controllers.AccessRequestReplacesAnnotation] = accessRequest.Name
+		rotatedAccessRequest.Status.SecretRef = &corev1.ObjectReference{Namespace: secret.Namespace, Name: secret.Name}
+
+		replicas := int32(1)
+		deployment := &appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:  "projectsveltos",
+				Name:       "sveltos-agent-manager",
+				Generation: 2,
+			},
+			Spec: appsv1.DeploymentSpec{
+				Replicas: &replicas,
+				Template: corev1.PodTemplateSpec{
+					ObjectMeta: metav1.ObjectMeta{
+						Annotations: map[string]string{
+							controllers.AgentKubeconfigHashAnnotation: controllers.GetAgentKubeconfigHash(kubeconfig),
+						},
+					},
+				},
+			},
+			Status: appsv1.DeploymentStatus{
+				ObservedGeneration: 1, Replicas: 2, UpdatedReplicas: 1, AvailableReplicas: 1,
+			},
+		}
+
+		initObjects := []client.Object{accessRequest, rotatedAccessRequest, secret}
+		c := fake.NewClientBuilder().WithScheme(scheme).WithStatusSubresource(initObjects...).
+			WithObjects(initObjects...).Build()
+		remoteClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(deployment).Build()
+		logger := textlogger.NewLogger(textlogger.NewConfig(textlogger.Verbosity(1)))
+
+		// New kubeconfig is not deployed yet
+		Expect(controllers.CompleteAgentKubeconfigRotation(context.TODO(), c, remoteClient, cluster.Namespace,
+			cluster.Name, libsveltosv1beta1.ClusterTypeSveltos, []byte(randomString()), logger)).ToNot(Succeed())
+		getAccessRequest(c)
+
+		// New kubeconfig is deployed but sveltos-agent is still rolling out
+		Expect(controllers.CompleteAgentKubeconfigRotation(context.TODO(), c, remoteClient, cluster.Namespace,
+			cluster.Name, libsveltosv1beta1.ClusterTypeSveltos, kubeconfig, logger)).ToNot(Succeed())
+		getAccessRequest(c)
+
+		Expect(remoteClient.Get(context.TODO(), client.ObjectKeyFromObject(deployment), deployment)).To(Succeed())
+		deployment.Status = appsv1.DeploymentStatus{
+			ObservedGeneration: deployment.Generation, Replicas: 1, UpdatedReplicas: 1, AvailableReplicas: 1,
+		}
+		Expect(remoteClient.Status().Update(context.TODO(), deployment)).To(Succeed())
+
+		Expect(controllers.CompleteAgentKubeconfigRotation(context.TODO(), c, remoteClient, cluster.Namespace,
+			cluster.Name, libsveltosv1beta1.ClusterTypeSveltos, kubeconfig, logger)).To(Succeed())
+
+		// Replaced AccessRequest, and with it the old kubeconfig, is gone
+		err := c.Get(context.TODO(), client.ObjectKeyFromObject(accessRequest), &libsveltosv1beta1.AccessRequest{})
+		Expect(apierrors.IsNotFound(err)).To(BeTrue())
+		Expect(getRotatedAccessRequest(c).Annotations).ToNot(HaveKey(controllers.AccessRequestReplacesAnnotation))
+
+		Expect(controllers.GetKubeconfigFromAccessRequest(context.TODO(), c, cluster.Namespace, cluster.Name,
+			libsveltosv1beta1.ClusterTypeSveltos, logger)).To(Equal(kubeconfig))
+	})
+
+	It("getAgentKubeconfigPatch sets kubeconfig hash on sveltos-agent pod template only", func() {
+		kubeconfig := []byte(randomString())
+
+		deployment, err := k8s_utils.GetUnstructured([]byte(`apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: sveltos-agent-manager
+  namespace: projectsveltos
+spec:
+  template:
+    spec:
+      containers:
+      - name: manager
+        image: sveltos-agent`))
+		Expect(err).To(BeNil())
+		serviceAccount, err := k8s_utils.GetUnstructured([]byte(`apiVersion: v1
+kind: ServiceAccount
+metadata:
+  name: sveltos-agent-manager
+  namespace: projectsveltos`))
+		Expect(err).To(BeNil())
+
+		p := &patcher.CustomPatchPostRenderer{
+			Patches: []libsveltosv1beta1.Patch{controllers.GetAgentKubeconfigPatch(kubeconfig)},
+		}
+		patched, err := p.RunUnstructured([]*unstructured.Unstructured{deployment, serviceAccount})
+		Expect(err).To(BeNil())
+		Expect(patched).To(HaveLen(2))
+		for i := range patched {
+			annotations, _, err := unstructured.NestedStringMap(patched[i].Object,
+				"spec", "template", "metadata", "annotations")
+			Expect(err).To(BeNil())
+			if patched[i].GetKind() == "Deployment" {
+				Expect(annotations).To(HaveKeyWithValue(controllers.AgentKubeconfigHashAnnotation,
+					controllers.GetAgentKubeconfigHash(kubeconfig)))
+			} else {
+				Expect(annotations).To(BeEmpty())
+			}
+		}
+	})
+})
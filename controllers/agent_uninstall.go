@@ -0,0 +1,313 @@
+/*
+Copyright 2022. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/go-logr/logr"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/projectsveltos/classifier/pkg/agent"
+	libsveltosv1beta1 "github.com/projectsveltos/libsveltos/api/v1beta1"
+	"github.com/projectsveltos/libsveltos/lib/clusterproxy"
+	"github.com/projectsveltos/libsveltos/lib/k8s_utils"
+	logs "github.com/projectsveltos/libsveltos/lib/logsettings"
+)
+
+// When uninstall is enabled, once no Classifier is deployed in a managed cluster anymore (or the
+// cluster is unregistered) classifier removes from the managed cluster everything it deployed there
+// for sveltos-agent: the sveltos-agent resources, the Secrets used by sveltos-agent to send
+// ClassifierReports, the Classifier and ClassifierReport CRDs and, if empty, the sveltos-agent namespace.
+// sveltos-agent also evaluates HealthChecks and EventSources on behalf of other Sveltos components. So
+// nothing is removed while any HealthCheck or EventSource exists in the managed cluster. CRDs shared with
+// other Sveltos components (HealthCheck, EventSource, DebuggingConfiguration, Reloader and their reports)
+// are never removed.
+
+var (
+	// classifierOwnedCRDs are the CRDs deployed by classifier that no other Sveltos component uses
+	classifierOwnedCRDs = []string{
+		"classifiers.lib.projectsveltos.io",
+		"classifierreports.lib.projectsveltos.io",
+	}
+
+	// agentUninstallReports contains, per cluster and Classifier, the resources removed from the managed
+	// cluster when sveltos-agent was uninstalled. Consumed by the Classifier reconciler to emit Events.
+	agentUninstallReports   = map[string][]string{}
+	agentUninstallReportsMu sync.Mutex
+)
+
+func getAgentUninstallReportKey(cluster *corev1.ObjectReference, classifierName string) string {
+	return fmt.Sprintf("%s/%s", getClusterDescription(cluster), classifierName)
+}
+
+// storeAgentUninstallReport stores the resources removed from a cluster when the last Classifier,
+// classifierName, was removed from it
+func storeAgentUninstallReport(cluster *corev1.ObjectReference, classifierName string, removed []string) {
+	agentUninstallReportsMu.Lock()
+	defer agentUninstallReportsMu.Unlock()
+
+	agentUninstallReports[getAgentUninstallReportKey(cluster, classifierName)] = removed
+}
+
+// popAgentUninstallReport returns, and forgets, the resources removed from a cluster when
+// Classifier classifierName was removed from it
+func popAgentUninstallReport(cluster *corev1.ObjectReference, classifierName string) []string {
+	agentUninstallReportsMu.Lock()
+	defer agentUninstallReportsMu.Unlock()
+
+	key := getAgentUninstallReportKey(cluster, classifierName)
+	removed := agentUninstallReports[key]
+	delete(agentUninstallReports, key)
+	return removed
+}
+
+// isSveltosAgentInUse returns true if sveltos-agent in the managed cluster is still needed by other
+// Sveltos components, i.e. any HealthCheck or EventSource exists.
+func isSveltosAgentInUse(ctx context.Context, remoteClient client.Client) (bool, error) {
+	lists := []client.ObjectList{
+		&libsveltosv1beta1.HealthCheckList{},
+		&libsveltosv1beta1.EventSourceList{},
+	}
+
+	for i := range lists {
+		err := remoteClient.List(ctx, lists[i], client.Limit(1))
+		if err != nil {
+			if meta.IsNoMatchError(err) || apierrors.IsNotFound(err) {
+				// CRD is not installed
+				continue
+			}
+			return false, err
+		}
+		if meta.LenList(lists[i]) > 0 {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// isClassifierPresentInCluster returns true if any Classifier, other than classifierName, is either
+// deployed in the managed cluster or being deployed there by the management cluster (clusterClassifiers).
+// Classifiers being removed from the cluster are ignored.
+func isClassifierPresentInCluster(ctx context.Context, remoteClient client.Client, clusterClassifiers []string,
+	classifierName string) (bool, error) {
+
+	remoteClassifiers := &libsveltosv1beta1.ClassifierList{}
+	err := remoteClient.List(ctx, remoteClassifiers)
+	if err != nil && !meta.IsNoMatchError(err) && !apierrors.IsNotFound(err) {
+		return false, err
+	}
+	for i := range remoteClassifiers.Items {
+		if remoteClassifiers.Items[i].Name != classifierName &&
+			remoteClassifiers.Items[i].DeletionTimestamp.IsZero() {
+
+			return true, nil
+		}
+	}
+
+	for i := range clusterClassifiers {
+		if clusterClassifiers[i] != classifierName {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// deleteIfPresent deletes obj. Returns true if obj existed and was deleted.
+func deleteIfPresent(ctx context.Context, remoteClient client.Client, obj client.Object) (bool, error) {
+	err := remoteClient.Delete(ctx, obj)
+	if err != nil {
+		if apierrors.IsNotFound(err) || meta.IsNoMatchError(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func getRemovedResourceDescription(kind string, obj client.Object) string {
+	if obj.GetNamespace() == "" {
+		return fmt.Sprintf("%s %s", kind, obj.GetName())
+	}
+	return fmt.Sprintf("%s %s/%s", kind, obj.GetNamespace(), obj.GetName())
+}
+
+// uninstallSveltosAgent removes sveltos-agent and the classifier owned CRDs from the managed cluster.
+// Nothing is removed if sveltos-agent is still used by other Sveltos components.
+// Returns the resources that were removed.
+func uninstallSveltosAgent(ctx context.Context, remoteClient client.Client,
+	clusterNamespace, clusterName string, clusterType libsveltosv1beta1.ClusterType, logger logr.Logger,
+) ([]string, error) {
+
+	inUse, err := isSveltosAgentInUse(ctx, remoteClient)
+	if err != nil {
+		return nil, err
+	}
+	if inUse {
+		logger.V(logs.LogInfo).Info("sveltos-agent is still used by other Sveltos components. Not uninstalling it")
+		return nil, nil
+	}
+
+	removed := make([]string, 0)
+
+	// sveltos-agent resources. Removed in reverse order (Deployment first). Namespace is handled last.
+	agentYAML := string(agent.GetSveltosAgentYAML())
+	agentYAML = prepareSveltosAgentYAML(agentYAML, clusterNamespace, clusterName, "", clusterType)
+
+	const separator = "---"
+	elements := strings.Split(agentYAML, separator)
+	for i := len(elements) - 1; i >= 0; i-- {
+		policy, err := k8s_utils.GetUnstructured([]byte(elements[i]))
+		if err != nil {
+			logger.V(logs.LogInfo).Info(fmt.Sprintf("failed to parse sveltos-agent yaml: %v", err))
+			return removed, err
+		}
+		if policy.GetKind() == "Namespace" {
+			continue
+		}
+
+		deleted, err := deleteIfPresent(ctx, remoteClient, policy)
+		if err != nil {
+			logger.V(logs.LogInfo).Info(fmt.Sprintf("failed to delete resource %s:%s/%s: %v",
+				policy.GetKind(), policy.GetNamespace(), policy.GetName(), err))
+			return removed, err
+		}
+		if deleted {
+			removed = append(removed, getRemovedResourceDescription(policy.GetKind(), policy))
+		}
+	}
+
+	// Secret sveltos-agent uses to send ClassifierReports to the management cluster
+	secret := &corev1.Secret{}
+	secret.Namespace = libsveltosv1beta1.ClassifierSecretNamespace
+	secret.Name = libsveltosv1beta1.ClassifierSecretName
+	deleted, err := deleteIfPresent(ctx, remoteClient, secret)
+	if err != nil {
+		return removed, err
+	}
+	if deleted {
+		removed = append(removed, getRemovedResourceDescription("Secret", secret))
+	}
+
+	for i := range classifierOwnedCRDs {
+		crd := &apiextensionsv1.CustomResourceDefinition{}
+		crd.Name = classifierOwnedCRDs[i]
+		deleted, err := deleteIfPresent(ctx, remoteClient, crd)
+		if err != nil {
+			return removed, err
+		}
+		if deleted {
+			removed = append(removed, getRemovedResourceDescription("CustomResourceDefinition", crd))
+		}
+	}
+
+	// Namespace might be shared with other Sveltos agents (drift-detection-manager for instance).
+	// It is removed only if no Deployment is left there.
+	deployments := &appsv1.DeploymentList{}
+	err = remoteClient.List(ctx, deployments, client.InNamespace(getSveltosAgentNamespace()))
+	if err != nil {
+		return removed, err
+	}
+	if len(deployments.Items) == 0 {
+		ns := &corev1.Namespace{}
+		ns.Name = getSveltosAgentNamespace()
+		deleted, err := deleteIfPresent(ctx, remoteClient, ns)
+		if err != nil {
+			return removed, err
+		}
+		if deleted {
+			removed = append(removed, getRemovedResourceDescription("Namespace", ns))
+		}
+	}
+
+	logger.V(logs.LogInfo).Info(fmt.Sprintf("sveltos-agent uninstalled. Removed: %s", strings.Join(removed, ", ")))
+	return removed, nil
+}
+
+// uninstallSveltosAgentIfUnused uninstalls sveltos-agent from the managed cluster if uninstall is enabled
+// and no Classifier, other than classifierName, is deployed there.
+func uninstallSveltosAgentIfUnused(ctx context.Context, remoteClient client.Client,
+	clusterNamespace, clusterName string, clusterType libsveltosv1beta1.ClusterType, classifierName string,
+	clusterClassifiers []string, logger logr.Logger) error {
+
+	if !getUninstallSveltosAgent() || getAgentInMgmtCluster() {
+		return nil
+	}
+
+	cluster := getClusterReference(clusterNamespace, clusterName, clusterType)
+	present, err := isClassifierPresentInCluster(ctx, remoteClient, clusterClassifiers, classifierName)
+	if err != nil {
+		return err
+	}
+	if present {
+		logger.V(logs.LogDebug).Info("other Classifiers are deployed in the cluster. Not uninstalling sveltos-agent")
+		return nil
+	}
+
+	removed, err := uninstallSveltosAgent(ctx, remoteClient, clusterNamespace, clusterName, clusterType, logger)
+	if err != nil {
+		return err
+	}
+	if len(removed) > 0 {
+		storeAgentUninstallReport(cluster, classifierName, removed)
+	}
+	return nil
+}
+
+// uninstallSveltosAgentFromUnregisteredCluster uninstalls sveltos-agent from a cluster which is being
+// unregistered (cluster is marked for deletion), if uninstall is enabled. Once cluster is gone,
+// its kubeconfig is not available anymore and nothing can be removed.
+// This is best effort: failures are only logged, so cluster cleanup is never blocked by an unreachable cluster.
+func uninstallSveltosAgentFromUnregisteredCluster(ctx context.Context, c client.Client,
+	clusterNamespace, clusterName string, clusterType libsveltosv1beta1.ClusterType, logger logr.Logger) {
+
+	if !getUninstallSveltosAgent() || getAgentInMgmtCluster() {
+		return
+	}
+
+	_, err := clusterproxy.GetCluster(ctx, c, clusterNamespace, clusterName, clusterType)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			logger.V(logs.LogDebug).Info("cluster is gone. sveltos-agent cannot be uninstalled")
+			return
+		}
+		logger.V(logs.LogInfo).Info(fmt.Sprintf("failed to get cluster. sveltos-agent not uninstalled: %v", err))
+		return
+	}
+
+	remoteClient, err := clusterproxy.GetKubernetesClient(ctx, c, clusterNamespace, clusterName,
+		"", "", clusterType, logger)
+	if err != nil {
+		logger.V(logs.LogInfo).Info(fmt.Sprintf("failed to get cluster client. sveltos-agent not uninstalled: %v", err))
+		return
+	}
+
+	_, err = uninstallSveltosAgent(ctx, remoteClient, clusterNamespace, clusterName, clusterType, logger)
+	if err != nil {
+		logger.V(logs.LogInfo).Info(fmt.Sprintf("failed to uninstall sveltos-agent: %v", err))
+	}
+}
@@ -0,0 +1,180 @@
+/*
+Copyright 2022. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers_test
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2/textlogger"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/projectsveltos/classifier/controllers"
+	libsveltosv1beta1 "github.com/projectsveltos/libsveltos/api/v1beta1"
+	fakedeployer "github.com/projectsveltos/libsveltos/lib/deployer/fake"
+	libsveltosset "github.com/projectsveltos/libsveltos/lib/set"
+)
+
+var _ = Describe("Sveltos-agent uninstall", func() {
+	const (
+		sveltosNamespace = "projectsveltos"
+		agentName        = "sveltos-agent-manager"
+	)
+
+	var agentObjects []client.Object
+
+	getCRD := func(name string) *apiextensionsv1.CustomResourceDefinition {
+		return &apiextensionsv1.CustomResourceDefinition{ObjectMeta: metav1.ObjectMeta{Name: name}}
+	}
+
+	BeforeEach(func() {
+		agentObjects = []client.Object{
+			&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: sveltosNamespace}},
+			&corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Namespace: sveltosNamespace, Name: agentName}},
+			&rbacv1.ClusterRole{ObjectMeta: metav1.ObjectMeta{Name: "sveltos-agent-manager-role"}},
+			&rbacv1.ClusterRoleBinding{ObjectMeta: metav1.ObjectMeta{Name: "sveltos-agent-manager-rolebinding"}},
+			&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Namespace: sveltosNamespace, Name: agentName}},
+			&corev1.Secret{ObjectMeta: metav1.ObjectMeta{
+				Namespace: libsveltosv1beta1.ClassifierSecretNamespace, Name: libsveltosv1beta1.ClassifierSecretName}},
+			getCRD("classifiers.lib.projectsveltos.io"),
+			getCRD("classifierreports.lib.projectsveltos.io"),
+			getCRD("healthchecks.lib.projectsveltos.io"),
+			getCRD("eventsources.lib.projectsveltos.io"),
+		}
+	})
+
+	It("uninstallSveltosAgent removes sveltos-agent and classifier CRDs only", func() {
+		remoteClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(agentObjects...).Build()
+		logger := textlogger.NewLogger(textlogger.NewConfig(textlogger.Verbosity(1)))
+
+		removed, err := controllers.UninstallSveltosAgent(context.TODO(), remoteClient, randomString(), randomString(),
+			libsveltosv1beta1.ClusterTypeSveltos, logger)
+		Expect(err).To(BeNil())
+		Expect(removed).To(ContainElements(
+			"Deployment projectsveltos/sveltos-agent-manager",
+			"ServiceAccount projectsveltos/sveltos-agent-manager",
+			"Secret projectsveltos/classifier-agent",
+			"CustomResourceDefinition classifiers.lib.projectsveltos.io",
+			"CustomResourceDefinition classifierreports.lib.projectsveltos.io",
+			"Namespace projectsveltos",
+		))
+
+		for i := range agentObjects {
+			err = remoteClient.Get(context.TODO(), client.ObjectKeyFromObject(agentObjects[i]), agentObjects[i])
+			switch agentObjects[i].GetName() {
+			case "healthchecks.lib.projectsveltos.io", "eventsources.lib.projectsveltos.io":
+				// CRDs used by other Sveltos components are never removed
+				Expect(err).To(BeNil())
+			default:
+				Expect(apierrors.IsNotFound(err)).To(BeTrue())
+			}
+		}
+
+		// Uninstall is idempotent
+		removed, err = controllers.UninstallSveltosAgent(context.TODO(), remoteClient, randomString(), randomString(),
+			libsveltosv1beta1.ClusterTypeSveltos, logger)
+		Expect(err).To(BeNil())
+		Expect(removed).To(BeEmpty())
+	})
+
+	It("sveltos-agent is kept while used by other Sveltos components or other Classifiers", func() {
+		logger := textlogger.NewLogger(textlogger.NewConfig(textlogger.Verbosity(1)))
+
+		healthCheck := &libsveltosv1beta1.HealthCheck{ObjectMeta: metav1.ObjectMeta{Name: randomString()}}
+		remoteClient := fake.NewClientBuilder().WithScheme(scheme).
+			WithObjects(append(agentObjects, healthCheck)...).Build()
+
+		removed, err := controllers.UninstallSveltosAgent(context.TODO(), remoteClient, randomString(), randomString(),
+			libsveltosv1beta1.ClusterTypeSveltos, logger)
+		Expect(err).To(BeNil())
+		Expect(removed).To(BeEmpty())
+		for i := range agentObjects {
+			Expect(remoteClient.Get(context.TODO(), client.ObjectKeyFromObject(agentObjects[i]),
+				agentObjects[i])).To(Succeed())
+		}
+
+		// Namespace is kept if other deployments are there
+		otherDeployment := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Namespace: sveltosNamespace, Name: randomString()}}
+		remoteClient = fake.NewClientBuilder().WithScheme(scheme).
+			WithObjects(append(agentObjects, otherDeployment)...).Build()
+		removed, err = controllers.UninstallSveltosAgent(context.TODO(), remoteClient, randomString(), randomString(),
+			libsveltosv1beta1.ClusterTypeSveltos, logger)
+		Expect(err).To(BeNil())
+		Expect(removed).ToNot(ContainElement("Namespace projectsveltos"))
+		Expect(remoteClient.Get(context.TODO(), client.ObjectKey{Name: sveltosNamespace}, &corev1.Namespace{})).To(Succeed())
+
+		// Another Classifier is deployed in the cluster
+		classifier := randomString()
+		otherClassifier := randomString()
+		remoteClient = fake.NewClientBuilder().WithScheme(scheme).Build()
+
+		present, err := controllers.IsClassifierPresentInCluster(context.TODO(), remoteClient,
+			[]string{classifier, otherClassifier}, classifier)
+		Expect(err).To(BeNil())
+		Expect(present).To(BeTrue())
+		present, err = controllers.IsClassifierPresentInCluster(context.TODO(), remoteClient,
+			[]string{otherClassifier}, otherClassifier)
+		Expect(err).To(BeNil())
+		Expect(present).To(BeFalse())
+
+		// Another Classifier is still deployed in the managed cluster
+		remoteClassifier := getClassifierInstance(otherClassifier)
+		remoteClient = fake.NewClientBuilder().WithScheme(scheme).WithObjects(remoteClassifier).Build()
+		present, err = controllers.IsClassifierPresentInCluster(context.TODO(), remoteClient,
+			[]string{classifier}, classifier)
+		Expect(err).To(BeNil())
+		Expect(present).To(BeTrue())
+	})
+
+	It("getClusterClassifiers returns Classifiers deployed in the cluster ignoring those being removed", func() {
+		cluster := &corev1.ObjectReference{
+			Namespace: randomString(), Name: randomString(),
+			Kind: libsveltosv1beta1.SveltosClusterKind, APIVersion: libsveltosv1beta1.GroupVersion.String(),
+		}
+
+		classifier := randomString()
+		removingClassifier := randomString()
+
+		c := fake.NewClientBuilder().WithScheme(scheme).Build()
+		dep := fakedeployer.GetClient(context.TODO(), textlogger.NewLogger(textlogger.NewConfig(textlogger.Verbosity(1))), c)
+		Expect(dep.RegisterFeatureID(libsveltosv1beta1.FeatureClassifier)).To(Succeed())
+		dep.StoreInProgress(cluster.Namespace, cluster.Name, removingClassifier, string(libsveltosv1beta1.FeatureClassifier),
+			libsveltosv1beta1.ClusterTypeSveltos, true)
+
+		reconciler := getClassifierReconciler(c, dep)
+		Expect(controllers.GetClusterClassifiers(reconciler, cluster)).To(BeEmpty())
+
+		classifiers := &libsveltosset.Set{}
+		for _, name := range []string{classifier, removingClassifier} {
+			classifiers.Insert(&corev1.ObjectReference{
+				Name: name, Kind: libsveltosv1beta1.ClassifierKind, APIVersion: libsveltosv1beta1.GroupVersion.String(),
+			})
+		}
+		reconciler.ClusterMap[*cluster] = classifiers
+
+		Expect(controllers.GetClusterClassifiers(reconciler, cluster)).To(Equal([]string{classifier}))
+	})
+})
@@ -0,0 +1,349 @@
+/*
+Copyright 2022. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	libsveltosv1beta1 "github.com/projectsveltos/libsveltos/api/v1beta1"
+	logs "github.com/projectsveltos/libsveltos/lib/logsettings"
+	libsveltosset "github.com/projectsveltos/libsveltos/lib/set"
+)
+
+const (
+	// ClassifierCompositionAnnotation contains, in JSON format, a ClassifierExpression.
+	// A Classifier with such annotation is a composite Classifier: whether a cluster is a match is
+	// computed by the classifier controller from the ClassifierReports of the referenced Classifiers
+	// for the same cluster. Composite Classifiers cannot have DeployedResourceConstraint nor
+	// KubernetesVersionConstraints and are never deployed in managed clusters.
+	// The classifier controller creates a ClassifierReport for each cluster, so a composite Classifier
+	// can itself be referenced by other composite Classifiers.
+	// For instance {"and": [{"classifier": "prod-ready"}, {"not": {"classifier": "legacy-ingress"}}]}
+	ClassifierCompositionAnnotation = "classifier.projectsveltos.io/composition"
+)
+
+// ClassifierExpression is a boolean expression over other Classifiers results.
+// Exactly one field must be set.
+type ClassifierExpression struct {
+	// Classifier is the name of a Classifier. It is true for a cluster if the ClassifierReport of
+	// that Classifier for the cluster has Spec.Match set. A missing ClassifierReport is false.
+	// +optional
+	Classifier string `json:"classifier,omitempty"`
+
+	// And is true if all expressions are true
+	// +optional
+	And []ClassifierExpression `json:"and,omitempty"`
+
+	// Or is true if at least one expression is true
+	// +optional
+	Or []ClassifierExpression `json:"or,omitempty"`
+
+	// Not is true if expression is false
+	// +optional
+	Not *ClassifierExpression `json:"not,omitempty"`
+}
+
+// hasClassifierComposition returns true if Classifier is a composite Classifier
+func hasClassifierComposition(classifier *libsveltosv1beta1.Classifier) bool {
+	_, ok := classifier.Annotations[ClassifierCompositionAnnotation]
+	return ok
+}
+
+// getClassifierComposition returns the ClassifierExpression defined for a Classifier.
+// Returns nil if Classifier is not a composite Classifier.
+func getClassifierComposition(classifier *libsveltosv1beta1.Classifier) (*ClassifierExpression, error) {
+	value, ok := classifier.Annotations[ClassifierCompositionAnnotation]
+	if !ok {
+		return nil, nil
+	}
+
+	expression := &ClassifierExpression{}
+	if err := json.Unmarshal([]byte(value), expression); err != nil {
+		return nil, fmt.Errorf("invalid annotation %s: %w", ClassifierCompositionAnnotation, err)
+	}
+
+	if err := expression.validate(); err != nil {
+		return nil, fmt.Errorf("invalid annotation %s: %w", ClassifierCompositionAnnotation, err)
+	}
+
+	if classifier.Spec.DeployedResourceConstraint != nil || len(classifier.Spec.KubernetesVersionConstraints) != 0 {
+		return nil, errors.New("composite Classifier cannot have DeployedResourceConstraint nor KubernetesVersionConstraints")
+	}
+
+	return expression, nil
+}
+
+// validate verifies exactly one field is set in each (sub)expression
+func (e *ClassifierExpression) validate() error {
+	set := 0
+	if e.Classifier != "" {
+		set++
+	}
+	if len(e.And) != 0 {
+		set++
+	}
+	if len(e.Or) != 0 {
+		set++
+	}
+	if e.Not != nil {
+		set++
+	}
+	if set != 1 {
+		return errors.New("exactly one of classifier, and, or, not must be set")
+	}
+
+	for i := range e.And {
+		if err := e.And[i].validate(); err != nil {
+			return err
+		}
+	}
+	for i := range e.Or {
+		if err := e.Or[i].validate(); err != nil {
+			return err
+		}
+	}
+	if e.Not != nil {
+		return e.Not.validate()
+	}
+
+	return nil
+}
+
+// getReferencedClassifiers returns the names of all Classifiers referenced by the expression
+func (e *ClassifierExpression) getReferencedClassifiers() map[string]bool {
+	result := make(map[string]bool)
+	e.collectReferencedClassifiers(result)
+	return result
+}
+
+func (e *ClassifierExpression) collectReferencedClassifiers(result map[string]bool) {
+	if e.Classifier != "" {
+		result[e.Classifier] = true
+	}
+	for i := range e.And {
+		e.And[i].collectReferencedClassifiers(result)
+	}
+	for i := range e.Or {
+		e.Or[i].collectReferencedClassifiers(result)
+	}
+	if e.Not != nil {
+		e.Not.collectReferencedClassifiers(result)
+	}
+}
+
+// evaluate evaluates the expression. matches contains, for each Classifier, whether
+// the cluster is a match.
+func (e *ClassifierExpression) evaluate(matches map[string]bool) bool {
+	switch {
+	case e.Classifier != "":
+		return matches[e.Classifier]
+	case len(e.And) != 0:
+		for i := range e.And {
+			if !e.And[i].evaluate(matches) {
+				return false
+			}
+		}
+		return true
+	case len(e.Or) != 0:
+		for i := range e.Or {
+			if e.Or[i].evaluate(matches) {
+				return true
+			}
+		}
+		return false
+	case e.Not != nil:
+		return !e.Not.evaluate(matches)
+	}
+	return false
+}
+
+// detectCompositionCycle returns an error if, following the references of composite Classifiers
+// starting from classifier, a Classifier is reached twice on the same path
+func detectCompositionCycle(ctx context.Context, c client.Client, classifier *libsveltosv1beta1.Classifier,
+	composition *ClassifierExpression) error {
+
+	classifiers := &libsveltosv1beta1.ClassifierList{}
+	if err := c.List(ctx, classifiers); err != nil {
+		return err
+	}
+
+	// key: Classifier name; value: referenced Classifiers (sorted so to always report same cycle)
+	graph := make(map[string][]string)
+	addToGraph := func(name string, expression *ClassifierExpression) {
+		referenced := make([]string, 0)
+		for k := range expression.getReferencedClassifiers() {
+			referenced = append(referenced, k)
+		}
+		sort.Strings(referenced)
+		graph[name] = referenced
+	}
+
+	for i := range classifiers.Items {
+		if classifiers.Items[i].Name == classifier.Name {
+			continue
+		}
+		expression, err := getClassifierComposition(&classifiers.Items[i])
+		if err != nil || expression == nil {
+			// Invalid compositions are reported on their own Classifier
+			continue
+		}
+		addToGraph(classifiers.Items[i].Name, expression)
+	}
+	addToGraph(classifier.Name, composition)
+
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := make(map[string]int)
+	path := make([]string, 0)
+
+	var visit func(name string) error
+	visit = func(name string) error {
+		switch state[name] {
+		case visiting:
+			return fmt.Errorf("composition cycle detected: %s -> %s", strings.Join(path, " -> "), name)
+		case visited:
+			return nil
+		}
+		state[name] = visiting
+		path = append(path, name)
+		for _, next := range graph[name] {
+			if err := visit(next); err != nil {
+				return err
+			}
+		}
+		path = path[:len(path)-1]
+		state[name] = visited
+		return nil
+	}
+
+	return visit(classifier.Name)
+}
+
+// getCompositeMatchingClusters returns the clusters currently matching a composite Classifier.
+// Every selected cluster is evaluated and a ClassifierReport, with the result, is created/updated for
+// each one of them, so that composite Classifier can be referenced by other composite Classifiers.
+func (r *ClassifierReconciler) getCompositeMatchingClusters(ctx context.Context,
+	classifier *libsveltosv1beta1.Classifier, logger logr.Logger) (map[corev1.ObjectReference]bool, error) {
+
+	composition, err := getClassifierComposition(classifier)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := detectCompositionCycle(ctx, r.Client, classifier, composition); err != nil {
+		r.recordEvent(classifier, corev1.EventTypeWarning, compositionCycleReason, err.Error())
+		return nil, err
+	}
+
+	// key: cluster (as returned by getClusterDescription); value: Classifiers cluster is a match for
+	clusterMatches := make(map[string]map[string]bool)
+	for referenced := range composition.getReferencedClassifiers() {
+		reports := &libsveltosv1beta1.ClassifierReportList{}
+		err := r.List(ctx, reports, client.MatchingLabels{libsveltosv1beta1.ClassifierlNameLabel: referenced})
+		if err != nil {
+			return nil, err
+		}
+		for i := range reports.Items {
+			report := &reports.Items[i]
+			// Skip reports created by sveltos-agent running in the management cluster
+			if report.Spec.ClusterNamespace == "" || !report.Spec.Match {
+				continue
+			}
+			clusterKey := getClusterDescription(getClusterRefFromClassifierReport(report))
+			if clusterMatches[clusterKey] == nil {
+				clusterMatches[clusterKey] = make(map[string]bool)
+			}
+			clusterMatches[clusterKey][referenced] = true
+		}
+	}
+
+	clusters, err := r.getSelectedClusters(ctx, classifier, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	matchingClusters := make(map[corev1.ObjectReference]bool)
+	for i := range clusters {
+		if composition.evaluate(clusterMatches[getClusterDescription(&clusters[i])]) {
+			matchingClusters[clusters[i]] = true
+		}
+	}
+
+	matchingClusters, err = r.applyManagementClusterConstraint(ctx, classifier, matchingClusters, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range clusters {
+		match := matchingClusters[clusters[i]]
+		report := &libsveltosv1beta1.ClassifierReport{}
+		report.Labels = map[string]string{libsveltosv1beta1.ClassifierlNameLabel: classifier.Name}
+		report.Spec.ClassifierName = classifier.Name
+		report.Spec.Match = match
+		if err := updateClassifierReport(ctx, r.Client, &clusters[i], report, logger); err != nil {
+			return nil, err
+		}
+		if match {
+			logger.V(logs.LogDebug).Info(fmt.Sprintf("cluster %s is a match for composition",
+				getClusterDescription(&clusters[i])))
+		}
+	}
+
+	return matchingClusters, nil
+}
+
+// updateComposedClassifierMap keeps track of the Classifiers referenced by a composite Classifier,
+// so that composite Classifier is reconciled when ClassifierReports of referenced Classifiers change.
+func (r *ClassifierReconciler) updateComposedClassifierMap(classifier *libsveltosv1beta1.Classifier) {
+	referenced := map[string]bool{}
+	if composition, err := getClassifierComposition(classifier); err == nil && composition != nil {
+		referenced = composition.getReferencedClassifiers()
+	}
+
+	r.Mux.Lock()
+	defer r.Mux.Unlock()
+
+	if r.ComposedClassifierMap == nil {
+		r.ComposedClassifierMap = make(map[string]*libsveltosset.Set)
+	}
+
+	classifierInfo := getKeyFromObject(r.Scheme, classifier)
+	for name, composites := range r.ComposedClassifierMap {
+		if !referenced[name] {
+			composites.Erase(classifierInfo)
+		}
+	}
+	for name := range referenced {
+		composites, ok := r.ComposedClassifierMap[name]
+		if !ok {
+			composites = &libsveltosset.Set{}
+			r.ComposedClassifierMap[name] = composites
+		}
+		composites.Insert(classifierInfo)
+	}
+}
@@ -0,0 +1,168 @@
+/*
+Copyright 2022. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2/textlogger"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/projectsveltos/classifier/controllers"
+	"github.com/projectsveltos/classifier/pkg/scope"
+	libsveltosv1beta1 "github.com/projectsveltos/libsveltos/api/v1beta1"
+	libsveltosset "github.com/projectsveltos/libsveltos/lib/set"
+)
+
+func getCompositeClassifier(name, composition string) *libsveltosv1beta1.Classifier {
+	return &libsveltosv1beta1.Classifier{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+			Annotations: map[string]string{
+				controllers.ClassifierCompositionAnnotation: composition,
+			},
+		},
+		Spec: libsveltosv1beta1.ClassifierSpec{
+			ClassifierLabels: []libsveltosv1beta1.ClassifierLabel{{Key: randomString(), Value: "true"}},
+		},
+	}
+}
+
+var _ = Describe("Classifier composition", func() {
+	It("evaluate computes AND/OR/NOT expressions", func() {
+		classifier := getCompositeClassifier(randomString(),
+			`{"and": [{"classifier": "prod-ready"}, {"not": {"classifier": "legacy-ingress"}}]}`)
+		expression, err := controllers.GetClassifierComposition(classifier)
+		Expect(err).To(BeNil())
+
+		Expect(controllers.EvaluateExpression(expression, map[string]bool{"prod-ready": true})).To(BeTrue())
+		Expect(controllers.EvaluateExpression(expression,
+			map[string]bool{"prod-ready": true, "legacy-ingress": true})).To(BeFalse())
+		Expect(controllers.EvaluateExpression(expression, nil)).To(BeFalse())
+
+		classifier = getCompositeClassifier(randomString(), `{"or": [{"classifier": "a"}, {"classifier": "b"}]}`)
+		expression, err = controllers.GetClassifierComposition(classifier)
+		Expect(err).To(BeNil())
+		Expect(controllers.EvaluateExpression(expression, map[string]bool{"b": true})).To(BeTrue())
+		Expect(controllers.EvaluateExpression(expression, map[string]bool{"c": true})).To(BeFalse())
+	})
+
+	It("getClassifierComposition rejects malformed expressions", func() {
+		classifier := getCompositeClassifier(randomString(), `{"classifier": "a", "not": {"classifier": "b"}}`)
+		_, err := controllers.GetClassifierComposition(classifier)
+		Expect(err).ToNot(BeNil())
+
+		classifier = getCompositeClassifier(randomString(), `{"and": [{}]}`)
+		_, err = controllers.GetClassifierComposition(classifier)
+		Expect(err).ToNot(BeNil())
+	})
+
+	It("detectCompositionCycle detects cycles across composite Classifiers", func() {
+		nameA := randomString()
+		nameB := randomString()
+		classifierA := getCompositeClassifier(nameA, fmt.Sprintf(`{"classifier": %q}`, nameB))
+		classifierB := getCompositeClassifier(nameB, fmt.Sprintf(`{"not": {"classifier": %q}}`, nameA))
+
+		c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(classifierA, classifierB).Build()
+
+		composition, err := controllers.GetClassifierComposition(classifierA)
+		Expect(err).To(BeNil())
+		err = controllers.DetectCompositionCycle(context.TODO(), c, classifierA, composition)
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(ContainSubstring("cycle"))
+
+		// Break the cycle
+		classifierB.Annotations[controllers.ClassifierCompositionAnnotation] = `{"classifier": "other"}`
+		Expect(c.Update(context.TODO(), classifierB)).To(Succeed())
+		Expect(controllers.DetectCompositionCycle(context.TODO(), c, classifierA, composition)).To(Succeed())
+	})
+
+	It("updateMatchingClustersAndRegistrations evaluates composite Classifier and publishes ClassifierReports", func() {
+		prodReady := randomString()
+		legacyIngress := randomString()
+		composite := getCompositeClassifier(randomString(),
+			fmt.Sprintf(`{"and": [{"classifier": %q}, {"not": {"classifier": %q}}]}`, prodReady, legacyIngress))
+
+		cluster1 := &libsveltosv1beta1.SveltosCluster{
+			ObjectMeta: metav1.ObjectMeta{Namespace: randomString(), Name: randomString()},
+		}
+		cluster2 := &libsveltosv1beta1.SveltosCluster{
+			ObjectMeta: metav1.ObjectMeta{Namespace: randomString(), Name: randomString()},
+		}
+
+		getReport := func(classifierName string, cluster *libsveltosv1beta1.SveltosCluster) *libsveltosv1beta1.ClassifierReport {
+			report := getClassifierReport(classifierName, cluster.Namespace, cluster.Name)
+			report.Namespace = cluster.Namespace
+			report.Spec.ClusterType = libsveltosv1beta1.ClusterTypeSveltos
+			report.Spec.Match = true
+			return report
+		}
+
+		initObjects := []client.Object{
+			composite, cluster1, cluster2,
+			getReport(prodReady, cluster1),
+			getReport(prodReady, cluster2),
+			getReport(legacyIngress, cluster2),
+		}
+		c := fake.NewClientBuilder().WithScheme(scheme).WithStatusSubresource(initObjects...).
+			WithObjects(initObjects...).Build()
+
+		reconciler := &controllers.ClassifierReconciler{
+			Client:        c,
+			Scheme:        scheme,
+			ClusterMap:    make(map[corev1.ObjectReference]*libsveltosset.Set),
+			ClassifierMap: make(map[corev1.ObjectReference]*libsveltosset.Set),
+			Mux:           sync.Mutex{},
+		}
+
+		classifierScope, err := scope.NewClassifierScope(scope.ClassifierScopeParams{
+			Client:         c,
+			Logger:         textlogger.NewLogger(textlogger.NewConfig(textlogger.Verbosity(1))),
+			Classifier:     composite,
+			ControllerName: "classifier",
+		})
+		Expect(err).To(BeNil())
+
+		Expect(controllers.UpdateMatchingClustersAndRegistrations(reconciler, context.TODO(), classifierScope,
+			textlogger.NewLogger(textlogger.NewConfig(textlogger.Verbosity(1))))).To(Succeed())
+
+		Expect(composite.Status.MachingClusterStatuses).To(HaveLen(1))
+		Expect(composite.Status.MachingClusterStatuses[0].ClusterRef.Name).To(Equal(cluster1.Name))
+
+		reports := &libsveltosv1beta1.ClassifierReportList{}
+		Expect(c.List(context.TODO(), reports,
+			client.MatchingLabels{libsveltosv1beta1.ClassifierlNameLabel: composite.Name})).To(Succeed())
+		Expect(reports.Items).To(HaveLen(2))
+		for i := range reports.Items {
+			Expect(reports.Items[i].Spec.Match).To(Equal(reports.Items[i].Spec.ClusterName == cluster1.Name))
+		}
+
+		// A change to a ClassifierReport of a referenced Classifier requeues composite Classifier
+		controllers.UpdateComposedClassifierMap(reconciler, composite)
+		requests := controllers.RequeueClassifierForClassifierReport(reconciler, context.TODO(),
+			getReport(legacyIngress, cluster1))
+		Expect(requests).To(ContainElement(HaveField("NamespacedName.Name", composite.Name)))
+	})
+})
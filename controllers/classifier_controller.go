@@ -19,6 +19,8 @@ package controllers
 import (
 	"context"
 	"fmt"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -27,6 +29,7 @@ import (
 	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
 	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/builder"
@@ -34,6 +37,8 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/controller"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 	"sigs.k8s.io/controller-runtime/pkg/source"
 
@@ -74,6 +79,10 @@ const (
 
 	controlplaneendpoint = "controlplaneendpoint-key"
 
+	// clusterclassifiers is the handler option with the comma separated names of the Classifiers
+	// deployed, or being deployed, in the cluster
+	clusterclassifiers = "clusterclassifiers-key"
+
 	projectsveltos = "projectsveltos"
 )
 
@@ -82,6 +91,7 @@ type ClassifierReconciler struct {
 	client.Client
 	Scheme               *runtime.Scheme
 	Deployer             deployer.DeployerInterface
+	EventRecorder        record.EventRecorder
 	ConcurrentReconciles int
 	ClassifierReportMode ReportMode
 	AgentInMgmtCluster   bool // if true, indicates sveltos-agent needs to be started in the management cluster
@@ -90,17 +100,25 @@ type ClassifierReconciler struct {
 	ControlPlaneEndpoint  string
 	ShardKey              string // when set, only clusters matching the ShardKey will be reconciled
 	CapiOnboardAnnotation string // when set, only capi clusters with this annotation are considered
+	// ReportCollectionConcurrency is the maximum number of clusters ClassifierReports are collected
+	// from in parallel (only when ClassifierReportMode is CollectFromManagementCluster)
+	ReportCollectionConcurrency int
+	// ReportCollectionTimeout is the maximum time spent collecting ClassifierReports from a single cluster
+	ReportCollectionTimeout time.Duration
+	// LabelChangeRateLimit is the maximum number of clusters all Classifiers together can relabel per minute.
+	// Zero means no limit.
+	LabelChangeRateLimit int
+	// AgentKubeconfigMaxAge is the maximum age of the kubeconfig sveltos-agent uses to reach the management
+	// cluster. Only used in AgentSendReportsNoGateway mode. Zero means kubeconfig is never rotated.
+	AgentKubeconfigMaxAge time.Duration
 	// use a Mutex to update in-memory structure as MaxConcurrentReconciles is higher than one
 	Mux sync.Mutex
 	// key: Sveltos/CAPI Cluster namespace/name; value: set of all Classifiers deployed int the Cluster
-	// When a Cluster changes, we need to reconcile one or more Classifier (as of now all Classifier
-	// are deployed in all Clusters). In order to do so, Classifier reconciler watches for Sveltos/CAPI Cluster
-	// changes. Inside a MapFunc there should be no I/O (if that fails, there is no way to recover).
-	// So keeps track of Classifier sets deployed in each Sveltos/CAPI Cluster, so that when Sveltos/CAPI Cluster changes
-	// list of Classifiers that need reconciliation is in memory.
-	// Even though currently each Classifier is deployed in each Sveltos/CAPI Cluster, do not simply keep an in-memory
-	// list of all existing Classifier. Rather keep a map per Sveltos/CAPI cluster. If in future, not all Classifiers
-	// are deployed in all clusters, map will come in handy.
+	// When a Cluster changes, we need to reconcile one or more Classifier (unless a Classifier has a
+	// ClassifierClusterSelector, it is deployed in all Clusters). In order to do so, Classifier reconciler watches
+	// for Sveltos/CAPI Cluster changes. Inside a MapFunc there should be no I/O (if that fails, there is no way
+	// to recover). So keeps track of Classifier sets deployed in each Sveltos/CAPI Cluster, so that when
+	// Sveltos/CAPI Cluster changes list of Classifiers that need reconciliation is in memory.
 	// key: Sveltos/CAPI Cluster namespace/name; value: set of all ClusterProfiles matching the Cluster
 	ClusterMap map[corev1.ObjectReference]*libsveltosset.Set
 
@@ -112,6 +130,11 @@ type ClassifierReconciler struct {
 
 	// List of current existing Classifiers
 	AllClassifierSet libsveltosset.Set
+
+	// key: Classifier name; value: set of all composite Classifiers referencing it.
+	// When a ClassifierReport changes, all composite Classifiers referencing its Classifier
+	// need to be reconciled.
+	ComposedClassifierMap map[string]*libsveltosset.Set
 }
 
 //+kubebuilder:rbac:groups=lib.projectsveltos.io,resources=classifiers,verbs=get;list;watch;create;update;patch;delete
@@ -119,12 +142,13 @@ type ClassifierReconciler struct {
 //+kubebuilder:rbac:groups=lib.projectsveltos.io,resources=classifiers/finalizers,verbs=update
 //+kubebuilder:rbac:groups=lib.projectsveltos.io,resources=classifierreports,verbs=get;list;watch;create;update;delete
 //+kubebuilder:rbac:groups=lib.projectsveltos.io,resources=accessrequests,verbs=get;list;watch;create;update;patch;delete
-//+kubebuilder:rbac:groups=cluster.x-k8s.io,resources=clusters,verbs=get;watch;list;update
+//+kubebuilder:rbac:groups=cluster.x-k8s.io,resources=clusters,verbs=get;watch;list;update;patch
 //+kubebuilder:rbac:groups=cluster.x-k8s.io,resources=clusters/status,verbs=get;watch;list
 //+kubebuilder:rbac:groups=cluster.x-k8s.io,resources=machines,verbs=get;watch;list
 //+kubebuilder:rbac:groups=cluster.x-k8s.io,resources=machines/status,verbs=get;watch;list
+//+kubebuilder:rbac:groups=controlplane.cluster.x-k8s.io,resources=*,verbs=get;list;watch
 //+kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch
-//+kubebuilder:rbac:groups="",resources=configmaps,verbs=get;list;watch
+//+kubebuilder:rbac:groups="",resources=configmaps,verbs=get;list;watch;create;update;delete
 
 func (r *ClassifierReconciler) Reconcile(ctx context.Context, req ctrl.Request) (_ ctrl.Result, reterr error) {
 	if r.ShardKey != "" {
@@ -168,6 +192,16 @@ func (r *ClassifierReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 		)
 	}
 
+	// Per-cluster status in the Classifier instance might be truncated. ConfigMaps have all of it
+	if err := classifierScope.LoadClusterStatuses(ctx); err != nil {
+		logger.Error(err, "Failed to load per-cluster status")
+		return reconcile.Result{}, errors.Wrapf(
+			err,
+			"unable to load per-cluster status for %s",
+			req.NamespacedName,
+		)
+	}
+
 	// Always close the scope when exiting this function so we can persist any Classifier
 	// changes.
 	defer func() {
@@ -199,6 +233,12 @@ func (r *ClassifierReconciler) reconcileDelete(
 		return reconcile.Result{}, err
 	}
 
+	err = r.removeLabelsFromMatchingClusters(ctx, classifierScope.Classifier, logger)
+	if err != nil {
+		logger.V(logs.LogInfo).Error(err, "failed to remove Classifier labels from clusters")
+		return reconcile.Result{Requeue: true, RequeueAfter: deleteRequeueAfter}, nil
+	}
+
 	if !r.AgentInMgmtCluster {
 		// In agentless mode, Classifier instances are not copied to managed clusters.
 		// So there is nothing to remove from managed cluster.
@@ -210,18 +250,24 @@ func (r *ClassifierReconciler) reconcileDelete(
 		}
 	}
 
+	err = removeDryRunReport(ctx, r.Client, classifierScope.Classifier)
+	if err != nil {
+		logger.V(logs.LogInfo).Error(err, "failed to remove dry-run report")
+		return reconcile.Result{Requeue: true, RequeueAfter: deleteRequeueAfter}, nil
+	}
+
 	err = removeClassifierReports(ctx, r.Client, classifierScope.Classifier, logger)
 	if err != nil {
 		logger.V(logs.LogInfo).Error(err, "failed to remove classifierReports")
 		return reconcile.Result{Requeue: true, RequeueAfter: deleteRequeueAfter}, nil
 	}
 
-	if r.ClassifierReportMode == CollectFromManagementCluster {
-		err = removeAccessRequest(ctx, r.Client, logger)
-		if err != nil {
-			logger.V(logs.LogInfo).Error(err, "failed to remove accessRequest")
-			return reconcile.Result{Requeue: true, RequeueAfter: deleteRequeueAfter}, nil
-		}
+	// AccessRequests are shared by all Classifiers deployed in a cluster. Those are removed only
+	// once no Classifier uses them anymore.
+	err = releaseAccessRequests(ctx, r.Client, classifierScope.Classifier.Name, logger)
+	if err != nil {
+		logger.V(logs.LogInfo).Error(err, "failed to release accessRequests")
+		return reconcile.Result{Requeue: true, RequeueAfter: deleteRequeueAfter}, nil
 	}
 
 	r.Mux.Lock()
@@ -240,6 +286,13 @@ func (r *ClassifierReconciler) reconcileDelete(
 	}
 	delete(r.ClassifierMap, *classifierInfo)
 
+	for _, composites := range r.ComposedClassifierMap {
+		composites.Erase(classifierInfo)
+	}
+
+	removeClassifierMetrics(classifierScope.Classifier.Name)
+	labelRateLimiter.forget(classifierScope.Classifier.Name)
+
 	if controllerutil.ContainsFinalizer(classifierScope.Classifier, libsveltosv1beta1.ClassifierFinalizer) {
 		controllerutil.RemoveFinalizer(classifierScope.Classifier, libsveltosv1beta1.ClassifierFinalizer)
 	}
@@ -251,11 +304,21 @@ func (r *ClassifierReconciler) reconcileDelete(
 func (r *ClassifierReconciler) reconcileNormal(
 	ctx context.Context,
 	classifierScope *scope.ClassifierScope,
-) (reconcile.Result, error) {
+) (result reconcile.Result, reterr error) {
 
 	logger := classifierScope.Logger
 	logger.V(logs.LogInfo).Info("Reconciling Classifier")
 
+	// Label changes still over the rate limit are queued again during this reconciliation
+	labelRateLimiter.resetQueued(classifierScope.Classifier.Name)
+
+	defer func() {
+		updateLabelChangesQueuedCondition(classifierScope)
+		// Requeue is only set on failures. RequeueAfter alone is used to wait for pending transitions
+		// and queued label changes.
+		updateReadyCondition(classifierScope, reterr, result.Requeue)
+	}()
+
 	if !controllerutil.ContainsFinalizer(classifierScope.Classifier, libsveltosv1beta1.ClassifierFinalizer) {
 		if err := r.addFinalizer(ctx, classifierScope); err != nil {
 			logger.V(logs.LogDebug).Info("failed to update finalizer")
@@ -263,16 +326,48 @@ func (r *ClassifierReconciler) reconcileNormal(
 		}
 	}
 
+	r.updateComposedClassifierMap(classifierScope.Classifier)
+
 	err := r.updateMatchingClustersAndRegistrations(ctx, classifierScope, logger)
 	if err != nil {
 		logger.V(logs.LogDebug).Info("failed to update matchingClusterRefs")
 		return reconcile.Result{}, err
 	}
 
-	err = r.updateLabelsOnMatchingClusters(ctx, classifierScope, logger)
-	if err != nil {
-		logger.V(logs.LogDebug).Info("failed to update cluster labels")
-		return reconcile.Result{}, err
+	if keymanager.IsDryRun(classifierScope.Classifier) {
+		updateLabelsAppliedCondition(classifierScope, true, nil)
+		err = r.publishDryRunReport(ctx, classifierScope.Classifier, logger)
+		if err != nil {
+			logger.V(logs.LogDebug).Info("failed to publish dry-run report")
+			return reconcile.Result{}, err
+		}
+	} else {
+		err = r.updateLabelsOnMatchingClusters(ctx, classifierScope, logger)
+		updateLabelsAppliedCondition(classifierScope, false, err)
+		if err != nil {
+			logger.V(logs.LogDebug).Info("failed to update cluster labels")
+			return reconcile.Result{}, err
+		}
+
+		err = removeDryRunReport(ctx, r.Client, classifierScope.Classifier)
+		if err != nil {
+			logger.V(logs.LogDebug).Info("failed to remove dry-run report")
+			return reconcile.Result{}, err
+		}
+	}
+
+	if isManagementOnlyClassifier(classifierScope.Classifier) {
+		// Classifier is only evaluated in the management cluster. Nothing needs to be deployed
+		// in the managed clusters.
+		err = r.removeClassifierFromManagedClusters(ctx, classifierScope, logger)
+		r.updateMaps(classifierScope)
+		if err != nil {
+			logger.V(logs.LogInfo).Error(err, "failed to undeploy")
+			return reconcile.Result{Requeue: true, RequeueAfter: normalRequeueAfter}, nil
+		}
+
+		logger.V(logs.LogInfo).Info("Reconcile success")
+		return reconcile.Result{RequeueAfter: r.getRequeueAfter(classifierScope)}, nil
 	}
 
 	err = r.updateClusterInfo(ctx, classifierScope)
@@ -283,6 +378,13 @@ func (r *ClassifierReconciler) reconcileNormal(
 
 	r.updateMaps(classifierScope)
 
+	rotationRequeueAfter, err := r.rotateAgentKubeconfigs(ctx, classifierScope, logger)
+	if err != nil {
+		// Classifier can still be deployed using current kubeconfig. Rotation is retried later.
+		logger.V(logs.LogInfo).Error(err, "failed to rotate sveltos-agent kubeconfig")
+		rotationRequeueAfter = normalRequeueAfter
+	}
+
 	f := getHandlersForFeature(libsveltosv1beta1.FeatureClassifier)
 
 	if err := r.deployClassifier(ctx, classifierScope, f, logger); err != nil {
@@ -290,8 +392,25 @@ func (r *ClassifierReconciler) reconcileNormal(
 		return reconcile.Result{Requeue: true, RequeueAfter: normalRequeueAfter}, nil
 	}
 
+	requeueAfter := r.getRequeueAfter(classifierScope)
+	if rotationRequeueAfter != 0 && (requeueAfter == 0 || rotationRequeueAfter < requeueAfter) {
+		requeueAfter = rotationRequeueAfter
+	}
+
 	logger.V(logs.LogInfo).Info("Reconcile success")
-	return reconcile.Result{}, nil
+	return reconcile.Result{RequeueAfter: requeueAfter}, nil
+}
+
+// getRequeueAfter returns when a successfully reconciled Classifier needs to be reconciled again
+// to act on pending transitions or on queued label changes. Zero if not needed.
+func (r *ClassifierReconciler) getRequeueAfter(classifierScope *scope.ClassifierScope) time.Duration {
+	requeueAfter := getStabilizationRequeueAfter(classifierScope, time.Now())
+	if retry := r.getLabelChangeRequeueAfter(classifierScope.Classifier); retry != 0 &&
+		(requeueAfter == 0 || retry < requeueAfter) {
+
+		requeueAfter = retry
+	}
+	return requeueAfter
 }
 
 // SetupWithManager sets up the controller with the Manager.
@@ -319,7 +438,10 @@ func (r *ClassifierReconciler) SetupWithManager(mgr ctrl.Manager) (controller.Co
 		Watches(&libsveltosv1beta1.SveltosCluster{},
 			handler.EnqueueRequestsFromMapFunc(r.requeueClassifierForSveltosCluster),
 			builder.WithPredicates(
-				predicates.SveltosClusterPredicates(mgr.GetLogger().WithValues("predicate", "sveltosclusterpredicate")),
+				predicate.Or(
+					predicates.SveltosClusterPredicates(mgr.GetLogger().WithValues("predicate", "sveltosclusterpredicate")),
+					SveltosClusterReportModePredicate(mgr.GetLogger().WithValues("predicate", "sveltosclusterreportmodepredicate")),
+				),
 			),
 		).
 		Watches(&corev1.Secret{},
@@ -342,8 +464,30 @@ func (r *ClassifierReconciler) SetupWithManager(mgr ctrl.Manager) (controller.Co
 	// At this point we don't know yet whether CAPI is present in the cluster.
 	// Later on, in main, we detect that and if CAPI is present WatchForCAPI will be invoked.
 
-	if r.ClassifierReportMode == CollectFromManagementCluster {
-		go collectClassifierReports(mgr.GetClient(), r.ShardKey, r.CapiOnboardAnnotation, getVersion(), mgr.GetLogger())
+	// Report mode can be overridden per cluster, so collection runs whatever ClassifierReportMode is.
+	// Only clusters in CollectFromManagementCluster mode are collected from.
+	options := &reportCollectionOptions{
+		shardKey:              r.ShardKey,
+		capiOnboardAnnotation: r.CapiOnboardAnnotation,
+		version:               getVersion(),
+		concurrency:           r.ReportCollectionConcurrency,
+		clusterTimeout:        r.ReportCollectionTimeout,
+		defaultReportMode:     r.ClassifierReportMode,
+	}
+	if options.concurrency <= 0 {
+		options.concurrency = DefaultReportCollectionConcurrency
+	}
+	if options.clusterTimeout <= 0 {
+		options.clusterTimeout = DefaultReportCollectionTimeout
+	}
+	// Collection runs as a manager runnable so it uses manager context and stops on shutdown.
+	// RunnableFunc needs leader election: when leader election is enabled, only the leader collects.
+	err = mgr.Add(manager.RunnableFunc(func(ctx context.Context) error {
+		collectClassifierReports(ctx, mgr.GetClient(), options, mgr.GetLogger())
+		return nil
+	}))
+	if err != nil {
+		return nil, errors.Wrap(err, "error adding ClassifierReport collector")
 	}
 
 	return c, nil
@@ -356,7 +500,11 @@ func (r *ClassifierReconciler) WatchForCAPI(mgr ctrl.Manager, c controller.Contr
 		mgr.GetCache(),
 		&clusterv1.Cluster{},
 		handler.TypedEnqueueRequestsFromMapFunc(r.requeueClassifierForCluster),
-		predicates.ClusterPredicate{Logger: mgr.GetLogger().WithValues("predicate", "clusterpredicate")},
+		predicate.Or[*clusterv1.Cluster](
+			predicates.ClusterPredicate{Logger: mgr.GetLogger().WithValues("predicate", "clusterpredicate")},
+			ClusterManagementConstraintPredicate(mgr.GetLogger().WithValues("predicate", "clustermgmtconstraintpredicate")),
+			ClusterReportModePredicate(mgr.GetLogger().WithValues("predicate", "clusterreportmodepredicate")),
+		),
 	)
 	if err := c.Watch(sourceCluster); err != nil {
 		return err
@@ -368,7 +516,10 @@ func (r *ClassifierReconciler) WatchForCAPI(mgr ctrl.Manager, c controller.Contr
 		mgr.GetCache(),
 		&clusterv1.Machine{},
 		handler.TypedEnqueueRequestsFromMapFunc(r.requeueClassifierForMachine),
-		predicates.MachinePredicate{Logger: mgr.GetLogger().WithValues("predicate", "clusterpredicate")},
+		predicate.Or[*clusterv1.Machine](
+			predicates.MachinePredicate{Logger: mgr.GetLogger().WithValues("predicate", "clusterpredicate")},
+			MachineManagementConstraintPredicate(mgr.GetLogger().WithValues("predicate", "machinemgmtconstraintpredicate")),
+		),
 	)
 	if err := c.Watch(machineCluster); err != nil {
 		return err
@@ -386,6 +537,44 @@ func (r *ClassifierReconciler) getClusterMapForEntry(entry *corev1.ObjectReferen
 	return s
 }
 
+// getClusterClassifiers returns the names of the Classifiers deployed, or being deployed, in the cluster
+// according to ClusterMap, so no API call is made. Classifiers being removed from the cluster (un-deploy
+// request queued or in progress) are ignored.
+func (r *ClassifierReconciler) getClusterClassifiers(cluster *corev1.ObjectReference) []string {
+	clusterType := clusterproxy.GetClusterType(cluster)
+	entry := getClusterReference(cluster.Namespace, cluster.Name, clusterType)
+
+	r.Mux.Lock()
+	var classifiers []corev1.ObjectReference
+	if s, ok := r.ClusterMap[*entry]; ok {
+		classifiers = s.Items()
+	}
+	r.Mux.Unlock()
+
+	f := getHandlersForFeature(libsveltosv1beta1.FeatureClassifier)
+	result := make([]string, 0, len(classifiers))
+	for i := range classifiers {
+		if r.Deployer != nil && r.Deployer.IsInProgress(cluster.Namespace, cluster.Name, classifiers[i].Name,
+			f.id, clusterType, true) {
+
+			continue
+		}
+		result = append(result, classifiers[i].Name)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// getClusterClassifiersFromOptions returns the names of the Classifiers deployed in the cluster passed
+// to a deployer handler
+func getClusterClassifiersFromOptions(options deployer.Options) []string {
+	value := options.HandlerOptions[clusterclassifiers]
+	if value == "" {
+		return []string{}
+	}
+	return strings.Split(value, ",")
+}
+
 func (r *ClassifierReconciler) addFinalizer(ctx context.Context, classifierScope *scope.ClassifierScope) error {
 	// If the Classifier doesn't have our finalizer, add it.
 	controllerutil.AddFinalizer(classifierScope.Classifier, libsveltosv1beta1.ClassifierFinalizer)
@@ -402,7 +591,9 @@ func (r *ClassifierReconciler) addFinalizer(ctx context.Context, classifierScope
 }
 
 // updateClusterInfo updates Classifier Status ClusterInfo by adding an entry for any
-// new cluster where Classifier needs to be deployed
+// new cluster where Classifier needs to be deployed.
+// Entries for clusters not selected anymore by Classifier are marked as Removing, so that
+// Classifier is removed from those.
 func (r *ClassifierReconciler) updateClusterInfo(ctx context.Context, classifierScope *scope.ClassifierScope) error {
 	classifier := classifierScope.Classifier
 
@@ -410,17 +601,32 @@ func (r *ClassifierReconciler) updateClusterInfo(ctx context.Context, classifier
 		return fmt.Sprintf("%s:%s/%s", clusterproxy.GetClusterType(&cluster), cluster.Namespace, cluster.Name)
 	}
 
-	matchingCluster, err := clusterproxy.GetListOfClusters(ctx, r.Client, "", r.CapiOnboardAnnotation,
-		classifierScope.Logger)
+	matchingCluster, err := r.getSelectedClusters(ctx, classifier, classifierScope.Logger)
 	if err != nil {
 		return err
 	}
 
+	selectedMap := make(map[string]bool)
+	for i := range matchingCluster {
+		selectedMap[getClusterID(matchingCluster[i])] = true
+	}
+
 	// Build Map for all Clusters with an entry in Classifier.Status.ClusterInfo
 	clusterMap := make(map[string]bool)
+	finalClusterInfo := make([]libsveltosv1beta1.ClusterInfo, len(classifier.Status.ClusterInfo))
 	for i := range classifier.Status.ClusterInfo {
-		c := &classifier.Status.ClusterInfo[i]
+		c := classifier.Status.ClusterInfo[i]
 		clusterMap[getClusterID(c.Cluster)] = true
+		switch {
+		case !selectedMap[getClusterID(c.Cluster)]:
+			c.Status = libsveltosv1beta1.SveltosStatusRemoving
+		case c.Status == libsveltosv1beta1.SveltosStatusRemoving:
+			// Cluster is selected again. Classifier needs to be deployed again.
+			c.Status = ""
+			c.Hash = nil
+			c.FailureMessage = nil
+		}
+		finalClusterInfo[i] = c
 	}
 
 	newClusterInfo := make([]libsveltosv1beta1.ClusterInfo, 0)
@@ -433,7 +639,6 @@ func (r *ClassifierReconciler) updateClusterInfo(ctx context.Context, classifier
 		}
 	}
 
-	finalClusterInfo := classifier.Status.ClusterInfo
 	finalClusterInfo = append(finalClusterInfo, newClusterInfo...)
 	classifierScope.SetClusterInfo(finalClusterInfo)
 	return nil
@@ -442,12 +647,121 @@ func (r *ClassifierReconciler) updateClusterInfo(ctx context.Context, classifier
 // updateMatchingClustersAndRegistrations does two things:
 // - updates Classifier Status.MachingClusterStatuses
 // - update label key registration with keymanager instance
+// When Classifier has a stabilization window, match changes are only considered once stable.
+// A cluster not matching anymore is considered a match till label change rate limits allow relabeling it.
 func (r *ClassifierReconciler) updateMatchingClustersAndRegistrations(ctx context.Context,
 	classifierScope *scope.ClassifierScope, logger logr.Logger) error {
 
+	var currentMatchingClusters map[corev1.ObjectReference]bool
+	var err error
+	if hasClassifierComposition(classifierScope.Classifier) {
+		currentMatchingClusters, err = r.getCompositeMatchingClusters(ctx, classifierScope.Classifier, logger)
+	} else {
+		currentMatchingClusters, err = r.getMatchingClusters(ctx, classifierScope.Classifier, logger)
+	}
+	if err != nil {
+		return err
+	}
+
+	// create map of old matching clusters
+	oldMatchingClusters := make(map[corev1.ObjectReference]bool)
+	for i := range classifierScope.Classifier.Status.MachingClusterStatuses {
+		ref := classifierScope.Classifier.Status.MachingClusterStatuses[i]
+		oldMatchingClusters[ref.ClusterRef] = true
+	}
+
+	// Changes are acted upon only once they have been observed for the stabilization window (if any)
+	window, err := getStabilizationWindow(classifierScope.Classifier)
+	if err != nil {
+		return err
+	}
+	var pendingTransitions []scope.PendingTransition
+	currentMatchingClusters, pendingTransitions = applyStabilizationWindow(window, time.Now(),
+		currentMatchingClusters, oldMatchingClusters, classifierScope.GetPendingTransitions())
+	if len(pendingTransitions) != 0 {
+		logger.V(logs.LogDebug).Info(fmt.Sprintf("%d cluster(s) with a pending transition", len(pendingTransitions)))
+	}
+	classifierScope.SetPendingTransitions(pendingTransitions)
+
+	if keymanager.IsDryRun(classifierScope.Classifier) {
+		// In dry-run mode Classifier does not register for any label and does not touch
+		// Cluster labels
+		err = r.removeRegistrationsForDryRun(ctx, classifierScope.Classifier, currentMatchingClusters,
+			oldMatchingClusters, logger)
+		if err != nil {
+			return err
+		}
+	} else {
+		// Clusters not matching anymore are kept until label change rate limits allow relabeling them
+		var reservations map[corev1.ObjectReference]*labelChangeReservation
+		currentMatchingClusters, reservations, err = r.limitMatchRemovals(ctx, classifierScope.Classifier,
+			currentMatchingClusters, oldMatchingClusters, logger)
+		if err != nil {
+			return err
+		}
+
+		err = r.handleLabelRegistrations(ctx, classifierScope.Classifier, currentMatchingClusters,
+			oldMatchingClusters, logger)
+		if err != nil {
+			releaseLabelChanges(reservations)
+			return err
+		}
+
+		// Remove labels from clusters not matching anymore
+		for c := range oldMatchingClusters {
+			if _, ok := currentMatchingClusters[c]; !ok {
+				err = r.removeLabelsFromCluster(ctx, classifierScope.Classifier, &c, logger)
+				if err != nil {
+					// Labels on this and remaining clusters were not removed
+					releaseLabelChanges(reservations)
+					return err
+				}
+				delete(reservations, c)
+			}
+		}
+	}
+
+	matchingClusterStatus := make([]libsveltosv1beta1.MachingClusterStatus, len(currentMatchingClusters))
+	i := 0
+	unManaged := 0
+	for c := range currentMatchingClusters {
+		tmpManaged, tmpUnmanaged, err := r.classifyLabels(ctx, classifierScope.Classifier, &c, logger)
+		if err != nil {
+			return err
+		}
+		unManaged += len(tmpUnmanaged)
+		matchingClusterStatus[i] =
+			libsveltosv1beta1.MachingClusterStatus{
+				ClusterRef:      c,
+				ManagedLabels:   tmpManaged,
+				UnManagedLabels: tmpUnmanaged,
+			}
+		i++
+	}
+
+	r.updateClassifierSet(classifierScope, unManaged != 0)
+
+	classifierMatchingClusters(classifierScope.Classifier.Name, len(currentMatchingClusters))
+	classifierConflictingLabels(classifierScope.Classifier.Name, unManaged)
+
+	r.recordMatchingClusterEvents(classifierScope.Classifier, currentMatchingClusters, oldMatchingClusters)
+	r.recordLabelConflictEvents(classifierScope.Classifier, classifierScope.Classifier.Status.MachingClusterStatuses,
+		matchingClusterStatus)
+	updateConflictsPresentCondition(classifierScope, unManaged)
+
+	classifierScope.SetMachingClusterStatuses(matchingClusterStatus)
+
+	return nil
+}
+
+// getMatchingClusters returns the clusters currently matching a Classifier, based on ClassifierReports
+// and on the ManagementClusterConstraint (if any)
+func (r *ClassifierReconciler) getMatchingClusters(ctx context.Context, classifier *libsveltosv1beta1.Classifier,
+	logger logr.Logger) (map[corev1.ObjectReference]bool, error) {
+
 	listOptions := []client.ListOption{
 		client.MatchingLabels{
-			libsveltosv1beta1.ClassifierlNameLabel: classifierScope.Classifier.Name,
+			libsveltosv1beta1.ClassifierlNameLabel: classifier.Name,
 		},
 	}
 
@@ -455,7 +769,7 @@ func (r *ClassifierReconciler) updateMatchingClustersAndRegistrations(ctx contex
 	err := r.List(ctx, classifierReportList, listOptions...)
 	if err != nil {
 		logger.V(logs.LogInfo).Info(fmt.Sprintf("failed to list ClassifierReports. Err: %v", err))
-		return err
+		return nil, err
 	}
 
 	logger.V(logs.LogDebug).Info(fmt.Sprintf("found %d ClassifierReports for this Classifier instance",
@@ -483,42 +797,22 @@ func (r *ClassifierReconciler) updateMatchingClustersAndRegistrations(ctx contex
 		}
 	}
 
-	// create map of old matching clusters
-	oldMatchingClusters := make(map[corev1.ObjectReference]bool)
-	for i := range classifierScope.Classifier.Status.MachingClusterStatuses {
-		ref := classifierScope.Classifier.Status.MachingClusterStatuses[i]
-		oldMatchingClusters[ref.ClusterRef] = true
-	}
-
-	err = r.handleLabelRegistrations(ctx, classifierScope.Classifier, currentMatchingClusters,
-		oldMatchingClusters, logger)
+	// ClassifierReports for clusters not selected anymore might still exist while Classifier is being
+	// removed from those
+	currentMatchingClusters, err = r.filterSelectedClusters(ctx, classifier, currentMatchingClusters)
 	if err != nil {
-		return err
+		logger.V(logs.LogInfo).Info(fmt.Sprintf("failed to evaluate cluster selector. Err: %v", err))
+		return nil, err
 	}
 
-	matchingClusterStatus := make([]libsveltosv1beta1.MachingClusterStatus, len(currentMatchingClusters))
-	i := 0
-	unManaged := 0
-	for c := range currentMatchingClusters {
-		tmpManaged, tmpUnmanaged, err := r.classifyLabels(ctx, classifierScope.Classifier, &c, logger)
-		if err != nil {
-			return err
-		}
-		unManaged += len(tmpUnmanaged)
-		matchingClusterStatus[i] =
-			libsveltosv1beta1.MachingClusterStatus{
-				ClusterRef:      c,
-				ManagedLabels:   tmpManaged,
-				UnManagedLabels: tmpUnmanaged,
-			}
-		i++
+	currentMatchingClusters, err = r.applyManagementClusterConstraint(ctx, classifier,
+		currentMatchingClusters, logger)
+	if err != nil {
+		logger.V(logs.LogInfo).Info(fmt.Sprintf("failed to evaluate management constraint. Err: %v", err))
+		return nil, err
 	}
 
-	r.updateClassifierSet(classifierScope, unManaged != 0)
-
-	classifierScope.SetMachingClusterStatuses(matchingClusterStatus)
-
-	return nil
+	return currentMatchingClusters, nil
 }
 
 func (r *ClassifierReconciler) updateClassifierSet(classifierScope *scope.ClassifierScope, hasUnManaged bool) {
@@ -546,6 +840,10 @@ func (r *ClassifierReconciler) updateLabelsOnMatchingClusters(ctx context.Contex
 		ref := &classifierScope.Classifier.Status.MachingClusterStatuses[i].ClusterRef
 		cluster, err := clusterproxy.GetCluster(ctx, r.Client, ref.Namespace, ref.Name, clusterproxy.GetClusterType(ref))
 		if err != nil {
+			if apierrors.IsNotFound(err) {
+				// Cluster is gone. It is still listed only while its transition is pending.
+				continue
+			}
 			logger.V(logs.LogInfo).Error(err, fmt.Sprintf("failed to get cluster %s/%s", ref.Namespace, ref.Name))
 			return err
 		}
@@ -572,15 +870,31 @@ func (r *ClassifierReconciler) updateLabelsOnCluster(ctx context.Context,
 		return err
 	}
 
+	// Render templated label values (if any) for this cluster
+	values, err := r.getClassifierLabelValues(ctx, classifierScope.Classifier, cluster, clusterType, logger)
+	if err != nil {
+		return err
+	}
+
+	fieldManager := getClassifierFieldManager(classifierScope.Classifier.Name)
+	applied := getAppliedLabels(cluster, fieldManager, logger)
+	legacy := getLegacyLabels(cluster, logger)
+	labels := cluster.GetLabels()
+	desired := make(map[string]string)
+
 	for i := range classifierScope.Classifier.Spec.ClassifierLabels {
 		label := classifierScope.Classifier.Spec.ClassifierLabels[i]
 		if manager.CanManageLabel(classifierScope.Classifier, cluster.GetNamespace(), cluster.GetName(), label.Key, clusterType) {
-			labels := cluster.GetLabels()
-			if labels == nil {
-				labels = make(map[string]string)
+			value, ok := values[label.Key]
+			if !ok {
+				// Template could not be rendered. Leave current label as it is.
+				current, exists := labels[label.Key]
+				if exists && (applied[label.Key] || legacy[label.Key]) {
+					desired[label.Key] = current
+				}
+				continue
 			}
-			labels[label.Key] = label.Value
-			cluster.SetLabels(labels)
+			desired[label.Key] = value
 		} else {
 			l := logger.WithValues("label", label.Key)
 			l.V(logs.LogInfo).Info("cannot manage label")
@@ -588,7 +902,9 @@ func (r *ClassifierReconciler) updateLabelsOnCluster(ctx context.Context,
 		}
 	}
 
-	return r.Update(ctx, cluster)
+	// Labels previously set by this Classifier and not managed anymore (for instance removed from
+	// Spec.ClassifierLabels) are not in desired, so they are garbage collected
+	return r.applyClusterLabels(ctx, classifierScope.Classifier, cluster, clusterType, desired, manager, true, logger)
 }
 
 func (r *ClassifierReconciler) updateMaps(classifierScope *scope.ClassifierScope) {
@@ -696,21 +1012,34 @@ func (r *ClassifierReconciler) classifyLabels(ctx context.Context, classifier *l
 		APIVersion: cluster.APIVersion, Kind: cluster.Kind,
 	})
 
+	strategy := keymanager.GetCurrentConflictResolver().Name()
+
+	// A Classifier in dry-run mode is never registered. Report what would happen if it were.
+	canManageLabel := manager.CanManageLabel
+	if keymanager.IsDryRun(classifier) {
+		canManageLabel = manager.WouldManageLabel
+	}
+
 	managed := make([]string, 0)
 	unManaged := make([]libsveltosv1beta1.UnManagedLabel, 0)
 	for i := range classifier.Spec.ClassifierLabels {
 		label := &classifier.Spec.ClassifierLabels[i]
-		if manager.CanManageLabel(classifier, cluster.Namespace, cluster.Name, label.Key, clusterType) {
+		if canManageLabel(classifier, cluster.Namespace, cluster.Name, label.Key, clusterType) {
 			logger.V(logs.LogDebug).Info(fmt.Sprintf("classifier can manage label %s", label.Key))
 			managed = append(managed, label.Key)
 		} else {
 			logger.V(logs.LogDebug).Info(fmt.Sprintf("classifier cannot manage label %s", label.Key))
 			tmpUnManaged := libsveltosv1beta1.UnManagedLabel{Key: label.Key}
+			var failureMessage string
 			currentManager, err := manager.GetManagerForKey(cluster.Namespace, cluster.Name, label.Key, clusterType)
 			if err == nil {
-				failureMessage := fmt.Sprintf("classifier %s currently manage this", currentManager)
-				tmpUnManaged.FailureMessage = &failureMessage
+				failureMessage = fmt.Sprintf("classifier %s currently manage this (conflict resolution strategy: %s)",
+					currentManager, strategy)
+			} else {
+				failureMessage = fmt.Sprintf("label is contested. No classifier currently manage this (conflict resolution strategy: %s)",
+					strategy)
 			}
+			tmpUnManaged.FailureMessage = &failureMessage
 			unManaged = append(unManaged, tmpUnManaged)
 		}
 	}
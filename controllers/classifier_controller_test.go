@@ -18,6 +18,8 @@ package controllers_test
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"sync"
 
 	. "github.com/onsi/ginkgo/v2"
@@ -27,6 +29,7 @@ import (
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/klog/v2/textlogger"
 	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
 	ctrl "sigs.k8s.io/controller-runtime"
@@ -215,6 +218,60 @@ var _ = Describe("Classifier: Reconciler", func() {
 		Expect(len(classifier.Status.MachingClusterStatuses[0].ManagedLabels)).To(Equal(len(classifier.Spec.ClassifierLabels)))
 	})
 
+	It("updateMatchingClustersAndRegistrations emits events and sets ConflictsPresent condition", func() {
+		clusterNamespace := randomString()
+		clusterName := randomString()
+		classifierReport := getClassifierReport(classifier.Name, clusterNamespace, clusterName)
+		classifierReport.Spec.Match = true
+
+		initObjects := []client.Object{
+			classifier,
+			classifierReport,
+		}
+
+		c := fake.NewClientBuilder().WithScheme(scheme).WithStatusSubresource(initObjects...).
+			WithObjects(initObjects...).Build()
+
+		const bufferSize = 10
+		recorder := record.NewFakeRecorder(bufferSize)
+		reconciler := &controllers.ClassifierReconciler{
+			Client:        c,
+			Scheme:        scheme,
+			EventRecorder: recorder,
+			ClusterMap:    make(map[corev1.ObjectReference]*libsveltosset.Set),
+			ClassifierMap: make(map[corev1.ObjectReference]*libsveltosset.Set),
+			Mux:           sync.Mutex{},
+		}
+
+		classifierScope, err := scope.NewClassifierScope(scope.ClassifierScopeParams{
+			Client:         c,
+			Logger:         textlogger.NewLogger(textlogger.NewConfig(textlogger.Verbosity(1))),
+			Classifier:     classifier,
+			ControllerName: "classifier",
+		})
+		Expect(err).To(BeNil())
+
+		Expect(controllers.UpdateMatchingClustersAndRegistrations(reconciler, context.TODO(), classifierScope,
+			textlogger.NewLogger(textlogger.NewConfig(textlogger.Verbosity(1))))).To(Succeed())
+
+		Expect(recorder.Events).To(Receive(And(ContainSubstring("ClusterMatched"),
+			ContainSubstring(clusterNamespace+"/"+clusterName))))
+
+		condition := classifierScope.GetCondition(scope.ConflictsPresentCondition)
+		Expect(condition).ToNot(BeNil())
+		Expect(condition.Status).To(Equal(metav1.ConditionFalse))
+
+		// Cluster is not a match anymore
+		classifierReport.Spec.Match = false
+		Expect(c.Update(context.TODO(), classifierReport)).To(Succeed())
+
+		Expect(controllers.UpdateMatchingClustersAndRegistrations(reconciler, context.TODO(), classifierScope,
+			textlogger.NewLogger(textlogger.NewConfig(textlogger.Verbosity(1))))).To(Succeed())
+
+		Expect(recorder.Events).To(Receive(And(ContainSubstring("ClusterUnmatched"),
+			ContainSubstring(clusterNamespace+"/"+clusterName))))
+	})
+
 	It("updateMatchingClustersAndRegistrations updates Classifier Status with detected misconfigurations", func() {
 		clusterNamespace := randomString()
 		clusterName := randomString()
@@ -277,6 +334,129 @@ var _ = Describe("Classifier: Reconciler", func() {
 		Expect(classifier.Status.MachingClusterStatuses[0].ClusterRef.Kind).To(Equal(clusterKind))
 		Expect(len(classifier.Status.MachingClusterStatuses[0].ManagedLabels)).To(BeZero())
 		Expect(len(classifier.Status.MachingClusterStatuses[0].UnManagedLabels)).To(Equal(len(classifier.Spec.ClassifierLabels)))
+		failureMessage := classifier.Status.MachingClusterStatuses[0].UnManagedLabels[0].FailureMessage
+		Expect(failureMessage).ToNot(BeNil())
+		Expect(*failureMessage).To(ContainSubstring(classifier1.Name))
+		Expect(*failureMessage).To(ContainSubstring(keymanager.FirstWinsStrategy))
+	})
+
+	It("updateMatchingClustersAndRegistrations in dry-run mode reports labels without registering", func() {
+		clusterNamespace := randomString()
+		clusterName := randomString()
+		classifierReport := getClassifierReport(classifier.Name, clusterNamespace, clusterName)
+		classifierReport.Spec.Match = true
+
+		classifier.Annotations = map[string]string{
+			keymanager.ClassifierDryRunAnnotation: "true",
+		}
+
+		initObjects := []client.Object{
+			classifier,
+			classifierReport,
+		}
+
+		c := fake.NewClientBuilder().WithScheme(scheme).WithStatusSubresource(initObjects...).
+			WithObjects(initObjects...).Build()
+
+		reconciler := &controllers.ClassifierReconciler{
+			Client:        c,
+			Scheme:        scheme,
+			ClusterMap:    make(map[corev1.ObjectReference]*libsveltosset.Set),
+			ClassifierMap: make(map[corev1.ObjectReference]*libsveltosset.Set),
+			Mux:           sync.Mutex{},
+		}
+
+		classifierScope, err := scope.NewClassifierScope(scope.ClassifierScopeParams{
+			Client:         c,
+			Logger:         textlogger.NewLogger(textlogger.NewConfig(textlogger.Verbosity(1))),
+			Classifier:     classifier,
+			ControllerName: "classifier",
+		})
+		Expect(err).To(BeNil())
+
+		Expect(controllers.UpdateMatchingClustersAndRegistrations(reconciler, context.TODO(), classifierScope,
+			textlogger.NewLogger(textlogger.NewConfig(textlogger.Verbosity(1))))).To(Succeed())
+
+		Expect(len(classifier.Status.MachingClusterStatuses)).To(Equal(1))
+		Expect(len(classifier.Status.MachingClusterStatuses[0].ManagedLabels)).To(Equal(len(classifier.Spec.ClassifierLabels)))
+
+		// Classifier in dry-run mode is never registered
+		manager, err := keymanager.GetKeyManagerInstance(ctx, c)
+		Expect(err).To(BeNil())
+		Expect(manager.GetRegisteredClassifiers(clusterNamespace, clusterName,
+			libsveltosv1beta1.ClusterTypeCapi)).ToNot(ContainElement(classifier.Name))
+	})
+
+	It("publishDryRunReport publishes label changes Classifier would apply", func() {
+		addedLabel := libsveltosv1beta1.ClassifierLabel{Key: randomString(), Value: randomString()}
+		updatedLabel := libsveltosv1beta1.ClassifierLabel{Key: randomString(), Value: randomString()}
+		unchangedLabel := libsveltosv1beta1.ClassifierLabel{Key: randomString(), Value: randomString()}
+		classifier.Spec.ClassifierLabels = []libsveltosv1beta1.ClassifierLabel{
+			addedLabel, updatedLabel, unchangedLabel,
+		}
+		classifier.Annotations = map[string]string{
+			keymanager.ClassifierDryRunAnnotation: "true",
+		}
+
+		cluster := &clusterv1.Cluster{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: randomString(),
+				Name:      randomString(),
+				Labels: map[string]string{
+					updatedLabel.Key:   randomString(),
+					unchangedLabel.Key: unchangedLabel.Value,
+				},
+			},
+		}
+
+		classifier.Status.MachingClusterStatuses = []libsveltosv1beta1.MachingClusterStatus{
+			{
+				ClusterRef: corev1.ObjectReference{
+					Namespace:  cluster.Namespace,
+					Name:       cluster.Name,
+					Kind:       clusterKind,
+					APIVersion: clusterv1.GroupVersion.String(),
+				},
+				ManagedLabels: []string{addedLabel.Key, updatedLabel.Key, unchangedLabel.Key},
+			},
+		}
+
+		initObjects := []client.Object{
+			classifier,
+			cluster,
+		}
+
+		c := fake.NewClientBuilder().WithScheme(scheme).WithStatusSubresource(initObjects...).
+			WithObjects(initObjects...).Build()
+
+		reconciler := &controllers.ClassifierReconciler{
+			Client:        c,
+			Scheme:        scheme,
+			ClusterMap:    make(map[corev1.ObjectReference]*libsveltosset.Set),
+			ClassifierMap: make(map[corev1.ObjectReference]*libsveltosset.Set),
+			Mux:           sync.Mutex{},
+		}
+
+		Expect(controllers.PublishDryRunReport(reconciler, context.TODO(), classifier,
+			textlogger.NewLogger(textlogger.NewConfig(textlogger.Verbosity(1))))).To(Succeed())
+
+		configMap := &corev1.ConfigMap{}
+		Expect(c.Get(context.TODO(), types.NamespacedName{Namespace: projectsveltosNamespace,
+			Name: controllers.GetDryRunReportName(classifier.Name)}, configMap)).To(Succeed())
+
+		var diffs []controllers.ClusterLabelDiff
+		Expect(json.Unmarshal([]byte(configMap.Data[controllers.DryRunReportKey]), &diffs)).To(Succeed())
+		Expect(len(diffs)).To(Equal(1))
+		Expect(diffs[0].Cluster.Name).To(Equal(cluster.Name))
+		Expect(diffs[0].Added).To(Equal(map[string]string{addedLabel.Key: addedLabel.Value}))
+		Expect(diffs[0].Updated).To(Equal(map[string]string{updatedLabel.Key: updatedLabel.Value}))
+		Expect(diffs[0].Unchanged).To(Equal([]string{unchangedLabel.Key}))
+
+		// Cluster labels are not modified
+		currentCluster := &clusterv1.Cluster{}
+		Expect(c.Get(context.TODO(),
+			types.NamespacedName{Namespace: cluster.Namespace, Name: cluster.Name}, currentCluster)).To(Succeed())
+		Expect(currentCluster.Labels).To(Equal(cluster.Labels))
 	})
 
 	It("updateLabelsOnMatchingClusters updates CAPI Cluster labels", func() {
@@ -312,8 +492,7 @@ var _ = Describe("Classifier: Reconciler", func() {
 			cluster,
 		}
 
-		c := fake.NewClientBuilder().WithScheme(scheme).WithStatusSubresource(initObjects...).
-			WithObjects(initObjects...).Build()
+		c := getFakeClientWithApply(initObjects...)
 
 		reconciler := &controllers.ClassifierReconciler{
 			Client:        c,
@@ -360,6 +539,162 @@ var _ = Describe("Classifier: Reconciler", func() {
 		}
 	})
 
+	It("updateLabelsOnMatchingClusters takes over labels set by previous versions and removes them when not a match", func() {
+		notOwnedKey := randomString()
+		notOwnedValue := randomString()
+		legacyKey := classifier.Spec.ClassifierLabels[0].Key
+		// Label set by another controller sharing the legacy field manager
+		otherLegacyKey := randomString()
+		otherLegacyValue := randomString()
+		cluster := &clusterv1.Cluster{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: randomString(),
+				Name:      randomString(),
+				Labels: map[string]string{
+					notOwnedKey:    notOwnedValue,
+					otherLegacyKey: otherLegacyValue,
+					legacyKey:      classifier.Spec.ClassifierLabels[0].Value,
+				},
+				ManagedFields: []metav1.ManagedFieldsEntry{
+					{
+						// Labels set by previous versions with client Update
+						Manager:    controllers.LegacyFieldManager,
+						Operation:  metav1.ManagedFieldsOperationUpdate,
+						FieldsType: "FieldsV1",
+						FieldsV1: &metav1.FieldsV1{Raw: []byte(fmt.Sprintf(`{"f:metadata":{"f:labels":{"f:%s":{},"f:%s":{}}}}`,
+							legacyKey, otherLegacyKey))},
+					},
+					{
+						Manager:    "kubectl",
+						Operation:  metav1.ManagedFieldsOperationUpdate,
+						FieldsType: "FieldsV1",
+						FieldsV1:   &metav1.FieldsV1{Raw: []byte(fmt.Sprintf(`{"f:metadata":{"f:labels":{"f:%s":{}}}}`, notOwnedKey))},
+					},
+				},
+			},
+		}
+
+		classifier.Status.MachingClusterStatuses = []libsveltosv1beta1.MachingClusterStatus{
+			{
+				ClusterRef: corev1.ObjectReference{
+					Namespace:  cluster.Namespace,
+					Name:       cluster.Name,
+					Kind:       clusterKind,
+					APIVersion: clusterv1.GroupVersion.String(),
+				},
+			},
+		}
+
+		initObjects := []client.Object{
+			classifier,
+			cluster,
+		}
+
+		c := getFakeClientWithApply(initObjects...)
+
+		reconciler := &controllers.ClassifierReconciler{
+			Client:        c,
+			Scheme:        scheme,
+			ClusterMap:    make(map[corev1.ObjectReference]*libsveltosset.Set),
+			ClassifierMap: make(map[corev1.ObjectReference]*libsveltosset.Set),
+			Mux:           sync.Mutex{},
+		}
+
+		classifierScope, err := scope.NewClassifierScope(scope.ClassifierScopeParams{
+			Client:         c,
+			Logger:         textlogger.NewLogger(textlogger.NewConfig(textlogger.Verbosity(1))),
+			Classifier:     classifier,
+			ControllerName: "classifier",
+		})
+		Expect(err).To(BeNil())
+
+		Expect(addTypeInformationToObject(scheme, cluster)).To(Succeed())
+
+		currentMatchingClusters := map[corev1.ObjectReference]bool{
+			{Namespace: cluster.Namespace, Name: cluster.Name, APIVersion: cluster.APIVersion, Kind: cluster.Kind}: true,
+		}
+		oldMatchingClusters := map[corev1.ObjectReference]bool{}
+		Expect(controllers.HandleLabelRegistrations(reconciler, context.TODO(), classifier, currentMatchingClusters,
+			oldMatchingClusters, textlogger.NewLogger(textlogger.NewConfig(textlogger.Verbosity(1))))).To(Succeed())
+
+		Expect(controllers.UpdateLabelsOnMatchingClusters(reconciler, context.TODO(), classifierScope,
+			textlogger.NewLogger(textlogger.NewConfig(textlogger.Verbosity(1))))).To(Succeed())
+
+		currentCluster := &clusterv1.Cluster{}
+		Expect(c.Get(context.TODO(),
+			types.NamespacedName{Namespace: cluster.Namespace, Name: cluster.Name}, currentCluster)).To(Succeed())
+
+		// Label not set by Classifier is left untouched
+		Expect(currentCluster.Labels[notOwnedKey]).To(Equal(notOwnedValue))
+		Expect(currentCluster.Labels[otherLegacyKey]).To(Equal(otherLegacyValue))
+		for i := range classifier.Spec.ClassifierLabels {
+			label := classifier.Spec.ClassifierLabels[i]
+			Expect(currentCluster.Labels[label.Key]).To(Equal(label.Value))
+		}
+		// Labels are owned by the Classifier field manager only
+		logger := textlogger.NewLogger(textlogger.NewConfig(textlogger.Verbosity(1)))
+		appliedLabels := controllers.GetAppliedLabels(currentCluster, controllers.GetClassifierFieldManager(classifier.Name),
+			logger)
+		Expect(appliedLabels).To(HaveLen(len(classifier.Spec.ClassifierLabels)))
+		// Legacy field manager keeps ownership of labels not managed by the Classifier
+		Expect(controllers.GetManagedLabels(currentCluster, controllers.LegacyFieldManager,
+			metav1.ManagedFieldsOperationUpdate, logger)).To(Equal(map[string]bool{otherLegacyKey: true}))
+
+		// Once Classifier does not match the cluster anymore, all its labels are removed
+		Expect(controllers.HandleLabelRegistrations(reconciler, context.TODO(), classifier,
+			map[corev1.ObjectReference]bool{}, currentMatchingClusters,
+			textlogger.NewLogger(textlogger.NewConfig(textlogger.Verbosity(1))))).To(Succeed())
+
+		ref := &classifier.Status.MachingClusterStatuses[0].ClusterRef
+		Expect(controllers.RemoveLabelsFromCluster(reconciler, context.TODO(), classifier, ref,
+			textlogger.NewLogger(textlogger.NewConfig(textlogger.Verbosity(1))))).To(Succeed())
+
+		Expect(c.Get(context.TODO(),
+			types.NamespacedName{Namespace: cluster.Namespace, Name: cluster.Name}, currentCluster)).To(Succeed())
+		Expect(currentCluster.Labels).To(Equal(map[string]string{notOwnedKey: notOwnedValue, otherLegacyKey: otherLegacyValue}))
+	})
+
+	It("updateLabelsOnMatchingClusters forces ownership of labels assigned by keymanager only on conflicts", func() {
+		conflictingKey := classifier.Spec.ClassifierLabels[0].Key
+		cluster := &clusterv1.Cluster{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: randomString(),
+				Name:      randomString(),
+				Labels:    map[string]string{conflictingKey: randomString()},
+				ManagedFields: []metav1.ManagedFieldsEntry{
+					{
+						Manager:    "kubectl",
+						Operation:  metav1.ManagedFieldsOperationApply,
+						FieldsType: "FieldsV1",
+						FieldsV1: &metav1.FieldsV1{
+							Raw: []byte(fmt.Sprintf(`{"f:metadata":{"f:labels":{"f:%s":{}}}}`, conflictingKey)),
+						},
+					},
+				},
+			},
+		}
+		Expect(addTypeInformationToObject(scheme, cluster)).To(Succeed())
+		ref := corev1.ObjectReference{
+			Namespace: cluster.Namespace, Name: cluster.Name, APIVersion: cluster.APIVersion, Kind: cluster.Kind,
+		}
+		classifier.Status.MachingClusterStatuses = []libsveltosv1beta1.MachingClusterStatus{{ClusterRef: ref}}
+
+		c := getFakeClientWithApply(classifier, cluster)
+		reconciler := getClassifierReconciler(c, nil)
+		logger := textlogger.NewLogger(textlogger.NewConfig(textlogger.Verbosity(1)))
+		classifierScope := getClassifierScope(c, logger, classifier)
+
+		Expect(controllers.HandleLabelRegistrations(reconciler, context.TODO(), classifier,
+			map[corev1.ObjectReference]bool{ref: true}, map[corev1.ObjectReference]bool{}, logger)).To(Succeed())
+		Expect(controllers.UpdateLabelsOnMatchingClusters(reconciler, context.TODO(), classifierScope, logger)).To(Succeed())
+
+		currentCluster := &clusterv1.Cluster{}
+		Expect(c.Get(context.TODO(), client.ObjectKeyFromObject(cluster), currentCluster)).To(Succeed())
+		Expect(currentCluster.Labels[conflictingKey]).To(Equal(classifier.Spec.ClassifierLabels[0].Value))
+		Expect(controllers.GetManagedLabels(currentCluster, "kubectl", metav1.ManagedFieldsOperationApply,
+			logger)).ToNot(HaveKey(conflictingKey))
+	})
+
 	It("removeAllRegistrations removes all label registrations", func() {
 		label := randomString()
 		clusterNamespace := randomString()
@@ -431,7 +766,11 @@ var _ = Describe("Classifier: Reconciler", func() {
 			managedLabel, unManagedLabel}
 
 		// Create an otherClassifier conflicting with first classifier for unManagedLabel
+		// otherClassifier has higher priority, so it manages "unManagedLabel"
 		otherClassifier := getClassifierInstance(randomString())
+		otherClassifier.Annotations = map[string]string{
+			keymanager.ClassifierPriorityAnnotation: "10",
+		}
 		otherClassifier.Spec.ClassifierLabels = []libsveltosv1beta1.ClassifierLabel{
 			unManagedLabel,
 		}
@@ -445,7 +784,6 @@ var _ = Describe("Classifier: Reconciler", func() {
 
 		manager, err := keymanager.GetKeyManagerInstance(ctx, c)
 		Expect(err).To(BeNil())
-		// Register in this order, so otherClassifier can manage "unManagedLabel"
 		// classifier can only manage "managedLabel" and has conflict for "unManagedLabel"
 		manager.RegisterClassifierForLabels(otherClassifier, clusterNamespace, clusterName, libsveltosv1beta1.ClusterTypeCapi)
 		manager.RegisterClassifierForLabels(classifier, clusterNamespace, clusterName, libsveltosv1beta1.ClusterTypeCapi)
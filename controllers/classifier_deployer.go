@@ -29,6 +29,7 @@ import (
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/labels"
@@ -78,8 +79,21 @@ func (r *ClassifierReconciler) deployClassifier(ctx context.Context, classifierS
 	var errorSeen error
 	allDeployed := true
 	clusterInfo := make([]libsveltosv1beta1.ClusterInfo, 0)
+	failedClusters := make([]string, 0)
 	for i := range classifier.Status.ClusterInfo {
 		c := classifier.Status.ClusterInfo[i]
+		if c.Status == libsveltosv1beta1.SveltosStatusRemoving {
+			// Cluster is not selected by Classifier anymore
+			cInfo, err := r.removeClassifierFromDeselectedCluster(ctx, classifierScope, &c.Cluster, f, logger)
+			if err != nil {
+				errorSeen = err
+			}
+			if cInfo != nil {
+				clusterInfo = append(clusterInfo, *cInfo)
+				allDeployed = false
+			}
+			continue
+		}
 		cInfo, err := r.processClassifier(ctx, classifierScope, r.ControlPlaneEndpoint, &c.Cluster, f, logger)
 		if err != nil {
 			errorSeen = err
@@ -89,11 +103,19 @@ func (r *ClassifierReconciler) deployClassifier(ctx context.Context, classifierS
 			if cInfo.Status != libsveltosv1beta1.SveltosStatusProvisioned {
 				allDeployed = false
 			}
+			if cInfo.Status == libsveltosv1beta1.SveltosStatusFailed {
+				failedClusters = append(failedClusters, getClusterDescription(&c.Cluster))
+				if c.Status != libsveltosv1beta1.SveltosStatusFailed {
+					r.recordEvent(classifier, corev1.EventTypeWarning, deploymentFailedReason,
+						"failed to deploy Classifier in cluster %s", getClusterDescription(&c.Cluster))
+				}
+			}
 		}
 	}
 
 	// Update Classifier Status
 	classifierScope.SetClusterInfo(clusterInfo)
+	updateDeploymentFailedCondition(classifierScope, failedClusters)
 
 	if errorSeen != nil {
 		return errorSeen
@@ -172,6 +194,79 @@ func (r *ClassifierReconciler) undeployClassifier(ctx context.Context, classifie
 	return nil
 }
 
+// removeClassifierFromDeselectedCluster removes Classifier from a cluster not selected anymore by the
+// Classifier ClassifierClusterSelector. Returns nil ClusterInfo once removal is completed.
+func (r *ClassifierReconciler) removeClassifierFromDeselectedCluster(ctx context.Context,
+	classifierScope *scope.ClassifierScope, cluster *corev1.ObjectReference, f feature, logger logr.Logger,
+) (*libsveltosv1beta1.ClusterInfo, error) {
+
+	logger = logger.WithValues("cluster", fmt.Sprintf("%s:%s/%s", cluster.Kind, cluster.Namespace, cluster.Name))
+	logger.V(logs.LogDebug).Info("cluster is not selected anymore")
+
+	classifier := classifierScope.Classifier
+
+	// Remove any queued entry to deploy
+	r.Deployer.CleanupEntries(cluster.Namespace, cluster.Name, classifier.Name, f.id,
+		clusterproxy.GetClusterType(cluster), false)
+
+	_, err := clusterproxy.GetCluster(ctx, r.Client, cluster.Namespace, cluster.Name,
+		clusterproxy.GetClusterType(cluster))
+	if err != nil && !apierrors.IsNotFound(err) {
+		return nil, err
+	}
+
+	if err == nil {
+		err = r.removeClassifier(ctx, classifierScope, cluster, f, logger)
+		if err != nil {
+			failureMessage := err.Error()
+			return &libsveltosv1beta1.ClusterInfo{
+				Cluster:        *cluster,
+				Status:         libsveltosv1beta1.SveltosStatusRemoving,
+				FailureMessage: &failureMessage,
+			}, nil
+		}
+	}
+
+	// ClassifierReports for this cluster are not collected anymore
+	if err := removeClassifierClusterReports(ctx, r.Client, classifier, cluster, logger); err != nil {
+		failureMessage := err.Error()
+		return &libsveltosv1beta1.ClusterInfo{
+			Cluster:        *cluster,
+			Status:         libsveltosv1beta1.SveltosStatusRemoving,
+			FailureMessage: &failureMessage,
+		}, err
+	}
+
+	return nil, nil
+}
+
+// removeClassifierFromManagedClusters removes Classifier from all clusters it was previously deployed to.
+// Used for Classifiers which do not need to be deployed in managed clusters (management only Classifiers).
+func (r *ClassifierReconciler) removeClassifierFromManagedClusters(ctx context.Context,
+	classifierScope *scope.ClassifierScope, logger logr.Logger) error {
+
+	updateDeploymentFailedCondition(classifierScope, nil)
+
+	if len(classifierScope.Classifier.Status.ClusterInfo) == 0 {
+		return nil
+	}
+
+	if r.AgentInMgmtCluster {
+		// In agentless mode, Classifier instances are not copied to managed clusters.
+		// So there is nothing to remove from managed cluster.
+		classifierScope.SetClusterInfo(make([]libsveltosv1beta1.ClusterInfo, 0))
+		return nil
+	}
+
+	// While removal is in progress, undeployClassifier resets Status.MachingClusterStatuses.
+	// Those must be preserved as Classifier is still matching clusters.
+	matchingClusterStatuses := classifierScope.Classifier.Status.MachingClusterStatuses
+	defer classifierScope.SetMachingClusterStatuses(matchingClusterStatuses)
+
+	f := getHandlersForFeature(libsveltosv1beta1.FeatureClassifier)
+	return r.undeployClassifier(ctx, classifierScope, f, logger)
+}
+
 // classifierHash returns the Classifier hash
 func classifierHash(classifier *libsveltosv1beta1.Classifier) []byte {
 	h := sha256.New()
@@ -229,12 +324,14 @@ func getAccessRequestName(clusterName string, clusterType libsveltosv1beta1.Clus
 	return fmt.Sprintf("%s-%s", strings.ToLower(string(clusterType)), clusterName)
 }
 
+// createAccessRequest creates, if it does not exist already, the AccessRequest for the cluster and
+// records applicant as one of the Classifiers using it.
 func createAccessRequest(ctx context.Context, c client.Client,
-	clusterNamespace, clusterName string, clusterType libsveltosv1beta1.ClusterType,
+	clusterNamespace, clusterName, applicant string, clusterType libsveltosv1beta1.ClusterType,
 	options deployer.Options) error {
 
 	// Currently there is one AccessRequest per cluster for all classifier-agents
-	// deployed in such cluster
+	// deployed in such cluster. It is removed once no Classifier uses it anymore.
 
 	missingControlPlaneMessage := "controlplane endpoint is missing"
 	if options.HandlerOptions == nil {
@@ -250,43 +347,72 @@ func createAccessRequest(ctx context.Context, c client.Client,
 	info := strings.Split(cpEndpoint, ":")
 	port, _ := strconv.ParseInt(info[2], 10, 32)
 
-	accessRequest := &libsveltosv1beta1.AccessRequest{}
-	err := c.Get(ctx,
-		types.NamespacedName{Namespace: clusterNamespace, Name: getAccessRequestName(clusterName, clusterType)}, accessRequest)
+	accessRequest, _, err := getClusterAccessRequests(ctx, c, clusterNamespace, clusterName, clusterType)
 	if err != nil {
-		if apierrors.IsNotFound(err) {
-			accessRequest.Namespace = clusterNamespace
-			accessRequest.Name = getAccessRequestName(clusterName, clusterType)
-			accessRequest.Labels = map[string]string{
-				accessRequestClassifierLabel: "ok",
-			}
-			accessRequest.Spec = libsveltosv1beta1.AccessRequestSpec{
-				Namespace: clusterNamespace,
-				Name:      clusterName,
-				Type:      libsveltosv1beta1.SveltosAgentRequest,
-				ControlPlaneEndpoint: clusterv1.APIEndpoint{
-					Host: fmt.Sprintf("%s:%s", info[0], info[1]),
-					Port: int32(port),
-				},
-			}
-			return c.Create(ctx, accessRequest)
+		return err
+	}
+	if accessRequest == nil {
+		accessRequest = &libsveltosv1beta1.AccessRequest{}
+		accessRequest.Namespace = clusterNamespace
+		accessRequest.Name = getAccessRequestName(clusterName, clusterType)
+		accessRequest.Labels = map[string]string{
+			accessRequestClassifierLabel: "ok",
+		}
+		accessRequest.Spec = libsveltosv1beta1.AccessRequestSpec{
+			Namespace: clusterNamespace,
+			Name:      clusterName,
+			Type:      libsveltosv1beta1.SveltosAgentRequest,
+			ControlPlaneEndpoint: clusterv1.APIEndpoint{
+				Host: fmt.Sprintf("%s:%s", info[0], info[1]),
+				Port: int32(port),
+			},
 		}
+		if err := setAccessRequestClassifiers(accessRequest, []string{applicant}); err != nil {
+			return err
+		}
+		return c.Create(ctx, accessRequest)
+	}
+
+	// AccessRequest created by a previous version is used by all Classifiers already deployed in the cluster
+	tracked, err := trackAccessRequestClassifiers(accessRequest, getClusterClassifiersFromOptions(options))
+	if err != nil {
 		return err
 	}
 
-	return nil
+	modified, err := addAccessRequestClassifier(accessRequest, applicant)
+	if err != nil || (!tracked && !modified) {
+		return err
+	}
+	return c.Update(ctx, accessRequest)
 }
 
-// getKubeconfigFromAccessRequest gets the Kubeconfig from AccessRequest
+// getKubeconfigFromAccessRequest gets the Kubeconfig from AccessRequest. While sveltos-agent kubeconfig is
+// being rotated, the kubeconfig of the replaced AccessRequest is returned till the new one is issued.
 func getKubeconfigFromAccessRequest(ctx context.Context, c client.Client, clusterNamespace, clusterName string,
 	clusterType libsveltosv1beta1.ClusterType, logger logr.Logger) ([]byte, error) {
 
-	accessRequest := &libsveltosv1beta1.AccessRequest{}
-	err := c.Get(ctx,
-		types.NamespacedName{Namespace: clusterNamespace, Name: getAccessRequestName(clusterName, clusterType)}, accessRequest)
+	accessRequest, previous, err := getClusterAccessRequests(ctx, c, clusterNamespace, clusterName, clusterType)
 	if err != nil {
 		return nil, err
 	}
+	if accessRequest == nil {
+		return nil, apierrors.NewNotFound(libsveltosv1beta1.GroupVersion.WithResource("accessrequests").GroupResource(),
+			getAccessRequestName(clusterName, clusterType))
+	}
+
+	kubeconfig, err := getAccessRequestKubeconfig(ctx, c, accessRequest, logger)
+	if err != nil || kubeconfig != nil || previous == nil {
+		return kubeconfig, err
+	}
+
+	logger.V(logs.LogDebug).Info("rotated kubeconfig not issued yet")
+	return getAccessRequestKubeconfig(ctx, c, previous, logger)
+}
+
+// getAccessRequestKubeconfig returns the Kubeconfig generated for an AccessRequest.
+// Returns nil if Kubeconfig has not been generated yet.
+func getAccessRequestKubeconfig(ctx context.Context, c client.Client, accessRequest *libsveltosv1beta1.AccessRequest,
+	logger logr.Logger) ([]byte, error) {
 
 	if accessRequest.Status.SecretRef == nil {
 		logger.V(logs.LogDebug).Info("accessRequest.Status.SecretRef still not set")
@@ -455,7 +581,7 @@ func deploySveltosAgentWithKubeconfigInCluster(ctx context.Context, c client.Cli
 	logger = logger.WithValues("classifier", applicant)
 	logger.V(logs.LogDebug).Info("deploy classifier: send reports mode")
 
-	if err := createAccessRequest(ctx, c, clusterNamespace, clusterName, clusterType, options); err != nil {
+	if err := createAccessRequest(ctx, c, clusterNamespace, clusterName, applicant, clusterType, options); err != nil {
 		return err
 	}
 
@@ -490,6 +616,8 @@ func deploySveltosAgentWithKubeconfigInCluster(ctx context.Context, c client.Cli
 	if err != nil {
 		return err
 	}
+	// sveltos-agent is restarted whenever kubeconfig changes
+	patches = append(patches, getAgentKubeconfigPatch(kubeconfig))
 
 	logger.V(logs.LogDebug).Info("Deploying sveltos agent")
 	// Deploy SveltosAgent
@@ -507,6 +635,12 @@ func deploySveltosAgentWithKubeconfigInCluster(ctx context.Context, c client.Cli
 		return err
 	}
 
+	err = completeAgentKubeconfigRotation(ctx, c, remoteClient, clusterNamespace, clusterName, clusterType,
+		kubeconfig, logger)
+	if err != nil {
+		return err
+	}
+
 	// Deploy Classifier instance
 	err = deployClassifierInstance(ctx, remoteClient, classifier, logger)
 	if err != nil {
@@ -523,7 +657,13 @@ func deployClassifierInCluster(ctx context.Context, c client.Client,
 
 	logger.V(logs.LogDebug).Info("deploy CRDs: do not send reports mode")
 
-	err := deployCRDs(ctx, c, clusterNamespace, clusterName, clusterType, logger)
+	// Cluster might have been previously in AgentSendReportsNoGateway mode
+	err := releaseClusterAccessRequest(ctx, c, clusterNamespace, clusterName, clusterType, applicant, logger)
+	if err != nil {
+		return err
+	}
+
+	err = deployCRDs(ctx, c, clusterNamespace, clusterName, clusterType, logger)
 	if err != nil {
 		return err
 	}
@@ -594,16 +734,22 @@ func undeployClassifierFromCluster(ctx context.Context, c client.Client,
 	currentClassifier := &libsveltosv1beta1.Classifier{}
 	err = remoteClient.Get(ctx, types.NamespacedName{Name: applicant}, currentClassifier)
 	if err != nil {
-		if apierrors.IsNotFound(err) {
-			logger.V(logs.LogInfo).Info("classifier not found")
-			return nil
+		if !apierrors.IsNotFound(err) && !meta.IsNoMatchError(err) {
+			logger.V(logs.LogInfo).Info(fmt.Sprintf("failed to get classifier. Err: %v", err))
+			return err
+		}
+		logger.V(logs.LogInfo).Info("classifier not found")
+	} else {
+		logger.V(logs.LogDebug).Info("remove classifier instance")
+		err = remoteClient.Delete(ctx, currentClassifier)
+		if err != nil && !apierrors.IsNotFound(err) {
+			return err
 		}
-		logger.V(logs.LogInfo).Info(fmt.Sprintf("failed to get classifier. Err: %v", err))
-		return err
 	}
 
-	logger.V(logs.LogDebug).Info("remove classifier instance")
-	return remoteClient.Delete(ctx, currentClassifier)
+	// If this was the last Classifier in the cluster, sveltos-agent might need to be uninstalled
+	return uninstallSveltosAgentIfUnused(ctx, remoteClient, clusterNamespace, clusterName, clusterType,
+		applicant, getClusterClassifiersFromOptions(options), logger)
 }
 
 func (r *ClassifierReconciler) convertResultStatus(result deployer.Result) *libsveltosv1beta1.SveltosFeatureStatus {
@@ -699,15 +845,25 @@ func (r *ClassifierReconciler) removeClassifier(ctx context.Context, classifierS
 			return fmt.Errorf("feature is still being removed")
 		}
 		if *status == libsveltosv1beta1.SveltosStatusRemoved {
-			return nil
+			// Classifier is not deployed in the cluster anymore
+			if removed := popAgentUninstallReport(cluster, classifier.Name); len(removed) > 0 {
+				r.recordEvent(classifier, corev1.EventTypeNormal, sveltosAgentUninstalledReason,
+					"sveltos-agent uninstalled from cluster %s. Removed: %s", getClusterDescription(cluster),
+					strings.Join(removed, ", "))
+			}
+			return releaseClusterAccessRequest(ctx, r.Client, cluster.Namespace, cluster.Name,
+				clusterproxy.GetClusterType(cluster), classifier.Name, logger)
 		}
 	} else {
 		logger.V(logs.LogDebug).Info("no result is available")
 	}
 
 	logger.V(logs.LogDebug).Info("queueing request to un-deploy")
+	options := deployer.Options{HandlerOptions: map[string]string{
+		clusterclassifiers: strings.Join(r.getClusterClassifiers(cluster), ","),
+	}}
 	if err := r.Deployer.Deploy(ctx, cluster.Namespace, cluster.Name, classifier.Name, f.id, clusterproxy.GetClusterType(cluster),
-		true, undeployClassifierFromCluster, programDuration, deployer.Options{}); err != nil {
+		true, undeployClassifierFromCluster, programDuration, options); err != nil {
 		return err
 	}
 
@@ -744,10 +900,12 @@ func (r *ClassifierReconciler) canProceed(ctx context.Context, classifierScope *
 }
 
 // getCurrentHash gets current hash.
-// It considers Classifier and if mode is ClassifierReportMode == AgentSendReportsNoGateway also
+// It considers Classifier and if cluster report mode is AgentSendReportsNoGateway also
 // the kubeconfig to access management cluster
 func (r *ClassifierReconciler) getCurrentHash(ctx context.Context, classifierScope *scope.ClassifierScope,
-	cpEndpoint string, cluster *corev1.ObjectReference, f feature, logger logr.Logger) ([]byte, error) {
+	cpEndpoint string, cluster *corev1.ObjectReference, reportMode ReportMode, f feature, logger logr.Logger,
+) ([]byte, error) {
+
 	// Get Classifier Spec hash (at this very precise moment)
 	currentHash := f.currentHash(classifierScope.Classifier)
 
@@ -767,7 +925,7 @@ func (r *ClassifierReconciler) getCurrentHash(ctx context.Context, classifierSco
 
 	var kubeconfig []byte
 	var err error
-	if r.ClassifierReportMode == AgentSendReportsNoGateway {
+	if reportMode == AgentSendReportsNoGateway {
 		h := sha256.New()
 		config := string(currentHash)
 		kubeconfig, err = getKubeconfigFromAccessRequest(ctx, r.Client, cluster.Namespace, cluster.Name,
@@ -794,8 +952,13 @@ func (r *ClassifierReconciler) processClassifier(ctx context.Context, classifier
 
 	logger = logger.WithValues("cluster", fmt.Sprintf("%s:%s/%s", cluster.Kind, cluster.Namespace, cluster.Name))
 
+	reportMode, err := r.getClusterReportMode(ctx, cluster, logger)
+	if err != nil {
+		return nil, err
+	}
+
 	// Get Classifier Spec hash (at this very precise moment)
-	currentHash, err := r.getCurrentHash(ctx, classifierScope, cpEndpoint, cluster, f, logger)
+	currentHash, err := r.getCurrentHash(ctx, classifierScope, cpEndpoint, cluster, reportMode, f, logger)
 	if err != nil {
 		return nil, err
 	}
@@ -867,9 +1030,10 @@ func (r *ClassifierReconciler) processClassifier(ctx context.Context, classifier
 		if r.AgentInMgmtCluster {
 			options.HandlerOptions[sveltosAgentInMgtmCluster] = "management"
 		}
+		options.HandlerOptions[clusterclassifiers] = strings.Join(r.getClusterClassifiers(cluster), ",")
 		var handler deployer.RequestHandler
 		handler = deployClassifierInCluster
-		if r.ClassifierReportMode == AgentSendReportsNoGateway {
+		if reportMode == AgentSendReportsNoGateway {
 			handler = deploySveltosAgentWithKubeconfigInCluster
 			options.HandlerOptions[controlplaneendpoint] = r.ControlPlaneEndpoint
 		}
@@ -498,8 +498,8 @@ var _ = Describe("Classifier Deployer", func() {
 
 		c := fake.NewClientBuilder().WithScheme(scheme).WithStatusSubresource(initObjects...).
 			WithObjects(initObjects...).Build()
-		Expect(controllers.CreateAccessRequest(ctx, c, clusterNamespace, clusterName, libsveltosv1beta1.ClusterTypeCapi,
-			options)).To(Succeed())
+		Expect(controllers.CreateAccessRequest(ctx, c, clusterNamespace, clusterName, classifier.Name,
+			libsveltosv1beta1.ClusterTypeCapi, options)).To(Succeed())
 
 		accessRequest := &libsveltosv1beta1.AccessRequest{}
 		Expect(c.Get(context.TODO(),
@@ -0,0 +1,228 @@
+/*
+Copyright 2022. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/projectsveltos/classifier/controllers/keymanager"
+	libsveltosv1beta1 "github.com/projectsveltos/libsveltos/api/v1beta1"
+	"github.com/projectsveltos/libsveltos/lib/clusterproxy"
+	logs "github.com/projectsveltos/libsveltos/lib/logsettings"
+)
+
+const (
+	// dryRunReportPrefix is the prefix of the name of the ConfigMap, in the projectsveltos namespace,
+	// containing the label changes a Classifier in dry-run mode would apply.
+	dryRunReportPrefix = "classifier-dry-run-"
+
+	// dryRunReportKey is the ConfigMap Data key containing the label changes
+	dryRunReportKey = "labels"
+)
+
+// clusterLabelDiff contains the label changes a Classifier in dry-run mode would apply to a cluster
+type clusterLabelDiff struct {
+	// Cluster is the matching cluster
+	Cluster corev1.ObjectReference `json:"cluster"`
+
+	// Added contains the labels which would be added to the cluster
+	Added map[string]string `json:"added,omitempty"`
+
+	// Updated contains the labels which would be changed, with their new value
+	Updated map[string]string `json:"updated,omitempty"`
+
+	// Unchanged contains the keys of the labels already set to the expected value
+	Unchanged []string `json:"unchanged,omitempty"`
+
+	// Conflicts contains the labels the Classifier would not be able to manage
+	Conflicts []libsveltosv1beta1.UnManagedLabel `json:"conflicts,omitempty"`
+}
+
+// getDryRunReportName returns the name of the ConfigMap containing the dry-run report for a Classifier
+func getDryRunReportName(classifierName string) string {
+	return dryRunReportPrefix + classifierName
+}
+
+// removeRegistrationsForDryRun removes any label registration for a Classifier in dry-run mode.
+// A Classifier moved to dry-run mode leaves Cluster labels it previously set untouched.
+func (r *ClassifierReconciler) removeRegistrationsForDryRun(ctx context.Context,
+	classifier *libsveltosv1beta1.Classifier,
+	currentMatchingClusters, oldMatchingClusters map[corev1.ObjectReference]bool,
+	logger logr.Logger) error {
+
+	manager, err := keymanager.GetKeyManagerInstance(ctx, r.Client)
+	if err != nil {
+		logger.V(logs.LogInfo).Error(err, "failed to get label key manager")
+		return err
+	}
+
+	for _, clusters := range []map[corev1.ObjectReference]bool{currentMatchingClusters, oldMatchingClusters} {
+		for c := range clusters {
+			manager.RemoveAllRegistrations(classifier, c.Namespace, c.Name, clusterproxy.GetClusterType(&c))
+		}
+	}
+
+	return nil
+}
+
+// getClusterLabelDiff returns the label changes Classifier would apply to the cluster
+// values contains the value (rendered if templated) of each label.
+func getClusterLabelDiff(classifier *libsveltosv1beta1.Classifier, cluster client.Object,
+	status *libsveltosv1beta1.MachingClusterStatus, values map[string]string) *clusterLabelDiff {
+
+	diff := &clusterLabelDiff{
+		Cluster:   status.ClusterRef,
+		Conflicts: status.UnManagedLabels,
+	}
+
+	managed := make(map[string]bool)
+	for i := range status.ManagedLabels {
+		managed[status.ManagedLabels[i]] = true
+	}
+
+	currentLabels := cluster.GetLabels()
+	for i := range classifier.Spec.ClassifierLabels {
+		label := &classifier.Spec.ClassifierLabels[i]
+		if !managed[label.Key] {
+			continue
+		}
+
+		value, ok := values[label.Key]
+		if !ok {
+			// Template could not be rendered
+			continue
+		}
+
+		v, ok := currentLabels[label.Key]
+		switch {
+		case !ok:
+			if diff.Added == nil {
+				diff.Added = make(map[string]string)
+			}
+			diff.Added[label.Key] = value
+		case v != value:
+			if diff.Updated == nil {
+				diff.Updated = make(map[string]string)
+			}
+			diff.Updated[label.Key] = value
+		default:
+			diff.Unchanged = append(diff.Unchanged, label.Key)
+		}
+	}
+
+	return diff
+}
+
+// publishDryRunReport stores, in a ConfigMap in the projectsveltos namespace, the label changes
+// a Classifier in dry-run mode would apply to each matching cluster
+func (r *ClassifierReconciler) publishDryRunReport(ctx context.Context,
+	classifier *libsveltosv1beta1.Classifier, logger logr.Logger) error {
+
+	diffs := make([]clusterLabelDiff, 0)
+	for i := range classifier.Status.MachingClusterStatuses {
+		status := &classifier.Status.MachingClusterStatuses[i]
+		ref := &status.ClusterRef
+		cluster, err := clusterproxy.GetCluster(ctx, r.Client, ref.Namespace, ref.Name, clusterproxy.GetClusterType(ref))
+		if err != nil {
+			if apierrors.IsNotFound(err) {
+				continue
+			}
+			logger.V(logs.LogInfo).Error(err, fmt.Sprintf("failed to get cluster %s/%s", ref.Namespace, ref.Name))
+			return err
+		}
+
+		values, err := r.getClassifierLabelValues(ctx, classifier, cluster,
+			clusterproxy.GetClusterType(ref), logger)
+		if err != nil {
+			return err
+		}
+
+		diffs = append(diffs, *getClusterLabelDiff(classifier, cluster, status, values))
+	}
+
+	sort.Slice(diffs, func(i, j int) bool {
+		return fmt.Sprintf("%s/%s/%s", diffs[i].Cluster.Kind, diffs[i].Cluster.Namespace, diffs[i].Cluster.Name) <
+			fmt.Sprintf("%s/%s/%s", diffs[j].Cluster.Kind, diffs[j].Cluster.Namespace, diffs[j].Cluster.Name)
+	})
+
+	data, err := json.Marshal(diffs)
+	if err != nil {
+		return err
+	}
+
+	reportData := map[string]string{dryRunReportKey: string(data)}
+
+	configMap := &corev1.ConfigMap{}
+	err = r.Get(ctx, types.NamespacedName{Namespace: projectsveltos, Name: getDryRunReportName(classifier.Name)},
+		configMap)
+	if err != nil {
+		if !apierrors.IsNotFound(err) {
+			return err
+		}
+
+		configMap.Namespace = projectsveltos
+		configMap.Name = getDryRunReportName(classifier.Name)
+		configMap.Labels = map[string]string{
+			libsveltosv1beta1.ClassifierlNameLabel: classifier.Name,
+		}
+		configMap.OwnerReferences = []metav1.OwnerReference{
+			{
+				APIVersion: libsveltosv1beta1.GroupVersion.String(),
+				Kind:       libsveltosv1beta1.ClassifierKind,
+				Name:       classifier.Name,
+				UID:        classifier.UID,
+			},
+		}
+		configMap.Data = reportData
+		logger.V(logs.LogDebug).Info("creating dry-run report")
+		return r.Create(ctx, configMap)
+	}
+
+	if reflect.DeepEqual(configMap.Data, reportData) {
+		return nil
+	}
+
+	configMap.Data = reportData
+	logger.V(logs.LogDebug).Info("updating dry-run report")
+	return r.Update(ctx, configMap)
+}
+
+// removeDryRunReport removes the dry-run report for a Classifier, if any
+func removeDryRunReport(ctx context.Context, c client.Client, classifier *libsveltosv1beta1.Classifier) error {
+	configMap := &corev1.ConfigMap{}
+	err := c.Get(ctx, types.NamespacedName{Namespace: projectsveltos, Name: getDryRunReportName(classifier.Name)},
+		configMap)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+
+	return client.IgnoreNotFound(c.Delete(ctx, configMap))
+}
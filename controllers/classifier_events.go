@@ -0,0 +1,214 @@
+/*
+Copyright 2022. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/projectsveltos/classifier/pkg/scope"
+	libsveltosv1beta1 "github.com/projectsveltos/libsveltos/api/v1beta1"
+	"github.com/projectsveltos/libsveltos/lib/clusterproxy"
+)
+
+// Reasons used for Events emitted on Classifier instances
+const (
+	clusterMatchedReason        = "ClusterMatched"
+	clusterUnmatchedReason      = "ClusterUnmatched"
+	labelAppliedReason          = "LabelApplied"
+	labelRemovedReason          = "LabelRemoved"
+	labelConflictReason         = "LabelConflict"
+	labelConflictResolvedReason = "LabelConflictResolved"
+	deploymentFailedReason      = "DeploymentFailed"
+	compositionCycleReason      = "CompositionCycle"
+	labelRenderFailedReason     = "LabelRenderFailed"
+
+	agentKubeconfigRotatedReason  = "AgentKubeconfigRotated"
+	agentKubeconfigExpiringReason = "AgentKubeconfigExpiring"
+	agentKubeconfigExpiredReason  = "AgentKubeconfigExpired"
+
+	sveltosAgentUninstalledReason = "SveltosAgentUninstalled"
+)
+
+// Reasons used for Classifier conditions
+const (
+	readyConditionReason       = "Ready"
+	reconcileFailedReason      = "ReconcileFailed"
+	provisioningReason         = "Provisioning"
+	labelsAppliedReason        = "LabelsApplied"
+	labelsUpdateFailedReason   = "LabelsUpdateFailed"
+	dryRunReason               = "DryRun"
+	conflictsPresentReason     = "ConflictsPresent"
+	noConflictsReason          = "NoConflicts"
+	deploymentSucceededReason  = "DeploymentSucceeded"
+	labelChangesQueuedReason   = "LabelChangesQueued"
+	noLabelChangesQueuedReason = "NoLabelChangesQueued"
+)
+
+// recordEvent emits an Event on the Classifier instance
+func (r *ClassifierReconciler) recordEvent(classifier *libsveltosv1beta1.Classifier, eventType, reason,
+	messageFmt string, args ...interface{}) {
+
+	if r.EventRecorder == nil {
+		return
+	}
+
+	r.EventRecorder.Eventf(classifier, eventType, reason, messageFmt, args...)
+}
+
+func getClusterDescription(cluster *corev1.ObjectReference) string {
+	return fmt.Sprintf("%s:%s/%s", clusterproxy.GetClusterType(cluster), cluster.Namespace, cluster.Name)
+}
+
+// recordMatchingClusterEvents emits an Event for every cluster which started or stopped matching
+// the Classifier
+func (r *ClassifierReconciler) recordMatchingClusterEvents(classifier *libsveltosv1beta1.Classifier,
+	currentMatchingClusters, oldMatchingClusters map[corev1.ObjectReference]bool) {
+
+	for c := range currentMatchingClusters {
+		if !oldMatchingClusters[c] {
+			r.recordEvent(classifier, corev1.EventTypeNormal, clusterMatchedReason,
+				"cluster %s is now a match", getClusterDescription(&c))
+		}
+	}
+
+	for c := range oldMatchingClusters {
+		if !currentMatchingClusters[c] {
+			r.recordEvent(classifier, corev1.EventTypeNormal, clusterUnmatchedReason,
+				"cluster %s is not a match anymore", getClusterDescription(&c))
+		}
+	}
+}
+
+// recordLabelConflictEvents emits an Event for every label which, in a matching cluster, either cannot be
+// managed anymore by the Classifier (conflict detected) or can now be managed (conflict resolved).
+func (r *ClassifierReconciler) recordLabelConflictEvents(classifier *libsveltosv1beta1.Classifier,
+	oldStatuses, newStatuses []libsveltosv1beta1.MachingClusterStatus) {
+
+	getConflicts := func(statuses []libsveltosv1beta1.MachingClusterStatus) map[corev1.ObjectReference]map[string]bool {
+		conflicts := make(map[corev1.ObjectReference]map[string]bool)
+		for i := range statuses {
+			conflicts[statuses[i].ClusterRef] = make(map[string]bool)
+			for j := range statuses[i].UnManagedLabels {
+				conflicts[statuses[i].ClusterRef][statuses[i].UnManagedLabels[j].Key] = true
+			}
+		}
+		return conflicts
+	}
+
+	oldConflicts := getConflicts(oldStatuses)
+	newConflicts := getConflicts(newStatuses)
+
+	for i := range newStatuses {
+		status := &newStatuses[i]
+		for j := range status.UnManagedLabels {
+			key := status.UnManagedLabels[j].Key
+			if !oldConflicts[status.ClusterRef][key] {
+				message := ""
+				if status.UnManagedLabels[j].FailureMessage != nil {
+					message = *status.UnManagedLabels[j].FailureMessage
+				}
+				r.recordEvent(classifier, corev1.EventTypeWarning, labelConflictReason,
+					"label %s cannot be managed in cluster %s: %s", key, getClusterDescription(&status.ClusterRef),
+					message)
+			}
+		}
+	}
+
+	for cluster, keys := range oldConflicts {
+		current, ok := newConflicts[cluster]
+		if !ok {
+			// Cluster is not a match anymore
+			continue
+		}
+		for key := range keys {
+			if !current[key] {
+				r.recordEvent(classifier, corev1.EventTypeNormal, labelConflictResolvedReason,
+					"label %s can now be managed in cluster %s", key, getClusterDescription(&cluster))
+			}
+		}
+	}
+}
+
+// updateConflictsPresentCondition sets ConflictsPresent condition
+func updateConflictsPresentCondition(classifierScope *scope.ClassifierScope, unManaged int) {
+	if unManaged == 0 {
+		classifierScope.SetCondition(scope.ConflictsPresentCondition, metav1.ConditionFalse, noConflictsReason, "")
+		return
+	}
+
+	classifierScope.SetCondition(scope.ConflictsPresentCondition, metav1.ConditionTrue, conflictsPresentReason,
+		fmt.Sprintf("%d label(s) cannot be managed because managed by other Classifiers", unManaged))
+}
+
+// updateLabelsAppliedCondition sets LabelsApplied condition
+func updateLabelsAppliedCondition(classifierScope *scope.ClassifierScope, dryRun bool, err error) {
+	switch {
+	case dryRun:
+		classifierScope.SetCondition(scope.LabelsAppliedCondition, metav1.ConditionFalse, dryRunReason,
+			"Classifier is in dry-run mode. Labels are not applied")
+	case err != nil:
+		classifierScope.SetCondition(scope.LabelsAppliedCondition, metav1.ConditionFalse, labelsUpdateFailedReason,
+			err.Error())
+	case len(labelRateLimiter.getQueued(classifierScope.Name())) != 0:
+		classifierScope.SetCondition(scope.LabelsAppliedCondition, metav1.ConditionFalse, labelChangesQueuedReason,
+			"label changes are queued by rate limit")
+	default:
+		classifierScope.SetCondition(scope.LabelsAppliedCondition, metav1.ConditionTrue, labelsAppliedReason, "")
+	}
+}
+
+// updateDeploymentFailedCondition sets DeploymentFailed condition. failedClusters contains
+// all clusters Classifier failed to be deployed to.
+func updateDeploymentFailedCondition(classifierScope *scope.ClassifierScope, failedClusters []string) {
+	if len(failedClusters) == 0 {
+		classifierScope.SetCondition(scope.DeploymentFailedCondition, metav1.ConditionFalse,
+			deploymentSucceededReason, "")
+		return
+	}
+
+	sort.Strings(failedClusters)
+	classifierScope.SetCondition(scope.DeploymentFailedCondition, metav1.ConditionTrue, deploymentFailedReason,
+		fmt.Sprintf("Classifier failed to be deployed in clusters: %s", strings.Join(failedClusters, ", ")))
+}
+
+// updateReadyCondition sets Ready condition based on reconciliation outcome and on the other conditions.
+// provisioning is true if Classifier is still being deployed in any cluster.
+func updateReadyCondition(classifierScope *scope.ClassifierScope, err error, provisioning bool) {
+	switch {
+	case err != nil:
+		classifierScope.SetCondition(scope.ReadyCondition, metav1.ConditionFalse, reconcileFailedReason,
+			err.Error())
+	case isConditionTrue(classifierScope, scope.DeploymentFailedCondition):
+		classifierScope.SetCondition(scope.ReadyCondition, metav1.ConditionFalse, deploymentFailedReason,
+			classifierScope.GetCondition(scope.DeploymentFailedCondition).Message)
+	case provisioning:
+		classifierScope.SetCondition(scope.ReadyCondition, metav1.ConditionFalse, provisioningReason,
+			"Classifier is being deployed")
+	default:
+		classifierScope.SetCondition(scope.ReadyCondition, metav1.ConditionTrue, readyConditionReason, "")
+	}
+}
+
+func isConditionTrue(classifierScope *scope.ClassifierScope, conditionType string) bool {
+	condition := classifierScope.GetCondition(conditionType)
+	return condition != nil && condition.Status == metav1.ConditionTrue
+}
@@ -21,9 +21,11 @@ import (
 
 	"github.com/go-logr/logr"
 	corev1 "k8s.io/api/core/v1"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
 	"sigs.k8s.io/controller-runtime/pkg/event"
 	"sigs.k8s.io/controller-runtime/pkg/predicate"
 
+	"github.com/projectsveltos/classifier/controllers/keymanager"
 	libsveltosv1beta1 "github.com/projectsveltos/libsveltos/api/v1beta1"
 	logs "github.com/projectsveltos/libsveltos/lib/logsettings"
 )
@@ -274,6 +276,20 @@ func ClassifierPredicate(logger logr.Logger) predicate.Funcs {
 				return true
 			}
 
+			// return true if Classifier priority has changed. That might move label ownership.
+			if keymanager.GetClassifierPriority(oldClassifier) != keymanager.GetClassifierPriority(newClassifer) {
+				log.V(logs.LogVerbose).Info(
+					"Classifier priority changed. Will attempt to reconcile associated Classifiers.")
+				return true
+			}
+
+			// return true if Classifier entered or left dry-run mode. That might move label ownership.
+			if keymanager.IsDryRun(oldClassifier) != keymanager.IsDryRun(newClassifer) {
+				log.V(logs.LogVerbose).Info(
+					"Classifier dry-run mode changed. Will attempt to reconcile associated Classifiers.")
+				return true
+			}
+
 			// otherwise, return false
 			log.V(logs.LogVerbose).Info(
 				"ClassifierReport did not match expected conditions.  Will not attempt to reconcile associated Classifiers.")
@@ -314,3 +330,178 @@ func ClassifierPredicate(logger logr.Logger) predicate.Funcs {
 		},
 	}
 }
+
+// ClusterManagementConstraintPredicate predicates for CAPI Cluster. It complements libsveltos ClusterPredicate
+// by reacting to changes to the fields a ManagementClusterConstraint is evaluated against.
+func ClusterManagementConstraintPredicate(logger logr.Logger) predicate.TypedFuncs[*clusterv1.Cluster] {
+	return predicate.TypedFuncs[*clusterv1.Cluster]{
+		UpdateFunc: func(e event.TypedUpdateEvent[*clusterv1.Cluster]) bool {
+			newCluster := e.ObjectNew
+			oldCluster := e.ObjectOld
+			log := logger.WithValues("predicate", "updateEvent",
+				"namespace", newCluster.Namespace,
+				"cluster", newCluster.Name,
+			)
+
+			if oldCluster == nil {
+				log.V(logs.LogVerbose).Info("Old Cluster is nil. Reconcile Classifiers")
+				return true
+			}
+
+			// return true if Cluster topology (class, version, replicas) has changed
+			if !reflect.DeepEqual(oldCluster.Spec.Topology, newCluster.Spec.Topology) {
+				log.V(logs.LogVerbose).Info(
+					"Cluster topology changed. Will attempt to reconcile associated Classifiers.")
+				return true
+			}
+
+			// return true if Cluster infrastructure has changed
+			if !reflect.DeepEqual(oldCluster.Spec.InfrastructureRef, newCluster.Spec.InfrastructureRef) {
+				log.V(logs.LogVerbose).Info(
+					"Cluster infrastructureRef changed. Will attempt to reconcile associated Classifiers.")
+				return true
+			}
+
+			// return true if desired number of control plane replicas has changed
+			if !reflect.DeepEqual(getDesiredControlPlaneReplicas(oldCluster), getDesiredControlPlaneReplicas(newCluster)) {
+				log.V(logs.LogVerbose).Info(
+					"Cluster control plane replicas changed. Will attempt to reconcile associated Classifiers.")
+				return true
+			}
+
+			// otherwise, return false
+			log.V(logs.LogVerbose).Info(
+				"Cluster did not match expected conditions.  Will not attempt to reconcile associated Classifiers.")
+			return false
+		},
+		CreateFunc: func(e event.TypedCreateEvent[*clusterv1.Cluster]) bool {
+			// Cluster creation is handled by libsveltos ClusterPredicate
+			return false
+		},
+		DeleteFunc: func(e event.TypedDeleteEvent[*clusterv1.Cluster]) bool {
+			// Cluster deletion is handled by libsveltos ClusterPredicate
+			return false
+		},
+		GenericFunc: func(e event.TypedGenericEvent[*clusterv1.Cluster]) bool {
+			return false
+		},
+	}
+}
+
+// MachineManagementConstraintPredicate predicates for CAPI Machine. It complements libsveltos MachinePredicate
+// by reacting to changes to the number of Machines and to their failure domains, which a
+// ManagementClusterConstraint can be evaluated against.
+func MachineManagementConstraintPredicate(logger logr.Logger) predicate.TypedFuncs[*clusterv1.Machine] {
+	return predicate.TypedFuncs[*clusterv1.Machine]{
+		UpdateFunc: func(e event.TypedUpdateEvent[*clusterv1.Machine]) bool {
+			newMachine := e.ObjectNew
+			oldMachine := e.ObjectOld
+			log := logger.WithValues("predicate", "updateEvent",
+				"namespace", newMachine.Namespace,
+				"machine", newMachine.Name,
+			)
+
+			if oldMachine == nil {
+				log.V(logs.LogVerbose).Info("Old Machine is nil. Reconcile Classifiers")
+				return true
+			}
+
+			// return true if Machine failure domain has changed
+			if !reflect.DeepEqual(oldMachine.Spec.FailureDomain, newMachine.Spec.FailureDomain) {
+				log.V(logs.LogVerbose).Info(
+					"Machine failureDomain changed. Will attempt to reconcile associated Classifiers.")
+				return true
+			}
+
+			// otherwise, return false
+			log.V(logs.LogVerbose).Info(
+				"Machine did not match expected conditions.  Will not attempt to reconcile associated Classifiers.")
+			return false
+		},
+		CreateFunc: func(e event.TypedCreateEvent[*clusterv1.Machine]) bool {
+			// Number of Machines has changed
+			return true
+		},
+		DeleteFunc: func(e event.TypedDeleteEvent[*clusterv1.Machine]) bool {
+			// Number of Machines has changed
+			return true
+		},
+		GenericFunc: func(e event.TypedGenericEvent[*clusterv1.Machine]) bool {
+			return false
+		},
+	}
+}
+
+// ClusterReportModePredicate predicates for CAPI Cluster. It complements libsveltos ClusterPredicate
+// by reacting to changes to the report mode selected for the cluster.
+func ClusterReportModePredicate(logger logr.Logger) predicate.TypedFuncs[*clusterv1.Cluster] {
+	return predicate.TypedFuncs[*clusterv1.Cluster]{
+		UpdateFunc: func(e event.TypedUpdateEvent[*clusterv1.Cluster]) bool {
+			newCluster := e.ObjectNew
+			oldCluster := e.ObjectOld
+			log := logger.WithValues("predicate", "updateEvent",
+				"namespace", newCluster.Namespace,
+				"cluster", newCluster.Name,
+			)
+
+			if oldCluster == nil {
+				log.V(logs.LogVerbose).Info("Old Cluster is nil. Reconcile Classifiers")
+				return true
+			}
+
+			if isReportModeChanged(oldCluster, newCluster) {
+				log.V(logs.LogVerbose).Info(
+					"Cluster report mode changed. Will attempt to reconcile associated Classifiers.")
+				return true
+			}
+
+			return false
+		},
+		CreateFunc: func(e event.TypedCreateEvent[*clusterv1.Cluster]) bool {
+			// Cluster creation is handled by libsveltos ClusterPredicate
+			return false
+		},
+		DeleteFunc: func(e event.TypedDeleteEvent[*clusterv1.Cluster]) bool {
+			// Cluster deletion is handled by libsveltos ClusterPredicate
+			return false
+		},
+		GenericFunc: func(e event.TypedGenericEvent[*clusterv1.Cluster]) bool {
+			return false
+		},
+	}
+}
+
+// SveltosClusterReportModePredicate predicates for SveltosCluster. It complements libsveltos
+// SveltosClusterPredicates by reacting to changes to the report mode selected for the cluster.
+func SveltosClusterReportModePredicate(logger logr.Logger) predicate.Funcs {
+	return predicate.Funcs{
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			if e.ObjectOld == nil || e.ObjectNew == nil {
+				return true
+			}
+			log := logger.WithValues("predicate", "updateEvent",
+				"namespace", e.ObjectNew.GetNamespace(),
+				"cluster", e.ObjectNew.GetName(),
+			)
+
+			if isReportModeChanged(e.ObjectOld, e.ObjectNew) {
+				log.V(logs.LogVerbose).Info(
+					"SveltosCluster report mode changed. Will attempt to reconcile associated Classifiers.")
+				return true
+			}
+
+			return false
+		},
+		CreateFunc: func(e event.CreateEvent) bool {
+			// SveltosCluster creation is handled by libsveltos SveltosClusterPredicates
+			return false
+		},
+		DeleteFunc: func(e event.DeleteEvent) bool {
+			// SveltosCluster deletion is handled by libsveltos SveltosClusterPredicates
+			return false
+		},
+		GenericFunc: func(e event.GenericEvent) bool {
+			return false
+		},
+	}
+}
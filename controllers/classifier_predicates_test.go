@@ -27,6 +27,7 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/event"
 
 	"github.com/projectsveltos/classifier/controllers"
+	"github.com/projectsveltos/classifier/controllers/keymanager"
 	libsveltosv1beta1 "github.com/projectsveltos/libsveltos/api/v1beta1"
 )
 
@@ -440,4 +441,47 @@ var _ = Describe("Classifier Predicates: ClassifierPredicate", func() {
 		result := classifierPredicate.Update(e)
 		Expect(result).To(BeFalse())
 	})
+	It("Update reprocesses when Classifier priority changes", func() {
+		classifierPredicate := controllers.ClassifierPredicate(logger)
+
+		classifier.Annotations = map[string]string{
+			keymanager.ClassifierPriorityAnnotation: "10",
+		}
+
+		oldClassifier := &libsveltosv1beta1.Classifier{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: classifier.Name,
+			},
+		}
+
+		e := event.UpdateEvent{
+			ObjectNew: classifier,
+			ObjectOld: oldClassifier,
+		}
+
+		result := classifierPredicate.Update(e)
+		Expect(result).To(BeTrue())
+	})
+
+	It("Update reprocesses when Classifier dry-run mode changes", func() {
+		classifierPredicate := controllers.ClassifierPredicate(logger)
+
+		classifier.Annotations = map[string]string{
+			keymanager.ClassifierDryRunAnnotation: "true",
+		}
+
+		oldClassifier := &libsveltosv1beta1.Classifier{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: classifier.Name,
+			},
+		}
+
+		e := event.UpdateEvent{
+			ObjectNew: classifier,
+			ObjectOld: oldClassifier,
+		}
+
+		result := classifierPredicate.Update(e)
+		Expect(result).To(BeTrue())
+	})
 })
@@ -20,7 +20,9 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"reflect"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-logr/logr"
@@ -35,6 +37,79 @@ import (
 	"github.com/projectsveltos/libsveltos/lib/sveltos_upgrade"
 )
 
+const (
+	// classifierReportResyncInterval is how often ClassifierReports are listed from all clusters,
+	// even the ones with a ClassifierReport watcher
+	classifierReportResyncInterval = 5 * time.Minute
+
+	// DefaultReportCollectionConcurrency is the default number of clusters ClassifierReports
+	// are collected from in parallel
+	DefaultReportCollectionConcurrency = 10
+
+	// DefaultReportCollectionTimeout is the default maximum time spent collecting ClassifierReports
+	// from a single cluster
+	DefaultReportCollectionTimeout = 30 * time.Second
+
+	collectionInitialBackoff = 20 * time.Second
+	collectionMaxBackoff     = 10 * time.Minute
+)
+
+// collectionBackoffs tracks clusters ClassifierReports could not be collected from.
+// Such clusters are skipped till their backoff expires.
+type collectionBackoffs struct {
+	mux      sync.Mutex
+	backoffs map[corev1.ObjectReference]*watcherBackoff
+}
+
+func newCollectionBackoffs() *collectionBackoffs {
+	return &collectionBackoffs{
+		backoffs: make(map[corev1.ObjectReference]*watcherBackoff),
+	}
+}
+
+// canAttempt returns true if ClassifierReports can be collected from cluster (cluster is not in backoff)
+func (b *collectionBackoffs) canAttempt(cluster *corev1.ObjectReference) bool {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	v, ok := b.backoffs[*cluster]
+	return !ok || time.Now().After(v.retryAfter)
+}
+
+// recordFailure records a failed collection. Cluster is skipped for an exponentially growing time.
+func (b *collectionBackoffs) recordFailure(cluster *corev1.ObjectReference) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	v, ok := b.backoffs[*cluster]
+	if !ok {
+		v = &watcherBackoff{}
+		b.backoffs[*cluster] = v
+	}
+	v.failures++
+	v.retryAfter = time.Now().Add(getExponentialBackoff(v.failures, collectionInitialBackoff, collectionMaxBackoff))
+}
+
+// recordSuccess resets cluster backoff
+func (b *collectionBackoffs) recordSuccess(cluster *corev1.ObjectReference) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	delete(b.backoffs, *cluster)
+}
+
+// removeStale forgets about clusters not in clusters
+func (b *collectionBackoffs) removeStale(clusters map[corev1.ObjectReference]bool) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	for cluster := range b.backoffs {
+		if !clusters[cluster] {
+			delete(b.backoffs, cluster)
+		}
+	}
+}
+
 // Classifier instances reside in the same cluster as the sveltos-agent component.
 // This function dynamically selects the appropriate Kubernetes client:
 // - Management cluster's client if sveltos-agent is deployed there.
@@ -53,33 +128,6 @@ func getClassifierClient(ctx context.Context, clusterNamespace, clusterName stri
 		clusterNamespace, clusterName, "", "", clusterType, logger)
 }
 
-// removeAccessRequest removes AccessRequest generated for SveltosAgent
-func removeAccessRequest(ctx context.Context, c client.Client, logger logr.Logger) error {
-	accessRequestList := &libsveltosv1beta1.AccessRequestList{}
-
-	listOptions := []client.ListOption{
-		client.MatchingLabels{
-			accessRequestClassifierLabel: "ok",
-		},
-	}
-
-	err := c.List(ctx, accessRequestList, listOptions...)
-	if err != nil {
-		return err
-	}
-
-	for i := range accessRequestList.Items {
-		ar := &accessRequestList.Items[i]
-		err = c.Delete(ctx, ar)
-		if err != nil {
-			return err
-		}
-	}
-
-	logger.V(logs.LogDebug).Info("remove AccessRequest for SveltosAgents")
-	return nil
-}
-
 // removeClassifierReports deletes all ClassifierReport corresponding to Classifier instance
 func removeClassifierReports(ctx context.Context, c client.Client, classifier *libsveltosv1beta1.Classifier,
 	logger logr.Logger) error {
@@ -137,42 +185,172 @@ func removeClusterClassifierReports(ctx context.Context, c client.Client, cluste
 	return nil
 }
 
-// Periodically collects ClassifierReports from each cluster.
+// reportCollectionOptions contains the options for ClassifierReport collection
+type reportCollectionOptions struct {
+	shardKey              string
+	capiOnboardAnnotation string
+	version               string
+	// concurrency is the maximum number of clusters ClassifierReports are collected from in parallel
+	concurrency int
+	// clusterTimeout is the maximum time spent collecting ClassifierReports from a single cluster
+	clusterTimeout time.Duration
+	// defaultReportMode is the report mode of clusters not overriding it with ClusterReportModeAnnotation.
+	// ClassifierReports are collected only from clusters in CollectFromManagementCluster mode.
+	defaultReportMode ReportMode
+}
+
+// Periodically collects ClassifierReports from each cluster in CollectFromManagementCluster mode.
 // If sharding is used, it will collect only from clusters matching shard.
-func collectClassifierReports(c client.Client, shardKey, capiOnboardAnnotation, version string, logger logr.Logger) {
+// When sveltos-agent runs in the managed clusters, ClassifierReports are collected as soon as they change by
+// per-cluster watchers. In such case, periodic collection is only performed every classifierReportResyncInterval
+// (or for clusters currently not watched).
+// Clusters are processed in parallel (up to options.concurrency at a time). Clusters which keep failing are
+// retried with an exponential backoff. Returns when ctx is cancelled.
+func collectClassifierReports(ctx context.Context, c client.Client, options *reportCollectionOptions,
+	logger logr.Logger) {
+
 	interval := 10 * time.Second
-	if shardKey != "" {
+	if options.shardKey != "" {
 		// This controller will only fetch ClassifierReport instances
 		// so it can be more aggressive
 		interval = 5 * time.Second
 	}
 
-	ctx := context.TODO()
+	watchers := newReportWatchers()
+	backoffs := newCollectionBackoffs()
+	var lastResync time.Time
 	for {
 		logger.V(logs.LogDebug).Info("collecting ClassifierReports")
+		resync := time.Since(lastResync) >= classifierReportResyncInterval
+
 		// Get a selectors that matches everything
-		clusterList, err := clusterproxy.GetListOfClustersForShardKey(ctx, c, "", capiOnboardAnnotation, shardKey, logger)
+		clusterList, err := clusterproxy.GetListOfClustersForShardKey(ctx, c, "", options.capiOnboardAnnotation,
+			options.shardKey, logger)
 		if err != nil {
 			logger.V(logs.LogInfo).Info(fmt.Sprintf("failed to get clusters: %v", err))
+		} else {
+			clusterList = filterClustersByReportMode(ctx, c, clusterList, options.defaultReportMode,
+				CollectFromManagementCluster, logger)
+			start := time.Now()
+			collectFromClusters(ctx, c, watchers, backoffs, clusterList, resync, options, logger)
+			collectionLoopDuration(time.Since(start))
+
+			if resync {
+				lastResync = time.Now()
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			watchers.stopStaleWatchers(map[corev1.ObjectReference]bool{})
+			logger.V(logs.LogInfo).Info("stop collecting ClassifierReports")
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// collectFromClusters collects ClassifierReports from all clusters using a bounded pool of workers.
+// Returns once all clusters have been processed.
+func collectFromClusters(ctx context.Context, c client.Client, watchers *reportWatchers,
+	backoffs *collectionBackoffs, clusterList []corev1.ObjectReference, resync bool,
+	options *reportCollectionOptions, logger logr.Logger) {
+
+	concurrency := options.concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	currentClusters := make(map[corev1.ObjectReference]bool)
+	semaphore := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+
+	for i := range clusterList {
+		cluster := &clusterList[i]
+		currentClusters[*cluster] = true
+
+		if !backoffs.canAttempt(cluster) {
+			continue
 		}
 
-		for i := range clusterList {
-			cluster := &clusterList[i]
-			err = collectClassifierReportsFromCluster(ctx, c, cluster, version, logger)
+		select {
+		case <-ctx.Done():
+			wg.Wait()
+			return
+		case semaphore <- struct{}{}:
+		}
+
+		wg.Add(1)
+		go func(cluster *corev1.ObjectReference) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+
+			clusterCtx, cancel := context.WithTimeout(ctx, options.clusterTimeout)
+			defer cancel()
+
+			start := time.Now()
+			err := collectClassifierReportsWithWatcher(clusterCtx, ctx, c, watchers, cluster, options.version,
+				resync, logger)
+			clusterCollectionDuration(time.Since(start), cluster)
 			if err != nil {
 				logger.V(logs.LogInfo).Info(fmt.Sprintf("failed to collect ClassifierReports from cluster: %s/%s %v",
 					cluster.Namespace, cluster.Name, err))
+				backoffs.recordFailure(cluster)
+				return
 			}
+			backoffs.recordSuccess(cluster)
+		}(cluster)
+	}
+
+	wg.Wait()
+
+	watchers.stopStaleWatchers(currentClusters)
+	backoffs.removeStale(currentClusters)
+}
+
+// collectClassifierReportsWithWatcher makes sure a ClassifierReport watcher is running for the cluster.
+// ClassifierReports are listed (and collected) from the cluster only if resync is true or no synced
+// watcher exists for the cluster.
+// Cluster readiness and sveltos-agent version are verified only when the watcher needs to be (re)started
+// or on resync, never for clusters with a synced watcher.
+// ctx bounds the collection while watchCtx, which outlives it, is the context watchers are started with.
+func collectClassifierReportsWithWatcher(ctx, watchCtx context.Context, c client.Client, watchers *reportWatchers,
+	cluster *corev1.ObjectReference, version string, resync bool, logger logr.Logger) error {
+
+	if !resync && watchers.isWatching(cluster) {
+		// Watcher keeps ClassifierReports up to date
+		clusterCollectionSucceeded(cluster)
+		return nil
+	}
+
+	logger = logger.WithValues("cluster", fmt.Sprintf("%s/%s", cluster.Namespace, cluster.Name))
+
+	ready, err := isClusterReadyForCollection(ctx, c, cluster, version, logger)
+	if err != nil || !ready {
+		watchers.stopWatcher(cluster)
+		return err
+	}
+
+	// When sveltos-agent runs in the management cluster, there is nothing to watch in the managed cluster
+	if !getAgentInMgmtCluster() {
+		if err := watchers.ensureWatcher(watchCtx, c, cluster, logger); err != nil {
+			logger.V(logs.LogDebug).Info(fmt.Sprintf("failed to watch ClassifierReports: %v", err))
 		}
+	}
 
-		time.Sleep(interval)
+	if !resync && watchers.isWatching(cluster) {
+		// Watcher has just been (re)started and it is synced
+		clusterCollectionSucceeded(cluster)
+		return nil
 	}
+
+	return collectClassifierReportsFromReadyCluster(ctx, c, cluster, logger)
 }
 
-func collectClassifierReportsFromCluster(ctx context.Context, c client.Client,
-	cluster *corev1.ObjectReference, version string, logger logr.Logger) error {
+// isClusterReadyForCollection returns true if cluster is ready and running a compatible sveltos-agent
+func isClusterReadyForCollection(ctx context.Context, c client.Client,
+	cluster *corev1.ObjectReference, version string, logger logr.Logger) (bool, error) {
 
-	logger = logger.WithValues("cluster", fmt.Sprintf("%s/%s", cluster.Namespace, cluster.Name))
 	clusterRef := &corev1.ObjectReference{
 		Namespace:  cluster.Namespace,
 		Name:       cluster.Name,
@@ -182,11 +360,13 @@ func collectClassifierReportsFromCluster(ctx context.Context, c client.Client,
 	ready, err := clusterproxy.IsClusterReadyToBeConfigured(ctx, c, clusterRef, logger)
 	if err != nil {
 		logger.V(logs.LogDebug).Info("cluster is not ready yet")
-		return err
+		clusterCollectionFailed(cluster, collectionErrorNotReady)
+		return false, err
 	}
 
 	if !ready {
-		return nil
+		clusterCollectionFailed(cluster, collectionErrorNotReady)
+		return false, nil
 	}
 
 	if !sveltos_upgrade.IsSveltosAgentVersionCompatible(ctx, getManagementClusterClient(), version, cluster.Namespace,
@@ -194,14 +374,22 @@ func collectClassifierReportsFromCluster(ctx context.Context, c client.Client,
 
 		msg := "compatibility checks failed"
 		logger.V(logs.LogDebug).Info(msg)
-		return errors.New(msg)
+		clusterCollectionFailed(cluster, collectionErrorIncompatibleAgentVersion)
+		return false, errors.New(msg)
 	}
 
+	return true, nil
+}
+
+func collectClassifierReportsFromReadyCluster(ctx context.Context, c client.Client,
+	cluster *corev1.ObjectReference, logger logr.Logger) error {
+
 	// Classifier instance location depends on sveltos-agent: management cluster if it's running there,
 	// otherwise managed cluster.
 	clusterClient, err := getClassifierClient(ctx, cluster.Namespace, cluster.Name,
-		clusterproxy.GetClusterType(clusterRef), logger)
+		clusterproxy.GetClusterType(cluster), logger)
 	if err != nil {
+		clusterCollectionFailed(cluster, collectionErrorListFailure)
 		return err
 	}
 
@@ -209,28 +397,50 @@ func collectClassifierReportsFromCluster(ctx context.Context, c client.Client,
 	classifierReportList := libsveltosv1beta1.ClassifierReportList{}
 	err = clusterClient.List(ctx, &classifierReportList)
 	if err != nil {
+		clusterCollectionFailed(cluster, collectionErrorListFailure)
 		return err
 	}
 
+	// Cluster is considered up to date only if every ClassifierReport was processed
+	failures := 0
 	for i := range classifierReportList.Items {
-		cr := &classifierReportList.Items[i]
-		if !cr.DeletionTimestamp.IsZero() {
-			// ignore deleted ClassifierReport
-			continue
-		}
-		if cr.Spec.ClusterName != "" {
-			// if ClusterName is set, this is coming from a
-			// managed cluster. If management cluster is in turn
-			// managed by another cluster, do not pull those.
-			continue
-		}
-		l := logger.WithValues("classifierReport", cr.Name)
-		err = updateClassifierReport(ctx, c, cluster, cr, l)
-		if err != nil {
-			logger.V(logs.LogInfo).Info(fmt.Sprintf("failed to process ClassifierReport. Err: %v", err))
+		if err := processCollectedClassifierReport(ctx, c, cluster, &classifierReportList.Items[i], logger); err != nil {
+			failures++
 		}
 	}
+	if failures != 0 {
+		return fmt.Errorf("failed to process %d ClassifierReports (out of %d)", failures, len(classifierReportList.Items))
+	}
 
+	clusterCollectionSucceeded(cluster)
+	return nil
+}
+
+// processCollectedClassifierReport copies a ClassifierReport collected from a cluster
+// to the management cluster. Failures are recorded in metrics and returned.
+func processCollectedClassifierReport(ctx context.Context, c client.Client, cluster *corev1.ObjectReference,
+	cr *libsveltosv1beta1.ClassifierReport, logger logr.Logger) error {
+
+	if !cr.DeletionTimestamp.IsZero() {
+		// ignore deleted ClassifierReport
+		classifierReportProcessed(classifierReportSkipped)
+		return nil
+	}
+	if cr.Spec.ClusterName != "" {
+		// if ClusterName is set, this is coming from a
+		// managed cluster. If management cluster is in turn
+		// managed by another cluster, do not pull those.
+		classifierReportProcessed(classifierReportSkipped)
+		return nil
+	}
+	l := logger.WithValues("classifierReport", cr.Name)
+	err := updateClassifierReport(ctx, c, cluster, cr, l)
+	if err != nil {
+		logger.V(logs.LogInfo).Info(fmt.Sprintf("failed to process ClassifierReport. Err: %v", err))
+		classifierReportProcessed(classifierReportFailed)
+		clusterCollectionFailed(cluster, collectionErrorUpdateFailure)
+		return err
+	}
 	return nil
 }
 
@@ -255,10 +465,12 @@ func updateClassifierReport(ctx context.Context, c client.Client, cluster *corev
 	err := c.Get(ctx, types.NamespacedName{Name: classifierName}, &currentClassifier)
 	if err != nil {
 		if apierrors.IsNotFound(err) {
+			classifierReportProcessed(classifierReportSkipped)
 			return nil
 		}
 	}
 	if !currentClassifier.DeletionTimestamp.IsZero() {
+		classifierReportProcessed(classifierReportSkipped)
 		return nil
 	}
 
@@ -280,17 +492,33 @@ func updateClassifierReport(ctx context.Context, c client.Client, cluster *corev
 			currentClassifierReport.Spec.ClusterNamespace = cluster.Namespace
 			currentClassifierReport.Spec.ClusterName = cluster.Name
 			currentClassifierReport.Spec.ClusterType = clusterType
-			return c.Create(ctx, currentClassifierReport)
+			if err := c.Create(ctx, currentClassifierReport); err != nil {
+				return err
+			}
+			classifierReportProcessed(classifierReportCreated)
+			return nil
 		}
 		return err
 	}
 
+	spec := classiferReport.Spec
+	spec.ClusterNamespace = cluster.Namespace
+	spec.ClusterName = cluster.Name
+	spec.ClusterType = clusterType
+	labels := libsveltosv1beta1.GetClassifierReportLabels(classifierName, cluster.Name, &clusterType)
+	if reflect.DeepEqual(currentClassifierReport.Spec, spec) &&
+		reflect.DeepEqual(currentClassifierReport.Labels, labels) {
+		// ClassifierReport in the management cluster is already up to date
+		classifierReportProcessed(classifierReportSkipped)
+		return nil
+	}
+
 	logger.V(logs.LogDebug).Info("update ClassifierReport in management cluster")
-	currentClassifierReport.Spec = classiferReport.Spec
-	currentClassifierReport.Spec.ClusterNamespace = cluster.Namespace
-	currentClassifierReport.Spec.ClusterName = cluster.Name
-	currentClassifierReport.Spec.ClusterType = clusterType
-	currentClassifierReport.Labels = libsveltosv1beta1.GetClassifierReportLabels(
-		classifierName, cluster.Name, &clusterType)
-	return c.Update(ctx, currentClassifierReport)
+	currentClassifierReport.Spec = spec
+	currentClassifierReport.Labels = labels
+	if err := c.Update(ctx, currentClassifierReport); err != nil {
+		return err
+	}
+	classifierReportProcessed(classifierReportUpdated)
+	return nil
 }
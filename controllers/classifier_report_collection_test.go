@@ -18,10 +18,12 @@ package controllers_test
 
 import (
 	"context"
+	"time"
 
 	"github.com/go-logr/logr"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 
 	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
@@ -29,6 +31,7 @@ import (
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/klog/v2/textlogger"
 	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/client/fake"
 
@@ -124,20 +127,150 @@ var _ = Describe("Classifier Deployer", func() {
 
 		Expect(waitForObject(context.TODO(), testEnv.Client, classifierReport)).To(Succeed())
 
-		Expect(controllers.CollectClassifierReportsFromCluster(context.TODO(), testEnv.Client,
-			getClusterRef(cluster), version, logger)).To(Succeed())
+		watchCtx, cancel := context.WithCancel(context.TODO())
+		defer cancel()
+		watchers := controllers.NewReportWatchers()
+
+		Expect(controllers.CollectClassifierReportsWithWatcher(context.TODO(), watchCtx, testEnv.Client, watchers,
+			getClusterRef(cluster), version, true, logger)).To(Succeed())
 
 		clusterType := libsveltosv1beta1.ClusterTypeCapi
 
 		validateClassifierReports(classifierName, cluster, &clusterType)
 
 		// Update ClassifierReports and validate again
-		Expect(controllers.CollectClassifierReportsFromCluster(context.TODO(), testEnv.Client,
-			getClusterRef(cluster), version, logger)).To(Succeed())
+		Expect(controllers.CollectClassifierReportsWithWatcher(context.TODO(), watchCtx, testEnv.Client, watchers,
+			getClusterRef(cluster), version, true, logger)).To(Succeed())
 
 		validateClassifierReports(classifierName, cluster, &clusterType)
 	})
 
+	It("collectClassifierReportsWithWatcher skips readiness checks for clusters with a synced watcher", func() {
+		// Cluster does not exist, so any readiness check would fail
+		cluster := &corev1.ObjectReference{
+			Namespace:  randomString(),
+			Name:       randomString(),
+			Kind:       libsveltosv1beta1.SveltosClusterKind,
+			APIVersion: libsveltosv1beta1.GroupVersion.String(),
+		}
+
+		c := fake.NewClientBuilder().WithScheme(scheme).Build()
+
+		watchers := controllers.NewReportWatchers()
+		controllers.AddSyncedReportWatcher(watchers, cluster, &syncedInformer{})
+		Expect(controllers.IsWatching(watchers, cluster)).To(BeTrue())
+
+		Expect(controllers.CollectClassifierReportsWithWatcher(context.TODO(), context.TODO(), c, watchers,
+			cluster, version, false, logger)).To(Succeed())
+		Expect(controllers.IsWatching(watchers, cluster)).To(BeTrue())
+
+		// On resync readiness is verified again and watcher is stopped
+		Expect(controllers.CollectClassifierReportsWithWatcher(context.TODO(), context.TODO(), c, watchers,
+			cluster, version, true, logger)).ToNot(Succeed())
+		Expect(controllers.IsWatching(watchers, cluster)).To(BeFalse())
+	})
+
+	It("getWatcherBackoff grows exponentially up to a maximum", func() {
+		Expect(controllers.GetWatcherBackoff(1)).To(Equal(controllers.WatcherInitialBackoff))
+		Expect(controllers.GetWatcherBackoff(2)).To(Equal(2 * controllers.WatcherInitialBackoff))
+		Expect(controllers.GetWatcherBackoff(3)).To(Equal(4 * controllers.WatcherInitialBackoff))
+		Expect(controllers.GetWatcherBackoff(100)).To(Equal(controllers.WatcherMaxBackoff))
+	})
+
+	It("ensureWatcher backs off when cluster cannot be watched", func() {
+		cluster := &corev1.ObjectReference{
+			Namespace:  randomString(),
+			Name:       randomString(),
+			Kind:       libsveltosv1beta1.SveltosClusterKind,
+			APIVersion: libsveltosv1beta1.GroupVersion.String(),
+		}
+
+		c := fake.NewClientBuilder().WithScheme(scheme).Build()
+
+		watchers := controllers.NewReportWatchers()
+
+		// Kubeconfig for cluster does not exist, so watcher cannot be started
+		Expect(controllers.EnsureWatcher(watchers, context.TODO(), c, cluster, logger)).ToNot(Succeed())
+		Expect(controllers.IsWatching(watchers, cluster)).To(BeFalse())
+
+		// Cluster is in backoff, so no new attempt is made
+		Expect(controllers.EnsureWatcher(watchers, context.TODO(), c, cluster, logger)).To(Succeed())
+		Expect(controllers.IsWatching(watchers, cluster)).To(BeFalse())
+
+		controllers.StopStaleWatchers(watchers, map[corev1.ObjectReference]bool{})
+	})
+
+	It("collectionBackoffs skips clusters with failed collections till success", func() {
+		cluster := &corev1.ObjectReference{
+			Namespace:  randomString(),
+			Name:       randomString(),
+			Kind:       libsveltosv1beta1.SveltosClusterKind,
+			APIVersion: libsveltosv1beta1.GroupVersion.String(),
+		}
+
+		backoffs := controllers.NewCollectionBackoffs()
+		Expect(controllers.CanAttemptCollection(backoffs, cluster)).To(BeTrue())
+
+		controllers.RecordCollectionFailure(backoffs, cluster)
+		Expect(controllers.CanAttemptCollection(backoffs, cluster)).To(BeFalse())
+
+		controllers.RecordCollectionSuccess(backoffs, cluster)
+		Expect(controllers.CanAttemptCollection(backoffs, cluster)).To(BeTrue())
+
+		controllers.RecordCollectionFailure(backoffs, cluster)
+		controllers.RemoveStaleCollectionBackoffs(backoffs, map[corev1.ObjectReference]bool{})
+		Expect(controllers.CanAttemptCollection(backoffs, cluster)).To(BeTrue())
+	})
+
+	It("processCollectedClassifierReport returns an error and counts ClassifierReports failed to be processed", func() {
+		cluster := &corev1.ObjectReference{
+			Namespace:  randomString(),
+			Name:       randomString(),
+			Kind:       libsveltosv1beta1.SveltosClusterKind,
+			APIVersion: libsveltosv1beta1.GroupVersion.String(),
+		}
+
+		c := fake.NewClientBuilder().WithScheme(scheme).Build()
+
+		// ClassifierReport without labels is malformed
+		classifierReport := getClassifierReport(randomString(), "", "")
+		classifierReport.Labels = nil
+
+		initialFailed := testutil.ToFloat64(controllers.ClassifierReportsCounter.WithLabelValues("failed"))
+
+		Expect(controllers.ProcessCollectedClassifierReport(context.TODO(), c, cluster, classifierReport,
+			logger)).ToNot(Succeed())
+		Expect(testutil.ToFloat64(controllers.ClassifierReportsCounter.WithLabelValues("failed"))).To(Equal(initialFailed + 1))
+
+		controllers.RemoveClusterMetrics(cluster.Namespace, cluster.Name, libsveltosv1beta1.ClusterTypeSveltos)
+	})
+
+	It("removeClusterMetrics removes metrics for a cluster", func() {
+		cluster := &corev1.ObjectReference{
+			Namespace:  randomString(),
+			Name:       randomString(),
+			Kind:       libsveltosv1beta1.SveltosClusterKind,
+			APIVersion: libsveltosv1beta1.GroupVersion.String(),
+		}
+
+		initialGauges := testutil.CollectAndCount(controllers.ClusterLastCollectionGauge)
+		initialErrors := testutil.CollectAndCount(controllers.CollectionErrorsCounter)
+		initialHistograms := testutil.CollectAndCount(controllers.ProgramClassifierDurationHistogram)
+
+		controllers.ClusterCollectionSucceeded(cluster)
+		controllers.ClusterCollectionFailed(cluster, "not_ready")
+		controllers.ClusterCollectionFailed(cluster, "list_failure")
+		controllers.ProgramDuration(time.Second, cluster.Namespace, cluster.Name,
+			string(libsveltosv1beta1.FeatureClassifier), libsveltosv1beta1.ClusterTypeSveltos, logger)
+		Expect(testutil.CollectAndCount(controllers.ProgramClassifierDurationHistogram)).To(Equal(initialHistograms + 1))
+		Expect(testutil.CollectAndCount(controllers.ClusterLastCollectionGauge)).To(Equal(initialGauges + 1))
+		Expect(testutil.CollectAndCount(controllers.CollectionErrorsCounter)).To(Equal(initialErrors + 2))
+
+		controllers.RemoveClusterMetrics(cluster.Namespace, cluster.Name, libsveltosv1beta1.ClusterTypeSveltos)
+		Expect(testutil.CollectAndCount(controllers.ClusterLastCollectionGauge)).To(Equal(initialGauges))
+		Expect(testutil.CollectAndCount(controllers.CollectionErrorsCounter)).To(Equal(initialErrors))
+		Expect(testutil.CollectAndCount(controllers.ProgramClassifierDurationHistogram)).To(Equal(initialHistograms))
+	})
 })
 
 func validateClassifierReports(classifierName string, cluster *clusterv1.Cluster, clusterType *libsveltosv1beta1.ClusterType) {
@@ -166,3 +299,12 @@ func validateClassifierReports(classifierName string, cluster *clusterv1.Cluster
 		return ok && v == classifierName
 	}, timeout, pollingInterval).Should(BeTrue())
 }
+
+// syncedInformer is an informer which has always synced
+type syncedInformer struct {
+	cache.Informer
+}
+
+func (i *syncedInformer) HasSynced() bool {
+	return true
+}
@@ -0,0 +1,285 @@
+/*
+Copyright 2022. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	toolscache "k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	libsveltosv1beta1 "github.com/projectsveltos/libsveltos/api/v1beta1"
+	"github.com/projectsveltos/libsveltos/lib/clusterproxy"
+	logs "github.com/projectsveltos/libsveltos/lib/logsettings"
+)
+
+// When ClassifierReports are collected by the management cluster, a watcher (an informer on
+// ClassifierReport) is started for each ready cluster. As soon as a ClassifierReport changes in a
+// managed cluster, it is copied to the management cluster.
+// Watchers are started and stopped as clusters come and go. A watcher which fails (or does not sync
+// in time) is stopped and restarted later on with an exponential backoff.
+// Periodic collection (see collectClassifierReports) is still performed as resync.
+
+const (
+	// watcherSyncTimeout is how long a watcher is given to sync before being considered failed
+	watcherSyncTimeout = 2 * time.Minute
+
+	watcherInitialBackoff = 10 * time.Second
+	watcherMaxBackoff     = 5 * time.Minute
+)
+
+// reportWatcher watches ClassifierReports in a single cluster
+type reportWatcher struct {
+	cancel    context.CancelFunc
+	done      chan struct{}
+	informer  cache.Informer
+	startTime time.Time
+}
+
+// isRunning returns true if watcher has not exited yet
+func (w *reportWatcher) isRunning() bool {
+	select {
+	case <-w.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// hasSynced returns true if watcher informer has synced
+func (w *reportWatcher) hasSynced() bool {
+	return w.informer != nil && w.informer.HasSynced()
+}
+
+// watcherBackoff tracks failed attempts to watch (or collect ClassifierReports from) a cluster
+type watcherBackoff struct {
+	failures   int
+	retryAfter time.Time
+}
+
+// reportWatchers keeps track of all ClassifierReport watchers
+type reportWatchers struct {
+	mux      sync.Mutex
+	watchers map[corev1.ObjectReference]*reportWatcher
+	backoffs map[corev1.ObjectReference]*watcherBackoff
+}
+
+func newReportWatchers() *reportWatchers {
+	return &reportWatchers{
+		watchers: make(map[corev1.ObjectReference]*reportWatcher),
+		backoffs: make(map[corev1.ObjectReference]*watcherBackoff),
+	}
+}
+
+// getWatcherBackoff returns how long to wait before trying again to watch a cluster
+// after failures consecutive failures
+func getWatcherBackoff(failures int) time.Duration {
+	return getExponentialBackoff(failures, watcherInitialBackoff, watcherMaxBackoff)
+}
+
+// getExponentialBackoff returns initial doubled for each failure after the first one, capped at maxBackoff
+func getExponentialBackoff(failures int, initial, maxBackoff time.Duration) time.Duration {
+	backoff := initial
+	for i := 1; i < failures; i++ {
+		backoff *= 2
+		if backoff >= maxBackoff {
+			return maxBackoff
+		}
+	}
+	return backoff
+}
+
+// recordFailure records a failed attempt to watch cluster. Caller must hold mux.
+func (w *reportWatchers) recordFailure(cluster *corev1.ObjectReference, logger logr.Logger) {
+	b, ok := w.backoffs[*cluster]
+	if !ok {
+		b = &watcherBackoff{}
+		w.backoffs[*cluster] = b
+	}
+	b.failures++
+	backoff := getWatcherBackoff(b.failures)
+	b.retryAfter = time.Now().Add(backoff)
+	logger.V(logs.LogDebug).Info(fmt.Sprintf("watching ClassifierReports failed %d times. Retry in %s",
+		b.failures, backoff))
+}
+
+// canStart returns true if cluster is not in backoff. Caller must hold mux.
+func (w *reportWatchers) canStart(cluster *corev1.ObjectReference) bool {
+	b, ok := w.backoffs[*cluster]
+	if !ok {
+		return true
+	}
+	return time.Now().After(b.retryAfter)
+}
+
+// isWatching returns true if a synced watcher exists for the cluster
+func (w *reportWatchers) isWatching(cluster *corev1.ObjectReference) bool {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	watcher, ok := w.watchers[*cluster]
+	return ok && watcher.isRunning() && watcher.hasSynced()
+}
+
+// ensureWatcher makes sure a watcher is running for the cluster. Cluster is expected to be ready
+// and running a compatible sveltos-agent.
+func (w *reportWatchers) ensureWatcher(ctx context.Context, c client.Client, cluster *corev1.ObjectReference,
+	logger logr.Logger) error {
+
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	if watcher, ok := w.watchers[*cluster]; ok {
+		switch {
+		case !watcher.isRunning():
+			// Watcher exited (failed)
+			delete(w.watchers, *cluster)
+			w.recordFailure(cluster, logger)
+		case watcher.hasSynced():
+			delete(w.backoffs, *cluster)
+			return nil
+		case time.Since(watcher.startTime) > watcherSyncTimeout:
+			logger.V(logs.LogInfo).Info("ClassifierReport watcher did not sync in time. Stopping it")
+			watcher.cancel()
+			delete(w.watchers, *cluster)
+			w.recordFailure(cluster, logger)
+		default:
+			// Still syncing
+			return nil
+		}
+	}
+
+	if !w.canStart(cluster) {
+		return nil
+	}
+
+	// Do not hold the lock while contacting the cluster. Each cluster is processed by a single
+	// worker at a time so no other watcher can be started for this cluster meanwhile.
+	w.mux.Unlock()
+	watcher, err := startReportWatcher(ctx, c, cluster, logger)
+	w.mux.Lock()
+
+	if err != nil {
+		w.recordFailure(cluster, logger)
+		return err
+	}
+
+	w.watchers[*cluster] = watcher
+	return nil
+}
+
+// stopWatcher stops the watcher for a cluster, if any
+func (w *reportWatchers) stopWatcher(cluster *corev1.ObjectReference) {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	if watcher, ok := w.watchers[*cluster]; ok {
+		watcher.cancel()
+		delete(w.watchers, *cluster)
+	}
+	delete(w.backoffs, *cluster)
+}
+
+// stopStaleWatchers stops watchers for all clusters not in clusters
+func (w *reportWatchers) stopStaleWatchers(clusters map[corev1.ObjectReference]bool) {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	for cluster, watcher := range w.watchers {
+		if !clusters[cluster] {
+			watcher.cancel()
+			delete(w.watchers, cluster)
+		}
+	}
+
+	for cluster := range w.backoffs {
+		if !clusters[cluster] {
+			delete(w.backoffs, cluster)
+		}
+	}
+}
+
+// startReportWatcher starts an informer on ClassifierReports in the cluster. Any ClassifierReport
+// created or updated is copied to the management cluster.
+func startReportWatcher(ctx context.Context, c client.Client, cluster *corev1.ObjectReference,
+	logger logr.Logger) (*reportWatcher, error) {
+
+	clusterType := clusterproxy.GetClusterType(cluster)
+	restConfig, err := clusterproxy.GetKubernetesRestConfig(ctx, getManagementClusterClient(),
+		cluster.Namespace, cluster.Name, "", "", clusterType, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	clusterCache, err := cache.New(restConfig, cache.Options{Scheme: c.Scheme()})
+	if err != nil {
+		return nil, err
+	}
+
+	watchCtx, cancel := context.WithCancel(ctx)
+
+	informer, err := clusterCache.GetInformer(watchCtx, &libsveltosv1beta1.ClassifierReport{},
+		cache.BlockUntilSynced(false))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	handle := func(obj interface{}) {
+		report, ok := obj.(*libsveltosv1beta1.ClassifierReport)
+		if !ok {
+			return
+		}
+		// Failures are recorded in metrics. Report is processed again on next update or resync.
+		_ = processCollectedClassifierReport(watchCtx, c, cluster, report, logger)
+	}
+
+	_, err = informer.AddEventHandler(toolscache.ResourceEventHandlerFuncs{
+		AddFunc: handle,
+		UpdateFunc: func(_, newObj interface{}) {
+			handle(newObj)
+		},
+	})
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	watcher := &reportWatcher{
+		cancel:    cancel,
+		done:      make(chan struct{}),
+		informer:  informer,
+		startTime: time.Now(),
+	}
+
+	go func() {
+		defer close(watcher.done)
+		logger.V(logs.LogDebug).Info("starting ClassifierReport watcher")
+		if err := clusterCache.Start(watchCtx); err != nil {
+			logger.V(logs.LogInfo).Info(fmt.Sprintf("ClassifierReport watcher failed: %v", err))
+		}
+		logger.V(logs.LogDebug).Info("ClassifierReport watcher stopped")
+	}()
+
+	return watcher, nil
+}
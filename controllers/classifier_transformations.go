@@ -27,6 +27,7 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 
+	"github.com/projectsveltos/classifier/controllers/keymanager"
 	libsveltosv1beta1 "github.com/projectsveltos/libsveltos/api/v1beta1"
 	logs "github.com/projectsveltos/libsveltos/lib/logsettings"
 )
@@ -215,6 +216,19 @@ func (r *ClassifierReconciler) requeueClassifierForClassifierReport(
 		},
 	}
 
+	// All composite Classifiers referencing this Classifier need to be reevaluated
+	if composites, ok := r.ComposedClassifierMap[report.Spec.ClassifierName]; ok {
+		items := composites.Items()
+		for i := range items {
+			logger.V(logs.LogDebug).Info(fmt.Sprintf("requeuing composite classifier %s", items[i].Name))
+			requests = append(requests, ctrl.Request{
+				NamespacedName: client.ObjectKey{
+					Name: items[i].Name,
+				},
+			})
+		}
+	}
+
 	return requests
 }
 
@@ -236,23 +250,33 @@ func (r *ClassifierReconciler) requeueClassifierForClassifier(
 	defer r.Mux.Unlock()
 
 	// Get all Classifier with at least one conflict
-	requests := make([]ctrl.Request, r.ClassifierSet.Len())
-
+	classifiers := make(map[string]bool)
 	classifierWithConflicts := r.ClassifierSet.Items()
-
 	for i := range classifierWithConflicts {
-		cName := classifierWithConflicts[i].Name
+		classifiers[classifierWithConflicts[i].Name] = true
+	}
 
+	// Get all Classifiers registered for the same labels. A change (priority for instance) to this
+	// Classifier might give them, or take from them, the manager role even if they have no conflict.
+	if manager, ok := keymanager.GetKeyManagerInstanceIfInitialized(); ok {
+		sharing := manager.GetClassifiersSharingLabels(classifier.Name)
+		for i := range sharing {
+			classifiers[sharing[i]] = true
+		}
+	}
+
+	requests := make([]ctrl.Request, 0, len(classifiers))
+	for cName := range classifiers {
 		if cName == classifier.Name {
 			continue
 		}
 
 		logger.V(logs.LogDebug).Info(fmt.Sprintf("queing %s for reconciliation", cName))
-		requests[i] = ctrl.Request{
+		requests = append(requests, ctrl.Request{
 			NamespacedName: client.ObjectKey{
 				Name: cName,
 			},
-		}
+		})
 	}
 
 	return requests
@@ -0,0 +1,455 @@
+/*
+Copyright 2022. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"text/template"
+
+	"github.com/blang/semver/v4"
+	lua "github.com/yuin/gopher-lua"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	"github.com/projectsveltos/classifier/controllers/keymanager"
+	libsveltosv1beta1 "github.com/projectsveltos/libsveltos/api/v1beta1"
+)
+
+//+kubebuilder:webhook:path=/mutate-lib-projectsveltos-io-v1beta1-classifier,mutating=true,failurePolicy=fail,sideEffects=None,groups=lib.projectsveltos.io,resources=classifiers,verbs=create;update,versions=v1beta1,name=mclassifier.projectsveltos.io,admissionReviewVersions=v1
+//+kubebuilder:webhook:path=/validate-lib-projectsveltos-io-v1beta1-classifier,mutating=false,failurePolicy=fail,sideEffects=None,groups=lib.projectsveltos.io,resources=classifiers,verbs=create;update,versions=v1beta1,name=vclassifier.projectsveltos.io,admissionReviewVersions=v1
+
+// ClassifierWebhook validates and defaults Classifier instances
+type ClassifierWebhook struct{}
+
+var (
+	_ admission.CustomValidator = &ClassifierWebhook{}
+	_ admission.CustomDefaulter = &ClassifierWebhook{}
+)
+
+// SetupWebhookWithManager registers Classifier validating and defaulting webhooks
+func (w *ClassifierWebhook) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(&libsveltosv1beta1.Classifier{}).
+		WithValidator(w).
+		WithDefaulter(w).
+		Complete()
+}
+
+// Default sets Comparison to Equal for any KubernetesVersionConstraint not specifying it
+func (w *ClassifierWebhook) Default(ctx context.Context, obj runtime.Object) error {
+	classifier, ok := obj.(*libsveltosv1beta1.Classifier)
+	if !ok {
+		return apierrors.NewBadRequest(fmt.Sprintf("expected a Classifier but got a %T", obj))
+	}
+
+	for i := range classifier.Spec.KubernetesVersionConstraints {
+		if classifier.Spec.KubernetesVersionConstraints[i].Comparison == "" {
+			classifier.Spec.KubernetesVersionConstraints[i].Comparison = string(libsveltosv1beta1.ComparisonEqual)
+		}
+	}
+
+	return nil
+}
+
+// ValidateCreate validates a Classifier on creation
+func (w *ClassifierWebhook) ValidateCreate(ctx context.Context, obj runtime.Object) (admission.Warnings, error) {
+	classifier, ok := obj.(*libsveltosv1beta1.Classifier)
+	if !ok {
+		return nil, apierrors.NewBadRequest(fmt.Sprintf("expected a Classifier but got a %T", obj))
+	}
+
+	return w.validate(classifier, nil)
+}
+
+// ValidateUpdate validates a Classifier on update. Only fields which changed are validated, so
+// Classifiers created before a validation rule was introduced can still be updated (for instance
+// to add or remove finalizers) and deleted.
+func (w *ClassifierWebhook) ValidateUpdate(ctx context.Context, oldObj, newObj runtime.Object,
+) (admission.Warnings, error) {
+
+	oldClassifier, ok := oldObj.(*libsveltosv1beta1.Classifier)
+	if !ok {
+		return nil, apierrors.NewBadRequest(fmt.Sprintf("expected a Classifier but got a %T", oldObj))
+	}
+	classifier, ok := newObj.(*libsveltosv1beta1.Classifier)
+	if !ok {
+		return nil, apierrors.NewBadRequest(fmt.Sprintf("expected a Classifier but got a %T", newObj))
+	}
+
+	if !classifier.DeletionTimestamp.IsZero() {
+		// Classifier is being deleted. Never block finalizers removal.
+		return nil, nil
+	}
+
+	if reflect.DeepEqual(oldClassifier.Spec, classifier.Spec) &&
+		reflect.DeepEqual(oldClassifier.Annotations, classifier.Annotations) {
+
+		return nil, nil
+	}
+
+	return w.validate(classifier, oldClassifier)
+}
+
+// ValidateDelete does nothing. Classifier can always be deleted
+func (w *ClassifierWebhook) ValidateDelete(ctx context.Context, obj runtime.Object) (admission.Warnings, error) {
+	return nil, nil
+}
+
+// validate validates classifier. If oldClassifier is not nil, only fields changed from oldClassifier
+// are validated.
+func (w *ClassifierWebhook) validate(classifier, oldClassifier *libsveltosv1beta1.Classifier,
+) (admission.Warnings, error) {
+
+	annotationChanged := func(key string) bool {
+		return oldClassifier == nil || oldClassifier.Annotations[key] != classifier.Annotations[key]
+	}
+
+	specPath := field.NewPath("spec")
+	annotationsPath := field.NewPath("metadata", "annotations")
+
+	var allErrs field.ErrorList
+	if oldClassifier == nil || !reflect.DeepEqual(oldClassifier.Spec.ClassifierLabels, classifier.Spec.ClassifierLabels) {
+		allErrs = append(allErrs, validateClassifierLabels(classifier.Spec.ClassifierLabels,
+			specPath.Child("classifierLabels"))...)
+	}
+	if oldClassifier == nil || !reflect.DeepEqual(oldClassifier.Spec.KubernetesVersionConstraints,
+		classifier.Spec.KubernetesVersionConstraints) {
+
+		allErrs = append(allErrs, validateKubernetesVersionConstraints(classifier.Spec.KubernetesVersionConstraints,
+			specPath.Child("kubernetesVersionConstraints"))...)
+	}
+	if oldClassifier == nil || !reflect.DeepEqual(oldClassifier.Spec.DeployedResourceConstraint,
+		classifier.Spec.DeployedResourceConstraint) {
+
+		allErrs = append(allErrs, validateDeployedResourceConstraint(classifier.Spec.DeployedResourceConstraint,
+			specPath.Child("deployedResourceConstraint"))...)
+	}
+	if annotationChanged(ClassifierManagementConstraintAnnotation) {
+		allErrs = append(allErrs, validateManagementClusterConstraint(classifier,
+			annotationsPath.Key(ClassifierManagementConstraintAnnotation))...)
+	}
+	if annotationChanged(ClassifierCompositionAnnotation) {
+		allErrs = append(allErrs, validateClassifierComposition(classifier,
+			annotationsPath.Key(ClassifierCompositionAnnotation))...)
+	}
+	if _, err := getClassifierClusterSelector(classifier); err != nil && annotationChanged(ClassifierClusterSelectorAnnotation) {
+		allErrs = append(allErrs, field.Invalid(annotationsPath.Key(ClassifierClusterSelectorAnnotation),
+			classifier.Annotations[ClassifierClusterSelectorAnnotation], err.Error()))
+	}
+	if _, err := getStabilizationWindow(classifier); err != nil && annotationChanged(ClassifierStabilizationWindowAnnotation) {
+		allErrs = append(allErrs, field.Invalid(annotationsPath.Key(ClassifierStabilizationWindowAnnotation),
+			classifier.Annotations[ClassifierStabilizationWindowAnnotation], err.Error()))
+	}
+	if _, err := getLabelChangeRateLimit(classifier); err != nil && annotationChanged(ClassifierLabelChangeRateLimitAnnotation) {
+		allErrs = append(allErrs, field.Invalid(annotationsPath.Key(ClassifierLabelChangeRateLimitAnnotation),
+			classifier.Annotations[ClassifierLabelChangeRateLimitAnnotation], err.Error()))
+	}
+
+	if len(allErrs) != 0 {
+		return nil, apierrors.NewInvalid(libsveltosv1beta1.GroupVersion.WithKind(libsveltosv1beta1.ClassifierKind).GroupKind(),
+			classifier.Name, allErrs)
+	}
+
+	return getClassifierLabelWarnings(classifier), nil
+}
+
+// validateClassifierLabels verifies label keys are valid qualified names and label values are either
+// valid label values or templates which can be parsed.
+func validateClassifierLabels(labels []libsveltosv1beta1.ClassifierLabel, fldPath *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+
+	keys := make(map[string]bool, len(labels))
+	for i := range labels {
+		label := &labels[i]
+		for _, msg := range validation.IsQualifiedName(label.Key) {
+			allErrs = append(allErrs, field.Invalid(fldPath.Index(i).Child("key"), label.Key, msg))
+		}
+		if keys[label.Key] {
+			allErrs = append(allErrs, field.Duplicate(fldPath.Index(i).Child("key"), label.Key))
+		}
+		keys[label.Key] = true
+
+		if isTemplatedLabelValue(label.Value) {
+			// Templated values are rendered per cluster. Only verify template can be parsed.
+			if _, err := template.New(label.Key).Option("missingkey=error").Parse(label.Value); err != nil {
+				allErrs = append(allErrs, field.Invalid(fldPath.Index(i).Child("value"), label.Value,
+					fmt.Sprintf("invalid template: %v", err)))
+			}
+			continue
+		}
+
+		for _, msg := range validation.IsValidLabelValue(label.Value) {
+			allErrs = append(allErrs, field.Invalid(fldPath.Index(i).Child("value"), label.Value, msg))
+		}
+	}
+
+	return allErrs
+}
+
+// parseConstraintVersion parses a KubernetesVersionConstraint version (leading "v" is allowed)
+func parseConstraintVersion(version string) (semver.Version, error) {
+	return semver.Parse(strings.TrimPrefix(version, "v"))
+}
+
+// versionBound is either a lower or an upper bound on the Kubernetes version
+type versionBound struct {
+	version   *semver.Version
+	inclusive bool
+	index     int
+}
+
+// validateKubernetesVersionConstraints verifies all versions are valid semver and that
+// constraints are not contradictory (no Kubernetes version can satisfy all of them).
+func validateKubernetesVersionConstraints(constraints []libsveltosv1beta1.KubernetesVersionConstraint,
+	fldPath *field.Path) field.ErrorList {
+
+	var allErrs field.ErrorList
+
+	lower := versionBound{}
+	upper := versionBound{}
+	var equal []versionBound
+	var notEqual []versionBound
+
+	for i := range constraints {
+		v, err := parseConstraintVersion(constraints[i].Version)
+		if err != nil {
+			allErrs = append(allErrs, field.Invalid(fldPath.Index(i).Child("version"), constraints[i].Version,
+				fmt.Sprintf("not a valid semantic version: %v", err)))
+			continue
+		}
+
+		current := versionBound{version: &v, index: i}
+		switch libsveltosv1beta1.KubernetesComparison(constraints[i].Comparison) {
+		case libsveltosv1beta1.ComparisonEqual, "":
+			equal = append(equal, current)
+		case libsveltosv1beta1.ComparisonNotEqual:
+			notEqual = append(notEqual, current)
+		case libsveltosv1beta1.ComparisonGreaterThan:
+			lower = tighterLowerBound(lower, current)
+		case libsveltosv1beta1.ComparisonGreaterThanOrEqualTo:
+			current.inclusive = true
+			lower = tighterLowerBound(lower, current)
+		case libsveltosv1beta1.ComparisonLessThan:
+			upper = tighterUpperBound(upper, current)
+		case libsveltosv1beta1.ComparisonLessThanOrEqualTo:
+			current.inclusive = true
+			upper = tighterUpperBound(upper, current)
+		default:
+			allErrs = append(allErrs, field.NotSupported(fldPath.Index(i).Child("comparison"),
+				constraints[i].Comparison, []string{
+					string(libsveltosv1beta1.ComparisonEqual), string(libsveltosv1beta1.ComparisonNotEqual),
+					string(libsveltosv1beta1.ComparisonGreaterThan), string(libsveltosv1beta1.ComparisonLessThan),
+					string(libsveltosv1beta1.ComparisonGreaterThanOrEqualTo),
+					string(libsveltosv1beta1.ComparisonLessThanOrEqualTo),
+				}))
+		}
+	}
+
+	if len(allErrs) != 0 {
+		return allErrs
+	}
+
+	if lower.version != nil && upper.version != nil {
+		cmp := lower.version.Compare(*upper.version)
+		if cmp > 0 || (cmp == 0 && (!lower.inclusive || !upper.inclusive)) {
+			allErrs = append(allErrs, field.Invalid(fldPath.Index(upper.index), constraints[upper.index],
+				fmt.Sprintf("contradicts constraint %d: no version can satisfy both", lower.index)))
+			return allErrs
+		}
+	}
+
+	for i := range equal {
+		if msg := checkEqualConstraint(&equal[i], equal, notEqual, lower, upper); msg != "" {
+			allErrs = append(allErrs, field.Invalid(fldPath.Index(equal[i].index), constraints[equal[i].index], msg))
+		}
+	}
+
+	return allErrs
+}
+
+// checkEqualConstraint returns a message if the Equal constraint contradicts any other constraint
+func checkEqualConstraint(eq *versionBound, equal, notEqual []versionBound, lower, upper versionBound) string {
+	for i := range equal {
+		if !eq.version.EQ(*equal[i].version) {
+			return fmt.Sprintf("contradicts constraint %d: version cannot be equal to both", equal[i].index)
+		}
+	}
+	for i := range notEqual {
+		if eq.version.EQ(*notEqual[i].version) {
+			return fmt.Sprintf("contradicts constraint %d: version cannot be both equal and not equal to %s",
+				notEqual[i].index, eq.version.String())
+		}
+	}
+	if lower.version != nil {
+		cmp := eq.version.Compare(*lower.version)
+		if cmp < 0 || (cmp == 0 && !lower.inclusive) {
+			return fmt.Sprintf("contradicts constraint %d", lower.index)
+		}
+	}
+	if upper.version != nil {
+		cmp := eq.version.Compare(*upper.version)
+		if cmp > 0 || (cmp == 0 && !upper.inclusive) {
+			return fmt.Sprintf("contradicts constraint %d", upper.index)
+		}
+	}
+	return ""
+}
+
+// tighterLowerBound returns the most restrictive of two lower bounds
+func tighterLowerBound(current, candidate versionBound) versionBound {
+	if current.version == nil {
+		return candidate
+	}
+	cmp := candidate.version.Compare(*current.version)
+	if cmp > 0 || (cmp == 0 && !candidate.inclusive) {
+		return candidate
+	}
+	return current
+}
+
+// tighterUpperBound returns the most restrictive of two upper bounds
+func tighterUpperBound(current, candidate versionBound) versionBound {
+	if current.version == nil {
+		return candidate
+	}
+	cmp := candidate.version.Compare(*current.version)
+	if cmp < 0 || (cmp == 0 && !candidate.inclusive) {
+		return candidate
+	}
+	return current
+}
+
+// validateDeployedResourceConstraint verifies all Lua scripts compile
+func validateDeployedResourceConstraint(constraint *libsveltosv1beta1.DeployedResourceConstraint,
+	fldPath *field.Path) field.ErrorList {
+
+	if constraint == nil {
+		return nil
+	}
+
+	var allErrs field.ErrorList
+	for i := range constraint.ResourceSelectors {
+		script := constraint.ResourceSelectors[i].Evaluate
+		if err := compileLuaScript(script); err != nil {
+			allErrs = append(allErrs, field.Invalid(fldPath.Child("resourceSelectors").Index(i).Child("evaluate"),
+				script, fmt.Sprintf("lua script does not compile: %v", err)))
+		}
+	}
+
+	if err := compileLuaScript(constraint.AggregatedClassification); err != nil {
+		allErrs = append(allErrs, field.Invalid(fldPath.Child("aggregatedClassification"),
+			constraint.AggregatedClassification, fmt.Sprintf("lua script does not compile: %v", err)))
+	}
+
+	return allErrs
+}
+
+// validateManagementClusterConstraint verifies ManagementClusterConstraint (if any) can be parsed and
+// contains a valid cluster selector and valid version constraints
+func validateManagementClusterConstraint(classifier *libsveltosv1beta1.Classifier,
+	fldPath *field.Path) field.ErrorList {
+
+	constraint, err := getManagementClusterConstraint(classifier)
+	if err != nil {
+		return field.ErrorList{field.Invalid(fldPath, classifier.Annotations[ClassifierManagementConstraintAnnotation],
+			err.Error())}
+	}
+	if constraint == nil {
+		return nil
+	}
+
+	var allErrs field.ErrorList
+	if constraint.ClusterSelector != nil {
+		if _, err := metav1.LabelSelectorAsSelector(constraint.ClusterSelector); err != nil {
+			allErrs = append(allErrs, field.Invalid(fldPath, classifier.Annotations[ClassifierManagementConstraintAnnotation],
+				fmt.Sprintf("invalid clusterSelector: %v", err)))
+		}
+	}
+
+	allErrs = append(allErrs, validateKubernetesVersionConstraints(constraint.KubernetesVersionConstraints,
+		fldPath.Child("kubernetesVersionConstraints"))...)
+
+	return allErrs
+}
+
+// validateClassifierComposition verifies composition (if any) is valid and does not reference
+// Classifier itself. Cycles involving other Classifiers are detected by the controller.
+func validateClassifierComposition(classifier *libsveltosv1beta1.Classifier, fldPath *field.Path) field.ErrorList {
+	composition, err := getClassifierComposition(classifier)
+	if err != nil {
+		return field.ErrorList{field.Invalid(fldPath, classifier.Annotations[ClassifierCompositionAnnotation],
+			err.Error())}
+	}
+	if composition == nil {
+		return nil
+	}
+
+	if composition.getReferencedClassifiers()[classifier.Name] {
+		return field.ErrorList{field.Invalid(fldPath, classifier.Annotations[ClassifierCompositionAnnotation],
+			"composite Classifier cannot reference itself")}
+	}
+
+	return nil
+}
+
+// compileLuaScript returns an error if script does not compile. Script is not executed.
+func compileLuaScript(script string) error {
+	if script == "" {
+		return nil
+	}
+
+	l := lua.NewState(lua.Options{SkipOpenLibs: true})
+	defer l.Close()
+
+	_, err := l.LoadString(script)
+	return err
+}
+
+// getClassifierLabelWarnings returns a warning for every label key already managed by a different
+// Classifier according to keymanager.
+// Warnings are best-effort: keymanager only runs on the leader, so when the request is served by
+// any other replica no warning is returned. Warnings are informational only and never used to
+// reject a Classifier; conflicts are always resolved (and reported) by the Classifier controller.
+func getClassifierLabelWarnings(classifier *libsveltosv1beta1.Classifier) admission.Warnings {
+	manager, ok := keymanager.GetKeyManagerInstanceIfInitialized()
+	if !ok {
+		return nil
+	}
+
+	var warnings admission.Warnings
+	for i := range classifier.Spec.ClassifierLabels {
+		key := classifier.Spec.ClassifierLabels[i].Key
+		for _, owner := range manager.GetManagersForKey(key) {
+			if owner == classifier.Name {
+				continue
+			}
+			warnings = append(warnings,
+				fmt.Sprintf("label %s is already managed by Classifier %s. It will not be managed by %s in clusters where that is the case",
+					key, owner, classifier.Name))
+		}
+	}
+
+	return warnings
+}
@@ -0,0 +1,194 @@
+/*
+Copyright 2022. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers_test
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/projectsveltos/classifier/controllers"
+	"github.com/projectsveltos/classifier/controllers/keymanager"
+	libsveltosv1beta1 "github.com/projectsveltos/libsveltos/api/v1beta1"
+)
+
+var _ = Describe("Classifier webhook", func() {
+	var classifierWebhook *controllers.ClassifierWebhook
+
+	BeforeEach(func() {
+		classifierWebhook = &controllers.ClassifierWebhook{}
+	})
+
+	It("Default sets empty comparison to Equal", func() {
+		classifier := getClassifierInstance(randomString())
+		classifier.Spec.KubernetesVersionConstraints = append(classifier.Spec.KubernetesVersionConstraints,
+			libsveltosv1beta1.KubernetesVersionConstraint{Version: "1.26.0"})
+
+		Expect(classifierWebhook.Default(context.TODO(), classifier)).To(Succeed())
+		for i := range classifier.Spec.KubernetesVersionConstraints {
+			Expect(classifier.Spec.KubernetesVersionConstraints[i].Comparison).To(
+				Equal(string(libsveltosv1beta1.ComparisonEqual)))
+		}
+	})
+
+	It("ValidateCreate accepts a valid Classifier", func() {
+		classifier := getClassifierInstance(randomString())
+		classifier.Spec.ClassifierLabels = append(classifier.Spec.ClassifierLabels,
+			libsveltosv1beta1.ClassifierLabel{Key: "projectsveltos.io/minor", Value: "{{ .KubernetesVersion.Minor }}"})
+		classifier.Spec.DeployedResourceConstraint = &libsveltosv1beta1.DeployedResourceConstraint{
+			ResourceSelectors: []libsveltosv1beta1.ResourceSelector{
+				{
+					Kind:     "Pod",
+					Version:  "v1",
+					Evaluate: `function evaluate() hs = {} hs.matching = true return hs end`,
+				},
+			},
+		}
+
+		_, err := classifierWebhook.ValidateCreate(context.TODO(), classifier)
+		Expect(err).To(BeNil())
+	})
+
+	It("ValidateCreate rejects malformed labels", func() {
+		classifier := getClassifierInstance(randomString())
+		classifier.Spec.ClassifierLabels = []libsveltosv1beta1.ClassifierLabel{
+			{Key: "not a valid key", Value: "value"},
+		}
+		_, err := classifierWebhook.ValidateCreate(context.TODO(), classifier)
+		Expect(err).ToNot(BeNil())
+
+		classifier.Spec.ClassifierLabels = []libsveltosv1beta1.ClassifierLabel{
+			{Key: "env", Value: "not/valid"},
+		}
+		_, err = classifierWebhook.ValidateCreate(context.TODO(), classifier)
+		Expect(err).ToNot(BeNil())
+
+		classifier.Spec.ClassifierLabels = []libsveltosv1beta1.ClassifierLabel{
+			{Key: "env", Value: "{{ .ClusterName "},
+		}
+		_, err = classifierWebhook.ValidateCreate(context.TODO(), classifier)
+		Expect(err).ToNot(BeNil())
+	})
+
+	It("ValidateCreate rejects invalid and contradictory version constraints", func() {
+		classifier := getClassifierInstance(randomString())
+		classifier.Spec.KubernetesVersionConstraints = []libsveltosv1beta1.KubernetesVersionConstraint{
+			{Version: "1.26", Comparison: string(libsveltosv1beta1.ComparisonEqual)},
+		}
+		_, err := classifierWebhook.ValidateCreate(context.TODO(), classifier)
+		Expect(err).ToNot(BeNil())
+
+		classifier.Spec.KubernetesVersionConstraints = []libsveltosv1beta1.KubernetesVersionConstraint{
+			{Version: "1.26.0", Comparison: string(libsveltosv1beta1.ComparisonGreaterThanOrEqualTo)},
+			{Version: "1.25.0", Comparison: string(libsveltosv1beta1.ComparisonLessThan)},
+		}
+		_, err = classifierWebhook.ValidateCreate(context.TODO(), classifier)
+		Expect(err).ToNot(BeNil())
+
+		classifier.Spec.KubernetesVersionConstraints = []libsveltosv1beta1.KubernetesVersionConstraint{
+			{Version: "1.26.0", Comparison: string(libsveltosv1beta1.ComparisonGreaterThanOrEqualTo)},
+			{Version: "v1.26.0", Comparison: string(libsveltosv1beta1.ComparisonLessThanOrEqualTo)},
+			{Version: "1.26.0", Comparison: string(libsveltosv1beta1.ComparisonNotEqual)},
+			{Version: "1.26.0", Comparison: string(libsveltosv1beta1.ComparisonEqual)},
+		}
+		_, err = classifierWebhook.ValidateCreate(context.TODO(), classifier)
+		Expect(err).ToNot(BeNil())
+
+		classifier.Spec.KubernetesVersionConstraints = []libsveltosv1beta1.KubernetesVersionConstraint{
+			{Version: "1.26.0", Comparison: string(libsveltosv1beta1.ComparisonGreaterThanOrEqualTo)},
+			{Version: "v1.26.0", Comparison: string(libsveltosv1beta1.ComparisonLessThanOrEqualTo)},
+			{Version: "1.26.0", Comparison: string(libsveltosv1beta1.ComparisonEqual)},
+		}
+		_, err = classifierWebhook.ValidateCreate(context.TODO(), classifier)
+		Expect(err).To(BeNil())
+	})
+
+	It("ValidateCreate rejects lua scripts which do not compile", func() {
+		classifier := getClassifierInstance(randomString())
+		classifier.Spec.DeployedResourceConstraint = &libsveltosv1beta1.DeployedResourceConstraint{
+			ResourceSelectors: []libsveltosv1beta1.ResourceSelector{
+				{Kind: "Pod", Version: "v1"},
+			},
+			AggregatedClassification: `function evaluate() hs = {} hs.matching = true return hs`,
+		}
+		_, err := classifierWebhook.ValidateCreate(context.TODO(), classifier)
+		Expect(err).ToNot(BeNil())
+	})
+
+	It("ValidateCreate warns about label keys managed by other Classifiers", func() {
+		labelKey := randomString()
+		otherClassifier := getClassifierInstance(randomString())
+		otherClassifier.Spec.ClassifierLabels = []libsveltosv1beta1.ClassifierLabel{{Key: labelKey, Value: "a"}}
+		classifier := getClassifierInstance(randomString())
+		classifier.Spec.ClassifierLabels = []libsveltosv1beta1.ClassifierLabel{{Key: labelKey, Value: "b"}}
+
+		initObjects := []client.Object{otherClassifier}
+		c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(initObjects...).Build()
+
+		manager, err := keymanager.GetKeyManagerInstance(context.TODO(), c)
+		Expect(err).To(BeNil())
+		clusterNamespace := randomString()
+		clusterName := randomString()
+		manager.RegisterClassifierForLabels(otherClassifier, clusterNamespace, clusterName,
+			libsveltosv1beta1.ClusterTypeCapi)
+		defer manager.RemoveAllRegistrations(otherClassifier, clusterNamespace, clusterName,
+			libsveltosv1beta1.ClusterTypeCapi)
+
+		warnings, err := classifierWebhook.ValidateCreate(context.TODO(), classifier)
+		Expect(err).To(BeNil())
+		Expect(warnings).To(HaveLen(1))
+		Expect(warnings[0]).To(ContainSubstring(otherClassifier.Name))
+	})
+
+	It("ValidateUpdate only validates changed fields and never blocks deletion", func() {
+		oldClassifier := getClassifierInstance(randomString())
+		// Created before label validation was introduced
+		oldClassifier.Spec.ClassifierLabels = []libsveltosv1beta1.ClassifierLabel{
+			{Key: "env", Value: "not/valid"},
+		}
+
+		// Adding a finalizer is allowed
+		classifier := oldClassifier.DeepCopy()
+		classifier.Finalizers = []string{libsveltosv1beta1.ClassifierFinalizer}
+		_, err := classifierWebhook.ValidateUpdate(context.TODO(), oldClassifier, classifier)
+		Expect(err).To(BeNil())
+
+		// Changing a valid field is allowed
+		classifier.Spec.KubernetesVersionConstraints = []libsveltosv1beta1.KubernetesVersionConstraint{
+			{Version: "1.26.0", Comparison: string(libsveltosv1beta1.ComparisonEqual)},
+		}
+		_, err = classifierWebhook.ValidateUpdate(context.TODO(), oldClassifier, classifier)
+		Expect(err).To(BeNil())
+
+		// Changing labels validates them
+		classifier.Spec.ClassifierLabels = append(classifier.Spec.ClassifierLabels,
+			libsveltosv1beta1.ClassifierLabel{Key: "zone", Value: "a"})
+		_, err = classifierWebhook.ValidateUpdate(context.TODO(), oldClassifier, classifier)
+		Expect(err).ToNot(BeNil())
+
+		// Classifier being deleted is never rejected
+		now := metav1.Now()
+		classifier.DeletionTimestamp = &now
+		_, err = classifierWebhook.ValidateUpdate(context.TODO(), oldClassifier, classifier)
+		Expect(err).To(BeNil())
+	})
+})
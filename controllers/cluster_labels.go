@@ -0,0 +1,407 @@
+/*
+Copyright 2022. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/projectsveltos/classifier/controllers/keymanager"
+	libsveltosv1beta1 "github.com/projectsveltos/libsveltos/api/v1beta1"
+	"github.com/projectsveltos/libsveltos/lib/clusterproxy"
+	logs "github.com/projectsveltos/libsveltos/lib/logsettings"
+)
+
+const (
+	// classifierFieldManagerPrefix is the prefix of the field manager each Classifier uses to
+	// apply labels on clusters
+	classifierFieldManagerPrefix = "classifier-"
+
+	// maxFieldManagerLength is the maximum length of a field manager accepted by the API server
+	maxFieldManagerLength = 128
+
+	// UserAgent is the user agent classifier uses to talk to the management cluster. API server
+	// derives from it the field manager of any change classifier makes with client Update/Patch.
+	// It must differ from legacyFieldManager.
+	UserAgent = "classifier-manager"
+
+	// legacyFieldManager is the field manager owning labels set by versions which updated clusters with
+	// client Update. API server derived it from the default user agent, which starts with the binary
+	// name. Other Sveltos controllers share it, so only the labels keymanager assigns to a Classifier
+	// are moved from it to the Classifier field manager (and removed once the Classifier stops managing them).
+	legacyFieldManager = "manager"
+)
+
+// labelKeyManager is the subset of keymanager used to find out whether a label (key) is
+// currently managed by any Classifier
+type labelKeyManager interface {
+	GetManagerForKey(clusterNamespace, clusterName, labelKey string,
+		clusterType libsveltosv1beta1.ClusterType) (string, error)
+}
+
+// getClassifierFieldManager returns the field manager used by a Classifier to apply labels on clusters
+func getClassifierFieldManager(classifierName string) string {
+	fieldManager := classifierFieldManagerPrefix + classifierName
+	if len(fieldManager) <= maxFieldManagerLength {
+		return fieldManager
+	}
+
+	h := sha256.Sum256([]byte(classifierName))
+	return fmt.Sprintf("%s%x", classifierFieldManagerPrefix, h[:16])
+}
+
+// getAppliedLabels returns the keys of the labels fieldManager owns on the cluster via server-side apply
+func getAppliedLabels(cluster client.Object, fieldManager string, logger logr.Logger) map[string]bool {
+	return getManagedLabels(cluster, fieldManager, metav1.ManagedFieldsOperationApply, logger)
+}
+
+// getLegacyLabels returns the keys of the labels owned on the cluster by legacyFieldManager
+func getLegacyLabels(cluster client.Object, logger logr.Logger) map[string]bool {
+	return getManagedLabels(cluster, legacyFieldManager, metav1.ManagedFieldsOperationUpdate, logger)
+}
+
+// getManagedLabels returns the keys of the labels fieldManager owns on the cluster with operation
+func getManagedLabels(cluster client.Object, fieldManager string, operation metav1.ManagedFieldsOperationType,
+	logger logr.Logger) map[string]bool {
+
+	managed := make(map[string]bool)
+
+	managedFields := cluster.GetManagedFields()
+	for i := range managedFields {
+		entry := &managedFields[i]
+		if entry.Manager != fieldManager || entry.Operation != operation || entry.FieldsV1 == nil {
+			continue
+		}
+
+		fields := make(map[string]interface{})
+		if err := json.Unmarshal(entry.FieldsV1.Raw, &fields); err != nil {
+			logger.V(logs.LogInfo).Info(fmt.Sprintf("failed to parse managedFields of %s: %v", fieldManager, err))
+			continue
+		}
+
+		for k := range getLabelFields(fields) {
+			if key, found := strings.CutPrefix(k, "f:"); found {
+				managed[key] = true
+			}
+		}
+	}
+
+	return managed
+}
+
+// getLabelFields returns the labels section of a managedFields entry fields. Nil if not present.
+func getLabelFields(fields map[string]interface{}) map[string]interface{} {
+	metadata, ok := fields["f:metadata"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	labels, ok := metadata["f:labels"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	return labels
+}
+
+// isLabelApplyNeeded returns true if labels applied by a Classifier on a cluster need to change to
+// match the desired ones. applied contains the keys of the labels currently owned by the Classifier
+// and current the labels currently on the cluster.
+func isLabelApplyNeeded(desired map[string]string, applied map[string]bool, current map[string]string) bool {
+	for key, value := range desired {
+		if !applied[key] {
+			return true
+		}
+		if v, ok := current[key]; !ok || v != value {
+			return true
+		}
+	}
+
+	for key := range applied {
+		if _, ok := desired[key]; !ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// releaseLegacyLabels removes labelKeys from the labels owned on the cluster by legacyFieldManager.
+// Once Classifier owns those labels via server-side apply, this leaves the Classifier field manager as
+// their only owner. managedFields entries left without any field are dropped.
+func (r *ClassifierReconciler) releaseLegacyLabels(ctx context.Context, cluster client.Object,
+	labelKeys map[string]bool, logger logr.Logger) error {
+
+	managedFields := cluster.GetManagedFields()
+	updated := make([]metav1.ManagedFieldsEntry, 0, len(managedFields))
+	for i := range managedFields {
+		entry := managedFields[i]
+		if entry.Manager != legacyFieldManager || entry.Operation != metav1.ManagedFieldsOperationUpdate ||
+			entry.FieldsV1 == nil {
+
+			updated = append(updated, entry)
+			continue
+		}
+
+		fields := make(map[string]interface{})
+		if err := json.Unmarshal(entry.FieldsV1.Raw, &fields); err != nil {
+			updated = append(updated, entry)
+			continue
+		}
+
+		labels := getLabelFields(fields)
+		if labels == nil {
+			updated = append(updated, entry)
+			continue
+		}
+		for key := range labelKeys {
+			delete(labels, "f:"+key)
+		}
+		metadata := fields["f:metadata"].(map[string]interface{})
+		if len(labels) == 0 {
+			delete(metadata, "f:labels")
+		}
+		if len(metadata) == 0 {
+			delete(fields, "f:metadata")
+		}
+		if len(fields) == 0 {
+			continue
+		}
+
+		raw, err := json.Marshal(fields)
+		if err != nil {
+			return err
+		}
+		entry.FieldsV1 = &metav1.FieldsV1{Raw: raw}
+		updated = append(updated, entry)
+	}
+
+	patch, err := json.Marshal([]map[string]interface{}{
+		{"op": "test", "path": "/metadata/resourceVersion", "value": cluster.GetResourceVersion()},
+		{"op": "replace", "path": "/metadata/managedFields", "value": updated},
+	})
+	if err != nil {
+		return err
+	}
+
+	logger.V(logs.LogDebug).Info(fmt.Sprintf("releasing ownership of labels set by %s", legacyFieldManager))
+	return r.Patch(ctx, cluster, client.RawPatch(types.JSONPatchType, patch))
+}
+
+// recordLabelRemovedEvents emits an Event for every label removed from the cluster
+func (r *ClassifierReconciler) recordLabelRemovedEvents(classifier *libsveltosv1beta1.Classifier,
+	cluster client.Object, clusterType libsveltosv1beta1.ClusterType, removed []string) {
+
+	for i := range removed {
+		r.recordEvent(classifier, corev1.EventTypeNormal, labelRemovedReason,
+			"label %s removed from cluster %s:%s/%s", removed[i], clusterType, cluster.GetNamespace(), cluster.GetName())
+	}
+}
+
+// getClusterGVK returns the GroupVersionKind of a cluster given its type
+func getClusterGVK(clusterType libsveltosv1beta1.ClusterType) schema.GroupVersionKind {
+	if clusterType == libsveltosv1beta1.ClusterTypeCapi {
+		return clusterv1.GroupVersion.WithKind("Cluster")
+	}
+	return libsveltosv1beta1.GroupVersion.WithKind(libsveltosv1beta1.SveltosClusterKind)
+}
+
+// getClusterRef returns a reference to a cluster given its type
+func getClusterRef(cluster client.Object, clusterType libsveltosv1beta1.ClusterType) *corev1.ObjectReference {
+	apiVersion, kind := getClusterGVK(clusterType).ToAPIVersionAndKind()
+	return &corev1.ObjectReference{
+		Namespace:  cluster.GetNamespace(),
+		Name:       cluster.GetName(),
+		Kind:       kind,
+		APIVersion: apiVersion,
+	}
+}
+
+// applyClusterLabels makes desired the set of labels the Classifier owns on the cluster.
+// Labels are applied with server-side apply using the Classifier field manager. Labels the Classifier
+// owned and which are not in desired anymore are removed by relinquishing their ownership (a label
+// still owned by another field manager is left on the cluster).
+// desired only contains labels keymanager assigned to the Classifier. Ownership of those is forced
+// only if applying them conflicts with another field manager.
+// Nothing is sent to the API server when the Classifier already owns exactly the desired labels.
+// If rateLimited is true, labels are changed only if allowed by label change rate limits. Otherwise
+// the change stays queued.
+func (r *ClassifierReconciler) applyClusterLabels(ctx context.Context, classifier *libsveltosv1beta1.Classifier,
+	cluster client.Object, clusterType libsveltosv1beta1.ClusterType, desired map[string]string,
+	manager labelKeyManager, rateLimited bool, logger logr.Logger) error {
+
+	fieldManager := getClassifierFieldManager(classifier.Name)
+	applied := getAppliedLabels(cluster, fieldManager, logger)
+	currentLabels := make(map[string]string)
+	for k, v := range cluster.GetLabels() {
+		currentLabels[k] = v
+	}
+
+	if isLabelApplyNeeded(desired, applied, currentLabels) {
+		var reservation *labelChangeReservation
+		if rateLimited {
+			var err error
+			reservation, err = r.canChangeLabels(classifier, getClusterRef(cluster, clusterType), logger)
+			if err != nil || reservation == nil {
+				return err
+			}
+		}
+
+		u, err := r.applyLabels(ctx, classifier, cluster, clusterType, desired, manager, logger)
+		if err != nil {
+			logger.V(logs.LogInfo).Info(fmt.Sprintf("failed to apply labels: %v", err))
+			labelRateLimiter.release(reservation)
+			return err
+		}
+
+		for key, value := range desired {
+			if current, ok := currentLabels[key]; (!ok || current != value) && u.GetLabels()[key] == value {
+				r.recordEvent(classifier, corev1.EventTypeNormal, labelAppliedReason,
+					"label %s=%s set on cluster %s:%s/%s", key, value, clusterType,
+					cluster.GetNamespace(), cluster.GetName())
+			}
+		}
+
+		removed := make([]string, 0)
+		for key := range applied {
+			if _, ok := u.GetLabels()[key]; !ok {
+				removed = append(removed, key)
+			}
+		}
+		sort.Strings(removed)
+		r.recordLabelRemovedEvents(classifier, cluster, clusterType, removed)
+
+		cluster = u
+	}
+
+	// Labels set by versions updating clusters are also owned by legacyFieldManager. Now that
+	// Classifier owns them as well, release that ownership (only for labels keymanager assigns
+	// to this Classifier).
+	legacy := getLegacyLabels(cluster, logger)
+	toRelease := make(map[string]bool)
+	for key := range desired {
+		if !legacy[key] {
+			continue
+		}
+		owner, err := manager.GetManagerForKey(cluster.GetNamespace(), cluster.GetName(), key, clusterType)
+		if err == nil && owner == classifier.Name {
+			toRelease[key] = true
+		}
+	}
+	if len(toRelease) == 0 {
+		return nil
+	}
+
+	return r.releaseLegacyLabels(ctx, cluster, toRelease, logger)
+}
+
+// applyLabels applies desired labels on the cluster with the Classifier field manager. On conflicts,
+// ownership is forced for the labels keymanager (still) assigns to the Classifier. Other labels are
+// not applied.
+// Returns the cluster as returned by the API server.
+func (r *ClassifierReconciler) applyLabels(ctx context.Context, classifier *libsveltosv1beta1.Classifier,
+	cluster client.Object, clusterType libsveltosv1beta1.ClusterType, desired map[string]string,
+	manager labelKeyManager, logger logr.Logger) (*unstructured.Unstructured, error) {
+
+	fieldManager := getClassifierFieldManager(classifier.Name)
+	getApplyConfiguration := func(labels map[string]string) *unstructured.Unstructured {
+		u := &unstructured.Unstructured{}
+		u.SetGroupVersionKind(getClusterGVK(clusterType))
+		u.SetNamespace(cluster.GetNamespace())
+		u.SetName(cluster.GetName())
+		if len(labels) != 0 {
+			u.SetLabels(labels)
+		}
+		return u
+	}
+
+	logger.V(logs.LogDebug).Info(fmt.Sprintf("applying labels with field manager %s", fieldManager))
+	u := getApplyConfiguration(desired)
+	err := r.Patch(ctx, u, client.Apply, client.FieldOwner(fieldManager))
+	if err == nil || !apierrors.IsConflict(err) {
+		return u, err
+	}
+
+	logger.V(logs.LogDebug).Info(fmt.Sprintf("conflict applying labels: %v", err))
+	assigned := make(map[string]string)
+	for key, value := range desired {
+		owner, managerErr := manager.GetManagerForKey(cluster.GetNamespace(), cluster.GetName(), key, clusterType)
+		if managerErr == nil && owner == classifier.Name {
+			assigned[key] = value
+		}
+	}
+
+	u = getApplyConfiguration(assigned)
+	err = r.Patch(ctx, u, client.Apply, client.FieldOwner(fieldManager), client.ForceOwnership)
+	return u, err
+}
+
+// removeLabelsFromCluster removes from the cluster all labels set by the Classifier.
+// It is invoked when the Classifier does not match the cluster anymore or when the Classifier is deleted
+// (in both cases Classifier registrations with keymanager must be removed first).
+func (r *ClassifierReconciler) removeLabelsFromCluster(ctx context.Context,
+	classifier *libsveltosv1beta1.Classifier, ref *corev1.ObjectReference, logger logr.Logger) error {
+
+	manager, err := keymanager.GetKeyManagerInstance(ctx, r.Client)
+	if err != nil {
+		logger.V(logs.LogInfo).Error(err, "failed to get label key manager")
+		return err
+	}
+
+	clusterType := clusterproxy.GetClusterType(ref)
+	cluster, err := clusterproxy.GetCluster(ctx, r.Client, ref.Namespace, ref.Name, clusterType)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		logger.V(logs.LogInfo).Error(err, fmt.Sprintf("failed to get cluster %s/%s", ref.Namespace, ref.Name))
+		return err
+	}
+
+	l := logger.WithValues("cluster", fmt.Sprintf("%s/%s", cluster.GetNamespace(), cluster.GetName()))
+	l.V(logs.LogDebug).Info("remove labels from cluster")
+	// Label changes caused by a cluster not matching anymore are accounted for when the match
+	// change is acted upon. Labels set by a deleted Classifier are always removed.
+	return r.applyClusterLabels(ctx, classifier, cluster, clusterType, nil, manager, false, l)
+}
+
+// removeLabelsFromMatchingClusters removes labels set by the Classifier from all clusters
+// currently matching it
+func (r *ClassifierReconciler) removeLabelsFromMatchingClusters(ctx context.Context,
+	classifier *libsveltosv1beta1.Classifier, logger logr.Logger) error {
+
+	for i := range classifier.Status.MachingClusterStatuses {
+		ref := &classifier.Status.MachingClusterStatuses[i].ClusterRef
+		if err := r.removeLabelsFromCluster(ctx, classifier, ref, logger); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
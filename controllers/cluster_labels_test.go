@@ -0,0 +1,118 @@
+/*
+Copyright 2022. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog/v2/textlogger"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/projectsveltos/classifier/controllers"
+	libsveltosv1beta1 "github.com/projectsveltos/libsveltos/api/v1beta1"
+)
+
+var _ = Describe("Classifier cluster labels", func() {
+	It("getAppliedLabels returns labels owned by field manager and isLabelApplyNeeded detects no-op", func() {
+		fieldManager := controllers.GetClassifierFieldManager(randomString())
+		Expect(fieldManager).To(HavePrefix("classifier-"))
+		Expect(len(controllers.GetClassifierFieldManager(strings.Repeat("a", 253)))).To(BeNumerically("<=", 128))
+
+		key := randomString()
+		cluster := &libsveltosv1beta1.SveltosCluster{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: randomString(),
+				Name:      randomString(),
+				Labels:    map[string]string{key: "true"},
+				ManagedFields: []metav1.ManagedFieldsEntry{
+					{
+						Manager:    fieldManager,
+						Operation:  metav1.ManagedFieldsOperationApply,
+						FieldsType: "FieldsV1",
+						FieldsV1:   &metav1.FieldsV1{Raw: []byte(fmt.Sprintf(`{"f:metadata":{"f:labels":{"f:%s":{}}}}`, key))},
+					},
+					{
+						Manager:    randomString(),
+						Operation:  metav1.ManagedFieldsOperationApply,
+						FieldsType: "FieldsV1",
+						FieldsV1:   &metav1.FieldsV1{Raw: []byte(`{"f:metadata":{"f:labels":{"f:other":{}}}}`)},
+					},
+				},
+			},
+		}
+
+		logger := textlogger.NewLogger(textlogger.NewConfig(textlogger.Verbosity(1)))
+		applied := controllers.GetAppliedLabels(cluster, fieldManager, logger)
+		Expect(applied).To(Equal(map[string]bool{key: true}))
+
+		Expect(controllers.IsLabelApplyNeeded(map[string]string{key: "true"}, applied, cluster.Labels)).To(BeFalse())
+		Expect(controllers.IsLabelApplyNeeded(map[string]string{key: "false"}, applied, cluster.Labels)).To(BeTrue())
+		Expect(controllers.IsLabelApplyNeeded(map[string]string{key: "true", "other": "true"}, applied,
+			cluster.Labels)).To(BeTrue())
+		Expect(controllers.IsLabelApplyNeeded(map[string]string{}, applied, cluster.Labels)).To(BeTrue())
+	})
+
+	It("updateLabelsOnMatchingClusters does not patch clusters when labels are already applied", func() {
+		classifier := getClassifierInstance(randomString())
+		for i := range classifier.Spec.ClassifierLabels {
+			classifier.Spec.ClassifierLabels[i].Key = randomString()
+		}
+
+		cluster := &libsveltosv1beta1.SveltosCluster{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: randomString(),
+				Name:      randomString(),
+			},
+		}
+		clusterRef := corev1.ObjectReference{
+			Namespace: cluster.Namespace, Name: cluster.Name,
+			Kind: libsveltosv1beta1.SveltosClusterKind, APIVersion: libsveltosv1beta1.GroupVersion.String(),
+		}
+		classifier.Status.MachingClusterStatuses = []libsveltosv1beta1.MachingClusterStatus{{ClusterRef: clusterRef}}
+
+		c := getFakeClientWithApply(classifier, cluster)
+		reconciler := getClassifierReconciler(c, nil)
+		logger := textlogger.NewLogger(textlogger.NewConfig(textlogger.Verbosity(1)))
+		classifierScope := getClassifierScope(c, logger, classifier)
+
+		Expect(controllers.HandleLabelRegistrations(reconciler, context.TODO(), classifier,
+			map[corev1.ObjectReference]bool{clusterRef: true}, map[corev1.ObjectReference]bool{}, logger)).To(Succeed())
+		Expect(controllers.UpdateLabelsOnMatchingClusters(reconciler, context.TODO(), classifierScope, logger)).To(Succeed())
+
+		currentCluster := &libsveltosv1beta1.SveltosCluster{}
+		Expect(c.Get(context.TODO(), types.NamespacedName{Namespace: cluster.Namespace, Name: cluster.Name},
+			currentCluster)).To(Succeed())
+		for i := range classifier.Spec.ClassifierLabels {
+			label := classifier.Spec.ClassifierLabels[i]
+			Expect(currentCluster.Labels[label.Key]).To(Equal(label.Value))
+		}
+		resourceVersion := currentCluster.ResourceVersion
+
+		// Nothing changed: cluster is not patched again
+		Expect(controllers.UpdateLabelsOnMatchingClusters(reconciler, context.TODO(), classifierScope, logger)).To(Succeed())
+		Expect(c.Get(context.TODO(), client.ObjectKeyFromObject(cluster), currentCluster)).To(Succeed())
+		Expect(currentCluster.ResourceVersion).To(Equal(resourceVersion))
+	})
+})
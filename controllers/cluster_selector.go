@@ -0,0 +1,214 @@
+/*
+Copyright 2022. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	libsveltosv1beta1 "github.com/projectsveltos/libsveltos/api/v1beta1"
+	"github.com/projectsveltos/libsveltos/lib/clusterproxy"
+	logs "github.com/projectsveltos/libsveltos/lib/logsettings"
+)
+
+const (
+	// ClassifierClusterSelectorAnnotation contains, in JSON format, a ClassifierClusterSelector.
+	// When set, Classifier (and sveltos-agent) is deployed only in the selected clusters and only
+	// those clusters can be a match. When a cluster stops being selected, Classifier is removed from it.
+	// When not set, Classifier is deployed in all clusters.
+	ClassifierClusterSelectorAnnotation = "classifier.projectsveltos.io/cluster-selector"
+)
+
+// ClassifierClusterSelector selects the clusters a Classifier is deployed in.
+// All specified fields must be satisfied for a cluster to be selected.
+type ClassifierClusterSelector struct {
+	// ClusterSelector selects clusters (CAPI Cluster or SveltosCluster) based on their labels.
+	// Avoid selecting on labels managed by Classifiers, as that might make Classifier deployment flip.
+	// +optional
+	ClusterSelector *metav1.LabelSelector `json:"clusterSelector,omitempty"`
+
+	// Namespaces selects clusters in any of the listed namespaces
+	// +optional
+	Namespaces []string `json:"namespaces,omitempty"`
+}
+
+// getClassifierClusterSelector returns the ClassifierClusterSelector defined for a Classifier.
+// Returns nil if Classifier has none, meaning all clusters are selected.
+func getClassifierClusterSelector(classifier *libsveltosv1beta1.Classifier) (*ClassifierClusterSelector, error) {
+	value, ok := classifier.Annotations[ClassifierClusterSelectorAnnotation]
+	if !ok {
+		return nil, nil
+	}
+
+	selector := &ClassifierClusterSelector{}
+	if err := json.Unmarshal([]byte(value), selector); err != nil {
+		return nil, fmt.Errorf("invalid annotation %s: %w", ClassifierClusterSelectorAnnotation, err)
+	}
+
+	if selector.ClusterSelector != nil {
+		if _, err := metav1.LabelSelectorAsSelector(selector.ClusterSelector); err != nil {
+			return nil, fmt.Errorf("invalid annotation %s: invalid clusterSelector: %w",
+				ClassifierClusterSelectorAnnotation, err)
+		}
+	}
+
+	return selector, nil
+}
+
+// isClusterSelected returns true if cluster is selected by ClassifierClusterSelector
+func isClusterSelected(selector *ClassifierClusterSelector, cluster client.Object) (bool, error) {
+	if len(selector.Namespaces) != 0 {
+		found := false
+		for i := range selector.Namespaces {
+			if selector.Namespaces[i] == cluster.GetNamespace() {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false, nil
+		}
+	}
+
+	if selector.ClusterSelector != nil {
+		labelSelector, err := metav1.LabelSelectorAsSelector(selector.ClusterSelector)
+		if err != nil {
+			return false, fmt.Errorf("invalid clusterSelector: %w", err)
+		}
+		if !labelSelector.Matches(labels.Set(cluster.GetLabels())) {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// getSelectedClusters returns all existing clusters selected by the Classifier ClassifierClusterSelector
+func (r *ClassifierReconciler) getSelectedClusters(ctx context.Context, classifier *libsveltosv1beta1.Classifier,
+	logger logr.Logger) ([]corev1.ObjectReference, error) {
+
+	clusters, err := clusterproxy.GetListOfClusters(ctx, r.Client, "", r.CapiOnboardAnnotation, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	selector, err := getClassifierClusterSelector(classifier)
+	if err != nil {
+		return nil, err
+	}
+	if selector == nil {
+		return clusters, nil
+	}
+
+	selected := make([]corev1.ObjectReference, 0, len(clusters))
+	for i := range clusters {
+		ok, err := r.isClusterRefSelected(ctx, selector, &clusters[i])
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			selected = append(selected, clusters[i])
+		}
+	}
+
+	logger.V(logs.LogDebug).Info(fmt.Sprintf("%d out of %d clusters are selected", len(selected), len(clusters)))
+	return selected, nil
+}
+
+// filterSelectedClusters removes from matchingClusters all clusters not selected by the Classifier
+// ClassifierClusterSelector
+func (r *ClassifierReconciler) filterSelectedClusters(ctx context.Context, classifier *libsveltosv1beta1.Classifier,
+	matchingClusters map[corev1.ObjectReference]bool) (map[corev1.ObjectReference]bool, error) {
+
+	selector, err := getClassifierClusterSelector(classifier)
+	if err != nil {
+		return nil, err
+	}
+	if selector == nil {
+		return matchingClusters, nil
+	}
+
+	result := make(map[corev1.ObjectReference]bool)
+	for ref := range matchingClusters {
+		ok, err := r.isClusterRefSelected(ctx, selector, &ref)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			result[ref] = true
+		}
+	}
+
+	return result, nil
+}
+
+// isClusterRefSelected returns true if the referenced cluster exists and is selected
+func (r *ClassifierReconciler) isClusterRefSelected(ctx context.Context, selector *ClassifierClusterSelector,
+	ref *corev1.ObjectReference) (bool, error) {
+
+	cluster, err := clusterproxy.GetCluster(ctx, r.Client, ref.Namespace, ref.Name, clusterproxy.GetClusterType(ref))
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return isClusterSelected(selector, cluster)
+}
+
+// removeClassifierClusterReports deletes the ClassifierReports of a Classifier for a given cluster
+func removeClassifierClusterReports(ctx context.Context, c client.Client, classifier *libsveltosv1beta1.Classifier,
+	cluster *corev1.ObjectReference, logger logr.Logger) error {
+
+	listOptions := []client.ListOption{
+		client.MatchingLabels{
+			libsveltosv1beta1.ClassifierlNameLabel: classifier.Name,
+		},
+	}
+
+	classifierReportList := &libsveltosv1beta1.ClassifierReportList{}
+	err := c.List(ctx, classifierReportList, listOptions...)
+	if err != nil {
+		logger.V(logs.LogInfo).Info(fmt.Sprintf("failed to list ClassifierReports. Err: %v", err))
+		return err
+	}
+
+	clusterType := clusterproxy.GetClusterType(cluster)
+	for i := range classifierReportList.Items {
+		cr := &classifierReportList.Items[i]
+		if cr.Spec.ClusterNamespace != cluster.Namespace || cr.Spec.ClusterName != cluster.Name ||
+			cr.Spec.ClusterType != clusterType {
+
+			continue
+		}
+		err = c.Delete(ctx, cr)
+		if err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+	}
+
+	return nil
+}
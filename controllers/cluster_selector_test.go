@@ -0,0 +1,172 @@
+/*
+Copyright 2022. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers_test
+
+import (
+	"context"
+	"fmt"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2/textlogger"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/projectsveltos/classifier/controllers"
+	libsveltosv1beta1 "github.com/projectsveltos/libsveltos/api/v1beta1"
+	"github.com/projectsveltos/libsveltos/lib/deployer"
+	fakedeployer "github.com/projectsveltos/libsveltos/lib/deployer/fake"
+)
+
+var _ = Describe("Classifier cluster selector", func() {
+	var edgeCluster, datacenterCluster *libsveltosv1beta1.SveltosCluster
+	var edgeLabelKey string
+
+	getClusterReference := func(cluster *libsveltosv1beta1.SveltosCluster) corev1.ObjectReference {
+		return corev1.ObjectReference{
+			Namespace: cluster.Namespace, Name: cluster.Name,
+			Kind: libsveltosv1beta1.SveltosClusterKind, APIVersion: libsveltosv1beta1.GroupVersion.String(),
+		}
+	}
+
+	BeforeEach(func() {
+		edgeLabelKey = randomString()
+		edgeCluster = &libsveltosv1beta1.SveltosCluster{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: randomString(), Name: randomString(),
+				Labels: map[string]string{edgeLabelKey: "true"},
+			},
+		}
+		datacenterCluster = &libsveltosv1beta1.SveltosCluster{
+			ObjectMeta: metav1.ObjectMeta{Namespace: randomString(), Name: randomString()},
+		}
+	})
+
+	It("isClusterSelected selects clusters by labels and namespaces", func() {
+		classifier := getClassifierInstance(randomString())
+		classifier.Annotations = map[string]string{
+			controllers.ClassifierClusterSelectorAnnotation: fmt.Sprintf(
+				`{"clusterSelector": {"matchLabels": {%q: "true"}}}`, edgeLabelKey),
+		}
+
+		selector, err := controllers.GetClassifierClusterSelector(classifier)
+		Expect(err).To(BeNil())
+		Expect(controllers.IsClusterSelected(selector, edgeCluster)).To(BeTrue())
+		Expect(controllers.IsClusterSelected(selector, datacenterCluster)).To(BeFalse())
+
+		selector.Namespaces = []string{datacenterCluster.Namespace}
+		Expect(controllers.IsClusterSelected(selector, edgeCluster)).To(BeFalse())
+
+		selector.ClusterSelector = nil
+		Expect(controllers.IsClusterSelected(selector, datacenterCluster)).To(BeTrue())
+
+		classifier.Annotations[controllers.ClassifierClusterSelectorAnnotation] =
+			`{"clusterSelector": {"matchExpressions": [{"key": "env", "operator": "Unknown"}]}}`
+		_, err = controllers.GetClassifierClusterSelector(classifier)
+		Expect(err).ToNot(BeNil())
+	})
+
+	It("updateClusterInfo adds selected clusters and marks not selected ones as Removing", func() {
+		classifier := getClassifierInstance(randomString())
+		classifier.Annotations = map[string]string{
+			controllers.ClassifierClusterSelectorAnnotation: fmt.Sprintf(
+				`{"clusterSelector": {"matchLabels": {%q: "true"}}}`, edgeLabelKey),
+		}
+		classifier.Status.ClusterInfo = []libsveltosv1beta1.ClusterInfo{
+			{
+				Cluster: getClusterReference(datacenterCluster),
+				Status:  libsveltosv1beta1.SveltosStatusProvisioned,
+				Hash:    []byte(randomString()),
+			},
+		}
+
+		initObjects := []client.Object{classifier, edgeCluster, datacenterCluster}
+		c := fake.NewClientBuilder().WithScheme(scheme).WithStatusSubresource(initObjects...).
+			WithObjects(initObjects...).Build()
+
+		reconciler := getClassifierReconciler(c, nil)
+		classifierScope := getClassifierScope(c, textlogger.NewLogger(textlogger.NewConfig(textlogger.Verbosity(1))),
+			classifier)
+
+		Expect(controllers.UpdateClusterInfo(reconciler, context.TODO(), classifierScope)).To(Succeed())
+		Expect(classifier.Status.ClusterInfo).To(HaveLen(2))
+		for i := range classifier.Status.ClusterInfo {
+			cInfo := &classifier.Status.ClusterInfo[i]
+			if cInfo.Cluster.Name == datacenterCluster.Name {
+				Expect(cInfo.Status).To(Equal(libsveltosv1beta1.SveltosStatusRemoving))
+			} else {
+				Expect(cInfo.Cluster).To(Equal(getClusterReference(edgeCluster)))
+				Expect(cInfo.Status).To(BeEmpty())
+			}
+		}
+
+		// Once selected again, Classifier is deployed again
+		datacenterCluster.Labels = map[string]string{edgeLabelKey: "true"}
+		Expect(c.Update(context.TODO(), datacenterCluster)).To(Succeed())
+		Expect(controllers.UpdateClusterInfo(reconciler, context.TODO(), classifierScope)).To(Succeed())
+		Expect(classifier.Status.ClusterInfo).To(HaveLen(2))
+		for i := range classifier.Status.ClusterInfo {
+			Expect(classifier.Status.ClusterInfo[i].Status).To(BeEmpty())
+		}
+	})
+
+	It("deployClassifier removes Classifier from clusters not selected anymore", func() {
+		classifier := getClassifierInstance(randomString())
+		classifier.Status.ClusterInfo = []libsveltosv1beta1.ClusterInfo{
+			{
+				Cluster: getClusterReference(datacenterCluster),
+				Status:  libsveltosv1beta1.SveltosStatusRemoving,
+				Hash:    []byte(randomString()),
+			},
+		}
+
+		report := getClassifierReport(classifier.Name, datacenterCluster.Namespace, datacenterCluster.Name)
+		report.Namespace = datacenterCluster.Namespace
+		report.Spec.ClusterType = libsveltosv1beta1.ClusterTypeSveltos
+
+		initObjects := []client.Object{classifier, datacenterCluster, report}
+		c := fake.NewClientBuilder().WithScheme(scheme).WithStatusSubresource(initObjects...).
+			WithObjects(initObjects...).Build()
+
+		logger := textlogger.NewLogger(textlogger.NewConfig(textlogger.Verbosity(1)))
+		dep := fakedeployer.GetClient(context.TODO(), logger, c)
+		Expect(dep.RegisterFeatureID(libsveltosv1beta1.FeatureClassifier)).To(Succeed())
+		reconciler := getClassifierReconciler(c, dep)
+		classifierScope := getClassifierScope(c, logger, classifier)
+
+		f := controllers.GetHandlersForFeature(libsveltosv1beta1.FeatureClassifier)
+		Expect(controllers.DeployClassifier(reconciler, context.TODO(), classifierScope, f, logger)).ToNot(Succeed())
+		Expect(classifier.Status.ClusterInfo).To(HaveLen(1))
+		Expect(classifier.Status.ClusterInfo[0].Status).To(Equal(libsveltosv1beta1.SveltosStatusRemoving))
+
+		key := deployer.GetKey(datacenterCluster.Namespace, datacenterCluster.Name,
+			classifier.Name, libsveltosv1beta1.FeatureClassifier, libsveltosv1beta1.ClusterTypeSveltos, true)
+		Expect(dep.IsKeyInProgress(key)).To(BeTrue())
+
+		// Once cluster is gone, entry and ClassifierReports are removed
+		Expect(c.Delete(context.TODO(), datacenterCluster)).To(Succeed())
+		Expect(controllers.DeployClassifier(reconciler, context.TODO(), classifierScope, f, logger)).To(Succeed())
+		Expect(classifier.Status.ClusterInfo).To(BeEmpty())
+
+		reports := &libsveltosv1beta1.ClassifierReportList{}
+		Expect(c.List(context.TODO(), reports)).To(Succeed())
+		Expect(reports.Items).To(BeEmpty())
+	})
+})
@@ -18,6 +18,7 @@ package controllers_test
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"sync"
 	"testing"
@@ -31,7 +32,10 @@ import (
 	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/wait"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	"k8s.io/klog/v2"
@@ -39,6 +43,8 @@ import (
 	"sigs.k8s.io/cluster-api/util"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
 
 	"github.com/projectsveltos/classifier/controllers"
 	"github.com/projectsveltos/classifier/internal/test/helpers"
@@ -265,3 +271,118 @@ func addTypeInformationToObject(scheme *runtime.Scheme, obj client.Object) error
 
 	return nil
 }
+
+// getFakeClientWithApply returns a fake client which supports applying labels with server-side apply.
+// controller-runtime fake client does not support server-side apply. Only what Classifier needs is
+// emulated: labels are applied by a field manager, which owns them (tracked in managedFields) and
+// relinquishes ownership of the labels not applied anymore.
+func getFakeClientWithApply(initObjects ...client.Object) client.Client {
+	return fake.NewClientBuilder().WithScheme(scheme).WithStatusSubresource(initObjects...).
+		WithObjects(initObjects...).WithInterceptorFuncs(interceptor.Funcs{Patch: applyLabels}).Build()
+}
+
+// applyLabels mimics server-side apply of labels: labels not applied anymore are removed unless owned
+// by another field manager and applying a label owned by another field manager with a different value
+// is a conflict unless ownership is forced.
+func applyLabels(ctx context.Context, c client.WithWatch, obj client.Object, patch client.Patch,
+	opts ...client.PatchOption) error {
+
+	if patch.Type() != types.ApplyPatchType {
+		return c.Patch(ctx, obj, patch, opts...)
+	}
+
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return fmt.Errorf("only unstructured objects can be applied")
+	}
+
+	patchOptions := &client.PatchOptions{}
+	patchOptions.ApplyOptions(opts)
+	fieldManager := patchOptions.FieldManager
+	force := patchOptions.Force != nil && *patchOptions.Force
+
+	current := &unstructured.Unstructured{}
+	current.SetGroupVersionKind(u.GroupVersionKind())
+	if err := c.Get(ctx, client.ObjectKeyFromObject(u), current); err != nil {
+		return err
+	}
+
+	// Labels owned by any other field manager
+	othersLabels := make(map[string]bool)
+	for _, entry := range current.GetManagedFields() {
+		if entry.Manager == fieldManager {
+			continue
+		}
+		for key := range controllers.GetManagedLabels(current, entry.Manager, entry.Operation, logr.Discard()) {
+			othersLabels[key] = true
+		}
+	}
+
+	labels := current.GetLabels()
+	if labels == nil {
+		labels = make(map[string]string)
+	}
+	for key, value := range u.GetLabels() {
+		if v, ok := labels[key]; ok && v != value && othersLabels[key] && !force {
+			return apierrors.NewConflict(schema.GroupResource{Resource: "clusters"}, u.GetName(),
+				fmt.Errorf("conflict with another field manager on label %s", key))
+		}
+	}
+	for key := range controllers.GetAppliedLabels(current, fieldManager, logr.Discard()) {
+		if _, ok := u.GetLabels()[key]; !ok && !othersLabels[key] {
+			delete(labels, key)
+		}
+	}
+	fields := make(map[string]interface{})
+	for key, value := range u.GetLabels() {
+		labels[key] = value
+		fields["f:"+key] = map[string]interface{}{}
+	}
+	current.SetLabels(labels)
+
+	raw, err := json.Marshal(map[string]interface{}{"f:metadata": map[string]interface{}{"f:labels": fields}})
+	if err != nil {
+		return err
+	}
+	managedFields := make([]metav1.ManagedFieldsEntry, 0)
+	for _, entry := range current.GetManagedFields() {
+		if entry.Manager == fieldManager {
+			continue
+		}
+		if force && entry.FieldsV1 != nil {
+			// Ownership of applied labels is taken from any other field manager
+			otherFields := make(map[string]interface{})
+			if err := json.Unmarshal(entry.FieldsV1.Raw, &otherFields); err != nil {
+				return err
+			}
+			if metadata, ok := otherFields["f:metadata"].(map[string]interface{}); ok {
+				if otherLabels, ok := metadata["f:labels"].(map[string]interface{}); ok {
+					for key := range fields {
+						delete(otherLabels, key)
+					}
+				}
+			}
+			otherRaw, err := json.Marshal(otherFields)
+			if err != nil {
+				return err
+			}
+			entry.FieldsV1 = &metav1.FieldsV1{Raw: otherRaw}
+		}
+		managedFields = append(managedFields, entry)
+	}
+	managedFields = append(managedFields, metav1.ManagedFieldsEntry{
+		Manager:    fieldManager,
+		Operation:  metav1.ManagedFieldsOperationApply,
+		APIVersion: u.GetAPIVersion(),
+		FieldsType: "FieldsV1",
+		FieldsV1:   &metav1.FieldsV1{Raw: raw},
+	})
+	current.SetManagedFields(managedFields)
+
+	if err := c.Update(ctx, current); err != nil {
+		return err
+	}
+
+	u.Object = current.Object
+	return nil
+}
@@ -16,6 +16,11 @@ limitations under the License.
 
 package controllers
 
+import (
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+)
+
 var (
 	DeployClassifierCRD                     = deployClassifierCRD
 	DeployClassifierReportCRD               = deployClassifierReportCRD
@@ -33,7 +38,26 @@ var (
 	UndeployClassifierFromCluster           = undeployClassifierFromCluster
 	RemoveClassifierReports                 = removeClassifierReports
 	RemoveClusterClassifierReports          = removeClusterClassifierReports
-	CollectClassifierReportsFromCluster     = collectClassifierReportsFromCluster
+	CollectClassifierReportsWithWatcher     = collectClassifierReportsWithWatcher
+	GetWatcherBackoff                       = getWatcherBackoff
+	NewReportWatchers                       = newReportWatchers
+	EnsureWatcher                           = (*reportWatchers).ensureWatcher
+	IsWatching                              = (*reportWatchers).isWatching
+	StopStaleWatchers                       = (*reportWatchers).stopStaleWatchers
+	NewCollectionBackoffs                   = newCollectionBackoffs
+	CanAttemptCollection                    = (*collectionBackoffs).canAttempt
+	RecordCollectionFailure                 = (*collectionBackoffs).recordFailure
+	RecordCollectionSuccess                 = (*collectionBackoffs).recordSuccess
+	RemoveStaleCollectionBackoffs           = (*collectionBackoffs).removeStale
+	ClusterCollectionSucceeded              = clusterCollectionSucceeded
+	ClusterCollectionFailed                 = clusterCollectionFailed
+	RemoveClusterMetrics                    = removeClusterMetrics
+	ClusterLastCollectionGauge              = clusterLastCollectionGauge
+	CollectionErrorsCounter                 = collectionErrorsCounter
+	ClassifierReportsCounter                = classifierReportsCounter
+	ProcessCollectedClassifierReport        = processCollectedClassifierReport
+	ProgramDuration                         = programDuration
+	ProgramClassifierDurationHistogram      = programClassifierDurationHistogram
 	DeploySveltosAgentInManagementCluster   = deploySveltosAgentInManagementCluster
 	RemoveSveltosAgentFromManagementCluster = removeSveltosAgentFromManagementCluster
 	GetSveltosAgentLabels                   = getSveltosAgentLabels
@@ -43,11 +67,20 @@ var (
 	GetAccessRequestName                       = getAccessRequestName
 	GetKubeconfigFromAccessRequest             = getKubeconfigFromAccessRequest
 	UpdateSecretWithAccessManagementKubeconfig = updateSecretWithAccessManagementKubeconfig
+	ReleaseClusterAccessRequest                = releaseClusterAccessRequest
+	GetAccessRequestClassifiers                = getAccessRequestClassifiers
+	SetAccessRequestClassifiers                = setAccessRequestClassifiers
+	ReleaseAccessRequests                      = releaseAccessRequests
+	RemoveClusterAccessRequest                 = removeClusterAccessRequest
 
 	GetHandlersForFeature = getHandlersForFeature
 
+	GetClassifierLabelValues = (*ClassifierReconciler).getClassifierLabelValues
+	ParseKubernetesVersion   = parseKubernetesVersion
+
 	ProcessClassifier                      = (*ClassifierReconciler).processClassifier
 	RemoveClassifier                       = (*ClassifierReconciler).removeClassifier
+	GetClusterClassifiers                  = (*ClassifierReconciler).getClusterClassifiers
 	RequeueClassifierForCluster            = (*ClassifierReconciler).requeueClassifierForCluster
 	RequeueClassifierForMachine            = (*ClassifierReconciler).requeueClassifierForMachine
 	RequeueClassifierForClassifierReport   = (*ClassifierReconciler).requeueClassifierForClassifierReport
@@ -58,12 +91,101 @@ var (
 	UndeployClassifier                     = (*ClassifierReconciler).undeployClassifier
 	RemoveAllRegistrations                 = (*ClassifierReconciler).removeAllRegistrations
 	ClassifyLabels                         = (*ClassifierReconciler).classifyLabels
+	RemoveLabelsFromCluster                = (*ClassifierReconciler).removeLabelsFromCluster
+	PublishDryRunReport                    = (*ClassifierReconciler).publishDryRunReport
+	GetDryRunReportName                    = getDryRunReportName
 )
 
 var (
 	CreatFeatureHandlerMaps = creatFeatureHandlerMaps
 )
 
+var (
+	IsManagementClusterConstraintMatch = isManagementClusterConstraintMatch
+	IsManagementOnlyClassifier         = isManagementOnlyClassifier
+	IsKubernetesVersionMatch           = isKubernetesVersionMatch
+)
+
+var (
+	GetClassifierComposition = getClassifierComposition
+	DetectCompositionCycle   = detectCompositionCycle
+	EvaluateExpression       = (*ClassifierExpression).evaluate
+
+	UpdateComposedClassifierMap = (*ClassifierReconciler).updateComposedClassifierMap
+)
+
+var (
+	GetStabilizationWindow       = getStabilizationWindow
+	ApplyStabilizationWindow     = applyStabilizationWindow
+	GetStabilizationRequeueAfter = getStabilizationRequeueAfter
+)
+
+var (
+	GetClassifierClusterSelector = getClassifierClusterSelector
+	IsClusterSelected            = isClusterSelected
+	UpdateClusterInfo            = (*ClassifierReconciler).updateClusterInfo
+	DeployClassifier             = (*ClassifierReconciler).deployClassifier
+)
+
+var (
+	GetClassifierFieldManager = getClassifierFieldManager
+	GetAppliedLabels          = getAppliedLabels
+	GetManagedLabels          = getManagedLabels
+	IsLabelApplyNeeded        = isLabelApplyNeeded
+	LegacyFieldManager        = legacyFieldManager
+)
+
+var (
+	NewLabelChangeLimiter   = newLabelChangeLimiter
+	ReserveLabelChange      = (*labelChangeLimiter).reserve
+	GetLabelChangeRetry     = (*labelChangeLimiter).retryAfter
+	GetQueuedLabelChanges   = (*labelChangeLimiter).getQueued
+	GetLabelChangeRateLimit = getLabelChangeRateLimit
+	LimitMatchRemovals      = (*ClassifierReconciler).limitMatchRemovals
+	ReleaseLabelChanges     = releaseLabelChanges
+)
+
+var (
+	RotateAgentKubeconfigs          = (*ClassifierReconciler).rotateAgentKubeconfigs
+	CompleteAgentKubeconfigRotation = completeAgentKubeconfigRotation
+	GetAgentKubeconfigPatch         = getAgentKubeconfigPatch
+	GetAgentKubeconfigHash          = getAgentKubeconfigHash
+)
+
+var (
+	FilterClustersByReportMode = filterClustersByReportMode
+)
+
+var (
+	UninstallSveltosAgent        = uninstallSveltosAgent
+	IsClassifierPresentInCluster = isClassifierPresentInCluster
+)
+
+// AddSyncedReportWatcher registers, for cluster, a running watcher using informer
+func AddSyncedReportWatcher(w *reportWatchers, cluster *corev1.ObjectReference, informer cache.Informer) {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	w.watchers[*cluster] = &reportWatcher{cancel: func() {}, done: make(chan struct{}), informer: informer}
+}
+
+const (
+	AccessRequestReplacesAnnotation   = accessRequestReplacesAnnotation
+	AccessRequestExpirationAnnotation = accessRequestExpirationAnnotation
+	AgentKubeconfigHashAnnotation     = agentKubeconfigHashAnnotation
+)
+
+const (
+	WatcherInitialBackoff = watcherInitialBackoff
+	WatcherMaxBackoff     = watcherMaxBackoff
+)
+
 const (
 	Controlplaneendpoint = controlplaneendpoint
+	Clusterclassifiers   = clusterclassifiers
+	DryRunReportKey      = dryRunReportKey
+)
+
+type (
+	ClusterLabelDiff = clusterLabelDiff
 )
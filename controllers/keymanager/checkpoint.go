@@ -0,0 +1,433 @@
+/*
+Copyright 2022. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package keymanager
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/projectsveltos/classifier/pkg/scope"
+	libsveltosv1beta1 "github.com/projectsveltos/libsveltos/api/v1beta1"
+	logs "github.com/projectsveltos/libsveltos/lib/logsettings"
+)
+
+//+kubebuilder:rbac:groups="",resources=configmaps,verbs=get;list;watch;create;update
+
+// keymanager state lives in memory. When a new classifier pod starts (restart or leader
+// failover), state would need to be rebuilt from all Classifier Status.
+// When checkpointing is enabled, keymanager periodically persists its state in a ConfigMap
+// and restores it on startup. Checkpoint also records the resourceVersion of each Classifier,
+// so that on restore only Classifiers modified since the checkpoint was written are rebuilt from
+// their Status. rebuildRegistrations is used as fallback when the checkpoint is missing or corrupted.
+
+const (
+	// checkpointFormatVersion is the version of the format used to persist keymanager state.
+	// A checkpoint with a different format version is ignored.
+	checkpointFormatVersion = 1
+
+	checkpointDataKey = "state"
+)
+
+// checkpoint is the keymanager state persisted in the ConfigMap
+type checkpoint struct {
+	// FormatVersion is the version of the checkpoint format
+	FormatVersion int `json:"formatVersion"`
+
+	// Generation is incremented every time a new checkpoint is written
+	Generation int64 `json:"generation"`
+
+	PerClusterLabelMap map[string]map[string][]string `json:"perClusterLabelMap"`
+	ClassifierInfo     map[string]ClassifierInfo      `json:"classifierInfo"`
+	SveltosAgentNames  map[string]string              `json:"sveltosAgentNames"`
+
+	// ClassifierResourceVersions contains, per Classifier, the resourceVersion the Classifier had
+	// when checkpoint was written
+	ClassifierResourceVersions map[string]string `json:"classifierResourceVersions"`
+}
+
+type checkpointConfig struct {
+	client    client.Client
+	namespace string
+	name      string
+	logger    logr.Logger
+}
+
+var (
+	checkpointMux sync.Mutex
+	checkpointCfg *checkpointConfig
+)
+
+// EnableCheckpoint enables persisting keymanager state in the ConfigMap namespace/name.
+// Must be called before GetKeyManagerInstance is first invoked, so state is restored from the ConfigMap.
+// State is only written by RunCheckpointer.
+func EnableCheckpoint(c client.Client, namespace, name string, logger logr.Logger) {
+	checkpointMux.Lock()
+	defer checkpointMux.Unlock()
+
+	checkpointCfg = &checkpointConfig{
+		client:    c,
+		namespace: namespace,
+		name:      name,
+		logger:    logger,
+	}
+}
+
+// RunCheckpointer writes keymanager state every interval (only if it has changed) and one last
+// time when ctx is cancelled. It blocks till ctx is cancelled.
+// When leader election is used, it must only run on the leader, so that the leader is the only one
+// writing the checkpoint and its last write happens before leadership is released.
+func RunCheckpointer(ctx context.Context, interval time.Duration) {
+	cfg := getCheckpointConfig()
+	if cfg == nil {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			// Best effort. Persist latest state before exiting.
+			const flushTimeout = 5 * time.Second
+			flushCtx, cancel := context.WithTimeout(context.Background(), flushTimeout)
+			flushCheckpoint(flushCtx, cfg.logger)
+			cancel()
+			return
+		case <-ticker.C:
+			flushCheckpoint(ctx, cfg.logger)
+		}
+	}
+}
+
+func getCheckpointConfig() *checkpointConfig {
+	checkpointMux.Lock()
+	defer checkpointMux.Unlock()
+
+	return checkpointCfg
+}
+
+// flushCheckpoint persists keymanager state if it has changed since last checkpoint
+func flushCheckpoint(ctx context.Context, logger logr.Logger) {
+	lock.Lock()
+	m := managerInstance
+	lock.Unlock()
+
+	if m == nil {
+		return
+	}
+
+	if err := m.writeCheckpoint(ctx); err != nil {
+		logger.V(logs.LogInfo).Info(fmt.Sprintf("failed to checkpoint keymanager state: %v", err))
+	}
+}
+
+// markDirty records that state has changed and needs to be checkpointed
+func (m *instance) markDirty() {
+	m.stateMux.Lock()
+	defer m.stateMux.Unlock()
+
+	m.stateGeneration++
+}
+
+// snapshot returns a deep copy of keymanager state
+func (m *instance) snapshot() *checkpoint {
+	m.chartMux.Lock()
+	perClusterLabelMap := make(map[string]map[string][]string, len(m.perClusterLabelMap))
+	for clusterKey := range m.perClusterLabelMap {
+		perClusterLabelMap[clusterKey] = make(map[string][]string, len(m.perClusterLabelMap[clusterKey]))
+		for labelKey, classifiers := range m.perClusterLabelMap[clusterKey] {
+			tmp := make([]string, len(classifiers))
+			copy(tmp, classifiers)
+			perClusterLabelMap[clusterKey][labelKey] = tmp
+		}
+	}
+	classifierInfo := make(map[string]ClassifierInfo, len(m.classifierInfo))
+	for k, v := range m.classifierInfo {
+		classifierInfo[k] = v
+	}
+	m.chartMux.Unlock()
+
+	m.sveltosAgentNameMux.Lock()
+	sveltosAgentNames := make(map[string]string, len(m.sveltosAgentNames))
+	for k, v := range m.sveltosAgentNames {
+		sveltosAgentNames[k] = v
+	}
+	m.sveltosAgentNameMux.Unlock()
+
+	return &checkpoint{
+		FormatVersion:      checkpointFormatVersion,
+		PerClusterLabelMap: perClusterLabelMap,
+		ClassifierInfo:     classifierInfo,
+		SveltosAgentNames:  sveltosAgentNames,
+	}
+}
+
+// writeCheckpoint persists keymanager state in the ConfigMap.
+// ConfigMap resourceVersion is used for optimistic concurrency: if ConfigMap was modified
+// since it was last read, update fails and it will be retried on next flush.
+func (m *instance) writeCheckpoint(ctx context.Context) error {
+	cfg := getCheckpointConfig()
+	if cfg == nil {
+		return nil
+	}
+
+	m.stateMux.Lock()
+	generation := m.stateGeneration
+	alreadyPersisted := generation == m.persistedGeneration
+	m.stateMux.Unlock()
+
+	if alreadyPersisted {
+		return nil
+	}
+
+	// Classifiers are listed before taking the snapshot. Classifier Status is updated after registrations
+	// change, so state in the snapshot already reflects the Status of any listed Classifier.
+	resourceVersions, err := getClassifierResourceVersions(ctx, cfg.client)
+	if err != nil {
+		return err
+	}
+
+	state := m.snapshot()
+	state.ClassifierResourceVersions = resourceVersions
+
+	configMap := &corev1.ConfigMap{}
+	err = cfg.client.Get(ctx, types.NamespacedName{Namespace: cfg.namespace, Name: cfg.name}, configMap)
+	if err != nil {
+		if !apierrors.IsNotFound(err) {
+			return err
+		}
+		state.Generation = 1
+		data, err := json.Marshal(state)
+		if err != nil {
+			return err
+		}
+		configMap.Namespace = cfg.namespace
+		configMap.Name = cfg.name
+		configMap.Data = map[string]string{checkpointDataKey: string(data)}
+		if err := cfg.client.Create(ctx, configMap); err != nil {
+			return err
+		}
+	} else {
+		if previous, err := parseCheckpoint(configMap); err == nil {
+			state.Generation = previous.Generation + 1
+		}
+		data, err := json.Marshal(state)
+		if err != nil {
+			return err
+		}
+		if configMap.Data == nil {
+			configMap.Data = map[string]string{}
+		}
+		configMap.Data[checkpointDataKey] = string(data)
+		// configMap.ResourceVersion is the one just read. Update fails with a conflict if
+		// anybody else modified the ConfigMap in the meantime.
+		if err := cfg.client.Update(ctx, configMap); err != nil {
+			return err
+		}
+	}
+
+	m.stateMux.Lock()
+	m.persistedGeneration = generation
+	m.stateMux.Unlock()
+
+	cfg.logger.V(logs.LogDebug).Info(fmt.Sprintf("keymanager state checkpointed (generation %d)", state.Generation))
+	return nil
+}
+
+// getClassifierResourceVersions returns the resourceVersion of each existing Classifier
+func getClassifierResourceVersions(ctx context.Context, c client.Client) (map[string]string, error) {
+	classifierList := &libsveltosv1beta1.ClassifierList{}
+	if err := c.List(ctx, classifierList); err != nil {
+		return nil, err
+	}
+
+	resourceVersions := make(map[string]string, len(classifierList.Items))
+	for i := range classifierList.Items {
+		resourceVersions[classifierList.Items[i].Name] = classifierList.Items[i].ResourceVersion
+	}
+	return resourceVersions, nil
+}
+
+// restoreFromCheckpoint restores keymanager state from the ConfigMap.
+// Restored registrations must then be reconciled with existing Classifiers (see reconcileWithClassifiers).
+// Returns nil if checkpointing is not enabled, or ConfigMap is missing or corrupted.
+// In such case, state must be rebuilt using rebuildRegistrations.
+func (m *instance) restoreFromCheckpoint(ctx context.Context) (*checkpoint, error) {
+	cfg := getCheckpointConfig()
+	if cfg == nil {
+		return nil, nil
+	}
+
+	configMap := &corev1.ConfigMap{}
+	err := cfg.client.Get(ctx, types.NamespacedName{Namespace: cfg.namespace, Name: cfg.name}, configMap)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			cfg.logger.V(logs.LogInfo).Info("keymanager checkpoint not found")
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	state, err := parseCheckpoint(configMap)
+	if err != nil {
+		cfg.logger.V(logs.LogInfo).Info(fmt.Sprintf("ignoring keymanager checkpoint: %v", err))
+		return nil, nil
+	}
+
+	m.chartMux.Lock()
+	m.perClusterLabelMap = state.PerClusterLabelMap
+	m.classifierInfo = state.ClassifierInfo
+	m.chartMux.Unlock()
+
+	m.sveltosAgentNameMux.Lock()
+	m.sveltosAgentNames = state.SveltosAgentNames
+	m.sveltosAgentNameMux.Unlock()
+
+	cfg.logger.V(logs.LogInfo).Info(fmt.Sprintf("keymanager state restored from checkpoint (generation %d)",
+		state.Generation))
+	return state, nil
+}
+
+// reconcileWithClassifiers reconciles restored registrations with existing Classifiers.
+// Checkpoint is trusted for Classifiers whose resourceVersion has not changed since checkpoint was
+// written. Registrations of any other Classifier (modified, created or deleted since then) are rebuilt
+// from its Status, like rebuildRegistrations does. Labels such Classifiers currently manage are registered
+// ahead of any other Classifier, so even with FirstWinsStrategy a restart does not change label managers.
+// Any remaining drift is corrected when Classifiers are reconciled.
+// Returns true if restored state was modified.
+func (m *instance) reconcileWithClassifiers(ctx context.Context, c client.Client,
+	resourceVersions map[string]string) (bool, error) {
+
+	classifierList := &libsveltosv1beta1.ClassifierList{}
+	if err := c.List(ctx, classifierList); err != nil {
+		return false, err
+	}
+
+	m.chartMux.Lock()
+	defer m.chartMux.Unlock()
+
+	existing := make(map[string]bool, len(classifierList.Items))
+	stale := make(map[string]bool)
+	modified := make([]*libsveltosv1beta1.Classifier, 0)
+	for i := range classifierList.Items {
+		cs := &classifierList.Items[i]
+		classifierKey := m.getClassifierKey(cs.Name)
+		existing[classifierKey] = true
+		if rv, ok := resourceVersions[classifierKey]; ok && rv == cs.ResourceVersion {
+			continue
+		}
+		stale[classifierKey] = true
+		// Classifiers in dry-run mode never register
+		if !IsDryRun(cs) {
+			modified = append(modified, cs)
+		}
+	}
+
+	// Classifiers deleted since checkpoint was written
+	for classifierKey := range m.classifierInfo {
+		if !existing[classifierKey] {
+			stale[classifierKey] = true
+		}
+	}
+	for clusterKey := range m.perClusterLabelMap {
+		for labelKey := range m.perClusterLabelMap[clusterKey] {
+			for _, classifierKey := range m.perClusterLabelMap[clusterKey][labelKey] {
+				if !existing[classifierKey] {
+					stale[classifierKey] = true
+				}
+			}
+		}
+	}
+
+	if len(stale) == 0 {
+		return false, nil
+	}
+
+	m.removeClassifiers(stale)
+
+	for i := range modified {
+		// Per-cluster status in the Classifier instance might be truncated. ConfigMaps have all of it
+		if err := scope.LoadClusterStatuses(ctx, c, modified[i]); err != nil {
+			return false, err
+		}
+		m.addManagers(modified[i], true)
+	}
+
+	for i := range modified {
+		m.addNonManagers(modified[i])
+	}
+
+	return true, nil
+}
+
+// removeClassifiers removes all registrations and information of the given Classifiers
+func (m *instance) removeClassifiers(classifierKeys map[string]bool) {
+	for clusterKey := range m.perClusterLabelMap {
+		for labelKey := range m.perClusterLabelMap[clusterKey] {
+			m.perClusterLabelMap[clusterKey][labelKey] = slices.DeleteFunc(m.perClusterLabelMap[clusterKey][labelKey],
+				func(classifierKey string) bool { return classifierKeys[classifierKey] })
+		}
+	}
+
+	for classifierKey := range classifierKeys {
+		delete(m.classifierInfo, classifierKey)
+	}
+}
+
+// parseCheckpoint returns the checkpoint contained in the ConfigMap.
+// Returns an error if ConfigMap does not contain a valid checkpoint.
+func parseCheckpoint(configMap *corev1.ConfigMap) (*checkpoint, error) {
+	data, ok := configMap.Data[checkpointDataKey]
+	if !ok {
+		return nil, fmt.Errorf("configMap does not contain key %s", checkpointDataKey)
+	}
+
+	state := &checkpoint{}
+	if err := json.Unmarshal([]byte(data), state); err != nil {
+		return nil, fmt.Errorf("corrupted checkpoint: %w", err)
+	}
+
+	if state.FormatVersion != checkpointFormatVersion {
+		return nil, fmt.Errorf("unsupported checkpoint format version %d", state.FormatVersion)
+	}
+
+	if state.PerClusterLabelMap == nil {
+		state.PerClusterLabelMap = make(map[string]map[string][]string)
+	}
+	if state.ClassifierInfo == nil {
+		state.ClassifierInfo = make(map[string]ClassifierInfo)
+	}
+	if state.SveltosAgentNames == nil {
+		state.SveltosAgentNames = make(map[string]string)
+	}
+	if state.ClassifierResourceVersions == nil {
+		state.ClassifierResourceVersions = make(map[string]string)
+	}
+
+	return state, nil
+}
@@ -0,0 +1,260 @@
+/*
+Copyright 2022. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package keymanager_test
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/projectsveltos/classifier/controllers/keymanager"
+	libsveltosv1beta1 "github.com/projectsveltos/libsveltos/api/v1beta1"
+)
+
+var _ = Describe("Keymanager checkpoint", func() {
+	var classifier *libsveltosv1beta1.Classifier
+	var c client.Client
+	var namespace string
+	var name string
+
+	BeforeEach(func() {
+		namespace = randomString()
+		name = randomString()
+
+		classifier = &libsveltosv1beta1.Classifier{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: randomString(),
+				Annotations: map[string]string{
+					keymanager.ClassifierPriorityAnnotation: "5",
+				},
+			},
+			Spec: libsveltosv1beta1.ClassifierSpec{
+				ClassifierLabels: []libsveltosv1beta1.ClassifierLabel{
+					{Key: randomString(), Value: randomString()},
+				},
+			},
+		}
+
+		c = fake.NewClientBuilder().WithScheme(setupScheme()).Build()
+		keymanager.SetCheckpointConfig(c, namespace, name)
+	})
+
+	AfterEach(func() {
+		keymanager.SetCheckpointConfig(nil, "", "")
+	})
+
+	It("writeCheckpoint persists state which restoreFromCheckpoint restores", func() {
+		clusterNamespace := randomString()
+		clusterName := randomString()
+
+		agentName := randomString()
+
+		manager := keymanager.NewInstance()
+		manager.RegisterClassifierForLabels(classifier, clusterNamespace, clusterName,
+			libsveltosv1beta1.ClusterTypeSveltos)
+		Expect(manager.RegisterSveltosAgentDeploymentName(agentName, clusterNamespace, clusterName,
+			libsveltosv1beta1.ClusterTypeSveltos)).To(Succeed())
+
+		Expect(keymanager.WriteCheckpoint(manager, context.TODO())).To(Succeed())
+
+		configMap := &corev1.ConfigMap{}
+		Expect(c.Get(context.TODO(), types.NamespacedName{Namespace: namespace, Name: name}, configMap)).To(Succeed())
+		resourceVersion := configMap.ResourceVersion
+
+		// Nothing changed, so ConfigMap is not updated
+		Expect(keymanager.WriteCheckpoint(manager, context.TODO())).To(Succeed())
+		Expect(c.Get(context.TODO(), types.NamespacedName{Namespace: namespace, Name: name}, configMap)).To(Succeed())
+		Expect(configMap.ResourceVersion).To(Equal(resourceVersion))
+
+		restored := keymanager.NewInstance()
+		state, err := keymanager.RestoreFromCheckpoint(restored, context.TODO())
+		Expect(err).To(BeNil())
+		Expect(state).ToNot(BeNil())
+
+		Expect(restored.CanManageLabel(classifier, clusterNamespace, clusterName,
+			classifier.Spec.ClassifierLabels[0].Key, libsveltosv1beta1.ClusterTypeSveltos)).To(BeTrue())
+		// A different sveltos-agent name is refused for the same cluster
+		Expect(restored.RegisterSveltosAgentDeploymentName(randomString(), clusterNamespace, clusterName,
+			libsveltosv1beta1.ClusterTypeSveltos)).ToNot(Succeed())
+		Expect(restored.RegisterSveltosAgentDeploymentName(agentName, clusterNamespace, clusterName,
+			libsveltosv1beta1.ClusterTypeSveltos)).To(Succeed())
+	})
+
+	It("writeCheckpoint updates existing checkpoint when state changes", func() {
+		clusterNamespace := randomString()
+		clusterName := randomString()
+
+		manager := keymanager.NewInstance()
+		manager.RegisterClassifierForLabels(classifier, clusterNamespace, clusterName,
+			libsveltosv1beta1.ClusterTypeSveltos)
+		Expect(keymanager.WriteCheckpoint(manager, context.TODO())).To(Succeed())
+
+		classifier.Spec.ClassifierLabels = nil
+		manager.RemoveStaleRegistrations(classifier, clusterNamespace, clusterName,
+			libsveltosv1beta1.ClusterTypeSveltos)
+		Expect(keymanager.WriteCheckpoint(manager, context.TODO())).To(Succeed())
+
+		restored := keymanager.NewInstance()
+		state, err := keymanager.RestoreFromCheckpoint(restored, context.TODO())
+		Expect(err).To(BeNil())
+		Expect(state).ToNot(BeNil())
+		Expect(restored.GetRegisteredClassifiers(clusterNamespace, clusterName,
+			libsveltosv1beta1.ClusterTypeSveltos)).To(BeEmpty())
+	})
+
+	It("reconcileWithClassifiers drops restored registrations not backed by Classifier Status", func() {
+		clusterNamespace := randomString()
+		clusterName := randomString()
+		clusterType := libsveltosv1beta1.ClusterTypeSveltos
+		labelKey := classifier.Spec.ClassifierLabels[0].Key
+
+		// deletedClassifier was removed after last checkpoint was written
+		deletedClassifier := &libsveltosv1beta1.Classifier{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        randomString(),
+				Annotations: map[string]string{keymanager.ClassifierPriorityAnnotation: "10"},
+			},
+			Spec: classifier.Spec,
+		}
+
+		manager := keymanager.NewInstance()
+		manager.RegisterClassifierForLabels(deletedClassifier, clusterNamespace, clusterName, clusterType)
+		manager.RegisterClassifierForLabels(classifier, clusterNamespace, clusterName, clusterType)
+		Expect(keymanager.WriteCheckpoint(manager, context.TODO())).To(Succeed())
+
+		classifier.Status = libsveltosv1beta1.ClassifierStatus{
+			MachingClusterStatuses: []libsveltosv1beta1.MachingClusterStatus{
+				{
+					ClusterRef: corev1.ObjectReference{Namespace: clusterNamespace, Name: clusterName,
+						APIVersion: libsveltosv1beta1.GroupVersion.String(), Kind: libsveltosv1beta1.SveltosClusterKind},
+					UnManagedLabels: []libsveltosv1beta1.UnManagedLabel{{Key: labelKey}},
+				},
+			},
+		}
+		Expect(c.Create(context.TODO(), classifier)).To(Succeed())
+
+		restored := keymanager.NewInstance()
+		state, err := keymanager.RestoreFromCheckpoint(restored, context.TODO())
+		Expect(err).To(BeNil())
+		Expect(state).ToNot(BeNil())
+		Expect(restored.CanManageLabel(deletedClassifier, clusterNamespace, clusterName, labelKey, clusterType)).To(BeTrue())
+
+		changed, err := keymanager.ReconcileWithClassifiers(restored, context.TODO(), c, state.ClassifierResourceVersions)
+		Expect(err).To(BeNil())
+		Expect(changed).To(BeTrue())
+		Expect(restored.GetRegisteredClassifiers(clusterNamespace, clusterName, clusterType)).To(
+			ConsistOf(classifier.Name))
+		Expect(restored.CanManageLabel(classifier, clusterNamespace, clusterName, labelKey, clusterType)).To(BeTrue())
+		Expect(keymanager.HasClassifierInfo(restored, deletedClassifier.Name)).To(BeFalse())
+
+		// Nothing left to reconcile
+		Expect(c.Get(context.TODO(), types.NamespacedName{Name: classifier.Name}, classifier)).To(Succeed())
+		changed, err = keymanager.ReconcileWithClassifiers(restored, context.TODO(), c,
+			map[string]string{classifier.Name: classifier.ResourceVersion})
+		Expect(err).To(BeNil())
+		Expect(changed).To(BeFalse())
+	})
+
+	It("reconcileWithClassifiers rebuilds only Classifiers modified since checkpoint was written", func() {
+		clusterNamespace := randomString()
+		clusterName := randomString()
+		clusterType := libsveltosv1beta1.ClusterTypeSveltos
+		labelKey := classifier.Spec.ClassifierLabels[0].Key
+
+		otherClassifier := &libsveltosv1beta1.Classifier{
+			ObjectMeta: metav1.ObjectMeta{Name: randomString()},
+			Spec:       classifier.Spec,
+		}
+		Expect(c.Create(context.TODO(), classifier)).To(Succeed())
+		Expect(c.Create(context.TODO(), otherClassifier)).To(Succeed())
+
+		manager := keymanager.NewInstance()
+		manager.RegisterClassifierForLabels(classifier, clusterNamespace, clusterName, clusterType)
+		manager.RegisterClassifierForLabels(otherClassifier, clusterNamespace, clusterName, clusterType)
+		Expect(keymanager.WriteCheckpoint(manager, context.TODO())).To(Succeed())
+
+		restored := keymanager.NewInstance()
+		state, err := keymanager.RestoreFromCheckpoint(restored, context.TODO())
+		Expect(err).To(BeNil())
+		Expect(state).ToNot(BeNil())
+
+		// Classifiers have not been modified, so checkpoint is trusted (their Status is not even considered)
+		changed, err := keymanager.ReconcileWithClassifiers(restored, context.TODO(), c, state.ClassifierResourceVersions)
+		Expect(err).To(BeNil())
+		Expect(changed).To(BeFalse())
+		Expect(restored.GetRegisteredClassifiers(clusterNamespace, clusterName, clusterType)).To(
+			ConsistOf(classifier.Name, otherClassifier.Name))
+		Expect(restored.CanManageLabel(classifier, clusterNamespace, clusterName, labelKey, clusterType)).To(BeTrue())
+
+		// otherClassifier, modified after checkpoint was written, manages the label according to its Status
+		otherClassifier.Status = libsveltosv1beta1.ClassifierStatus{
+			MachingClusterStatuses: []libsveltosv1beta1.MachingClusterStatus{
+				{
+					ClusterRef: corev1.ObjectReference{Namespace: clusterNamespace, Name: clusterName,
+						APIVersion: libsveltosv1beta1.GroupVersion.String(), Kind: libsveltosv1beta1.SveltosClusterKind},
+					ManagedLabels: []string{labelKey},
+				},
+			},
+		}
+		Expect(c.Update(context.TODO(), otherClassifier)).To(Succeed())
+
+		changed, err = keymanager.ReconcileWithClassifiers(restored, context.TODO(), c, state.ClassifierResourceVersions)
+		Expect(err).To(BeNil())
+		Expect(changed).To(BeTrue())
+		Expect(restored.GetRegisteredClassifiers(clusterNamespace, clusterName, clusterType)).To(
+			ConsistOf(classifier.Name, otherClassifier.Name))
+		Expect(restored.CanManageLabel(otherClassifier, clusterNamespace, clusterName, labelKey, clusterType)).To(BeTrue())
+		Expect(restored.CanManageLabel(classifier, clusterNamespace, clusterName, labelKey, clusterType)).To(BeFalse())
+	})
+
+	It("restoreFromCheckpoint returns false when checkpoint is missing or invalid", func() {
+		manager := keymanager.NewInstance()
+
+		state, err := keymanager.RestoreFromCheckpoint(manager, context.TODO())
+		Expect(err).To(BeNil())
+		Expect(state).To(BeNil())
+
+		configMap := &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: namespace,
+				Name:      name,
+			},
+			Data: map[string]string{
+				"state": "not a valid checkpoint",
+			},
+		}
+		Expect(c.Create(context.TODO(), configMap)).To(Succeed())
+
+		state, err = keymanager.RestoreFromCheckpoint(manager, context.TODO())
+		Expect(err).To(BeNil())
+		Expect(state).To(BeNil())
+
+		configMap.Data["state"] = `{"formatVersion":1000,"generation":1}`
+		Expect(c.Update(context.TODO(), configMap)).To(Succeed())
+
+		state, err = keymanager.RestoreFromCheckpoint(manager, context.TODO())
+		Expect(err).To(BeNil())
+		Expect(state).To(BeNil())
+	})
+})
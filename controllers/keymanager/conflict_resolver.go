@@ -0,0 +1,198 @@
+/*
+Copyright 2022. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package keymanager
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// FirstWinsStrategy gives the manager role to the first Classifier registering for a label (key)
+	FirstWinsStrategy = "first-wins"
+
+	// PriorityStrategy gives the manager role to the Classifier with highest priority
+	// (see ClassifierPriorityAnnotation). Ties are broken by name.
+	PriorityStrategy = "priority"
+
+	// OldestStrategy gives the manager role to the Classifier with the oldest creationTimestamp.
+	// Ties are broken by name.
+	OldestStrategy = "oldest"
+
+	// LexicalNameStrategy gives the manager role to the Classifier with lexicographically smallest name
+	LexicalNameStrategy = "lexical-name"
+
+	// RefuseAllStrategy does not give the manager role to any Classifier while a label (key) is
+	// contested (more than one Classifier is registered for it)
+	RefuseAllStrategy = "refuse-all"
+)
+
+// ClassifierInfo contains the Classifier information conflict resolvers use to decide which
+// Classifier manages a label (key)
+type ClassifierInfo struct {
+	Name              string
+	Priority          int32
+	CreationTimestamp metav1.Time
+}
+
+// ConflictResolver decides which Classifier, among all the ones registered for the
+// same label (key) in the same cluster, manages such label.
+type ConflictResolver interface {
+	// Name returns the name of the strategy
+	Name() string
+
+	// Resolve returns the name of the Classifier managing the label (key).
+	// Registrations are passed in registration order.
+	// Returns false if no Classifier can manage the label (key).
+	Resolve(registrations []ClassifierInfo) (string, bool)
+}
+
+var (
+	resolverMux      sync.RWMutex
+	conflictResolver ConflictResolver = &firstWinsResolver{}
+)
+
+// GetConflictResolver returns the built-in ConflictResolver for a given strategy name
+func GetConflictResolver(strategy string) (ConflictResolver, error) {
+	switch strategy {
+	case FirstWinsStrategy:
+		return &firstWinsResolver{}, nil
+	case PriorityStrategy:
+		return &priorityResolver{}, nil
+	case OldestStrategy:
+		return &oldestResolver{}, nil
+	case LexicalNameStrategy:
+		return &lexicalNameResolver{}, nil
+	case RefuseAllStrategy:
+		return &refuseAllResolver{}, nil
+	default:
+		return nil, fmt.Errorf("unknown conflict resolution strategy %q. Valid strategies: %s",
+			strategy, strings.Join(GetConflictResolutionStrategies(), ", "))
+	}
+}
+
+// GetConflictResolutionStrategies returns the names of all built-in strategies
+func GetConflictResolutionStrategies() []string {
+	return []string{FirstWinsStrategy, PriorityStrategy, OldestStrategy, LexicalNameStrategy, RefuseAllStrategy}
+}
+
+// SetConflictResolver sets the ConflictResolver used by keymanager.
+// Default is FirstWinsStrategy.
+func SetConflictResolver(resolver ConflictResolver) {
+	resolverMux.Lock()
+	defer resolverMux.Unlock()
+
+	conflictResolver = resolver
+}
+
+// GetCurrentConflictResolver returns the ConflictResolver currently used by keymanager
+func GetCurrentConflictResolver() ConflictResolver {
+	resolverMux.RLock()
+	defer resolverMux.RUnlock()
+
+	return conflictResolver
+}
+
+type firstWinsResolver struct{}
+
+func (r *firstWinsResolver) Name() string {
+	return FirstWinsStrategy
+}
+
+func (r *firstWinsResolver) Resolve(registrations []ClassifierInfo) (string, bool) {
+	if len(registrations) == 0 {
+		return "", false
+	}
+
+	return registrations[0].Name, true
+}
+
+type priorityResolver struct{}
+
+func (r *priorityResolver) Name() string {
+	return PriorityStrategy
+}
+
+func (r *priorityResolver) Resolve(registrations []ClassifierInfo) (string, bool) {
+	return pickFirst(registrations, func(a, b *ClassifierInfo) bool {
+		if a.Priority != b.Priority {
+			return a.Priority > b.Priority
+		}
+		return a.Name < b.Name
+	})
+}
+
+type oldestResolver struct{}
+
+func (r *oldestResolver) Name() string {
+	return OldestStrategy
+}
+
+func (r *oldestResolver) Resolve(registrations []ClassifierInfo) (string, bool) {
+	return pickFirst(registrations, func(a, b *ClassifierInfo) bool {
+		if !a.CreationTimestamp.Equal(&b.CreationTimestamp) {
+			return a.CreationTimestamp.Before(&b.CreationTimestamp)
+		}
+		return a.Name < b.Name
+	})
+}
+
+type lexicalNameResolver struct{}
+
+func (r *lexicalNameResolver) Name() string {
+	return LexicalNameStrategy
+}
+
+func (r *lexicalNameResolver) Resolve(registrations []ClassifierInfo) (string, bool) {
+	return pickFirst(registrations, func(a, b *ClassifierInfo) bool {
+		return a.Name < b.Name
+	})
+}
+
+type refuseAllResolver struct{}
+
+func (r *refuseAllResolver) Name() string {
+	return RefuseAllStrategy
+}
+
+func (r *refuseAllResolver) Resolve(registrations []ClassifierInfo) (string, bool) {
+	if len(registrations) != 1 {
+		// Either nobody wants this label or label is contested.
+		return "", false
+	}
+
+	return registrations[0].Name, true
+}
+
+// pickFirst returns the name of the Classifier coming first according to less
+func pickFirst(registrations []ClassifierInfo, less func(a, b *ClassifierInfo) bool) (string, bool) {
+	if len(registrations) == 0 {
+		return "", false
+	}
+
+	sorted := make([]ClassifierInfo, len(registrations))
+	copy(sorted, registrations)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return less(&sorted[i], &sorted[j])
+	})
+
+	return sorted[0].Name, true
+}
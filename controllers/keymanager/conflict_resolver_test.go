@@ -0,0 +1,159 @@
+/*
+Copyright 2022. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package keymanager_test
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/projectsveltos/classifier/controllers/keymanager"
+	libsveltosv1beta1 "github.com/projectsveltos/libsveltos/api/v1beta1"
+)
+
+var _ = Describe("Conflict resolvers", func() {
+	var registrations []keymanager.ClassifierInfo
+
+	BeforeEach(func() {
+		now := time.Now()
+		registrations = []keymanager.ClassifierInfo{
+			{Name: "c", Priority: 1, CreationTimestamp: metav1.NewTime(now)},
+			{Name: "b", Priority: 5, CreationTimestamp: metav1.NewTime(now.Add(time.Minute))},
+			{Name: "a", Priority: 1, CreationTimestamp: metav1.NewTime(now.Add(-time.Minute))},
+			{Name: "d", Priority: 5, CreationTimestamp: metav1.NewTime(now.Add(-time.Minute))},
+		}
+	})
+
+	It("GetConflictResolver returns an error for unknown strategies", func() {
+		_, err := keymanager.GetConflictResolver(randomString())
+		Expect(err).ToNot(BeNil())
+
+		for _, strategy := range keymanager.GetConflictResolutionStrategies() {
+			resolver, err := keymanager.GetConflictResolver(strategy)
+			Expect(err).To(BeNil())
+			Expect(resolver.Name()).To(Equal(strategy))
+		}
+	})
+
+	DescribeTable("Resolve picks the manager",
+		func(strategy, expected string) {
+			resolver, err := keymanager.GetConflictResolver(strategy)
+			Expect(err).To(BeNil())
+
+			manager, ok := resolver.Resolve(registrations)
+			Expect(ok).To(BeTrue())
+			Expect(manager).To(Equal(expected))
+
+			_, ok = resolver.Resolve(nil)
+			Expect(ok).To(BeFalse())
+		},
+		Entry("first-wins", keymanager.FirstWinsStrategy, "c"),
+		Entry("priority", keymanager.PriorityStrategy, "b"),
+		Entry("oldest", keymanager.OldestStrategy, "a"),
+		Entry("lexical-name", keymanager.LexicalNameStrategy, "a"),
+	)
+
+	It("refuse-all does not give the manager role while label is contested", func() {
+		resolver, err := keymanager.GetConflictResolver(keymanager.RefuseAllStrategy)
+		Expect(err).To(BeNil())
+
+		_, ok := resolver.Resolve(registrations)
+		Expect(ok).To(BeFalse())
+
+		manager, ok := resolver.Resolve(registrations[:1])
+		Expect(ok).To(BeTrue())
+		Expect(manager).To(Equal(registrations[0].Name))
+	})
+
+	It("keymanager uses the configured ConflictResolver", func() {
+		defer useConflictResolver(keymanager.RefuseAllStrategy)()
+
+		c := fake.NewClientBuilder().WithScheme(setupScheme()).Build()
+		manager, err := keymanager.GetKeyManagerInstance(context.TODO(), c)
+		Expect(err).To(BeNil())
+
+		clusterNamespace := randomString()
+		clusterName := randomString()
+		clusterType := libsveltosv1beta1.ClusterTypeCapi
+		labelKey := randomString()
+
+		classifier1 := &libsveltosv1beta1.Classifier{
+			ObjectMeta: metav1.ObjectMeta{Name: randomString()},
+			Spec: libsveltosv1beta1.ClassifierSpec{
+				ClassifierLabels: []libsveltosv1beta1.ClassifierLabel{{Key: labelKey, Value: randomString()}},
+			},
+		}
+		classifier2 := &libsveltosv1beta1.Classifier{
+			ObjectMeta: metav1.ObjectMeta{Name: randomString()},
+			Spec:       classifier1.Spec,
+		}
+
+		manager.RegisterClassifierForLabels(classifier1, clusterNamespace, clusterName, clusterType)
+		defer removeSubscriptions(c, classifier1, clusterNamespace, clusterName, clusterType)
+		Expect(manager.CanManageLabel(classifier1, clusterNamespace, clusterName, labelKey, clusterType)).To(BeTrue())
+
+		manager.RegisterClassifierForLabels(classifier2, clusterNamespace, clusterName, clusterType)
+		defer removeSubscriptions(c, classifier2, clusterNamespace, clusterName, clusterType)
+		Expect(manager.CanManageLabel(classifier1, clusterNamespace, clusterName, labelKey, clusterType)).To(BeFalse())
+		Expect(manager.CanManageLabel(classifier2, clusterNamespace, clusterName, labelKey, clusterType)).To(BeFalse())
+		_, err = manager.GetManagerForKey(clusterNamespace, clusterName, labelKey, clusterType)
+		Expect(err).ToNot(BeNil())
+	})
+
+	It("with FirstWinsStrategy, removing the manager promotes the next Classifier in registration order", func() {
+		defer useConflictResolver(keymanager.FirstWinsStrategy)()
+
+		c := fake.NewClientBuilder().WithScheme(setupScheme()).Build()
+		manager, err := keymanager.GetKeyManagerInstance(context.TODO(), c)
+		Expect(err).To(BeNil())
+
+		clusterNamespace := randomString()
+		clusterName := randomString()
+		clusterType := libsveltosv1beta1.ClusterTypeSveltos
+		labelKey := randomString()
+
+		classifiers := make([]*libsveltosv1beta1.Classifier, 3)
+		for i := range classifiers {
+			classifiers[i] = &libsveltosv1beta1.Classifier{
+				ObjectMeta: metav1.ObjectMeta{Name: randomString()},
+				Spec: libsveltosv1beta1.ClassifierSpec{
+					ClassifierLabels: []libsveltosv1beta1.ClassifierLabel{{Key: labelKey, Value: randomString()}},
+				},
+			}
+			manager.RegisterClassifierForLabels(classifiers[i], clusterNamespace, clusterName, clusterType)
+			defer removeSubscriptions(c, classifiers[i], clusterNamespace, clusterName, clusterType)
+		}
+
+		Expect(manager.CanManageLabel(classifiers[0], clusterNamespace, clusterName, labelKey, clusterType)).To(BeTrue())
+		Expect(manager.GetClassifiersSharingLabels(classifiers[0].Name)).To(ConsistOf(classifiers[1].Name,
+			classifiers[2].Name))
+
+		manager.RemoveAllRegistrations(classifiers[0], clusterNamespace, clusterName, clusterType)
+		Expect(manager.CanManageLabel(classifiers[1], clusterNamespace, clusterName, labelKey, clusterType)).To(BeTrue())
+		Expect(manager.CanManageLabel(classifiers[2], clusterNamespace, clusterName, labelKey, clusterType)).To(BeFalse())
+
+		// Classifier information is forgotten once Classifier is not registered anywhere
+		Expect(keymanager.HasClassifierInfo(manager, classifiers[0].Name)).To(BeFalse())
+		Expect(keymanager.HasClassifierInfo(manager, classifiers[1].Name)).To(BeTrue())
+		Expect(manager.GetClassifiersSharingLabels(classifiers[0].Name)).To(BeEmpty())
+	})
+})
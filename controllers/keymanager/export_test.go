@@ -16,7 +16,43 @@ limitations under the License.
 
 package keymanager
 
+import (
+	"k8s.io/klog/v2/textlogger"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
 var (
 	IsClassifierAlreadyRegistered = isClassifierAlreadyRegistered
 	RebuildRegistrations          = (*instance).rebuildRegistrations
+
+	NewInstance           = newInstance
+	WriteCheckpoint       = (*instance).writeCheckpoint
+	RestoreFromCheckpoint = (*instance).restoreFromCheckpoint
+
+	ReconcileWithClassifiers = (*instance).reconcileWithClassifiers
 )
+
+func HasClassifierInfo(m *instance, classifierName string) bool {
+	m.chartMux.Lock()
+	defer m.chartMux.Unlock()
+
+	_, ok := m.classifierInfo[classifierName]
+	return ok
+}
+
+func SetCheckpointConfig(c client.Client, namespace, name string) {
+	checkpointMux.Lock()
+	defer checkpointMux.Unlock()
+
+	if c == nil {
+		checkpointCfg = nil
+		return
+	}
+
+	checkpointCfg = &checkpointConfig{
+		client:    c,
+		namespace: namespace,
+		name:      name,
+		logger:    textlogger.NewLogger(textlogger.NewConfig(textlogger.Verbosity(1))),
+	}
+}
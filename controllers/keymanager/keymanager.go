@@ -19,10 +19,14 @@ package keymanager
 import (
 	"context"
 	"fmt"
+	"slices"
+	"sort"
+	"strconv"
 	"sync"
 
 	"sigs.k8s.io/controller-runtime/pkg/client"
 
+	"github.com/projectsveltos/classifier/pkg/scope"
 	libsveltosv1beta1 "github.com/projectsveltos/libsveltos/api/v1beta1"
 )
 
@@ -35,6 +39,10 @@ import (
 // Only one Classifier can manage a label (key) on a given Cluster at any point of time.
 // Following client is used to solve such scenarios. One Classifier will get the manager role for a given label (key)
 // in a given CAPI Cluster.
+// Which Classifier is the manager is decided by the configured ConflictResolver (see SetConflictResolver).
+// Default strategy gives the role to the first Classifier registering for a label (key). PriorityStrategy
+// gives it to the Classifier with the highest priority (see ClassifierPriorityAnnotation), breaking ties
+// by Classifier name.
 // All other Classifiers will report a conflict that requires admin intervention to be resolved.
 
 type instance struct {
@@ -46,7 +54,7 @@ type instance struct {
 	// - per CAPI Cluster (key: clusterNamespace/clusterName)
 	//     - per Label (key: <label ke>))
 	//         - list of Classifiers that want to set such label in CAPI Cluster.
-	// First Classifier able to add entry for a given CAPI Cluster/Label is allowed to manage that key.
+	// Among those, the Classifier chosen by the ConflictResolver is allowed to manage that key.
 	// canManageKey answers whether a Classifier can manage a label (key) for a given CAPI cluster.
 	// Any other Classifier will report the misconfiguration.
 	//
@@ -60,6 +68,11 @@ type instance struct {
 	//     - list of Classifier Names
 	perClusterLabelMap map[string]map[string][]string
 
+	// Information (priority, creationTimestamp) of each Classifier (key: Classifier name) registered
+	// for at least one label. Updated every time a Classifier registers, so a priority change moves
+	// ownership automatically.
+	classifierInfo map[string]ClassifierInfo
+
 	// When in agentless mode, Sveltos deploy a sveltos-agent per managed cluster in the management cluster.
 	// Name is randomly generated. Flow consists in first querying all existing sveltos-agent deployments and
 	// only if no sveltos-agent deployment exists for a given managed cluster, create a new one.
@@ -70,6 +83,12 @@ type instance struct {
 	// and will retry at which point will find an existing sveltos-agent deployment in the management cluster.
 	sveltosAgentNames   map[string]string
 	sveltosAgentNameMux sync.Mutex
+
+	// stateGeneration is incremented any time state changes. persistedGeneration is the
+	// stateGeneration last checkpointed. Used to checkpoint only when something has changed.
+	stateMux            sync.Mutex
+	stateGeneration     int64
+	persistedGeneration int64
 }
 
 var (
@@ -79,31 +98,116 @@ var (
 
 const (
 	keySeparator = "/"
+
+	// ClassifierPriorityAnnotation can be set on a Classifier to define its priority.
+	// With PriorityStrategy, when multiple Classifiers want to set the same label (key) on the same
+	// cluster, the Classifier with the highest priority manages it. Ties are broken by name.
+	// If not set (or not a valid integer), priority is 0.
+	ClassifierPriorityAnnotation = "classifier.projectsveltos.io/priority"
+
+	// ClassifierDryRunAnnotation can be set (to "true") on a Classifier to run it in dry-run mode.
+	// In dry-run mode, Classifier never registers for any label (key) and never changes Cluster labels.
+	// It only reports which labels it would set on which clusters.
+	ClassifierDryRunAnnotation = "classifier.projectsveltos.io/dry-run"
 )
 
-// GetKeyManagerInstance return keyManager instance
+// IsDryRun returns true if Classifier is in dry-run mode (see ClassifierDryRunAnnotation)
+func IsDryRun(classifier *libsveltosv1beta1.Classifier) bool {
+	if classifier.Annotations == nil {
+		return false
+	}
+
+	v, ok := classifier.Annotations[ClassifierDryRunAnnotation]
+	if !ok {
+		return false
+	}
+
+	dryRun, err := strconv.ParseBool(v)
+	if err != nil {
+		return false
+	}
+
+	return dryRun
+}
+
+// GetClassifierPriority returns the priority of a Classifier instance, as defined by
+// ClassifierPriorityAnnotation. Default priority is 0.
+func GetClassifierPriority(classifier *libsveltosv1beta1.Classifier) int32 {
+	if classifier.Annotations == nil {
+		return 0
+	}
+
+	v, ok := classifier.Annotations[ClassifierPriorityAnnotation]
+	if !ok {
+		return 0
+	}
+
+	priority, err := strconv.ParseInt(v, 10, 32)
+	if err != nil {
+		return 0
+	}
+
+	return int32(priority)
+}
+
+// GetKeyManagerInstance return keyManager instance.
+// On first invocation, state is restored from checkpoint (if checkpointing is enabled) and reconciled
+// with Classifier Status. If checkpoint is not available, state is rebuilt from Classifier Status.
 func GetKeyManagerInstance(ctx context.Context, c client.Client) (*instance, error) {
 	if managerInstance == nil {
 		lock.Lock()
 		defer lock.Unlock()
 		if managerInstance == nil {
-			managerInstance = &instance{
-				perClusterLabelMap:  make(map[string]map[string][]string),
-				chartMux:            sync.Mutex{},
-				sveltosAgentNames:   make(map[string]string),
-				sveltosAgentNameMux: sync.Mutex{},
-			}
+			tmpInstance := newInstance()
 
-			if err := managerInstance.rebuildRegistrations(ctx, c); err != nil {
-				managerInstance = nil
+			state, err := tmpInstance.restoreFromCheckpoint(ctx)
+			if err != nil {
 				return nil, err
 			}
+
+			if state != nil {
+				changed, err := tmpInstance.reconcileWithClassifiers(ctx, c, state.ClassifierResourceVersions)
+				if err != nil {
+					return nil, err
+				}
+				if changed {
+					tmpInstance.markDirty()
+				}
+			} else {
+				if err := tmpInstance.rebuildRegistrations(ctx, c); err != nil {
+					return nil, err
+				}
+				// Make sure rebuilt state is checkpointed
+				tmpInstance.markDirty()
+			}
+
+			managerInstance = tmpInstance
 		}
 	}
 
 	return managerInstance, nil
 }
 
+// GetKeyManagerInstanceIfInitialized returns keyManager instance only if it has already been initialized.
+// Unlike GetKeyManagerInstance, it never initializes it. Meant to be used by components (like webhooks)
+// running on every replica, while keymanager only runs on the leader.
+func GetKeyManagerInstanceIfInitialized() (*instance, bool) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	return managerInstance, managerInstance != nil
+}
+
+func newInstance() *instance {
+	return &instance{
+		perClusterLabelMap:  make(map[string]map[string][]string),
+		classifierInfo:      make(map[string]ClassifierInfo),
+		chartMux:            sync.Mutex{},
+		sveltosAgentNames:   make(map[string]string),
+		sveltosAgentNameMux: sync.Mutex{},
+	}
+}
+
 func (m *instance) RegisterSveltosAgentDeploymentName(name, clusterNamespace, clusterName string,
 	clusterType libsveltosv1beta1.ClusterType) error {
 
@@ -111,12 +215,15 @@ func (m *instance) RegisterSveltosAgentDeploymentName(name, clusterNamespace, cl
 	m.sveltosAgentNameMux.Lock()
 	defer m.sveltosAgentNameMux.Unlock()
 
-	v, ok := managerInstance.sveltosAgentNames[clusterKey]
+	v, ok := m.sveltosAgentNames[clusterKey]
 	if ok && v != name {
 		return fmt.Errorf("there is a different name already registered")
 	}
 
-	managerInstance.sveltosAgentNames[clusterKey] = name
+	if !ok {
+		m.sveltosAgentNames[clusterKey] = name
+		m.markDirty()
+	}
 	return nil
 }
 
@@ -125,12 +232,16 @@ func (m *instance) RemoveSveltosAgentDeploymentName(clusterNamespace, clusterNam
 	m.sveltosAgentNameMux.Lock()
 	defer m.sveltosAgentNameMux.Unlock()
 
-	delete(managerInstance.sveltosAgentNames, clusterKey)
+	if _, ok := m.sveltosAgentNames[clusterKey]; ok {
+		delete(m.sveltosAgentNames, clusterKey)
+		m.markDirty()
+	}
 }
 
 // RegisterClassifierForLabels registers Classifier as one requestor to manage all Spec.ClassifierLabels in
 // all CAPI clusters currently matching this Classifier.
-// Only first Classifier registering for a given label in a given CAPI Cluster is given the manager role.
+// Classifier priority and creationTimestamp are recorded as well. Among all Classifiers registered for a given
+// label in a given CAPI Cluster, the one chosen by the ConflictResolver is given the manager role.
 func (m *instance) RegisterClassifierForLabels(classifier *libsveltosv1beta1.Classifier,
 	clusterNamespace, clusterName string, clusterType libsveltosv1beta1.ClusterType) {
 
@@ -140,10 +251,18 @@ func (m *instance) RegisterClassifierForLabels(classifier *libsveltosv1beta1.Cla
 	m.chartMux.Lock()
 	defer m.chartMux.Unlock()
 
+	changed := m.recordClassifierInfo(classifierKey, classifier)
+
 	for i := range classifier.Spec.ClassifierLabels {
 		m.addClusterEntry(clusterKey)
 		m.addLabelKeyEntry(clusterKey, classifier.Spec.ClassifierLabels[i].Key)
-		m.addClassifierEntry(clusterKey, classifier.Spec.ClassifierLabels[i].Key, classifierKey)
+		if m.addClassifierEntry(clusterKey, classifier.Spec.ClassifierLabels[i].Key, classifierKey) {
+			changed = true
+		}
+	}
+
+	if changed {
+		m.markDirty()
 	}
 }
 
@@ -192,21 +311,68 @@ func (m *instance) cleanRegistrations(classifier *libsveltosv1beta1.Classifier,
 		}
 		// If Classifier was previously registered to manage this label key,
 		// consider this entry stale and remove it.
-		for i := range m.perClusterLabelMap[clusterKey][labelKey] {
-			if m.perClusterLabelMap[clusterKey][labelKey][i] == classifierKey {
-				// Order is not important. So move the element at index i with last one in order to avoid moving all elements.
-				length := len(m.perClusterLabelMap[clusterKey][labelKey])
-				m.perClusterLabelMap[clusterKey][labelKey][i] =
-					m.perClusterLabelMap[clusterKey][labelKey][length-1]
-				m.perClusterLabelMap[clusterKey][labelKey] = m.perClusterLabelMap[clusterKey][labelKey][:length-1]
-				break
+		// Order matters (FirstWinsStrategy relies on registration order), so it is preserved.
+		if i := slices.Index(m.perClusterLabelMap[clusterKey][labelKey], classifierKey); i >= 0 {
+			m.perClusterLabelMap[clusterKey][labelKey] = slices.Delete(m.perClusterLabelMap[clusterKey][labelKey], i, i+1)
+			m.markDirty()
+		}
+	}
+
+	// Forget Classifier information once Classifier is not registered anywhere anymore
+	if _, ok := m.classifierInfo[classifierKey]; ok && !m.isRegistered(classifierKey) {
+		delete(m.classifierInfo, classifierKey)
+		m.markDirty()
+	}
+}
+
+// isRegistered returns true if Classifier is registered for at least one label (key) in any cluster
+func (m *instance) isRegistered(classifierKey string) bool {
+	for clusterKey := range m.perClusterLabelMap {
+		for labelKey := range m.perClusterLabelMap[clusterKey] {
+			if slices.Contains(m.perClusterLabelMap[clusterKey][labelKey], classifierKey) {
+				return true
 			}
 		}
 	}
+	return false
+}
+
+// GetClassifiersSharingLabels returns the names (sorted) of all Classifiers, other than classifierName,
+// registered for at least one label (key), in at least one cluster, classifierName is registered for.
+// Those are the Classifiers which might gain or lose a label when classifierName priority changes.
+func (m *instance) GetClassifiersSharingLabels(classifierName string) []string {
+	classifierKey := m.getClassifierKey(classifierName)
+
+	m.chartMux.Lock()
+	defer m.chartMux.Unlock()
+
+	classifiers := make(map[string]bool)
+	for clusterKey := range m.perClusterLabelMap {
+		for labelKey := range m.perClusterLabelMap[clusterKey] {
+			registered := m.perClusterLabelMap[clusterKey][labelKey]
+			if !slices.Contains(registered, classifierKey) {
+				continue
+			}
+			for i := range registered {
+				if registered[i] != classifierKey {
+					classifiers[registered[i]] = true
+				}
+			}
+		}
+	}
+
+	result := make([]string, 0, len(classifiers))
+	for cl := range classifiers {
+		result = append(result, cl)
+	}
+	sort.Strings(result)
+
+	return result
 }
 
 // CanManageLabel returns true if a Classifier can manage a given label key.
-// Only the first Classifier registered for a given label key in a given cluster can manage it.
+// Only the Classifier chosen by the ConflictResolver among the ones registered
+// for a given label key in a given cluster can manage it.
 func (m *instance) CanManageLabel(classifier *libsveltosv1beta1.Classifier,
 	clusterNamespace, clusterName, labelKey string, clusterType libsveltosv1beta1.ClusterType) bool {
 
@@ -219,6 +385,39 @@ func (m *instance) CanManageLabel(classifier *libsveltosv1beta1.Classifier,
 	return m.isCurrentlyManager(clusterKey, labelKey, classifierKey)
 }
 
+// WouldManageLabel returns true if Classifier would be given the manager role for a given label key,
+// were it registered for it. Current registrations are not modified.
+// Used by Classifiers in dry-run mode.
+func (m *instance) WouldManageLabel(classifier *libsveltosv1beta1.Classifier,
+	clusterNamespace, clusterName, labelKey string, clusterType libsveltosv1beta1.ClusterType) bool {
+
+	clusterKey := m.getClusterKey(clusterNamespace, clusterName, clusterType)
+	classifierKey := m.getClassifierKey(classifier.Name)
+
+	m.chartMux.Lock()
+	defer m.chartMux.Unlock()
+
+	registrations := make([]ClassifierInfo, 0)
+	if _, ok := m.perClusterLabelMap[clusterKey]; ok {
+		classifiers := m.perClusterLabelMap[clusterKey][labelKey]
+		for i := range classifiers {
+			if classifiers[i] == classifierKey {
+				continue
+			}
+			registrations = append(registrations, m.getClassifierInfo(classifiers[i]))
+		}
+	}
+
+	registrations = append(registrations, ClassifierInfo{
+		Name:              classifierKey,
+		Priority:          GetClassifierPriority(classifier),
+		CreationTimestamp: classifier.CreationTimestamp,
+	})
+
+	manager, ok := GetCurrentConflictResolver().Resolve(registrations)
+	return ok && manager == classifierKey
+}
+
 // GetManagerForKey returns the name of the Classifier currently in charge of managing
 // label key
 // Returns an error if no Classifier is currently managing the label key
@@ -227,19 +426,37 @@ func (m *instance) GetManagerForKey(clusterNamespace, clusterName, labelKey stri
 
 	clusterKey := m.getClusterKey(clusterNamespace, clusterName, clusterType)
 
-	if _, ok := m.perClusterLabelMap[clusterKey]; !ok {
+	m.chartMux.Lock()
+	defer m.chartMux.Unlock()
+
+	manager, ok := m.getManager(clusterKey, labelKey)
+	if !ok {
 		return "", fmt.Errorf("no Classifier manging label key %s", labelKey)
 	}
 
-	if _, ok := m.perClusterLabelMap[clusterKey][labelKey]; !ok {
-		return "", fmt.Errorf("no Classifier manging label key %s", labelKey)
+	return manager, nil
+}
+
+// GetManagersForKey returns the names (sorted) of all Classifiers currently managing label key
+// in at least one cluster
+func (m *instance) GetManagersForKey(labelKey string) []string {
+	m.chartMux.Lock()
+	defer m.chartMux.Unlock()
+
+	managers := make(map[string]bool)
+	for clusterKey := range m.perClusterLabelMap {
+		if manager, ok := m.getManager(clusterKey, labelKey); ok {
+			managers[manager] = true
+		}
 	}
 
-	if len(m.perClusterLabelMap[clusterKey][labelKey]) == 0 {
-		return "", fmt.Errorf("no Classifier manging label key %s", labelKey)
+	result := make([]string, 0, len(managers))
+	for manager := range managers {
+		result = append(result, manager)
 	}
+	sort.Strings(result)
 
-	return m.perClusterLabelMap[clusterKey][labelKey][0], nil
+	return result
 }
 
 // GetRegisteredClassifiers returns all Classifiers currently registered for at
@@ -277,21 +494,60 @@ func (m *instance) GetRegisteredClassifiers(clusterNamespace, clusterName string
 // isCurrentlyManager returns true if classifierKey is currently the designed manager
 // for label (key) in the CAPI cluster clusterKey
 func (m *instance) isCurrentlyManager(clusterKey, labelKey, classifierKey string) bool {
-	if _, ok := m.perClusterLabelMap[clusterKey]; !ok {
+	manager, ok := m.getManager(clusterKey, labelKey)
+	if !ok {
 		return false
 	}
 
-	if _, ok := m.perClusterLabelMap[clusterKey][labelKey]; !ok {
-		return false
+	return manager == classifierKey
+}
+
+// getManager returns the Classifier currently in charge of managing label (key) in the
+// cluster clusterKey, as decided by the ConflictResolver.
+// Returns false if no Classifier is managing label (key).
+func (m *instance) getManager(clusterKey, labelKey string) (string, bool) {
+	if _, ok := m.perClusterLabelMap[clusterKey]; !ok {
+		return "", false
 	}
 
-	if len(m.perClusterLabelMap[clusterKey][labelKey]) > 0 &&
-		m.perClusterLabelMap[clusterKey][labelKey][0] == classifierKey {
+	classifiers, ok := m.perClusterLabelMap[clusterKey][labelKey]
+	if !ok || len(classifiers) == 0 {
+		return "", false
+	}
 
-		return true
+	registrations := make([]ClassifierInfo, len(classifiers))
+	for i := range classifiers {
+		registrations[i] = m.getClassifierInfo(classifiers[i])
 	}
 
-	return false
+	return GetCurrentConflictResolver().Resolve(registrations)
+}
+
+// getClassifierInfo returns the Classifier information used by ConflictResolver
+func (m *instance) getClassifierInfo(classifierKey string) ClassifierInfo {
+	info, ok := m.classifierInfo[classifierKey]
+	if !ok {
+		info = ClassifierInfo{Name: classifierKey}
+	}
+	return info
+}
+
+// recordClassifierInfo stores the Classifier information used by ConflictResolver.
+// Returns true if information has changed.
+func (m *instance) recordClassifierInfo(classifierKey string, classifier *libsveltosv1beta1.Classifier) bool {
+	info := ClassifierInfo{
+		Name:              classifierKey,
+		Priority:          GetClassifierPriority(classifier),
+		CreationTimestamp: classifier.CreationTimestamp,
+	}
+
+	current, ok := m.classifierInfo[classifierKey]
+	if ok && current.Priority == info.Priority && current.CreationTimestamp.Equal(&info.CreationTimestamp) {
+		return false
+	}
+
+	m.classifierInfo[classifierKey] = info
+	return true
 }
 
 // getClusterKey returns the Key representing a CAPI Cluster
@@ -324,8 +580,8 @@ func (m *instance) addLabelKeyEntry(clusterKey, labelKey string) {
 
 // addClassifierEntry adds an entry for classifier for a given label (key)
 // Method is idempotent. If Classifier is already registered for a given label (key), it won't be added
-// again
-func (m *instance) addClassifierEntry(clusterKey, labelKey, classifierKey string) {
+// again. Returns true if entry was added.
+func (m *instance) addClassifierEntry(clusterKey, labelKey, classifierKey string) bool {
 	if _, ok := m.perClusterLabelMap[clusterKey]; !ok {
 		m.perClusterLabelMap[clusterKey] = make(map[string][]string)
 	}
@@ -335,10 +591,11 @@ func (m *instance) addClassifierEntry(clusterKey, labelKey, classifierKey string
 	}
 
 	if isClassifierAlreadyRegistered(m.perClusterLabelMap[clusterKey][labelKey], classifierKey) {
-		return
+		return false
 	}
 
 	m.perClusterLabelMap[clusterKey][labelKey] = append(m.perClusterLabelMap[clusterKey][labelKey], classifierKey)
+	return true
 }
 
 // isClassifierAlreadyRegistered returns true if a given Classifier is already present in the slice
@@ -354,7 +611,8 @@ func isClassifierAlreadyRegistered(classifiers []string, classifierKey string) b
 
 // rebuildRegistrations rebuilds internal structures to identify Classifiers managing
 // labels and Classifiers currently just registered but not managing.
-// Relies completely on Classifier.Status
+// Relies completely on Classifier.Status. Classifiers currently managing labels are registered first,
+// so even with FirstWinsStrategy a restart does not change label managers.
 func (m *instance) rebuildRegistrations(ctx context.Context, c client.Client) error {
 	// Lock here
 	m.chartMux.Lock()
@@ -368,20 +626,33 @@ func (m *instance) rebuildRegistrations(ctx context.Context, c client.Client) er
 
 	for i := range classifierList.Items {
 		cs := &classifierList.Items[i]
-		m.addManagers(cs)
+		// Classifiers in dry-run mode never register
+		if IsDryRun(cs) {
+			continue
+		}
+		// Per-cluster status in the Classifier instance might be truncated. ConfigMaps have all of it
+		if err := scope.LoadClusterStatuses(ctx, c, cs); err != nil {
+			return err
+		}
+		m.addManagers(cs, false)
 	}
 
 	for i := range classifierList.Items {
 		cs := &classifierList.Items[i]
+		if IsDryRun(cs) {
+			continue
+		}
 		m.addNonManagers(cs)
 	}
 
 	return nil
 }
 
-// addManagers walks Classifier's status and registers it for each label currently managed
-func (m *instance) addManagers(classifier *libsveltosv1beta1.Classifier) {
+// addManagers walks Classifier's status and registers it for each label currently managed.
+// If first is true, Classifier is registered ahead of any other Classifier already registered.
+func (m *instance) addManagers(classifier *libsveltosv1beta1.Classifier, first bool) {
 	classifierKey := m.getClassifierKey(classifier.Name)
+	m.recordClassifierInfo(classifierKey, classifier)
 
 	for i := range classifier.Status.MachingClusterStatuses {
 		clusterStatus := &classifier.Status.MachingClusterStatuses[i]
@@ -391,16 +662,20 @@ func (m *instance) addManagers(classifier *libsveltosv1beta1.Classifier) {
 		}
 		clusterKey := m.getClusterKey(clusterStatus.ClusterRef.Namespace, clusterStatus.ClusterRef.Name, clusterType)
 
-		m.addManagedLabelsInCluster(classifierKey, clusterKey, clusterStatus.ManagedLabels)
+		m.addManagedLabelsInCluster(classifierKey, clusterKey, clusterStatus.ManagedLabels, first)
 	}
 }
 
-func (m *instance) addManagedLabelsInCluster(classifierKey, clusterKey string, managedLabels []string) {
+func (m *instance) addManagedLabelsInCluster(classifierKey, clusterKey string, managedLabels []string, first bool) {
 	for i := range managedLabels {
 		labelKey := managedLabels[i]
 		m.addClusterEntry(clusterKey)
 		m.addLabelKeyEntry(clusterKey, labelKey)
-		m.addClassifierEntry(clusterKey, labelKey, classifierKey)
+		if m.addClassifierEntry(clusterKey, labelKey, classifierKey) && first {
+			registrations := m.perClusterLabelMap[clusterKey][labelKey]
+			m.perClusterLabelMap[clusterKey][labelKey] = append([]string{classifierKey},
+				registrations[:len(registrations)-1]...)
+		}
 	}
 }
 
@@ -418,7 +693,7 @@ func (m *instance) addNonManagers(classifier *libsveltosv1beta1.Classifier) {
 		clusterKey := m.getClusterKey(clusterStatus.ClusterRef.Namespace, clusterStatus.ClusterRef.Name, clusterType)
 
 		unManagedLabels := m.buildSliceOfUnManagedLabels(clusterStatus.UnManagedLabels)
-		m.addManagedLabelsInCluster(classifierKey, clusterKey, unManagedLabels)
+		m.addManagedLabelsInCluster(classifierKey, clusterKey, unManagedLabels, false)
 	}
 }
 
@@ -234,6 +234,142 @@ var _ = Describe("Chart manager", func() {
 			Expect(registered).To(ContainElement(tmpClassifier1.Name))
 		})
 
+	It("CanManageLabel honors Classifier priority", func() {
+		defer useConflictResolver(keymanager.PriorityStrategy)()
+
+		manager, err := keymanager.GetKeyManagerInstance(context.TODO(), c)
+		Expect(err).To(BeNil())
+
+		clusterType := libsveltosv1beta1.ClusterTypeCapi
+		manager.RegisterClassifierForLabels(classifier, cluster.Namespace, cluster.Name, clusterType)
+
+		// Name is lexicographically greater, so it would lose a tie
+		tmpClassifier := &libsveltosv1beta1.Classifier{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: classifier.Name + randomString(),
+				Annotations: map[string]string{
+					keymanager.ClassifierPriorityAnnotation: "10",
+				},
+			},
+			Spec: classifier.Spec,
+		}
+
+		manager.RegisterClassifierForLabels(tmpClassifier, cluster.Namespace, cluster.Name, clusterType)
+		defer removeSubscriptions(c, tmpClassifier, cluster.Namespace, cluster.Name, clusterType)
+
+		for i := range classifier.Spec.ClassifierLabels {
+			labelKey := classifier.Spec.ClassifierLabels[i].Key
+			Expect(manager.CanManageLabel(tmpClassifier, cluster.Namespace, cluster.Name, labelKey, clusterType)).To(BeTrue())
+			Expect(manager.CanManageLabel(classifier, cluster.Namespace, cluster.Name, labelKey, clusterType)).To(BeFalse())
+			csName, err := manager.GetManagerForKey(cluster.Namespace, cluster.Name, labelKey, clusterType)
+			Expect(err).To(BeNil())
+			Expect(csName).To(Equal(tmpClassifier.Name))
+		}
+
+		By("Lowering tmpClassifier priority ownership moves back")
+		tmpClassifier.Annotations[keymanager.ClassifierPriorityAnnotation] = "-1"
+		manager.RegisterClassifierForLabels(tmpClassifier, cluster.Namespace, cluster.Name, clusterType)
+
+		for i := range classifier.Spec.ClassifierLabels {
+			labelKey := classifier.Spec.ClassifierLabels[i].Key
+			Expect(manager.CanManageLabel(tmpClassifier, cluster.Namespace, cluster.Name, labelKey, clusterType)).To(BeFalse())
+			Expect(manager.CanManageLabel(classifier, cluster.Namespace, cluster.Name, labelKey, clusterType)).To(BeTrue())
+		}
+	})
+
+	It("CanManageLabel breaks ties by Classifier name", func() {
+		defer useConflictResolver(keymanager.PriorityStrategy)()
+
+		manager, err := keymanager.GetKeyManagerInstance(context.TODO(), c)
+		Expect(err).To(BeNil())
+
+		clusterType := libsveltosv1beta1.ClusterTypeCapi
+
+		// Name is lexicographically smaller. Even if registering last, it wins the tie
+		tmpClassifier := &libsveltosv1beta1.Classifier{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: "0" + classifier.Name,
+			},
+			Spec: classifier.Spec,
+		}
+
+		manager.RegisterClassifierForLabels(classifier, cluster.Namespace, cluster.Name, clusterType)
+		manager.RegisterClassifierForLabels(tmpClassifier, cluster.Namespace, cluster.Name, clusterType)
+		defer removeSubscriptions(c, tmpClassifier, cluster.Namespace, cluster.Name, clusterType)
+
+		for i := range classifier.Spec.ClassifierLabels {
+			labelKey := classifier.Spec.ClassifierLabels[i].Key
+			Expect(manager.CanManageLabel(tmpClassifier, cluster.Namespace, cluster.Name, labelKey, clusterType)).To(BeTrue())
+			Expect(manager.CanManageLabel(classifier, cluster.Namespace, cluster.Name, labelKey, clusterType)).To(BeFalse())
+		}
+	})
+
+	It("GetClassifierPriority returns Classifier priority", func() {
+		Expect(keymanager.GetClassifierPriority(classifier)).To(Equal(int32(0)))
+
+		classifier.Annotations = map[string]string{keymanager.ClassifierPriorityAnnotation: "5"}
+		Expect(keymanager.GetClassifierPriority(classifier)).To(Equal(int32(5)))
+
+		classifier.Annotations = map[string]string{keymanager.ClassifierPriorityAnnotation: randomString()}
+		Expect(keymanager.GetClassifierPriority(classifier)).To(Equal(int32(0)))
+	})
+
+	It("WouldManageLabel reports ownership without registering Classifier", func() {
+		defer useConflictResolver(keymanager.PriorityStrategy)()
+
+		manager, err := keymanager.GetKeyManagerInstance(context.TODO(), c)
+		Expect(err).To(BeNil())
+
+		otherClassifier := &libsveltosv1beta1.Classifier{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: randomString(),
+				Annotations: map[string]string{
+					keymanager.ClassifierPriorityAnnotation: "5",
+				},
+			},
+			Spec: classifier.Spec,
+		}
+		manager.RegisterClassifierForLabels(otherClassifier, cluster.Namespace, cluster.Name, libsveltosv1beta1.ClusterTypeCapi)
+		defer removeSubscriptions(c, otherClassifier, cluster.Namespace, cluster.Name, libsveltosv1beta1.ClusterTypeCapi)
+
+		labelKey := classifier.Spec.ClassifierLabels[0].Key
+
+		classifier.Annotations = map[string]string{
+			keymanager.ClassifierDryRunAnnotation: "true",
+		}
+		Expect(keymanager.IsDryRun(classifier)).To(BeTrue())
+		Expect(manager.WouldManageLabel(classifier, cluster.Namespace, cluster.Name, labelKey,
+			libsveltosv1beta1.ClusterTypeCapi)).To(BeFalse())
+
+		classifier.Annotations[keymanager.ClassifierPriorityAnnotation] = "10"
+		Expect(manager.WouldManageLabel(classifier, cluster.Namespace, cluster.Name, labelKey,
+			libsveltosv1beta1.ClusterTypeCapi)).To(BeTrue())
+
+		// Classifier has not been registered
+		Expect(manager.GetRegisteredClassifiers(cluster.Namespace, cluster.Name,
+			libsveltosv1beta1.ClusterTypeCapi)).ToNot(ContainElement(classifier.Name))
+		Expect(manager.CanManageLabel(otherClassifier, cluster.Namespace, cluster.Name, labelKey,
+			libsveltosv1beta1.ClusterTypeCapi)).To(BeTrue())
+	})
+
+	It("GetManagersForKey returns Classifiers managing a label key in any cluster", func() {
+		manager, err := keymanager.GetKeyManagerInstance(context.TODO(), c)
+		Expect(err).To(BeNil())
+
+		labelKey := classifier.Spec.ClassifierLabels[0].Key
+		Expect(manager.GetManagersForKey(labelKey)).ToNot(ContainElement(classifier.Name))
+
+		manager.RegisterClassifierForLabels(classifier, cluster.Namespace, cluster.Name, libsveltosv1beta1.ClusterTypeCapi)
+		defer removeSubscriptions(c, classifier, cluster.Namespace, cluster.Name, libsveltosv1beta1.ClusterTypeCapi)
+
+		Expect(manager.GetManagersForKey(labelKey)).To(ContainElement(classifier.Name))
+		Expect(manager.GetManagersForKey(randomString())).To(BeEmpty())
+
+		initialized, ok := keymanager.GetKeyManagerInstanceIfInitialized()
+		Expect(ok).To(BeTrue())
+		Expect(initialized).To(Equal(manager))
+	})
+
 	It("rebuildRegistrations rebuilds label (keys) registrations", func() {
 		Expect(len(classifier.Spec.ClassifierLabels)).Should(BeNumerically(">=", 2))
 
@@ -286,8 +422,79 @@ var _ = Describe("Chart manager", func() {
 		Expect(manager.CanManageLabel(tmpClassifier, sveltosCluster.Namespace, sveltosCluster.Name,
 			classifier.Spec.ClassifierLabels[1].Key, libsveltosv1beta1.ClusterTypeSveltos)).To(BeTrue())
 	})
+
+	It("rebuildRegistrations rebuilds label (keys) registrations honoring priority", func() {
+		defer useConflictResolver(keymanager.PriorityStrategy)()
+
+		Expect(len(classifier.Spec.ClassifierLabels)).Should(BeNumerically(">=", 2))
+
+		// Mark classifier as manager for one release
+		classifier.Status = libsveltosv1beta1.ClassifierStatus{
+			MachingClusterStatuses: []libsveltosv1beta1.MachingClusterStatus{
+				{
+					ClusterRef: corev1.ObjectReference{Namespace: sveltosCluster.Namespace, Name: sveltosCluster.Name,
+						APIVersion: libsveltosv1beta1.GroupVersion.String(), Kind: libsveltosv1beta1.SveltosClusterKind},
+					ManagedLabels:   []string{classifier.Spec.ClassifierLabels[0].Key},
+					UnManagedLabels: []libsveltosv1beta1.UnManagedLabel{{Key: classifier.Spec.ClassifierLabels[1].Key}},
+				},
+			},
+		}
+		Expect(c.Status().Update(context.TODO(), classifier)).To(Succeed())
+
+		// Mark tmpClassifier as manager for classifier.Spec.ClassifierLabels[1]. tmpClassifier has higher
+		// priority so after rebuild it manages both labels.
+		tmpClassifier := &libsveltosv1beta1.Classifier{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: classifier.Name + randomString(),
+				Annotations: map[string]string{
+					keymanager.ClassifierPriorityAnnotation: "1",
+				},
+			},
+			Spec: classifier.Spec,
+			Status: libsveltosv1beta1.ClassifierStatus{
+				MachingClusterStatuses: []libsveltosv1beta1.MachingClusterStatus{
+					{
+						ClusterRef: corev1.ObjectReference{Namespace: sveltosCluster.Namespace, Name: sveltosCluster.Name,
+							APIVersion: libsveltosv1beta1.GroupVersion.String(), Kind: libsveltosv1beta1.SveltosClusterKind},
+						ManagedLabels:   []string{classifier.Spec.ClassifierLabels[1].Key},
+						UnManagedLabels: []libsveltosv1beta1.UnManagedLabel{{Key: classifier.Spec.ClassifierLabels[0].Key}},
+					},
+				},
+			},
+		}
+		Expect(c.Create(context.TODO(), tmpClassifier)).To(Succeed())
+		defer removeSubscriptions(c, tmpClassifier, sveltosCluster.Namespace, sveltosCluster.Name, libsveltosv1beta1.ClusterTypeSveltos)
+
+		manager, err := keymanager.GetKeyManagerInstance(context.TODO(), c)
+		Expect(err).To(BeNil())
+
+		err = keymanager.RebuildRegistrations(manager, context.TODO(), c)
+		Expect(err).To(BeNil())
+
+		for i := range classifier.Spec.ClassifierLabels {
+			labelKey := classifier.Spec.ClassifierLabels[i].Key
+			Expect(manager.CanManageLabel(classifier, sveltosCluster.Namespace, sveltosCluster.Name,
+				labelKey, libsveltosv1beta1.ClusterTypeSveltos)).To(BeFalse())
+			Expect(manager.CanManageLabel(tmpClassifier, sveltosCluster.Namespace, sveltosCluster.Name,
+				labelKey, libsveltosv1beta1.ClusterTypeSveltos)).To(BeTrue())
+		}
+	})
 })
 
+// useConflictResolver sets the ConflictResolver for strategy and returns a function
+// restoring the default one
+func useConflictResolver(strategy string) func() {
+	resolver, err := keymanager.GetConflictResolver(strategy)
+	Expect(err).To(BeNil())
+	keymanager.SetConflictResolver(resolver)
+
+	return func() {
+		resolver, err := keymanager.GetConflictResolver(keymanager.FirstWinsStrategy)
+		Expect(err).To(BeNil())
+		keymanager.SetConflictResolver(resolver)
+	}
+}
+
 func removeSubscriptions(c client.Client, classifier *libsveltosv1beta1.Classifier,
 	clusterNamespace, clusterName string, clusterType libsveltosv1beta1.ClusterType) {
 
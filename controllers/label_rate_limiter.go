@@ -0,0 +1,361 @@
+/*
+Copyright 2022. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/projectsveltos/classifier/pkg/scope"
+	libsveltosv1beta1 "github.com/projectsveltos/libsveltos/api/v1beta1"
+	"github.com/projectsveltos/libsveltos/lib/clusterproxy"
+	logs "github.com/projectsveltos/libsveltos/lib/logsettings"
+)
+
+const (
+	// ClassifierLabelChangeRateLimitAnnotation contains the maximum number of clusters the Classifier
+	// can relabel per minute. A cluster is relabeled when labels set by the Classifier change or when
+	// the cluster stops matching the Classifier. Changes over the limit stay queued (listed in the
+	// LabelChangesQueued condition) and are applied once allowed.
+	// When not set, only the global limit (if any) applies.
+	ClassifierLabelChangeRateLimitAnnotation = "classifier.projectsveltos.io/label-change-rate-limit"
+
+	// ClassifierSkipLabelChangeRateLimitAnnotation, when set to "true", makes Classifier bypass both the
+	// global and its own label change rate limit. Meant for emergencies.
+	ClassifierSkipLabelChangeRateLimitAnnotation = "classifier.projectsveltos.io/skip-label-change-rate-limit"
+)
+
+const (
+	// labelChangeRateWindow is the window label change rate limits refer to
+	labelChangeRateWindow = time.Minute
+
+	// maxReportedQueuedClusters is the maximum number of clusters listed in the LabelChangesQueued condition
+	maxReportedQueuedClusters = 10
+)
+
+// labelChangeLimiter tracks the clusters relabeled in the last labelChangeRateWindow, globally and
+// per Classifier, and the clusters whose label changes are queued because over the limit.
+type labelChangeLimiter struct {
+	mu sync.Mutex
+
+	// time clusters were relabeled at (by any Classifier)
+	global []time.Time
+
+	// key: Classifier name; value: time clusters were relabeled at by the Classifier
+	perClassifier map[string][]time.Time
+
+	// key: Classifier name; value: set of clusters (as returned by getClusterDescription)
+	// with label changes queued
+	queued map[string]map[string]bool
+}
+
+var labelRateLimiter = newLabelChangeLimiter()
+
+// labelChangeReservation is a cluster relabeling accounted for by labelChangeLimiter
+type labelChangeReservation struct {
+	classifierName string
+	at             time.Time
+}
+
+func newLabelChangeLimiter() *labelChangeLimiter {
+	return &labelChangeLimiter{
+		perClassifier: make(map[string][]time.Time),
+		queued:        make(map[string]map[string]bool),
+	}
+}
+
+// getLabelChangeRateLimit returns the maximum number of clusters a Classifier can relabel per minute.
+// Zero means no limit.
+func getLabelChangeRateLimit(classifier *libsveltosv1beta1.Classifier) (int, error) {
+	value, ok := classifier.Annotations[ClassifierLabelChangeRateLimitAnnotation]
+	if !ok {
+		return 0, nil
+	}
+
+	limit, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid annotation %s: %w", ClassifierLabelChangeRateLimitAnnotation, err)
+	}
+	if limit < 0 {
+		return 0, fmt.Errorf("invalid annotation %s: limit cannot be negative",
+			ClassifierLabelChangeRateLimitAnnotation)
+	}
+
+	return limit, nil
+}
+
+// isLabelChangeRateLimitSkipped returns true if Classifier bypasses label change rate limits
+func isLabelChangeRateLimitSkipped(classifier *libsveltosv1beta1.Classifier) bool {
+	return classifier.Annotations[ClassifierSkipLabelChangeRateLimitAnnotation] == "true"
+}
+
+// prune removes relabel times older than labelChangeRateWindow. Must be called with mu held.
+func (l *labelChangeLimiter) prune(classifierName string, now time.Time) {
+	pruneTimes := func(times []time.Time) []time.Time {
+		i := 0
+		for i < len(times) && now.Sub(times[i]) >= labelChangeRateWindow {
+			i++
+		}
+		return times[i:]
+	}
+
+	l.global = pruneTimes(l.global)
+	l.perClassifier[classifierName] = pruneTimes(l.perClassifier[classifierName])
+	if len(l.perClassifier[classifierName]) == 0 {
+		delete(l.perClassifier, classifierName)
+	}
+}
+
+// reserve returns true if Classifier can relabel cluster now. In such case the change is accounted for.
+// Otherwise cluster is added to the clusters with label changes queued for the Classifier.
+// A limit of zero means no limit. If skip is true, limits are not enforced (change is still accounted for).
+func (l *labelChangeLimiter) reserve(classifierName, cluster string, globalLimit, classifierLimit int,
+	skip bool, now time.Time) bool {
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.prune(classifierName, now)
+
+	if !skip {
+		if (globalLimit > 0 && len(l.global) >= globalLimit) ||
+			(classifierLimit > 0 && len(l.perClassifier[classifierName]) >= classifierLimit) {
+
+			if l.queued[classifierName] == nil {
+				l.queued[classifierName] = make(map[string]bool)
+			}
+			l.queued[classifierName][cluster] = true
+			return false
+		}
+	}
+
+	l.global = append(l.global, now)
+	l.perClassifier[classifierName] = append(l.perClassifier[classifierName], now)
+	if l.queued[classifierName] != nil {
+		delete(l.queued[classifierName], cluster)
+	}
+	return true
+}
+
+// release gives back a reservation, for instance because the label change it was made for failed.
+// Nil reservations are ignored.
+func (l *labelChangeLimiter) release(reservation *labelChangeReservation) {
+	if reservation == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	removeTime := func(times []time.Time) []time.Time {
+		for i := len(times) - 1; i >= 0; i-- {
+			if times[i].Equal(reservation.at) {
+				return append(times[:i], times[i+1:]...)
+			}
+		}
+		return times
+	}
+
+	l.global = removeTime(l.global)
+	l.perClassifier[reservation.classifierName] = removeTime(l.perClassifier[reservation.classifierName])
+	if len(l.perClassifier[reservation.classifierName]) == 0 {
+		delete(l.perClassifier, reservation.classifierName)
+	}
+}
+
+// retryAfter returns how long to wait before Classifier can relabel a cluster again
+func (l *labelChangeLimiter) retryAfter(classifierName string, globalLimit, classifierLimit int,
+	now time.Time) time.Duration {
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.prune(classifierName, now)
+
+	var retry time.Duration
+	if globalLimit > 0 && len(l.global) >= globalLimit {
+		retry = l.global[len(l.global)-globalLimit].Add(labelChangeRateWindow).Sub(now)
+	}
+	times := l.perClassifier[classifierName]
+	if classifierLimit > 0 && len(times) >= classifierLimit {
+		if tmp := times[len(times)-classifierLimit].Add(labelChangeRateWindow).Sub(now); tmp > retry {
+			retry = tmp
+		}
+	}
+
+	return retry
+}
+
+// getQueued returns the clusters with label changes queued for a Classifier (sorted)
+func (l *labelChangeLimiter) getQueued(classifierName string) []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	queued := make([]string, 0, len(l.queued[classifierName]))
+	for cluster := range l.queued[classifierName] {
+		queued = append(queued, cluster)
+	}
+	sort.Strings(queued)
+	return queued
+}
+
+// resetQueued forgets all label changes queued for a Classifier. Called at the beginning of each
+// reconciliation, as label changes still over the limit are queued again.
+func (l *labelChangeLimiter) resetQueued(classifierName string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.queued, classifierName)
+}
+
+// forget removes all information about a Classifier
+func (l *labelChangeLimiter) forget(classifierName string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.queued, classifierName)
+	delete(l.perClassifier, classifierName)
+}
+
+// canChangeLabels returns a reservation if Classifier is allowed to relabel cluster now, considering
+// both the global and the Classifier label change rate limits. Nil otherwise.
+// Callers must be about to change labels on the cluster, and release the reservation if that fails.
+func (r *ClassifierReconciler) canChangeLabels(classifier *libsveltosv1beta1.Classifier,
+	cluster *corev1.ObjectReference, logger logr.Logger) (*labelChangeReservation, error) {
+
+	classifierLimit, err := getLabelChangeRateLimit(classifier)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if !labelRateLimiter.reserve(classifier.Name, getClusterDescription(cluster), r.LabelChangeRateLimit,
+		classifierLimit, isLabelChangeRateLimitSkipped(classifier), now) {
+
+		logger.V(logs.LogInfo).Info(fmt.Sprintf("label changes on cluster %s queued: rate limit reached",
+			getClusterDescription(cluster)))
+		return nil, nil
+	}
+
+	return &labelChangeReservation{classifierName: classifier.Name, at: now}, nil
+}
+
+// limitMatchRemovals returns the clusters to consider a match for the Classifier. Clusters which stopped
+// matching (present in oldMatchingClusters but not in currentMatchingClusters) are still considered a match
+// if label change rate limits do not allow relabeling those yet. Clusters which do not exist anymore, or
+// where Classifier has no label to remove, are never kept.
+// It also returns the reservations made for the clusters whose labels can be removed. Those must be
+// released if removing labels fails.
+func (r *ClassifierReconciler) limitMatchRemovals(ctx context.Context, classifier *libsveltosv1beta1.Classifier,
+	currentMatchingClusters, oldMatchingClusters map[corev1.ObjectReference]bool, logger logr.Logger,
+) (map[corev1.ObjectReference]bool, map[corev1.ObjectReference]*labelChangeReservation, error) {
+
+	removed := make([]corev1.ObjectReference, 0)
+	for ref := range oldMatchingClusters {
+		if !currentMatchingClusters[ref] {
+			removed = append(removed, ref)
+		}
+	}
+	sort.Slice(removed, func(i, j int) bool {
+		return getClusterDescription(&removed[i]) < getClusterDescription(&removed[j])
+	})
+
+	fieldManager := getClassifierFieldManager(classifier.Name)
+	reservations := make(map[corev1.ObjectReference]*labelChangeReservation)
+	for i := range removed {
+		ref := &removed[i]
+		cluster, err := clusterproxy.GetCluster(ctx, r.Client, ref.Namespace, ref.Name, clusterproxy.GetClusterType(ref))
+		if err != nil {
+			if apierrors.IsNotFound(err) {
+				continue
+			}
+			releaseLabelChanges(reservations)
+			return nil, nil, err
+		}
+
+		if len(getAppliedLabels(cluster, fieldManager, logger)) == 0 {
+			// No label to remove. This is not a relabeling.
+			continue
+		}
+
+		reservation, err := r.canChangeLabels(classifier, ref, logger)
+		if err != nil {
+			releaseLabelChanges(reservations)
+			return nil, nil, err
+		}
+		if reservation == nil {
+			currentMatchingClusters[*ref] = true
+			continue
+		}
+		reservations[*ref] = reservation
+	}
+
+	return currentMatchingClusters, reservations, nil
+}
+
+// releaseLabelChanges releases all reservations
+func releaseLabelChanges(reservations map[corev1.ObjectReference]*labelChangeReservation) {
+	for _, reservation := range reservations {
+		labelRateLimiter.release(reservation)
+	}
+}
+
+// getLabelChangeRequeueAfter returns how long to wait before queued label changes can be applied.
+// Zero if no label change is queued.
+func (r *ClassifierReconciler) getLabelChangeRequeueAfter(classifier *libsveltosv1beta1.Classifier) time.Duration {
+	if len(labelRateLimiter.getQueued(classifier.Name)) == 0 {
+		return 0
+	}
+
+	// Annotation was already successfully parsed during this reconciliation
+	classifierLimit, _ := getLabelChangeRateLimit(classifier)
+	retry := labelRateLimiter.retryAfter(classifier.Name, r.LabelChangeRateLimit, classifierLimit, time.Now())
+	if retry < minStabilizationRequeueAfter {
+		retry = minStabilizationRequeueAfter
+	}
+	return retry
+}
+
+// updateLabelChangesQueuedCondition sets LabelChangesQueued condition
+func updateLabelChangesQueuedCondition(classifierScope *scope.ClassifierScope) {
+	queued := labelRateLimiter.getQueued(classifierScope.Name())
+	if len(queued) == 0 {
+		classifierScope.SetCondition(scope.LabelChangesQueuedCondition, metav1.ConditionFalse,
+			noLabelChangesQueuedReason, "")
+		return
+	}
+
+	message := fmt.Sprintf("label changes on %d cluster(s) are queued by rate limit", len(queued))
+	if len(queued) > maxReportedQueuedClusters {
+		message += fmt.Sprintf(": %s and %d more", strings.Join(queued[:maxReportedQueuedClusters], ", "),
+			len(queued)-maxReportedQueuedClusters)
+	} else {
+		message += ": " + strings.Join(queued, ", ")
+	}
+	classifierScope.SetCondition(scope.LabelChangesQueuedCondition, metav1.ConditionTrue,
+		labelChangesQueuedReason, message)
+}
@@ -0,0 +1,155 @@
+/*
+Copyright 2022. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers_test
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2/textlogger"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/projectsveltos/classifier/controllers"
+	libsveltosv1beta1 "github.com/projectsveltos/libsveltos/api/v1beta1"
+)
+
+var _ = Describe("Classifier label change rate limiter", func() {
+	It("getLabelChangeRateLimit parses the rate limit annotation", func() {
+		classifier := getClassifierInstance(randomString())
+		limit, err := controllers.GetLabelChangeRateLimit(classifier)
+		Expect(err).To(BeNil())
+		Expect(limit).To(BeZero())
+
+		classifier.Annotations = map[string]string{controllers.ClassifierLabelChangeRateLimitAnnotation: "5"}
+		limit, err = controllers.GetLabelChangeRateLimit(classifier)
+		Expect(err).To(BeNil())
+		Expect(limit).To(Equal(5))
+
+		classifier.Annotations[controllers.ClassifierLabelChangeRateLimitAnnotation] = "five"
+		_, err = controllers.GetLabelChangeRateLimit(classifier)
+		Expect(err).ToNot(BeNil())
+
+		classifier.Annotations[controllers.ClassifierLabelChangeRateLimitAnnotation] = "-1"
+		_, err = controllers.GetLabelChangeRateLimit(classifier)
+		Expect(err).ToNot(BeNil())
+	})
+
+	It("reserve enforces global and per Classifier limits and queues changes over the limit", func() {
+		limiter := controllers.NewLabelChangeLimiter()
+		now := time.Now()
+		classifier1 := randomString()
+		classifier2 := randomString()
+
+		// Per Classifier limit
+		Expect(controllers.ReserveLabelChange(limiter, classifier1, "cluster1", 0, 2, false, now)).To(BeTrue())
+		Expect(controllers.ReserveLabelChange(limiter, classifier1, "cluster2", 0, 2, false, now)).To(BeTrue())
+		Expect(controllers.ReserveLabelChange(limiter, classifier1, "cluster3", 0, 2, false, now)).To(BeFalse())
+		Expect(controllers.GetQueuedLabelChanges(limiter, classifier1)).To(Equal([]string{"cluster3"}))
+		Expect(controllers.GetLabelChangeRetry(limiter, classifier1, 0, 2, now.Add(10*time.Second))).
+			To(Equal(50 * time.Second))
+
+		// Global limit counts changes by all Classifiers
+		Expect(controllers.ReserveLabelChange(limiter, classifier2, "cluster1", 2, 0, false, now)).To(BeFalse())
+		Expect(controllers.GetQueuedLabelChanges(limiter, classifier2)).To(Equal([]string{"cluster1"}))
+
+		// Override annotation bypasses limits
+		Expect(controllers.ReserveLabelChange(limiter, classifier2, "cluster1", 2, 0, true, now)).To(BeTrue())
+		Expect(controllers.GetQueuedLabelChanges(limiter, classifier2)).To(BeEmpty())
+
+		// Once window elapses, queued changes are allowed
+		later := now.Add(time.Minute)
+		Expect(controllers.ReserveLabelChange(limiter, classifier1, "cluster3", 0, 2, false, later)).To(BeTrue())
+		Expect(controllers.GetQueuedLabelChanges(limiter, classifier1)).To(BeEmpty())
+	})
+
+	It("limitMatchRemovals keeps clusters not matching anymore till rate limit allows relabeling them", func() {
+		classifier := getClassifierInstance(randomString())
+		classifier.Annotations = map[string]string{controllers.ClassifierLabelChangeRateLimitAnnotation: "1"}
+
+		getClusterReference := func(cluster *libsveltosv1beta1.SveltosCluster) corev1.ObjectReference {
+			return corev1.ObjectReference{
+				Namespace: cluster.Namespace, Name: cluster.Name,
+				Kind: libsveltosv1beta1.SveltosClusterKind, APIVersion: libsveltosv1beta1.GroupVersion.String(),
+			}
+		}
+
+		initObjects := []client.Object{classifier}
+		oldMatchingClusters := make(map[corev1.ObjectReference]bool)
+		for i := 0; i < 3; i++ {
+			cluster := &libsveltosv1beta1.SveltosCluster{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: randomString(),
+					Name:      randomString(),
+					ManagedFields: []metav1.ManagedFieldsEntry{
+						{
+							Manager:    controllers.GetClassifierFieldManager(classifier.Name),
+							Operation:  metav1.ManagedFieldsOperationApply,
+							FieldsType: "FieldsV1",
+							FieldsV1:   &metav1.FieldsV1{Raw: []byte(`{"f:metadata":{"f:labels":{"f:env":{}}}}`)},
+						},
+					},
+				},
+			}
+			initObjects = append(initObjects, cluster)
+			oldMatchingClusters[getClusterReference(cluster)] = true
+		}
+		// Cluster with no label set by Classifier is never kept and does not consume the rate limit
+		unlabeledCluster := &libsveltosv1beta1.SveltosCluster{
+			ObjectMeta: metav1.ObjectMeta{Namespace: randomString(), Name: randomString()},
+		}
+		initObjects = append(initObjects, unlabeledCluster)
+		oldMatchingClusters[getClusterReference(unlabeledCluster)] = true
+		// Cluster which does not exist anymore is never kept
+		oldMatchingClusters[corev1.ObjectReference{
+			Namespace: randomString(), Name: randomString(),
+			Kind: libsveltosv1beta1.SveltosClusterKind, APIVersion: libsveltosv1beta1.GroupVersion.String(),
+		}] = true
+
+		c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(initObjects...).Build()
+		reconciler := getClassifierReconciler(c, nil)
+		logger := textlogger.NewLogger(textlogger.NewConfig(textlogger.Verbosity(1)))
+
+		currentMatchingClusters, reservations, err := controllers.LimitMatchRemovals(reconciler, context.TODO(), classifier,
+			map[corev1.ObjectReference]bool{}, oldMatchingClusters, logger)
+		Expect(err).To(BeNil())
+		Expect(currentMatchingClusters).To(HaveLen(2))
+		Expect(currentMatchingClusters).ToNot(HaveKey(getClusterReference(unlabeledCluster)))
+		Expect(reservations).To(HaveLen(1))
+
+		// Releasing reservations (label removal failed) allows relabeling again
+		controllers.ReleaseLabelChanges(reservations)
+		currentMatchingClusters, reservations, err = controllers.LimitMatchRemovals(reconciler, context.TODO(), classifier,
+			map[corev1.ObjectReference]bool{}, oldMatchingClusters, logger)
+		Expect(err).To(BeNil())
+		Expect(currentMatchingClusters).To(HaveLen(2))
+		Expect(reservations).To(HaveLen(1))
+
+		// With override annotation all clusters are released
+		classifier.Annotations[controllers.ClassifierSkipLabelChangeRateLimitAnnotation] = "true"
+		currentMatchingClusters, reservations, err = controllers.LimitMatchRemovals(reconciler, context.TODO(), classifier,
+			map[corev1.ObjectReference]bool{}, oldMatchingClusters, logger)
+		Expect(err).To(BeNil())
+		Expect(currentMatchingClusters).To(BeEmpty())
+		Expect(reservations).To(HaveLen(3))
+	})
+})
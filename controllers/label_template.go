@@ -0,0 +1,234 @@
+/*
+Copyright 2022. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	libsveltosv1beta1 "github.com/projectsveltos/libsveltos/api/v1beta1"
+	logs "github.com/projectsveltos/libsveltos/lib/logsettings"
+)
+
+// ClassifierLabels values can be templates (for instance "v{{ .KubernetesVersion.Major }}.{{ .KubernetesVersion.Minor }}").
+// Templates are rendered per cluster using labelTemplateData, which only contains cluster fields
+// (namespace, name, type, labels, annotations and Kubernetes version). Values of resources matched
+// by Classifier in the managed cluster are not available: ClassifierReport only says whether the
+// cluster is a match.
+// Keymanager only deals with label keys, so a templated label is owned the same way a static one is.
+
+// kubernetesVersion is the Kubernetes version of a cluster. Major, Minor and Patch are
+// empty if version is not known.
+type kubernetesVersion struct {
+	// Version is the full version (for instance v1.29.3)
+	Version string
+	Major   string
+	Minor   string
+	Patch   string
+}
+
+// labelTemplateData is the data available when rendering a templated label value
+type labelTemplateData struct {
+	ClusterNamespace   string
+	ClusterName        string
+	ClusterType        string
+	ClusterLabels      map[string]string
+	ClusterAnnotations map[string]string
+	KubernetesVersion  kubernetesVersion
+}
+
+// isTemplatedLabelValue returns true if label value is a template
+func isTemplatedLabelValue(value string) bool {
+	return strings.Contains(value, "{{")
+}
+
+// hasTemplatedLabels returns true if at least one of Classifier labels has a templated value
+func hasTemplatedLabels(classifier *libsveltosv1beta1.Classifier) bool {
+	for i := range classifier.Spec.ClassifierLabels {
+		if isTemplatedLabelValue(classifier.Spec.ClassifierLabels[i].Value) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseKubernetesVersion splits a version (for instance v1.29.3+k3s1) in its components
+func parseKubernetesVersion(version string) kubernetesVersion {
+	result := kubernetesVersion{Version: version}
+	if version == "" {
+		return result
+	}
+
+	v := strings.TrimPrefix(version, "v")
+	// Drop pre-release and build metadata
+	if index := strings.IndexAny(v, "-+"); index != -1 {
+		v = v[:index]
+	}
+
+	const components = 3
+	parts := strings.SplitN(v, ".", components)
+	result.Major = parts[0]
+	if len(parts) > 1 {
+		result.Minor = parts[1]
+	}
+	if len(parts) > 2 {
+		result.Patch = parts[2]
+	}
+
+	return result
+}
+
+// getClusterKubernetesVersion returns the Kubernetes version of a cluster.
+// For SveltosCluster, that is Status.Version. For CAPI Cluster, that is Spec.Topology.Version for
+// clusters using a ClusterClass, otherwise the version reported by the control plane referenced by
+// Spec.ControlPlaneRef (status.version, falling back to spec.version).
+// Returns an empty string if version is not known.
+func getClusterKubernetesVersion(ctx context.Context, c client.Client, cluster client.Object) (string, error) {
+	switch cl := cluster.(type) {
+	case *libsveltosv1beta1.SveltosCluster:
+		return cl.Status.Version, nil
+	case *clusterv1.Cluster:
+		if cl.Spec.Topology != nil && cl.Spec.Topology.Version != "" {
+			return cl.Spec.Topology.Version, nil
+		}
+		if cl.Spec.ControlPlaneRef != nil {
+			return getControlPlaneVersion(ctx, c, cl)
+		}
+	}
+	return "", nil
+}
+
+// getControlPlaneVersion returns the Kubernetes version of the control plane referenced by a CAPI Cluster
+func getControlPlaneVersion(ctx context.Context, c client.Client, cluster *clusterv1.Cluster) (string, error) {
+	ref := cluster.Spec.ControlPlaneRef
+
+	controlPlane := &unstructured.Unstructured{}
+	controlPlane.SetAPIVersion(ref.APIVersion)
+	controlPlane.SetKind(ref.Kind)
+	namespace := ref.Namespace
+	if namespace == "" {
+		namespace = cluster.Namespace
+	}
+	if err := c.Get(ctx, types.NamespacedName{Namespace: namespace, Name: ref.Name}, controlPlane); err != nil {
+		if apierrors.IsNotFound(err) {
+			return "", nil
+		}
+		return "", err
+	}
+
+	for _, path := range [][]string{{"status", "version"}, {"spec", "version"}} {
+		version, found, err := unstructured.NestedString(controlPlane.Object, path...)
+		if err != nil {
+			return "", err
+		}
+		if found && version != "" {
+			return version, nil
+		}
+	}
+
+	return "", nil
+}
+
+// getLabelTemplateData returns the data used to render templated label values for a cluster
+func getLabelTemplateData(ctx context.Context, c client.Client, cluster client.Object,
+	clusterType libsveltosv1beta1.ClusterType) (*labelTemplateData, error) {
+
+	version, err := getClusterKubernetesVersion(ctx, c, cluster)
+	if err != nil {
+		return nil, err
+	}
+
+	return &labelTemplateData{
+		ClusterNamespace:   cluster.GetNamespace(),
+		ClusterName:        cluster.GetName(),
+		ClusterType:        string(clusterType),
+		ClusterLabels:      cluster.GetLabels(),
+		ClusterAnnotations: cluster.GetAnnotations(),
+		KubernetesVersion:  parseKubernetesVersion(version),
+	}, nil
+}
+
+// renderLabelValue renders a templated label value. Returns an error if template is not valid
+// or rendered value is not a valid label value.
+func renderLabelValue(labelKey, value string, data *labelTemplateData) (string, error) {
+	tmpl, err := template.New(labelKey).Option("missingkey=error").Parse(value)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse template for label %s: %w", labelKey, err)
+	}
+
+	var buffer bytes.Buffer
+	if err := tmpl.Execute(&buffer, data); err != nil {
+		return "", fmt.Errorf("failed to render template for label %s: %w", labelKey, err)
+	}
+
+	rendered := strings.TrimSpace(buffer.String())
+	if errs := validation.IsValidLabelValue(rendered); len(errs) != 0 {
+		return "", fmt.Errorf("rendered value %q for label %s is not valid: %s", rendered, labelKey,
+			strings.Join(errs, ", "))
+	}
+
+	return rendered, nil
+}
+
+// getClassifierLabelValues returns, for each label in Classifier ClassifierLabels, the value to set
+// on the cluster. Templated values are rendered. Labels whose template cannot be rendered are
+// skipped (error is logged and reported with an Event).
+func (r *ClassifierReconciler) getClassifierLabelValues(ctx context.Context, classifier *libsveltosv1beta1.Classifier,
+	cluster client.Object, clusterType libsveltosv1beta1.ClusterType, logger logr.Logger) (map[string]string, error) {
+
+	values := make(map[string]string, len(classifier.Spec.ClassifierLabels))
+
+	var data *labelTemplateData
+	if hasTemplatedLabels(classifier) {
+		var err error
+		data, err = getLabelTemplateData(ctx, r.Client, cluster, clusterType)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for i := range classifier.Spec.ClassifierLabels {
+		label := &classifier.Spec.ClassifierLabels[i]
+		if !isTemplatedLabelValue(label.Value) {
+			values[label.Key] = label.Value
+			continue
+		}
+
+		rendered, err := renderLabelValue(label.Key, label.Value, data)
+		if err != nil {
+			logger.V(logs.LogInfo).Info(err.Error())
+			r.recordEvent(classifier, corev1.EventTypeWarning, labelRenderFailedReason,
+				"label %s not set on cluster %s/%s: %v", label.Key, cluster.GetNamespace(), cluster.GetName(), err)
+			continue
+		}
+		values[label.Key] = rendered
+	}
+
+	return values, nil
+}
@@ -0,0 +1,148 @@
+/*
+Copyright 2022. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers_test
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog/v2/textlogger"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/projectsveltos/classifier/controllers"
+	libsveltosv1beta1 "github.com/projectsveltos/libsveltos/api/v1beta1"
+)
+
+var _ = Describe("Templated label values", func() {
+	It("parseKubernetesVersion splits version in its components", func() {
+		version := controllers.ParseKubernetesVersion("v1.29.3+k3s1")
+		Expect(version.Version).To(Equal("v1.29.3+k3s1"))
+		Expect(version.Major).To(Equal("1"))
+		Expect(version.Minor).To(Equal("29"))
+		Expect(version.Patch).To(Equal("3"))
+
+		version = controllers.ParseKubernetesVersion("1.30.0-rc.1")
+		Expect(version.Major).To(Equal("1"))
+		Expect(version.Minor).To(Equal("30"))
+		Expect(version.Patch).To(Equal("0"))
+
+		version = controllers.ParseKubernetesVersion("")
+		Expect(version.Major).To(BeEmpty())
+	})
+
+	It("getClassifierLabelValues renders templated label values", func() {
+		sveltosCluster := &libsveltosv1beta1.SveltosCluster{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: randomString(),
+				Name:      randomString(),
+			},
+			Status: libsveltosv1beta1.SveltosClusterStatus{
+				Version: "v1.29.3",
+			},
+		}
+
+		staticValue := randomString()
+		classifier := getClassifierInstance(randomString())
+		classifier.Spec.ClassifierLabels = []libsveltosv1beta1.ClassifierLabel{
+			{Key: "static", Value: staticValue},
+			{Key: "k8s-version", Value: "v{{ .KubernetesVersion.Major }}.{{ .KubernetesVersion.Minor }}"},
+			{Key: "namespace", Value: "{{ .ClusterNamespace }}"},
+			{Key: "missing", Value: "{{ .NotExisting }}"},
+			// Only cluster fields are available
+			{Key: "report", Value: "{{ .ClassifierReport.Name }}"},
+			{Key: "invalid", Value: "{{ .ClusterName }}!"},
+		}
+
+		initObjects := []client.Object{
+			classifier,
+			sveltosCluster,
+		}
+
+		c := fake.NewClientBuilder().WithScheme(scheme).WithStatusSubresource(initObjects...).
+			WithObjects(initObjects...).Build()
+
+		recorder := record.NewFakeRecorder(10)
+		reconciler := getClassifierReconciler(c, nil)
+		reconciler.EventRecorder = recorder
+
+		values, err := controllers.GetClassifierLabelValues(reconciler, context.TODO(), classifier, sveltosCluster,
+			libsveltosv1beta1.ClusterTypeSveltos, textlogger.NewLogger(textlogger.NewConfig(textlogger.Verbosity(1))))
+		Expect(err).To(BeNil())
+		Expect(values).To(HaveKeyWithValue("static", staticValue))
+		Expect(values).To(HaveKeyWithValue("k8s-version", "v1.29"))
+		Expect(values).To(HaveKeyWithValue("namespace", sveltosCluster.Namespace))
+		// Labels whose template cannot be rendered into a valid label value are skipped
+		Expect(values).ToNot(HaveKey("missing"))
+		Expect(values).ToNot(HaveKey("report"))
+		Expect(values).ToNot(HaveKey("invalid"))
+		// and reported with an event
+		Expect(recorder.Events).To(HaveLen(3))
+		Expect(<-recorder.Events).To(ContainSubstring("LabelRenderFailed"))
+	})
+
+	It("getClassifierLabelValues uses control plane version for CAPI clusters without topology", func() {
+		controlPlane := &unstructured.Unstructured{}
+		controlPlane.SetAPIVersion("controlplane.cluster.x-k8s.io/v1beta1")
+		controlPlane.SetKind("KubeadmControlPlane")
+		controlPlane.SetNamespace(randomString())
+		controlPlane.SetName(randomString())
+		Expect(unstructured.SetNestedField(controlPlane.Object, "v1.31.2", "spec", "version")).To(Succeed())
+
+		cluster := &clusterv1.Cluster{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: controlPlane.GetNamespace(),
+				Name:      randomString(),
+			},
+			Spec: clusterv1.ClusterSpec{
+				ControlPlaneRef: &corev1.ObjectReference{
+					APIVersion: controlPlane.GetAPIVersion(),
+					Kind:       controlPlane.GetKind(),
+					Name:       controlPlane.GetName(),
+				},
+			},
+		}
+
+		classifier := getClassifierInstance(randomString())
+		classifier.Spec.ClassifierLabels = []libsveltosv1beta1.ClassifierLabel{
+			{Key: "k8s-version", Value: "v{{ .KubernetesVersion.Major }}.{{ .KubernetesVersion.Minor }}"},
+		}
+
+		c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(classifier, cluster, controlPlane).Build()
+
+		values, err := controllers.GetClassifierLabelValues(getClassifierReconciler(c, nil), context.TODO(), classifier,
+			cluster, libsveltosv1beta1.ClusterTypeCapi, textlogger.NewLogger(textlogger.NewConfig(textlogger.Verbosity(1))))
+		Expect(err).To(BeNil())
+		Expect(values).To(HaveKeyWithValue("k8s-version", "v1.31"))
+
+		// status.version, when reported, takes precedence
+		Expect(unstructured.SetNestedField(controlPlane.Object, "v1.30.5", "status", "version")).To(Succeed())
+		Expect(c.Update(context.TODO(), controlPlane)).To(Succeed())
+
+		values, err = controllers.GetClassifierLabelValues(getClassifierReconciler(c, nil), context.TODO(), classifier,
+			cluster, libsveltosv1beta1.ClusterTypeCapi, textlogger.NewLogger(textlogger.NewConfig(textlogger.Verbosity(1))))
+		Expect(err).To(BeNil())
+		Expect(values).To(HaveKeyWithValue("k8s-version", "v1.30"))
+	})
+})
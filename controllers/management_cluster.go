@@ -31,6 +31,7 @@ var (
 	sveltosAgentConfigMap   string
 	registry                string
 	agentInMgmtCluster      bool
+	uninstallAgent          bool
 )
 
 func SetManagementClusterAccess(config *rest.Config, c client.Client) {
@@ -50,6 +51,10 @@ func SetAgentInMgmtCluster(isInMgmtCluster bool) {
 	agentInMgmtCluster = isInMgmtCluster
 }
 
+func SetUninstallSveltosAgent(uninstall bool) {
+	uninstallAgent = uninstall
+}
+
 func getManagementClusterConfig() *rest.Config {
 	return managementClusterConfig
 }
@@ -70,6 +75,10 @@ func getAgentInMgmtCluster() bool {
 	return agentInMgmtCluster
 }
 
+func getUninstallSveltosAgent() bool {
+	return uninstallAgent
+}
+
 func collectSveltosAgentConfigMap(ctx context.Context, name string) (*corev1.ConfigMap, error) {
 	c := getManagementClusterClient()
 	configMap := &corev1.ConfigMap{}
@@ -0,0 +1,376 @@
+/*
+Copyright 2022. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	libsveltosv1beta1 "github.com/projectsveltos/libsveltos/api/v1beta1"
+	"github.com/projectsveltos/libsveltos/lib/clusterproxy"
+	logs "github.com/projectsveltos/libsveltos/lib/logsettings"
+)
+
+const (
+	// ClassifierManagementConstraintAnnotation contains, in JSON format, a ManagementClusterConstraint.
+	// Such constraint is evaluated by the classifier controller using only the CAPI Cluster/Machine and
+	// SveltosCluster instances present in the management cluster.
+	// If Classifier has neither DeployedResourceConstraint nor KubernetesVersionConstraints, the
+	// ManagementClusterConstraint is the only criteria and neither sveltos-agent nor any CRD is deployed
+	// in the managed clusters. Otherwise a cluster is a match only if it matches both.
+	ClassifierManagementConstraintAnnotation = "classifier.projectsveltos.io/management-constraint"
+)
+
+// ReplicaRange defines a range for a number of replicas. Both ends are inclusive.
+type ReplicaRange struct {
+	// Min is the minimum number of replicas
+	// +optional
+	Min *int32 `json:"min,omitempty"`
+
+	// Max is the maximum number of replicas
+	// +optional
+	Max *int32 `json:"max,omitempty"`
+}
+
+// ManagementClusterConstraint allows to classify clusters based only on information available
+// in the management cluster. All specified fields must be satisfied for a cluster to be a match.
+// Fields only available for CAPI Clusters are never satisfied by a SveltosCluster.
+type ManagementClusterConstraint struct {
+	// ClusterSelector selects clusters (CAPI Cluster or SveltosCluster) based on their labels.
+	// Avoid selecting on labels managed by Classifiers, as that might make cluster matching flip.
+	// +optional
+	ClusterSelector *metav1.LabelSelector `json:"clusterSelector,omitempty"`
+
+	// Annotations are annotations cluster (CAPI Cluster or SveltosCluster) must have.
+	// An empty value only requires annotation to be present.
+	// +optional
+	Annotations map[string]string `json:"annotations,omitempty"`
+
+	// KubernetesVersionConstraints are evaluated against CAPI Cluster Spec.Topology.Version
+	// or SveltosCluster Status.Version
+	// +optional
+	KubernetesVersionConstraints []libsveltosv1beta1.KubernetesVersionConstraint `json:"kubernetesVersionConstraints,omitempty"`
+
+	// TopologyClass is the ClusterClass CAPI Cluster must be using. CAPI only.
+	// +optional
+	TopologyClass string `json:"topologyClass,omitempty"`
+
+	// InfrastructureProviderKind is the kind of the CAPI Cluster InfrastructureRef
+	// (for instance DockerCluster). CAPI only.
+	// +optional
+	InfrastructureProviderKind string `json:"infrastructureProviderKind,omitempty"`
+
+	// ControlPlaneReplicas is the range the number of control plane replicas must be in. CAPI only.
+	// +optional
+	ControlPlaneReplicas *ReplicaRange `json:"controlPlaneReplicas,omitempty"`
+
+	// Machines is the range the number of CAPI Machines must be in. CAPI only.
+	// +optional
+	Machines *ReplicaRange `json:"machines,omitempty"`
+
+	// FailureDomains are failure domains CAPI Machines must be spread across. Cluster is a match
+	// only if each of those failure domains has at least one Machine. CAPI only.
+	// +optional
+	FailureDomains []string `json:"failureDomains,omitempty"`
+}
+
+// getManagementClusterConstraint returns the ManagementClusterConstraint defined for a Classifier.
+// Returns nil if none is defined.
+func getManagementClusterConstraint(classifier *libsveltosv1beta1.Classifier,
+) (*ManagementClusterConstraint, error) {
+
+	value, ok := classifier.Annotations[ClassifierManagementConstraintAnnotation]
+	if !ok {
+		return nil, nil
+	}
+
+	constraint := &ManagementClusterConstraint{}
+	if err := json.Unmarshal([]byte(value), constraint); err != nil {
+		return nil, fmt.Errorf("invalid annotation %s: %w", ClassifierManagementConstraintAnnotation, err)
+	}
+
+	return constraint, nil
+}
+
+// isManagementOnlyClassifier returns true if Classifier is only evaluated in the management cluster
+// (using a ManagementClusterConstraint and/or a composition of other Classifiers), so nothing (neither
+// sveltos-agent nor CRDs nor Classifier) needs to be deployed in managed clusters.
+func isManagementOnlyClassifier(classifier *libsveltosv1beta1.Classifier) bool {
+	_, hasConstraint := classifier.Annotations[ClassifierManagementConstraintAnnotation]
+	if !hasConstraint && !hasClassifierComposition(classifier) {
+		return false
+	}
+
+	return classifier.Spec.DeployedResourceConstraint == nil &&
+		len(classifier.Spec.KubernetesVersionConstraints) == 0
+}
+
+// applyManagementClusterConstraint filters matching clusters using the Classifier ManagementClusterConstraint
+// (if any). If ManagementClusterConstraint is the only criteria, all selected clusters are evaluated.
+// Otherwise, only the clusters matching according to ClassifierReports (or composition) are.
+func (r *ClassifierReconciler) applyManagementClusterConstraint(ctx context.Context,
+	classifier *libsveltosv1beta1.Classifier, reportMatchingClusters map[corev1.ObjectReference]bool,
+	logger logr.Logger) (map[corev1.ObjectReference]bool, error) {
+
+	constraint, err := getManagementClusterConstraint(classifier)
+	if err != nil {
+		return nil, err
+	}
+	if constraint == nil {
+		return reportMatchingClusters, nil
+	}
+
+	candidates := reportMatchingClusters
+	if isManagementOnlyClassifier(classifier) && !hasClassifierComposition(classifier) {
+		clusters, err := r.getSelectedClusters(ctx, classifier, logger)
+		if err != nil {
+			return nil, err
+		}
+		candidates = make(map[corev1.ObjectReference]bool, len(clusters))
+		for i := range clusters {
+			candidates[clusters[i]] = true
+		}
+	}
+
+	matchingClusters := make(map[corev1.ObjectReference]bool)
+	for ref := range candidates {
+		cluster, err := clusterproxy.GetCluster(ctx, r.Client, ref.Namespace, ref.Name,
+			clusterproxy.GetClusterType(&ref))
+		if err != nil {
+			if apierrors.IsNotFound(err) {
+				continue
+			}
+			return nil, err
+		}
+
+		match, err := isManagementClusterConstraintMatch(ctx, r.Client, constraint, cluster)
+		if err != nil {
+			return nil, err
+		}
+		if match {
+			logger.V(logs.LogDebug).Info(fmt.Sprintf("cluster %s is a match for management constraint",
+				getClusterDescription(&ref)))
+			matchingClusters[ref] = true
+		}
+	}
+
+	return matchingClusters, nil
+}
+
+// isManagementClusterConstraintMatch returns true if cluster satisfies ManagementClusterConstraint
+func isManagementClusterConstraintMatch(ctx context.Context, c client.Client,
+	constraint *ManagementClusterConstraint, cluster client.Object) (bool, error) {
+
+	if constraint.ClusterSelector != nil {
+		selector, err := metav1.LabelSelectorAsSelector(constraint.ClusterSelector)
+		if err != nil {
+			return false, fmt.Errorf("invalid clusterSelector: %w", err)
+		}
+		if !selector.Matches(labels.Set(cluster.GetLabels())) {
+			return false, nil
+		}
+	}
+
+	for k, v := range constraint.Annotations {
+		current, ok := cluster.GetAnnotations()[k]
+		if !ok || (v != "" && current != v) {
+			return false, nil
+		}
+	}
+
+	if len(constraint.KubernetesVersionConstraints) != 0 {
+		version, err := getClusterKubernetesVersion(ctx, c, cluster)
+		if err != nil {
+			return false, err
+		}
+		match, err := isKubernetesVersionMatch(version, constraint.KubernetesVersionConstraints)
+		if err != nil || !match {
+			return false, err
+		}
+	}
+
+	if !hasCAPIOnlyConstraints(constraint) {
+		return true, nil
+	}
+
+	capiCluster, ok := cluster.(*clusterv1.Cluster)
+	if !ok {
+		// Remaining constraints can only be satisfied by CAPI Clusters
+		return false, nil
+	}
+
+	return isCAPIClusterConstraintMatch(ctx, c, constraint, capiCluster)
+}
+
+func hasCAPIOnlyConstraints(constraint *ManagementClusterConstraint) bool {
+	return constraint.TopologyClass != "" || constraint.InfrastructureProviderKind != "" ||
+		constraint.ControlPlaneReplicas != nil || constraint.Machines != nil ||
+		len(constraint.FailureDomains) != 0
+}
+
+func isCAPIClusterConstraintMatch(ctx context.Context, c client.Client,
+	constraint *ManagementClusterConstraint, cluster *clusterv1.Cluster) (bool, error) {
+
+	if constraint.TopologyClass != "" {
+		if cluster.Spec.Topology == nil || cluster.Spec.Topology.Class != constraint.TopologyClass {
+			return false, nil
+		}
+	}
+
+	if constraint.InfrastructureProviderKind != "" {
+		if cluster.Spec.InfrastructureRef == nil ||
+			cluster.Spec.InfrastructureRef.Kind != constraint.InfrastructureProviderKind {
+
+			return false, nil
+		}
+	}
+
+	// Machines are only listed if needed
+	var machines []clusterv1.Machine
+	needsMachines := constraint.Machines != nil || len(constraint.FailureDomains) != 0 ||
+		(constraint.ControlPlaneReplicas != nil && getDesiredControlPlaneReplicas(cluster) == nil)
+	if needsMachines {
+		machineList := &clusterv1.MachineList{}
+		err := c.List(ctx, machineList, client.InNamespace(cluster.Namespace),
+			client.MatchingLabels{clusterv1.ClusterNameLabel: cluster.Name})
+		if err != nil {
+			return false, err
+		}
+		machines = machineList.Items
+	}
+
+	if constraint.ControlPlaneReplicas != nil {
+		var replicas int32
+		if desired := getDesiredControlPlaneReplicas(cluster); desired != nil {
+			replicas = *desired
+		} else {
+			for i := range machines {
+				if _, ok := machines[i].Labels[clusterv1.MachineControlPlaneLabel]; ok {
+					replicas++
+				}
+			}
+		}
+		if !constraint.ControlPlaneReplicas.contains(replicas) {
+			return false, nil
+		}
+	}
+
+	if constraint.Machines != nil {
+		// #nosec G115 -- number of Machines in a cluster never overflows int32
+		if !constraint.Machines.contains(int32(len(machines))) {
+			return false, nil
+		}
+	}
+
+	if len(constraint.FailureDomains) != 0 {
+		failureDomains := make(map[string]bool)
+		for i := range machines {
+			if machines[i].Spec.FailureDomain != nil {
+				failureDomains[*machines[i].Spec.FailureDomain] = true
+			}
+		}
+		for _, fd := range constraint.FailureDomains {
+			if !failureDomains[fd] {
+				return false, nil
+			}
+		}
+	}
+
+	return true, nil
+}
+
+// getDesiredControlPlaneReplicas returns the desired number of control plane replicas for a CAPI Cluster.
+// Returns nil if not known. In such case, control plane Machines need to be counted.
+func getDesiredControlPlaneReplicas(cluster *clusterv1.Cluster) *int32 {
+	if cluster.Spec.Topology != nil && cluster.Spec.Topology.ControlPlane.Replicas != nil {
+		return cluster.Spec.Topology.ControlPlane.Replicas
+	}
+
+	if cluster.Status.V1Beta2 != nil && cluster.Status.V1Beta2.ControlPlane != nil {
+		return cluster.Status.V1Beta2.ControlPlane.DesiredReplicas
+	}
+
+	return nil
+}
+
+func (r *ReplicaRange) contains(replicas int32) bool {
+	if r.Min != nil && replicas < *r.Min {
+		return false
+	}
+	if r.Max != nil && replicas > *r.Max {
+		return false
+	}
+	return true
+}
+
+// isKubernetesVersionMatch returns true if version satisfies all constraints.
+// An empty version (not known) is never a match.
+func isKubernetesVersionMatch(version string, constraints []libsveltosv1beta1.KubernetesVersionConstraint,
+) (bool, error) {
+
+	if version == "" {
+		return false, nil
+	}
+
+	current, err := parseConstraintVersion(version)
+	if err != nil {
+		return false, nil
+	}
+	// Drop pre-release and build metadata (for instance v1.29.3+k3s1)
+	current.Pre = nil
+	current.Build = nil
+
+	for i := range constraints {
+		v, err := parseConstraintVersion(constraints[i].Version)
+		if err != nil {
+			return false, fmt.Errorf("invalid version %s: %w", constraints[i].Version, err)
+		}
+
+		var match bool
+		switch libsveltosv1beta1.KubernetesComparison(constraints[i].Comparison) {
+		case libsveltosv1beta1.ComparisonEqual, "":
+			match = current.EQ(v)
+		case libsveltosv1beta1.ComparisonNotEqual:
+			match = current.NE(v)
+		case libsveltosv1beta1.ComparisonGreaterThan:
+			match = current.GT(v)
+		case libsveltosv1beta1.ComparisonGreaterThanOrEqualTo:
+			match = current.GTE(v)
+		case libsveltosv1beta1.ComparisonLessThan:
+			match = current.LT(v)
+		case libsveltosv1beta1.ComparisonLessThanOrEqualTo:
+			match = current.LTE(v)
+		default:
+			return false, fmt.Errorf("unknown comparison %s", constraints[i].Comparison)
+		}
+
+		if !match {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
@@ -0,0 +1,186 @@
+/*
+Copyright 2022. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers_test
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2/textlogger"
+	"k8s.io/utils/ptr"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1beta1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/projectsveltos/classifier/controllers"
+	"github.com/projectsveltos/classifier/pkg/scope"
+	libsveltosv1beta1 "github.com/projectsveltos/libsveltos/api/v1beta1"
+	libsveltosset "github.com/projectsveltos/libsveltos/lib/set"
+)
+
+var _ = Describe("Management cluster constraint", func() {
+	It("isManagementClusterConstraintMatch evaluates CAPI Cluster and Machines", func() {
+		cluster := &clusterv1.Cluster{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: randomString(),
+				Name:      randomString(),
+				Labels:    map[string]string{"env": "production"},
+			},
+			Spec: clusterv1.ClusterSpec{
+				InfrastructureRef: &corev1.ObjectReference{Kind: "DockerCluster"},
+				Topology: &clusterv1.Topology{
+					Class:   "quick-start",
+					Version: "v1.30.2",
+					ControlPlane: clusterv1.ControlPlaneTopology{
+						Replicas: ptr.To(int32(3)),
+					},
+				},
+			},
+		}
+
+		initObjects := []client.Object{cluster}
+		for _, fd := range []string{"fd1", "fd2"} {
+			initObjects = append(initObjects, &clusterv1.Machine{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: cluster.Namespace,
+					Name:      randomString(),
+					Labels:    map[string]string{clusterv1.ClusterNameLabel: cluster.Name},
+				},
+				Spec: clusterv1.MachineSpec{
+					ClusterName:   cluster.Name,
+					FailureDomain: ptr.To(fd),
+				},
+			})
+		}
+
+		c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(initObjects...).Build()
+
+		constraint := &controllers.ManagementClusterConstraint{
+			ClusterSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"env": "production"}},
+			KubernetesVersionConstraints: []libsveltosv1beta1.KubernetesVersionConstraint{
+				{Version: "1.30.0", Comparison: string(libsveltosv1beta1.ComparisonGreaterThanOrEqualTo)},
+			},
+			TopologyClass:              "quick-start",
+			InfrastructureProviderKind: "DockerCluster",
+			ControlPlaneReplicas:       &controllers.ReplicaRange{Min: ptr.To(int32(3))},
+			Machines:                   &controllers.ReplicaRange{Min: ptr.To(int32(2)), Max: ptr.To(int32(2))},
+			FailureDomains:             []string{"fd1", "fd2"},
+		}
+
+		match, err := controllers.IsManagementClusterConstraintMatch(context.TODO(), c, constraint, cluster)
+		Expect(err).To(BeNil())
+		Expect(match).To(BeTrue())
+
+		constraint.FailureDomains = append(constraint.FailureDomains, "fd3")
+		match, err = controllers.IsManagementClusterConstraintMatch(context.TODO(), c, constraint, cluster)
+		Expect(err).To(BeNil())
+		Expect(match).To(BeFalse())
+
+		constraint.FailureDomains = nil
+		constraint.TopologyClass = "other"
+		match, err = controllers.IsManagementClusterConstraintMatch(context.TODO(), c, constraint, cluster)
+		Expect(err).To(BeNil())
+		Expect(match).To(BeFalse())
+	})
+
+	It("isKubernetesVersionMatch compares versions", func() {
+		constraints := []libsveltosv1beta1.KubernetesVersionConstraint{
+			{Version: "1.29.0", Comparison: string(libsveltosv1beta1.ComparisonGreaterThan)},
+			{Version: "v1.31.0", Comparison: string(libsveltosv1beta1.ComparisonLessThan)},
+		}
+
+		match, err := controllers.IsKubernetesVersionMatch("v1.30.1+k3s1", constraints)
+		Expect(err).To(BeNil())
+		Expect(match).To(BeTrue())
+
+		match, err = controllers.IsKubernetesVersionMatch("v1.31.0", constraints)
+		Expect(err).To(BeNil())
+		Expect(match).To(BeFalse())
+
+		match, err = controllers.IsKubernetesVersionMatch("", constraints)
+		Expect(err).To(BeNil())
+		Expect(match).To(BeFalse())
+	})
+
+	It("updateMatchingClustersAndRegistrations matches SveltosClusters with no ClassifierReport", func() {
+		constraint := &controllers.ManagementClusterConstraint{
+			Annotations: map[string]string{"inventory": "gpu"},
+		}
+		data, err := json.Marshal(constraint)
+		Expect(err).To(BeNil())
+
+		classifier := &libsveltosv1beta1.Classifier{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: randomString(),
+				Annotations: map[string]string{
+					controllers.ClassifierManagementConstraintAnnotation: string(data),
+				},
+			},
+			Spec: libsveltosv1beta1.ClassifierSpec{
+				ClassifierLabels: []libsveltosv1beta1.ClassifierLabel{{Key: "gpu", Value: "true"}},
+			},
+		}
+		Expect(controllers.IsManagementOnlyClassifier(classifier)).To(BeTrue())
+
+		matchingCluster := &libsveltosv1beta1.SveltosCluster{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:   randomString(),
+				Name:        randomString(),
+				Annotations: map[string]string{"inventory": "gpu"},
+			},
+		}
+		nonMatchingCluster := &libsveltosv1beta1.SveltosCluster{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: randomString(),
+				Name:      randomString(),
+			},
+		}
+
+		initObjects := []client.Object{classifier, matchingCluster, nonMatchingCluster}
+		c := fake.NewClientBuilder().WithScheme(scheme).WithStatusSubresource(initObjects...).
+			WithObjects(initObjects...).Build()
+
+		reconciler := &controllers.ClassifierReconciler{
+			Client:        c,
+			Scheme:        scheme,
+			ClusterMap:    make(map[corev1.ObjectReference]*libsveltosset.Set),
+			ClassifierMap: make(map[corev1.ObjectReference]*libsveltosset.Set),
+			Mux:           sync.Mutex{},
+		}
+
+		classifierScope, err := scope.NewClassifierScope(scope.ClassifierScopeParams{
+			Client:         c,
+			Logger:         textlogger.NewLogger(textlogger.NewConfig(textlogger.Verbosity(1))),
+			Classifier:     classifier,
+			ControllerName: "classifier",
+		})
+		Expect(err).To(BeNil())
+
+		Expect(controllers.UpdateMatchingClustersAndRegistrations(reconciler, context.TODO(), classifierScope,
+			textlogger.NewLogger(textlogger.NewConfig(textlogger.Verbosity(1))))).To(Succeed())
+
+		Expect(classifier.Status.MachingClusterStatuses).To(HaveLen(1))
+		Expect(classifier.Status.MachingClusterStatuses[0].ClusterRef.Namespace).To(Equal(matchingCluster.Namespace))
+		Expect(classifier.Status.MachingClusterStatuses[0].ClusterRef.Name).To(Equal(matchingCluster.Name))
+	})
+})
@@ -14,82 +14,226 @@ limitations under the License.
 package controllers
 
 import (
-	"errors"
 	"fmt"
-	"strings"
 	"time"
 
 	"github.com/go-logr/logr"
 	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
 	"sigs.k8s.io/controller-runtime/pkg/metrics"
 
 	libsveltosv1beta1 "github.com/projectsveltos/libsveltos/api/v1beta1"
+	"github.com/projectsveltos/libsveltos/lib/clusterproxy"
 	logs "github.com/projectsveltos/libsveltos/lib/logsettings"
 )
 
+const (
+	classifierReportCollectionMetricSubsystem = "classifier_report_collection"
+
+	clusterNamespaceMetricLabel = "cluster_namespace"
+	clusterNameMetricLabel      = "cluster_name"
+	clusterTypeMetricLabel      = "cluster_type"
+	classifierMetricLabel       = "classifier"
+	reasonMetricLabel           = "reason"
+	resultMetricLabel           = "result"
+)
+
+// Reasons ClassifierReports could not be collected from a cluster
+const (
+	collectionErrorNotReady                 = "not_ready"
+	collectionErrorIncompatibleAgentVersion = "incompatible_agent_version"
+	collectionErrorListFailure              = "list_failure"
+	collectionErrorUpdateFailure            = "update_failure"
+)
+
+// Outcomes of copying a collected ClassifierReport to the management cluster
+const (
+	classifierReportCreated = "created"
+	classifierReportUpdated = "updated"
+	classifierReportSkipped = "skipped"
+	classifierReportFailed  = "failed"
+)
+
 var (
-	programClassifierDurationHistogram = prometheus.NewHistogram(
+	programClassifierDurationHistogram = prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{
 			Namespace: "projectsveltos",
 			Name:      "program_classifier_time_seconds",
 			Help:      "Program Classifier on a workload cluster duration distribution",
 			Buckets:   []float64{0.1, 0.5, 1, 5, 10, 20, 30},
 		},
+		[]string{clusterTypeMetricLabel, clusterNamespaceMetricLabel, clusterNameMetricLabel},
+	)
+
+	matchingClustersGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "projectsveltos",
+			Name:      "classifier_matching_clusters",
+			Help:      "Number of clusters matching a Classifier",
+		},
+		[]string{classifierMetricLabel},
+	)
+
+	conflictingLabelsGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "projectsveltos",
+			Name:      "classifier_conflicting_labels",
+			Help:      "Number of labels a Classifier cannot manage, across all matching clusters, because managed by another Classifier",
+		},
+		[]string{classifierMetricLabel},
+	)
+
+	collectionLoopDurationHistogram = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: "projectsveltos",
+			Subsystem: classifierReportCollectionMetricSubsystem,
+			Name:      "loop_duration_seconds",
+			Help:      "Time spent collecting ClassifierReports from all clusters",
+			Buckets:   []float64{0.1, 0.5, 1, 5, 10, 30, 60, 120, 300},
+		},
+	)
+
+	clusterCollectionDurationHistogram = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "projectsveltos",
+			Subsystem: classifierReportCollectionMetricSubsystem,
+			Name:      "cluster_duration_seconds",
+			Help:      "Time spent collecting ClassifierReports from a cluster",
+			Buckets:   []float64{0.05, 0.1, 0.5, 1, 5, 10, 30},
+		},
+		[]string{clusterNamespaceMetricLabel, clusterNameMetricLabel, clusterTypeMetricLabel},
+	)
+
+	clusterLastCollectionGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "projectsveltos",
+			Subsystem: classifierReportCollectionMetricSubsystem,
+			Name:      "last_success_timestamp_seconds",
+			Help:      "Unix time ClassifierReports were last successfully collected from a cluster",
+		},
+		[]string{clusterNamespaceMetricLabel, clusterNameMetricLabel, clusterTypeMetricLabel},
+	)
+
+	collectionErrorsCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "projectsveltos",
+			Subsystem: classifierReportCollectionMetricSubsystem,
+			Name:      "errors_total",
+			Help:      "Number of errors collecting ClassifierReports from a cluster, by reason",
+		},
+		[]string{clusterNamespaceMetricLabel, clusterNameMetricLabel, clusterTypeMetricLabel, reasonMetricLabel},
+	)
+
+	agentKubeconfigExpirationGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "projectsveltos",
+			Name:      "classifier_agent_kubeconfig_expiration_timestamp_seconds",
+			Help:      "Unix time the kubeconfig used by sveltos-agent in a cluster reaches its maximum age",
+		},
+		[]string{clusterNamespaceMetricLabel, clusterNameMetricLabel, clusterTypeMetricLabel},
+	)
+
+	classifierReportsCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "projectsveltos",
+			Subsystem: classifierReportCollectionMetricSubsystem,
+			Name:      "classifier_reports_total",
+			Help:      "Number of collected ClassifierReports created, updated, skipped or failed to be copied in the management cluster",
+		},
+		[]string{resultMetricLabel},
 	)
 )
 
 //nolint:gochecknoinits // forced pattern, can't workaround
 func init() {
 	// Register custom metrics with the global prometheus registry
-	metrics.Registry.MustRegister(programClassifierDurationHistogram)
+	metrics.Registry.MustRegister(programClassifierDurationHistogram, matchingClustersGauge, conflictingLabelsGauge,
+		collectionLoopDurationHistogram, clusterCollectionDurationHistogram, clusterLastCollectionGauge,
+		collectionErrorsCounter, classifierReportsCounter, agentKubeconfigExpirationGauge)
 }
 
-func newClassifierHistogram(clusterNamespace, clusterName string, clusterType libsveltosv1beta1.ClusterType,
-	logger logr.Logger) prometheus.Histogram {
+func programDuration(elapsed time.Duration, clusterNamespace, clusterName, featureID string,
+	clusterType libsveltosv1beta1.ClusterType, logger logr.Logger) {
 
-	clusterInfo := strings.ReplaceAll(fmt.Sprintf("%s_%s_%s", clusterType, clusterNamespace, clusterName), "-", "_")
-	histogram := prometheus.NewHistogram(
-		prometheus.HistogramOpts{
-			Namespace: clusterInfo,
-			Name:      "program_classifier_time_seconds",
-			Help:      "Program Classifier on a workload cluster duration distribution",
-			Buckets:   []float64{0.1, 0.5, 1, 5, 10, 20, 30},
-		},
-	)
+	if featureID == string(libsveltosv1beta1.FeatureClassifier) {
+		logger.V(logs.LogVerbose).Info(fmt.Sprintf("register data for %s/%s %s",
+			clusterNamespace, clusterName, featureID))
+		programClassifierDurationHistogram.With(prometheus.Labels{
+			clusterTypeMetricLabel:      string(clusterType),
+			clusterNamespaceMetricLabel: clusterNamespace,
+			clusterNameMetricLabel:      clusterName,
+		}).Observe(elapsed.Seconds())
+	}
+}
 
-	err := metrics.Registry.Register(histogram)
-	if err != nil {
-		var registrationError *prometheus.AlreadyRegisteredError
-		ok := errors.As(err, &registrationError)
-		if ok {
-			_, ok = registrationError.ExistingCollector.(prometheus.Histogram)
-			if ok {
-				return registrationError.ExistingCollector.(prometheus.Histogram)
-			}
-			logCollectorError(err, logger)
-			return nil
-		}
-		logCollectorError(err, logger)
-		return nil
+// classifierMatchingClusters records the number of clusters matching a Classifier
+func classifierMatchingClusters(classifierName string, matching int) {
+	matchingClustersGauge.WithLabelValues(classifierName).Set(float64(matching))
+}
+
+// classifierConflictingLabels records the number of labels a Classifier cannot manage
+func classifierConflictingLabels(classifierName string, conflicts int) {
+	conflictingLabelsGauge.WithLabelValues(classifierName).Set(float64(conflicts))
+}
+
+// removeClassifierMetrics removes all series for a Classifier
+func removeClassifierMetrics(classifierName string) {
+	matchingClustersGauge.DeleteLabelValues(classifierName)
+	conflictingLabelsGauge.DeleteLabelValues(classifierName)
+}
+
+func getClusterMetricLabels(cluster *corev1.ObjectReference) prometheus.Labels {
+	return prometheus.Labels{
+		clusterNamespaceMetricLabel: cluster.Namespace,
+		clusterNameMetricLabel:      cluster.Name,
+		clusterTypeMetricLabel:      string(clusterproxy.GetClusterType(cluster)),
 	}
+}
 
-	return histogram
+// collectionLoopDuration records time spent collecting ClassifierReports from all clusters
+func collectionLoopDuration(elapsed time.Duration) {
+	collectionLoopDurationHistogram.Observe(elapsed.Seconds())
 }
 
-func logCollectorError(err error, logger logr.Logger) {
-	logger.V(logs.LogInfo).Info(fmt.Sprintf("failed to register collector: %v", err))
+// clusterCollectionDuration records time spent collecting ClassifierReports from a cluster
+func clusterCollectionDuration(elapsed time.Duration, cluster *corev1.ObjectReference) {
+	clusterCollectionDurationHistogram.With(getClusterMetricLabels(cluster)).Observe(elapsed.Seconds())
 }
 
-func programDuration(elapsed time.Duration, clusterNamespace, clusterName, featureID string,
-	clusterType libsveltosv1beta1.ClusterType, logger logr.Logger) {
+// clusterCollectionSucceeded records ClassifierReports from cluster are up to date
+func clusterCollectionSucceeded(cluster *corev1.ObjectReference) {
+	clusterLastCollectionGauge.With(getClusterMetricLabels(cluster)).SetToCurrentTime()
+}
 
-	if featureID == string(libsveltosv1beta1.FeatureClassifier) {
-		programClassifierDurationHistogram.Observe(elapsed.Seconds())
-		clusterHistogram := newClassifierHistogram(clusterNamespace, clusterName, clusterType, logger)
-		if clusterHistogram != nil {
-			logger.V(logs.LogVerbose).Info(fmt.Sprintf("register data for %s/%s %s",
-				clusterNamespace, clusterName, featureID))
-			clusterHistogram.Observe(elapsed.Seconds())
-		}
+// clusterCollectionFailed records a failure collecting ClassifierReports from a cluster
+func clusterCollectionFailed(cluster *corev1.ObjectReference, reason string) {
+	labels := getClusterMetricLabels(cluster)
+	labels[reasonMetricLabel] = reason
+	collectionErrorsCounter.With(labels).Inc()
+}
+
+// classifierReportProcessed records the outcome of copying a collected ClassifierReport
+// to the management cluster
+func classifierReportProcessed(result string) {
+	classifierReportsCounter.WithLabelValues(result).Inc()
+}
+
+// agentKubeconfigExpiration records when the kubeconfig used by sveltos-agent in a cluster
+// reaches its maximum age
+func agentKubeconfigExpiration(cluster *corev1.ObjectReference, expiresAt time.Time) {
+	agentKubeconfigExpirationGauge.With(getClusterMetricLabels(cluster)).Set(float64(expiresAt.Unix()))
+}
+
+// removeClusterMetrics removes all series for a cluster
+func removeClusterMetrics(clusterNamespace, clusterName string, clusterType libsveltosv1beta1.ClusterType) {
+	labels := prometheus.Labels{
+		clusterNamespaceMetricLabel: clusterNamespace,
+		clusterNameMetricLabel:      clusterName,
+		clusterTypeMetricLabel:      string(clusterType),
 	}
+	programClassifierDurationHistogram.DeletePartialMatch(labels)
+	clusterCollectionDurationHistogram.DeletePartialMatch(labels)
+	clusterLastCollectionGauge.DeletePartialMatch(labels)
+	collectionErrorsCounter.DeletePartialMatch(labels)
+	agentKubeconfigExpirationGauge.DeletePartialMatch(labels)
 }
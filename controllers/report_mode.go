@@ -0,0 +1,124 @@
+/*
+Copyright 2022. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/projectsveltos/libsveltos/lib/clusterproxy"
+	logs "github.com/projectsveltos/libsveltos/lib/logsettings"
+)
+
+const (
+	// ClusterReportModeAnnotation can be set on a SveltosCluster or a CAPI Cluster to choose how
+	// ClassifierReports are sent from such cluster to the management cluster, overriding the
+	// report-mode flag. Accepted values are:
+	// - collect: classifier collects ClassifierReports (CollectFromManagementCluster);
+	// - send-reports: sveltos-agent sends ClassifierReports using a kubeconfig (AgentSendReportsNoGateway).
+	ClusterReportModeAnnotation = "classifier.projectsveltos.io/report-mode"
+)
+
+const (
+	reportModeCollect     = "collect"
+	reportModeSendReports = "send-reports"
+)
+
+// parseReportMode returns the ReportMode corresponding to a ClusterReportModeAnnotation value
+func parseReportMode(value string) (ReportMode, error) {
+	switch value {
+	case reportModeCollect:
+		return CollectFromManagementCluster, nil
+	case reportModeSendReports:
+		return AgentSendReportsNoGateway, nil
+	default:
+		return CollectFromManagementCluster, fmt.Errorf("invalid annotation %s: unknown report mode %q",
+			ClusterReportModeAnnotation, value)
+	}
+}
+
+// getReportModeForCluster returns the ReportMode to use for a cluster: the one set with
+// ClusterReportModeAnnotation if any and valid, defaultMode otherwise.
+func getReportModeForCluster(cluster client.Object, defaultMode ReportMode, logger logr.Logger) ReportMode {
+	value, ok := cluster.GetAnnotations()[ClusterReportModeAnnotation]
+	if !ok {
+		return defaultMode
+	}
+
+	mode, err := parseReportMode(value)
+	if err != nil {
+		logger.V(logs.LogInfo).Info(fmt.Sprintf("cluster %s/%s: %v. Using default report mode",
+			cluster.GetNamespace(), cluster.GetName(), err))
+		return defaultMode
+	}
+	return mode
+}
+
+// getClusterReportMode returns the ReportMode to use for a cluster. If cluster does not exist,
+// defaultMode is returned.
+func getClusterReportMode(ctx context.Context, c client.Client, cluster *corev1.ObjectReference,
+	defaultMode ReportMode, logger logr.Logger) (ReportMode, error) {
+
+	clusterObj, err := clusterproxy.GetCluster(ctx, c, cluster.Namespace, cluster.Name,
+		clusterproxy.GetClusterType(cluster))
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return defaultMode, nil
+		}
+		return defaultMode, err
+	}
+
+	return getReportModeForCluster(clusterObj, defaultMode, logger), nil
+}
+
+// getClusterReportMode returns the ReportMode to use for a cluster, with ClassifierReportMode as default
+func (r *ClassifierReconciler) getClusterReportMode(ctx context.Context, cluster *corev1.ObjectReference,
+	logger logr.Logger) (ReportMode, error) {
+
+	return getClusterReportMode(ctx, r.Client, cluster, r.ClassifierReportMode, logger)
+}
+
+// filterClustersByReportMode returns the clusters using the given ReportMode
+func filterClustersByReportMode(ctx context.Context, c client.Client, clusters []corev1.ObjectReference,
+	defaultMode, mode ReportMode, logger logr.Logger) []corev1.ObjectReference {
+
+	filtered := make([]corev1.ObjectReference, 0, len(clusters))
+	for i := range clusters {
+		clusterMode, err := getClusterReportMode(ctx, c, &clusters[i], defaultMode, logger)
+		if err != nil {
+			logger.V(logs.LogInfo).Info(fmt.Sprintf("failed to get report mode for cluster %s: %v",
+				getClusterDescription(&clusters[i]), err))
+			continue
+		}
+		if clusterMode == mode {
+			filtered = append(filtered, clusters[i])
+		}
+	}
+	return filtered
+}
+
+// isReportModeChanged returns true if ClusterReportModeAnnotation differs between the two
+// versions of a cluster
+func isReportModeChanged(oldCluster, newCluster client.Object) bool {
+	return oldCluster.GetAnnotations()[ClusterReportModeAnnotation] !=
+		newCluster.GetAnnotations()[ClusterReportModeAnnotation]
+}
@@ -0,0 +1,121 @@
+/*
+Copyright 2022. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers_test
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2/textlogger"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+
+	"github.com/projectsveltos/classifier/controllers"
+	libsveltosv1beta1 "github.com/projectsveltos/libsveltos/api/v1beta1"
+	fakedeployer "github.com/projectsveltos/libsveltos/lib/deployer/fake"
+)
+
+var _ = Describe("Per-cluster report mode", func() {
+	var collectCluster, pushCluster, invalidCluster *libsveltosv1beta1.SveltosCluster
+
+	getClusterReference := func(cluster *libsveltosv1beta1.SveltosCluster) corev1.ObjectReference {
+		return corev1.ObjectReference{
+			Namespace: cluster.Namespace, Name: cluster.Name,
+			Kind: libsveltosv1beta1.SveltosClusterKind, APIVersion: libsveltosv1beta1.GroupVersion.String(),
+		}
+	}
+
+	BeforeEach(func() {
+		collectCluster = &libsveltosv1beta1.SveltosCluster{
+			ObjectMeta: metav1.ObjectMeta{Namespace: randomString(), Name: randomString()},
+		}
+		pushCluster = &libsveltosv1beta1.SveltosCluster{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:   randomString(),
+				Name:        randomString(),
+				Annotations: map[string]string{controllers.ClusterReportModeAnnotation: "send-reports"},
+			},
+		}
+		invalidCluster = &libsveltosv1beta1.SveltosCluster{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:   randomString(),
+				Name:        randomString(),
+				Annotations: map[string]string{controllers.ClusterReportModeAnnotation: randomString()},
+			},
+		}
+	})
+
+	It("filterClustersByReportMode honors the annotation and falls back to the default mode", func() {
+		initObjects := []client.Object{collectCluster, pushCluster, invalidCluster}
+		c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(initObjects...).Build()
+		logger := textlogger.NewLogger(textlogger.NewConfig(textlogger.Verbosity(1)))
+
+		clusters := []corev1.ObjectReference{
+			getClusterReference(collectCluster), getClusterReference(pushCluster), getClusterReference(invalidCluster),
+		}
+
+		filtered := controllers.FilterClustersByReportMode(context.TODO(), c, clusters,
+			controllers.CollectFromManagementCluster, controllers.CollectFromManagementCluster, logger)
+		Expect(filtered).To(ConsistOf(getClusterReference(collectCluster), getClusterReference(invalidCluster)))
+
+		filtered = controllers.FilterClustersByReportMode(context.TODO(), c, clusters,
+			controllers.AgentSendReportsNoGateway, controllers.CollectFromManagementCluster, logger)
+		Expect(filtered).To(BeEmpty())
+
+		filtered = controllers.FilterClustersByReportMode(context.TODO(), c, clusters,
+			controllers.AgentSendReportsNoGateway, controllers.AgentSendReportsNoGateway, logger)
+		Expect(filtered).To(ConsistOf(getClusterReference(collectCluster), getClusterReference(pushCluster),
+			getClusterReference(invalidCluster)))
+
+		p := controllers.SveltosClusterReportModePredicate(logger)
+		Expect(p.Update(event.UpdateEvent{ObjectOld: collectCluster, ObjectNew: pushCluster})).To(BeTrue())
+		Expect(p.Update(event.UpdateEvent{ObjectOld: collectCluster, ObjectNew: collectCluster})).To(BeFalse())
+	})
+
+	It("processClassifier hash depends on the cluster report mode", func() {
+		classifier := getClassifierInstance(randomString())
+
+		collectCluster.Status.Ready = true
+		pushCluster.Status.Ready = true
+
+		initObjects := []client.Object{classifier, collectCluster, pushCluster}
+		c := fake.NewClientBuilder().WithScheme(scheme).WithStatusSubresource(initObjects...).
+			WithObjects(initObjects...).Build()
+
+		logger := textlogger.NewLogger(textlogger.NewConfig(textlogger.Verbosity(1)))
+		dep := fakedeployer.GetClient(context.TODO(), logger, c)
+		Expect(dep.RegisterFeatureID(libsveltosv1beta1.FeatureClassifier)).To(Succeed())
+		reconciler := getClassifierReconciler(c, dep)
+		classifierScope := getClassifierScope(c, logger, classifier)
+
+		f := controllers.GetHandlersForFeature(libsveltosv1beta1.FeatureClassifier)
+		ref := getClusterReference(collectCluster)
+		clusterInfo, err := controllers.ProcessClassifier(reconciler, context.TODO(), classifierScope, "", &ref, f, logger)
+		Expect(err).To(BeNil())
+		Expect(clusterInfo.Hash).To(Equal(controllers.ClassifierHash(classifier)))
+
+		ref = getClusterReference(pushCluster)
+		clusterInfo, err = controllers.ProcessClassifier(reconciler, context.TODO(), classifierScope, "", &ref, f, logger)
+		Expect(err).To(BeNil())
+		Expect(clusterInfo.Hash).ToNot(Equal(controllers.ClassifierHash(classifier)))
+	})
+})
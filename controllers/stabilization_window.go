@@ -0,0 +1,147 @@
+/*
+Copyright 2022. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/projectsveltos/classifier/pkg/scope"
+	libsveltosv1beta1 "github.com/projectsveltos/libsveltos/api/v1beta1"
+)
+
+const (
+	// ClassifierStabilizationWindowAnnotation contains a duration (for instance "5m").
+	// When set, a cluster must be continuously reported as a match (or as not a match) for
+	// such duration before the classifier controller acts on the change (registering labels,
+	// setting and removing labels). Changes not acted upon yet are stored with the per-cluster
+	// status and counted in its summary (see scope.GetClusterStatusSummary).
+	ClassifierStabilizationWindowAnnotation = "classifier.projectsveltos.io/stabilization-window"
+)
+
+// minStabilizationRequeueAfter is the minimum time to wait before checking pending transitions again
+const minStabilizationRequeueAfter = time.Second
+
+// getStabilizationWindow returns the stabilization window defined for a Classifier.
+// Zero means changes are acted upon immediately.
+func getStabilizationWindow(classifier *libsveltosv1beta1.Classifier) (time.Duration, error) {
+	value, ok := classifier.Annotations[ClassifierStabilizationWindowAnnotation]
+	if !ok {
+		return 0, nil
+	}
+
+	window, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid annotation %s: %w", ClassifierStabilizationWindowAnnotation, err)
+	}
+	if window < 0 {
+		return 0, fmt.Errorf("invalid annotation %s: duration cannot be negative",
+			ClassifierStabilizationWindowAnnotation)
+	}
+
+	return window, nil
+}
+
+// applyStabilizationWindow returns the clusters the classifier controller must consider a match and
+// the transitions still pending.
+// observed contains clusters currently reported as a match, acted the clusters currently considered
+// a match. A cluster whose match differs from the acted one is moved only once the new match has been
+// observed continuously for window.
+func applyStabilizationWindow(window time.Duration, now time.Time,
+	observed, acted map[corev1.ObjectReference]bool, pending []scope.PendingTransition,
+) (map[corev1.ObjectReference]bool, []scope.PendingTransition) {
+
+	if window == 0 {
+		return observed, nil
+	}
+
+	pendingMap := make(map[corev1.ObjectReference]scope.PendingTransition, len(pending))
+	for i := range pending {
+		pendingMap[pending[i].ClusterRef] = pending[i]
+	}
+
+	clusters := make(map[corev1.ObjectReference]bool)
+	result := make(map[corev1.ObjectReference]bool)
+	for c := range acted {
+		clusters[c] = true
+		result[c] = true
+	}
+	for c := range observed {
+		clusters[c] = true
+	}
+
+	newPending := make([]scope.PendingTransition, 0)
+	for c := range clusters {
+		match := observed[c]
+		if match == acted[c] {
+			continue
+		}
+
+		transition, ok := pendingMap[c]
+		if !ok || transition.Match != match {
+			transition = scope.PendingTransition{
+				ClusterRef: c,
+				Match:      match,
+				Since:      metav1.NewTime(now).Rfc3339Copy(),
+			}
+		}
+
+		if now.Sub(transition.Since.Time) < window {
+			newPending = append(newPending, transition)
+			continue
+		}
+
+		if match {
+			result[c] = true
+		} else {
+			delete(result, c)
+		}
+	}
+
+	sort.Slice(newPending, func(i, j int) bool {
+		return getClusterDescription(&newPending[i].ClusterRef) < getClusterDescription(&newPending[j].ClusterRef)
+	})
+
+	return result, newPending
+}
+
+// getStabilizationRequeueAfter returns how long to wait before the first pending transition
+// can be acted upon. Zero if there are no pending transitions.
+func getStabilizationRequeueAfter(classifierScope *scope.ClassifierScope, now time.Time) time.Duration {
+	window, err := getStabilizationWindow(classifierScope.Classifier)
+	if err != nil || window == 0 {
+		return 0
+	}
+
+	var requeueAfter time.Duration
+	pending := classifierScope.GetPendingTransitions()
+	for i := range pending {
+		remaining := window - now.Sub(pending[i].Since.Time)
+		if remaining < minStabilizationRequeueAfter {
+			remaining = minStabilizationRequeueAfter
+		}
+		if requeueAfter == 0 || remaining < requeueAfter {
+			requeueAfter = remaining
+		}
+	}
+
+	return requeueAfter
+}
@@ -0,0 +1,122 @@
+/*
+Copyright 2022. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers_test
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2/textlogger"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/projectsveltos/classifier/controllers"
+	libsveltosv1beta1 "github.com/projectsveltos/libsveltos/api/v1beta1"
+)
+
+var _ = Describe("Classifier stabilization window", func() {
+	var cluster1, cluster2 corev1.ObjectReference
+
+	BeforeEach(func() {
+		cluster1 = corev1.ObjectReference{Namespace: randomString(), Name: randomString(),
+			Kind: libsveltosv1beta1.SveltosClusterKind, APIVersion: libsveltosv1beta1.GroupVersion.String()}
+		cluster2 = corev1.ObjectReference{Namespace: randomString(), Name: randomString(),
+			Kind: libsveltosv1beta1.SveltosClusterKind, APIVersion: libsveltosv1beta1.GroupVersion.String()}
+	})
+
+	It("getStabilizationWindow parses the stabilization window annotation", func() {
+		classifier := getClassifierInstance(randomString())
+		window, err := controllers.GetStabilizationWindow(classifier)
+		Expect(err).To(BeNil())
+		Expect(window).To(BeZero())
+
+		classifier.Annotations = map[string]string{controllers.ClassifierStabilizationWindowAnnotation: "5m"}
+		window, err = controllers.GetStabilizationWindow(classifier)
+		Expect(err).To(BeNil())
+		Expect(window).To(Equal(5 * time.Minute))
+
+		classifier.Annotations[controllers.ClassifierStabilizationWindowAnnotation] = "five minutes"
+		_, err = controllers.GetStabilizationWindow(classifier)
+		Expect(err).ToNot(BeNil())
+
+		classifier.Annotations[controllers.ClassifierStabilizationWindowAnnotation] = "-1m"
+		_, err = controllers.GetStabilizationWindow(classifier)
+		Expect(err).ToNot(BeNil())
+	})
+
+	It("applyStabilizationWindow acts on changes only once observed for the whole window", func() {
+		window := 5 * time.Minute
+		now := time.Now()
+
+		// No window: observed clusters are used as they are
+		result, pending := controllers.ApplyStabilizationWindow(0, now,
+			map[corev1.ObjectReference]bool{cluster1: true}, map[corev1.ObjectReference]bool{cluster2: true}, nil)
+		Expect(result).To(Equal(map[corev1.ObjectReference]bool{cluster1: true}))
+		Expect(pending).To(BeEmpty())
+
+		// cluster1 starts matching, cluster2 stops matching. Both transitions are pending.
+		result, pending = controllers.ApplyStabilizationWindow(window, now,
+			map[corev1.ObjectReference]bool{cluster1: true}, map[corev1.ObjectReference]bool{cluster2: true}, nil)
+		Expect(result).To(Equal(map[corev1.ObjectReference]bool{cluster2: true}))
+		Expect(pending).To(HaveLen(2))
+
+		// Before window elapses nothing changes and original timestamps are kept
+		later := now.Add(window / 2)
+		result, newPending := controllers.ApplyStabilizationWindow(window, later,
+			map[corev1.ObjectReference]bool{cluster1: true}, map[corev1.ObjectReference]bool{cluster2: true}, pending)
+		Expect(result).To(Equal(map[corev1.ObjectReference]bool{cluster2: true}))
+		Expect(newPending).To(Equal(pending))
+
+		// cluster2 flaps back to matching: its pending transition is dropped
+		result, newPending = controllers.ApplyStabilizationWindow(window, later,
+			map[corev1.ObjectReference]bool{cluster1: true, cluster2: true},
+			map[corev1.ObjectReference]bool{cluster2: true}, pending)
+		Expect(result).To(Equal(map[corev1.ObjectReference]bool{cluster2: true}))
+		Expect(newPending).To(HaveLen(1))
+		Expect(newPending[0].ClusterRef).To(Equal(cluster1))
+		Expect(newPending[0].Match).To(BeTrue())
+
+		// Once window elapses, transitions are acted upon
+		result, newPending = controllers.ApplyStabilizationWindow(window, now.Add(window+time.Second),
+			map[corev1.ObjectReference]bool{cluster1: true}, map[corev1.ObjectReference]bool{cluster2: true}, pending)
+		Expect(result).To(Equal(map[corev1.ObjectReference]bool{cluster1: true}))
+		Expect(newPending).To(BeEmpty())
+	})
+
+	It("getStabilizationRequeueAfter returns time left for first pending transition", func() {
+		window := 5 * time.Minute
+		now := time.Now()
+
+		classifier := getClassifierInstance(randomString())
+		classifier.Annotations = map[string]string{controllers.ClassifierStabilizationWindowAnnotation: window.String()}
+
+		c := fake.NewClientBuilder().WithScheme(scheme).Build()
+		classifierScope := getClassifierScope(c, textlogger.NewLogger(textlogger.NewConfig(textlogger.Verbosity(1))),
+			classifier)
+		Expect(controllers.GetStabilizationRequeueAfter(classifierScope, now)).To(BeZero())
+
+		_, pending := controllers.ApplyStabilizationWindow(window, now,
+			map[corev1.ObjectReference]bool{cluster1: true}, map[corev1.ObjectReference]bool{}, nil)
+		classifierScope.SetPendingTransitions(pending)
+
+		requeueAfter := controllers.GetStabilizationRequeueAfter(classifierScope, now.Add(time.Minute))
+		Expect(requeueAfter).To(BeNumerically("<=", 4*time.Minute))
+		Expect(requeueAfter).To(BeNumerically(">", 3*time.Minute))
+	})
+})
@@ -38,7 +38,7 @@ type SveltosClusterReconciler struct {
 	Scheme *runtime.Scheme
 }
 
-//+kubebuilder:rbac:groups=lib.projectsveltos.io,resources=sveltosclusters,verbs=get;list;watch;update
+//+kubebuilder:rbac:groups=lib.projectsveltos.io,resources=sveltosclusters,verbs=get;list;watch;update;patch
 //+kubebuilder:rbac:groups=lib.projectsveltos.io,resources=sveltosclusters/status,verbs=get;list;watch
 
 func (r *SveltosClusterReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
@@ -80,6 +80,9 @@ func (r *SveltosClusterReconciler) SetupWithManager(mgr ctrl.Manager) error {
 // - any classifierReport coming from this cluster
 // - if sveltos-agent was deployed in the management cluster, sveltos-agent resources
 // created for this cluster are removed from the management cluster
+// - metrics for this cluster
+// - the AccessRequest generated for sveltos-agents in this cluster
+// - if uninstall is enabled and cluster is still reachable, sveltos-agent from the cluster
 func cleanClusterStaleResources(ctx context.Context, c client.Client,
 	clusterNamespace, clusterName string, clusterType libsveltosv1beta1.ClusterType,
 	logger logr.Logger) (ctrl.Result, error) {
@@ -100,5 +103,15 @@ func cleanClusterStaleResources(ctx context.Context, c client.Client,
 		return reconcile.Result{Requeue: true, RequeueAfter: deleteRequeueAfter}, nil
 	}
 
+	err = removeClusterAccessRequest(ctx, c, clusterNamespace, clusterName, clusterType, logger)
+	if err != nil {
+		logger.V(logs.LogInfo).Info(fmt.Sprintf("failed to remove accessRequest: %v", err))
+		return reconcile.Result{Requeue: true, RequeueAfter: deleteRequeueAfter}, nil
+	}
+
+	uninstallSveltosAgentFromUnregisteredCluster(ctx, c, clusterNamespace, clusterName, clusterType, logger)
+
+	removeClusterMetrics(clusterNamespace, clusterName, clusterType)
+
 	return reconcile.Result{}, nil
 }
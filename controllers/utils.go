@@ -103,6 +103,23 @@ func getClusterRefFromClassifierReport(report *libsveltosv1beta1.ClassifierRepor
 	return &cluster
 }
 
+// getClusterReference returns the reference to a cluster given its namespace, name and type
+func getClusterReference(clusterNamespace, clusterName string, clusterType libsveltosv1beta1.ClusterType,
+) *corev1.ObjectReference {
+
+	ref := &corev1.ObjectReference{
+		Namespace:  clusterNamespace,
+		Name:       clusterName,
+		Kind:       libsveltosv1beta1.SveltosClusterKind,
+		APIVersion: libsveltosv1beta1.GroupVersion.String(),
+	}
+	if clusterType == libsveltosv1beta1.ClusterTypeCapi {
+		ref.Kind = clusterv1.ClusterKind
+		ref.APIVersion = clusterv1.GroupVersion.String()
+	}
+	return ref
+}
+
 func SetVersion(v string) {
 	version = v
 }
@@ -22,6 +22,7 @@ import (
 	"fmt"
 	"os"
 	"regexp"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -51,6 +52,7 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/webhook"
 
 	"github.com/projectsveltos/classifier/controllers"
+	"github.com/projectsveltos/classifier/controllers/keymanager"
 	libsveltosv1beta1 "github.com/projectsveltos/libsveltos/api/v1beta1"
 	"github.com/projectsveltos/libsveltos/lib/crd"
 	"github.com/projectsveltos/libsveltos/lib/deployer"
@@ -74,12 +76,29 @@ var (
 	restConfigQPS                         float32
 	restConfigBurst                       int
 	webhookPort                           int
+	enableWebhooks                        bool
 	syncPeriod                            time.Duration
 	version                               string
 	healthAddr                            string
 	sveltosAgentConfigMap                 string
 	capiOnboardAnnotation                 string
 	registry                              string
+	conflictResolution                    string
+	keymanagerCheckpoint                  bool
+	keymanagerCheckpointNamespace         string
+	keymanagerCheckpointName              string
+	keymanagerCheckpointInterval          time.Duration
+	reportCollectionConcurrency           int
+	reportCollectionTimeout               time.Duration
+	labelChangeRateLimit                  int
+	agentKubeconfigMaxAge                 time.Duration
+	uninstallAgent                        bool
+	leaderElect                           bool
+	leaderElectionID                      string
+	leaderElectionNamespace               string
+	leaderElectLeaseDuration              time.Duration
+	leaderElectRenewDeadline              time.Duration
+	leaderElectRetryPeriod                time.Duration
 )
 
 const (
@@ -93,6 +112,10 @@ const (
 // +kubebuilder:rbac:groups=authentication.k8s.io,resources=tokenreviews,verbs=create
 // +kubebuilder:rbac:groups=authorization.k8s.io,resources=subjectaccessreviews,verbs=create
 
+// Add RBAC for leader election.
+// +kubebuilder:rbac:groups=coordination.k8s.io,resources=leases,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+
 func main() {
 	scheme, err := controllers.InitScheme()
 	if err != nil {
@@ -121,11 +144,23 @@ func main() {
 		Cache: cache.Options{
 			SyncPeriod: &syncPeriod,
 		},
+		LeaderElection:          leaderElect,
+		LeaderElectionID:        leaderElectionID,
+		LeaderElectionNamespace: leaderElectionNamespace,
+		LeaseDuration:           &leaderElectLeaseDuration,
+		RenewDeadline:           &leaderElectRenewDeadline,
+		RetryPeriod:             &leaderElectRetryPeriod,
+		// Process exits as soon as manager stops. Releasing the lease lets a standby replica
+		// take over without waiting for the lease to expire.
+		LeaderElectionReleaseOnCancel: true,
 	}
 
 	restConfig := ctrl.GetConfigOrDie()
 	restConfig.QPS = restConfigQPS
 	restConfig.Burst = restConfigBurst
+	// Dedicated identity, so changes made by classifier are not attributed to the field manager
+	// other Sveltos controllers share
+	restConfig.UserAgent = fmt.Sprintf("%s/%s", controllers.UserAgent, version)
 
 	mgr, err := ctrl.NewManager(restConfig, ctrlOptions)
 	if err != nil {
@@ -137,12 +172,29 @@ func main() {
 	controllers.SetSveltosAgentConfigMap(sveltosAgentConfigMap)
 	controllers.SetSveltosAgentRegistry(registry)
 	controllers.SetAgentInMgmtCluster(agentInMgmtCluster)
+	controllers.SetUninstallSveltosAgent(uninstallAgent)
+
+	resolver, err := keymanager.GetConflictResolver(conflictResolution)
+	if err != nil {
+		setupLog.Error(err, "invalid conflict resolution strategy")
+		os.Exit(1)
+	}
+	keymanager.SetConflictResolver(resolver)
+	setupLog.V(logs.LogInfo).Info(fmt.Sprintf("Label conflict resolution strategy: %s", resolver.Name()))
 
 	setupLog.V(logs.LogInfo).Info(fmt.Sprintf("Running in managemnt cluster: %t", agentInMgmtCluster))
 
 	// Setup the context that's going to be used in controllers and for the manager.
 	ctx := ctrl.SetupSignalHandler()
 
+	if keymanagerCheckpoint {
+		keymanager.EnableCheckpoint(mgr.GetClient(), keymanagerCheckpointNamespace, keymanagerCheckpointName,
+			ctrl.Log.WithName("keymanager-checkpoint"))
+		setupLog.V(logs.LogInfo).Info(fmt.Sprintf("Keymanager state checkpointed in ConfigMap %s/%s",
+			keymanagerCheckpointNamespace, keymanagerCheckpointName))
+	}
+	setupKeyManager(mgr)
+
 	d := deployer.GetClient(ctx, ctrl.Log.WithName("deployer"), mgr.GetClient(), workers)
 	controllers.RegisterFeatures(d, setupLog)
 
@@ -176,6 +228,12 @@ func main() {
 		setupLog.Error(err, "unable to create controller", "controller", "SveltosCluster")
 		os.Exit(1)
 	}
+	if enableWebhooks {
+		if err = (&controllers.ClassifierWebhook{}).SetupWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "Classifier")
+			os.Exit(1)
+		}
+	}
 	//+kubebuilder:scaffold:builder
 
 	setupChecks(mgr)
@@ -193,7 +251,9 @@ func main() {
 
 func initFlags(fs *pflag.FlagSet) {
 	fs.IntVar(&tmpReportMode, "report-mode", defaulReportMode,
-		"Indicates how ClassifierReport needs to be collected")
+		"Indicates how ClassifierReport needs to be collected. 0: collected by classifier; "+
+			"1: sent by sveltos-agent to the management cluster API server. "+
+			"It is the default for clusters not setting the "+controllers.ClusterReportModeAnnotation+" annotation")
 
 	fs.BoolVar(&agentInMgmtCluster, "agent-in-mgmt-cluster", false,
 		"When set, indicates drift-detection-manager needs to be started in the management cluster")
@@ -233,6 +293,46 @@ func initFlags(fs *pflag.FlagSet) {
 	fs.StringVar(&registry, "registry", "",
 		"Container registry for sveltos-agent images. Defaults to docker.io/ if empty.")
 
+	fs.StringVar(&conflictResolution, "conflict-resolution", keymanager.FirstWinsStrategy,
+		fmt.Sprintf("Strategy used to decide which Classifier sets a label when multiple Classifiers want to set it on the same cluster. "+
+			"One of: %s", strings.Join(keymanager.GetConflictResolutionStrategies(), ", ")))
+
+	fs.BoolVar(&keymanagerCheckpoint, "keymanager-checkpoint", false,
+		"When set, label ownership state is persisted in a ConfigMap and restored on restart or leader failover "+
+			"instead of being rebuilt from all Classifier Status")
+
+	fs.StringVar(&keymanagerCheckpointNamespace, "keymanager-checkpoint-namespace", "projectsveltos",
+		"Namespace of the ConfigMap used to persist label ownership state")
+
+	fs.StringVar(&keymanagerCheckpointName, "keymanager-checkpoint-name", "classifier-keymanager-state",
+		"Name of the ConfigMap used to persist label ownership state")
+
+	const defaultCheckpointInterval = 10
+	fs.DurationVar(&keymanagerCheckpointInterval, "keymanager-checkpoint-interval", defaultCheckpointInterval*time.Second,
+		fmt.Sprintf("How often label ownership state is persisted (only if changed). Default: %d seconds",
+			defaultCheckpointInterval))
+
+	fs.IntVar(&reportCollectionConcurrency, "report-collection-concurrency", controllers.DefaultReportCollectionConcurrency,
+		fmt.Sprintf("Maximum number of clusters ClassifierReports are collected from in parallel. Default: %d",
+			controllers.DefaultReportCollectionConcurrency))
+
+	fs.DurationVar(&reportCollectionTimeout, "report-collection-timeout", controllers.DefaultReportCollectionTimeout,
+		fmt.Sprintf("Maximum time spent collecting ClassifierReports from a single cluster. Default: %s",
+			controllers.DefaultReportCollectionTimeout))
+
+	fs.IntVar(&labelChangeRateLimit, "label-change-rate-limit", 0,
+		"Maximum number of clusters all Classifiers together can relabel per minute. Label changes over the limit "+
+			"are queued. Default: 0 (no limit)")
+
+	fs.DurationVar(&agentKubeconfigMaxAge, "agent-kubeconfig-max-age", 0,
+		"Maximum age of the kubeconfig sveltos-agent uses to reach the management cluster (only when "+
+			"sveltos-agent sends reports). Kubeconfig is rotated before reaching it. Default: 0 (never rotated)")
+
+	fs.BoolVar(&uninstallAgent, "uninstall-agent", false,
+		"When set, sveltos-agent and the Classifier CRDs are removed from a managed cluster once no Classifier "+
+			"is deployed there anymore or the cluster is unregistered. sveltos-agent is kept while other Sveltos "+
+			"components use it (HealthChecks or EventSources are present). Shared Sveltos CRDs are never removed")
+
 	const defautlRestConfigQPS = 20
 	fs.Float32Var(&restConfigQPS, "kube-api-qps", defautlRestConfigQPS,
 		fmt.Sprintf("Maximum queries per second from the controller client to the Kubernetes API server. Defaults to %d",
@@ -243,16 +343,68 @@ func initFlags(fs *pflag.FlagSet) {
 		fmt.Sprintf("Maximum number of queries that should be allowed in one burst from the controller client to the Kubernetes API server. Default %d",
 			defaultRestConfigBurst))
 
+	fs.BoolVar(&leaderElect, "leader-elect", false,
+		"Enable leader election. Only the leader reconciles, collects ClassifierReports and manages label ownership. "+
+			"Enabling this ensures there is only one active classifier when multiple replicas run.")
+
+	fs.StringVar(&leaderElectionID, "leader-election-id", "1aea9208.projectsveltos.io",
+		"Name of the Lease used for leader election")
+
+	fs.StringVar(&leaderElectionNamespace, "leader-election-namespace", "",
+		"Namespace of the Lease used for leader election. Defaults to the namespace classifier is running in.")
+
+	const defaultLeaseDuration = 15
+	fs.DurationVar(&leaderElectLeaseDuration, "leader-elect-lease-duration", defaultLeaseDuration*time.Second,
+		fmt.Sprintf("Duration non-leader candidates wait before forcing to acquire leadership. Default: %d seconds",
+			defaultLeaseDuration))
+
+	const defaultRenewDeadline = 10
+	fs.DurationVar(&leaderElectRenewDeadline, "leader-elect-renew-deadline", defaultRenewDeadline*time.Second,
+		fmt.Sprintf("Duration the leader retries refreshing leadership before giving it up. Default: %d seconds",
+			defaultRenewDeadline))
+
+	const defaultRetryPeriod = 2
+	fs.DurationVar(&leaderElectRetryPeriod, "leader-elect-retry-period", defaultRetryPeriod*time.Second,
+		fmt.Sprintf("Duration leader election clients wait between tries of actions. Default: %d seconds",
+			defaultRetryPeriod))
+
 	const defaultWebhookPort = 9443
 	fs.IntVar(&webhookPort, "webhook-port", defaultWebhookPort,
 		"Webhook Server port")
 
+	fs.BoolVar(&enableWebhooks, "enable-webhooks", false,
+		"If set, Classifier validating and defaulting webhooks are registered. Webhook server requires a serving certificate. "+
+			"Label conflict warnings are best-effort: only returned when the request is served by the leader")
+
 	const defaultSyncPeriod = 10
 	fs.DurationVar(&syncPeriod, "sync-period", defaultSyncPeriod*time.Minute,
 		fmt.Sprintf("The minimum interval at which watched resources are reconciled (e.g. 15m). Default: %d minutes",
 			defaultSyncPeriod))
 }
 
+// setupKeyManager makes keymanager run only on the leader.
+// As soon as leadership is acquired, keymanager state is restored (from checkpoint or rebuilt), so
+// the new leader is ready to reconcile. When leadership is lost, keymanager state is checkpointed
+// one last time before leadership is released.
+func setupKeyManager(mgr ctrl.Manager) {
+	// RunnableFunc needs leader election, so it is started only once this instance is the leader
+	// (or right away if leader election is disabled).
+	// Without keymanager, label ownership cannot be tracked. Returning an error stops the manager
+	// so the pod is restarted instead of running with it silently disabled.
+	err := mgr.Add(manager.RunnableFunc(func(ctx context.Context) error {
+		if _, err := keymanager.GetKeyManagerInstance(ctx, mgr.GetClient()); err != nil {
+			setupLog.Error(err, "failed to initialize keymanager")
+			return err
+		}
+		keymanager.RunCheckpointer(ctx, keymanagerCheckpointInterval)
+		return nil
+	}))
+	if err != nil {
+		setupLog.Error(err, "unable to set up keymanager")
+		os.Exit(1)
+	}
+}
+
 func setupChecks(mgr ctrl.Manager) {
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
 		setupLog.Error(err, "unable to set up health check")
@@ -332,12 +484,19 @@ func getClassifierReconciler(mgr manager.Manager) *controllers.ClassifierReconci
 		ConcurrentReconciles:  concurrentReconciles,
 		ClusterMap:            make(map[corev1.ObjectReference]*libsveltosset.Set),
 		ClassifierMap:         make(map[corev1.ObjectReference]*libsveltosset.Set),
+		ComposedClassifierMap: make(map[string]*libsveltosset.Set),
 		ShardKey:              shardKey,
 		CapiOnboardAnnotation: capiOnboardAnnotation,
 		AgentInMgmtCluster:    agentInMgmtCluster,
 		ClassifierReportMode:  reportMode,
 		ControlPlaneEndpoint:  managementClusterControlPlaneEndpoint,
 		Mux:                   sync.Mutex{},
+		EventRecorder:         mgr.GetEventRecorderFor("classifier-controller"),
+
+		ReportCollectionConcurrency: reportCollectionConcurrency,
+		ReportCollectionTimeout:     reportCollectionTimeout,
+		LabelChangeRateLimit:        labelChangeRateLimit,
+		AgentKubeconfigMaxAge:       agentKubeconfigMaxAge,
 	}
 }
 
@@ -18,15 +18,59 @@ package scope
 
 import (
 	"context"
+	"encoding/json"
 
 	"github.com/go-logr/logr"
 	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"sigs.k8s.io/cluster-api/util/patch"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 
 	libsveltosv1beta1 "github.com/projectsveltos/libsveltos/api/v1beta1"
 )
 
+const (
+	// ClassifierConditionsAnnotation contains Classifier conditions (JSON list of metav1.Condition).
+	// ClassifierStatus does not have a Conditions field, so conditions are kept in this annotation.
+	ClassifierConditionsAnnotation = "classifier.projectsveltos.io/conditions"
+)
+
+// PendingTransition represents a cluster whose match changed and the time it was first observed.
+// The change is not acted upon until Classifier stabilization window has elapsed.
+type PendingTransition struct {
+	// ClusterRef references the cluster
+	ClusterRef corev1.ObjectReference `json:"clusterRef"`
+
+	// Match is the newly observed match
+	Match bool `json:"match"`
+
+	// Since is the time new match was first observed. It has been observed continuously since then.
+	Since metav1.Time `json:"since"`
+}
+
+// Classifier condition types
+const (
+	// ReadyCondition is True when Classifier has been successfully reconciled: labels are applied
+	// and Classifier is deployed in all clusters
+	ReadyCondition = "Ready"
+
+	// LabelsAppliedCondition is True when labels have been applied to all matching clusters
+	LabelsAppliedCondition = "LabelsApplied"
+
+	// ConflictsPresentCondition is True when at least one label cannot be managed by Classifier
+	// in at least one matching cluster because it is managed by another Classifier
+	ConflictsPresentCondition = "ConflictsPresent"
+
+	// DeploymentFailedCondition is True when Classifier failed to be deployed in at least one cluster
+	DeploymentFailedCondition = "DeploymentFailed"
+
+	// LabelChangesQueuedCondition is True when label changes on at least one cluster are queued
+	// because over the label change rate limits
+	LabelChangesQueuedCondition = "LabelChangesQueued"
+)
+
 // ClassifierScopeParams defines the input parameters used to create a new Classifier Scope.
 type ClassifierScopeParams struct {
 	Client         client.Client
@@ -65,6 +109,10 @@ type ClassifierScope struct {
 	patchHelper    *patch.Helper
 	Classifier     *libsveltosv1beta1.Classifier
 	controllerName string
+	// ConfigMaps containing per-cluster status. Set only once LoadClusterStatuses is called.
+	clusterStatusConfigMaps map[string]*corev1.ConfigMap
+	// Pending transitions are stored, as any other per-cluster status, in ConfigMaps
+	pendingTransitions []PendingTransition
 }
 
 // PatchObject persists the feature configuration and status.
@@ -76,7 +124,13 @@ func (s *ClassifierScope) PatchObject(ctx context.Context) error {
 }
 
 // Close closes the current scope persisting the Classifier configuration and status.
+// If per-cluster status was loaded, it is stored back in ConfigMaps.
 func (s *ClassifierScope) Close(ctx context.Context) error {
+	if s.clusterStatusConfigMaps != nil {
+		if err := s.storeClusterStatuses(ctx); err != nil {
+			return err
+		}
+	}
 	return s.PatchObject(ctx)
 }
 
@@ -100,3 +154,67 @@ func (s *ClassifierScope) SetMachingClusterStatuses(matchingClusters []libsvelto
 func (s *ClassifierScope) SetClusterInfo(clusterInfo []libsveltosv1beta1.ClusterInfo) {
 	s.Classifier.Status.ClusterInfo = clusterInfo
 }
+
+// GetConditions returns Classifier conditions.
+func (s *ClassifierScope) GetConditions() []metav1.Condition {
+	annotations := s.Classifier.GetAnnotations()
+	if annotations == nil {
+		return nil
+	}
+
+	value, ok := annotations[ClassifierConditionsAnnotation]
+	if !ok {
+		return nil
+	}
+
+	var conditions []metav1.Condition
+	if err := json.Unmarshal([]byte(value), &conditions); err != nil {
+		// Conditions are recomputed on each reconciliation. Corrupted ones can be ignored.
+		return nil
+	}
+
+	return conditions
+}
+
+// GetCondition returns the Classifier condition with the given type, nil if not present.
+func (s *ClassifierScope) GetCondition(conditionType string) *metav1.Condition {
+	return meta.FindStatusCondition(s.GetConditions(), conditionType)
+}
+
+// SetCondition adds or updates a Classifier condition.
+// LastTransitionTime is only changed when condition status changes.
+func (s *ClassifierScope) SetCondition(conditionType string, status metav1.ConditionStatus, reason, message string) {
+	conditions := s.GetConditions()
+
+	meta.SetStatusCondition(&conditions, metav1.Condition{
+		Type:               conditionType,
+		Status:             status,
+		Reason:             reason,
+		Message:            message,
+		ObservedGeneration: s.Classifier.Generation,
+	})
+
+	value, err := json.Marshal(conditions)
+	if err != nil {
+		s.Logger.Error(err, "failed to marshal conditions")
+		return
+	}
+
+	annotations := s.Classifier.GetAnnotations()
+	if annotations == nil {
+		annotations = make(map[string]string)
+	}
+	annotations[ClassifierConditionsAnnotation] = string(value)
+	s.Classifier.SetAnnotations(annotations)
+}
+
+// GetPendingTransitions returns Classifier pending transitions.
+func (s *ClassifierScope) GetPendingTransitions() []PendingTransition {
+	return s.pendingTransitions
+}
+
+// SetPendingTransitions sets Classifier pending transitions.
+// Those are persisted by Close only if LoadClusterStatuses was called.
+func (s *ClassifierScope) SetPendingTransitions(transitions []PendingTransition) {
+	s.pendingTransitions = transitions
+}
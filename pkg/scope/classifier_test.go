@@ -146,4 +146,36 @@ var _ = Describe("ClassifierScope", func() {
 		Expect(reflect.DeepEqual(classifier.Status.MachingClusterStatuses, machingClusterStatuses)).To(BeTrue())
 	})
 
+	It("SetCondition adds and updates Classifier conditions", func() {
+		params := scope.ClassifierScopeParams{
+			Client:     c,
+			Classifier: classifier,
+			Logger:     textlogger.NewLogger(textlogger.NewConfig(textlogger.Verbosity(1))),
+		}
+
+		classifierScope, err := scope.NewClassifierScope(params)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(classifierScope).ToNot(BeNil())
+
+		Expect(classifierScope.GetConditions()).To(BeEmpty())
+		Expect(classifierScope.GetCondition(scope.ReadyCondition)).To(BeNil())
+
+		classifierScope.SetCondition(scope.ReadyCondition, metav1.ConditionFalse, "Provisioning", randomString())
+		classifierScope.SetCondition(scope.ConflictsPresentCondition, metav1.ConditionFalse, "NoConflicts", "")
+		Expect(classifierScope.GetConditions()).To(HaveLen(2))
+		Expect(classifier.Annotations).To(HaveKey(scope.ClassifierConditionsAnnotation))
+
+		ready := classifierScope.GetCondition(scope.ReadyCondition)
+		Expect(ready).ToNot(BeNil())
+		Expect(ready.Status).To(Equal(metav1.ConditionFalse))
+		Expect(ready.Reason).To(Equal("Provisioning"))
+
+		classifierScope.SetCondition(scope.ReadyCondition, metav1.ConditionTrue, "Ready", "")
+		Expect(classifierScope.GetConditions()).To(HaveLen(2))
+		ready = classifierScope.GetCondition(scope.ReadyCondition)
+		Expect(ready).ToNot(BeNil())
+		Expect(ready.Status).To(Equal(metav1.ConditionTrue))
+		Expect(ready.Reason).To(Equal("Ready"))
+	})
+
 })
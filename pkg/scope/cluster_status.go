@@ -0,0 +1,422 @@
+/*
+Copyright 2022. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package scope
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	libsveltosv1beta1 "github.com/projectsveltos/libsveltos/api/v1beta1"
+	logs "github.com/projectsveltos/libsveltos/lib/logsettings"
+)
+
+// Per-cluster Classifier status (Status.ClusterInfo and Status.MachingClusterStatuses entries, and
+// pending transitions) is stored in ConfigMaps in the projectsveltos namespace, one per (Classifier, cluster)
+// pair, plus one per Classifier with aggregated counts. ConfigMaps are the source of truth.
+// Classifier Status is still populated with all per-cluster entries, so existing consumers keep working.
+// Only when those would exceed MaxClusterStatusSize, and put Classifier close to etcd object size limit,
+// they are truncated: failed ClusterInfo entries are kept first.
+
+const (
+	// ClusterStatusClassifierLabel is set on ConfigMaps containing per-cluster Classifier status.
+	// Value is the Classifier name.
+	ClusterStatusClassifierLabel = "classifier.projectsveltos.io/status-classifier"
+
+	// ClusterStatusNamespace is the namespace ConfigMaps containing per-cluster Classifier status are in
+	ClusterStatusNamespace = "projectsveltos"
+
+	// MaxClusterStatusSize is the maximum size, in bytes, of the per-cluster entries kept in Classifier Status
+	MaxClusterStatusSize = 512 * 1024
+
+	clusterInfoKey           = "clusterInfo"
+	matchingClusterStatusKey = "matchingClusterStatus"
+	pendingTransitionKey     = "pendingTransition"
+	summaryKey               = "summary"
+)
+
+// ClusterStatusSummary contains aggregated counts of Classifier per-cluster status
+type ClusterStatusSummary struct {
+	// MatchingClusters is the number of clusters currently matching Classifier
+	MatchingClusters int `json:"matchingClusters"`
+
+	// ConflictingClusters is the number of matching clusters where at least one label
+	// cannot be managed by Classifier
+	ConflictingClusters int `json:"conflictingClusters"`
+
+	// ProvisionedClusters is the number of clusters Classifier is deployed in
+	ProvisionedClusters int `json:"provisionedClusters"`
+
+	// ProvisioningClusters is the number of clusters Classifier is being deployed in
+	ProvisioningClusters int `json:"provisioningClusters"`
+
+	// FailedClusters is the number of clusters Classifier failed to be deployed in
+	FailedClusters int `json:"failedClusters"`
+
+	// RemovingClusters is the number of clusters Classifier is being removed from
+	RemovingClusters int `json:"removingClusters"`
+
+	// PendingTransitions is the number of clusters whose match changed but the change
+	// was not acted upon yet because Classifier stabilization window has not elapsed
+	PendingTransitions int `json:"pendingTransitions,omitempty"`
+
+	// Truncated is true if Classifier Status does not contain all per-cluster entries
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// GetClusterStatusSummary returns the ClusterStatusSummary of a Classifier.
+// Returns nil if Classifier has no per-cluster status stored in ConfigMaps.
+func GetClusterStatusSummary(ctx context.Context, c client.Client, classifierName string,
+) (*ClusterStatusSummary, error) {
+
+	configMap := &corev1.ConfigMap{}
+	err := c.Get(ctx, client.ObjectKey{Namespace: ClusterStatusNamespace, Name: getClusterStatusSummaryName(classifierName)},
+		configMap)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	summary := &ClusterStatusSummary{}
+	if err := json.Unmarshal([]byte(configMap.Data[summaryKey]), summary); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse ConfigMap %s/%s", configMap.Namespace, configMap.Name)
+	}
+
+	return summary, nil
+}
+
+// LoadClusterStatuses fills Classifier Status.ClusterInfo and Status.MachingClusterStatuses
+// with the per-cluster status stored in ConfigMaps.
+// Classifier whose per-cluster status has never been stored in ConfigMaps is left untouched.
+func LoadClusterStatuses(ctx context.Context, c client.Client, classifier *libsveltosv1beta1.Classifier) error {
+	configMaps, err := listClusterStatusConfigMaps(ctx, c, classifier.Name)
+	if err != nil {
+		return err
+	}
+
+	_, err = fillClusterStatuses(classifier, configMaps)
+	return err
+}
+
+// LoadClusterStatuses fills Classifier Status and pending transitions with the per-cluster status
+// stored in ConfigMaps. Once loaded, Close stores per-cluster status back in ConfigMaps.
+func (s *ClassifierScope) LoadClusterStatuses(ctx context.Context) error {
+	configMaps, err := listClusterStatusConfigMaps(ctx, s.client, s.Classifier.Name)
+	if err != nil {
+		return err
+	}
+
+	s.pendingTransitions, err = fillClusterStatuses(s.Classifier, configMaps)
+	if err != nil {
+		return err
+	}
+
+	s.clusterStatusConfigMaps = make(map[string]*corev1.ConfigMap, len(configMaps))
+	for i := range configMaps {
+		s.clusterStatusConfigMaps[configMaps[i].Name] = &configMaps[i]
+	}
+	return nil
+}
+
+// fillClusterStatuses fills Classifier Status with the per-cluster status contained in configMaps
+// and returns the pending transitions.
+func fillClusterStatuses(classifier *libsveltosv1beta1.Classifier, configMaps []corev1.ConfigMap,
+) ([]PendingTransition, error) {
+
+	if len(configMaps) == 0 {
+		// Status, if any, is only in the Classifier instance
+		return nil, nil
+	}
+
+	clusterInfo := make([]libsveltosv1beta1.ClusterInfo, 0)
+	matchingClusterStatuses := make([]libsveltosv1beta1.MachingClusterStatus, 0)
+	var pendingTransitions []PendingTransition
+	for i := range configMaps {
+		data := configMaps[i].Data
+		if value, ok := data[clusterInfoKey]; ok {
+			info := libsveltosv1beta1.ClusterInfo{}
+			if err := json.Unmarshal([]byte(value), &info); err != nil {
+				return nil, errors.Wrapf(err, "failed to parse ConfigMap %s/%s", configMaps[i].Namespace, configMaps[i].Name)
+			}
+			clusterInfo = append(clusterInfo, info)
+		}
+		if value, ok := data[matchingClusterStatusKey]; ok {
+			status := libsveltosv1beta1.MachingClusterStatus{}
+			if err := json.Unmarshal([]byte(value), &status); err != nil {
+				return nil, errors.Wrapf(err, "failed to parse ConfigMap %s/%s", configMaps[i].Namespace, configMaps[i].Name)
+			}
+			matchingClusterStatuses = append(matchingClusterStatuses, status)
+		}
+		if value, ok := data[pendingTransitionKey]; ok {
+			transition := PendingTransition{}
+			if err := json.Unmarshal([]byte(value), &transition); err != nil {
+				// A corrupted value only restarts the stabilization window
+				continue
+			}
+			pendingTransitions = append(pendingTransitions, transition)
+		}
+	}
+
+	sort.Slice(pendingTransitions, func(i, j int) bool {
+		return clusterSortKey(&pendingTransitions[i].ClusterRef) < clusterSortKey(&pendingTransitions[j].ClusterRef)
+	})
+
+	classifier.Status.ClusterInfo = clusterInfo
+	classifier.Status.MachingClusterStatuses = matchingClusterStatuses
+	return pendingTransitions, nil
+}
+
+// storeClusterStatuses stores Classifier per-cluster status and its summary in ConfigMaps (only the ones
+// which changed are updated). Per-cluster status in the Classifier instance is truncated if too big.
+func (s *ClassifierScope) storeClusterStatuses(ctx context.Context) error {
+	desired := make(map[string]map[string]string)
+	addEntry := func(cluster *corev1.ObjectReference, key string, value interface{}) error {
+		name := getClusterStatusConfigMapName(s.Classifier.Name, cluster)
+		raw, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		if desired[name] == nil {
+			desired[name] = make(map[string]string)
+		}
+		desired[name][key] = string(raw)
+		return nil
+	}
+
+	if s.Classifier.DeletionTimestamp.IsZero() || len(s.Classifier.Finalizers) != 0 {
+		for i := range s.Classifier.Status.ClusterInfo {
+			if err := addEntry(&s.Classifier.Status.ClusterInfo[i].Cluster, clusterInfoKey,
+				&s.Classifier.Status.ClusterInfo[i]); err != nil {
+				return err
+			}
+		}
+		for i := range s.Classifier.Status.MachingClusterStatuses {
+			if err := addEntry(&s.Classifier.Status.MachingClusterStatuses[i].ClusterRef, matchingClusterStatusKey,
+				&s.Classifier.Status.MachingClusterStatuses[i]); err != nil {
+				return err
+			}
+		}
+		for i := range s.pendingTransitions {
+			if err := addEntry(&s.pendingTransitions[i].ClusterRef, pendingTransitionKey,
+				&s.pendingTransitions[i]); err != nil {
+				return err
+			}
+		}
+	}
+
+	summary, err := s.truncateClusterStatuses()
+	if err != nil {
+		return err
+	}
+	if len(desired) != 0 {
+		raw, err := json.Marshal(summary)
+		if err != nil {
+			return err
+		}
+		desired[getClusterStatusSummaryName(s.Classifier.Name)] = map[string]string{summaryKey: string(raw)}
+	}
+
+	for name, data := range desired {
+		current, ok := s.clusterStatusConfigMaps[name]
+		if !ok {
+			configMap := &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: ClusterStatusNamespace,
+					Name:      name,
+					Labels:    map[string]string{ClusterStatusClassifierLabel: s.Classifier.Name},
+					OwnerReferences: []metav1.OwnerReference{
+						{
+							APIVersion: libsveltosv1beta1.GroupVersion.String(),
+							Kind:       libsveltosv1beta1.ClassifierKind,
+							Name:       s.Classifier.Name,
+							UID:        s.Classifier.UID,
+						},
+					},
+				},
+				Data: data,
+			}
+			err := s.client.Create(ctx, configMap)
+			if err == nil {
+				s.clusterStatusConfigMaps[name] = configMap
+				continue
+			}
+			if !apierrors.IsAlreadyExists(err) {
+				return errors.Wrapf(err, "failed to create ConfigMap %s/%s", ClusterStatusNamespace, name)
+			}
+			// Cache was not updated yet
+			current = &corev1.ConfigMap{}
+			if err := s.client.Get(ctx, client.ObjectKey{Namespace: ClusterStatusNamespace, Name: name}, current); err != nil {
+				return errors.Wrapf(err, "failed to get ConfigMap %s/%s", ClusterStatusNamespace, name)
+			}
+			s.clusterStatusConfigMaps[name] = current
+		}
+		if reflect.DeepEqual(current.Data, data) {
+			continue
+		}
+		current.Data = data
+		if err := s.client.Update(ctx, current); err != nil {
+			return errors.Wrapf(err, "failed to update ConfigMap %s/%s", ClusterStatusNamespace, name)
+		}
+	}
+
+	for name, configMap := range s.clusterStatusConfigMaps {
+		if _, ok := desired[name]; ok {
+			continue
+		}
+		if err := s.client.Delete(ctx, configMap); err != nil && !apierrors.IsNotFound(err) {
+			return errors.Wrapf(err, "failed to delete ConfigMap %s/%s", ClusterStatusNamespace, name)
+		}
+		delete(s.clusterStatusConfigMaps, name)
+	}
+
+	return nil
+}
+
+// truncateClusterStatuses returns the summary of Classifier per-cluster status. If per-cluster entries in
+// Classifier Status exceed MaxClusterStatusSize, those are truncated keeping failed ClusterInfo entries first.
+func (s *ClassifierScope) truncateClusterStatuses() (*ClusterStatusSummary, error) {
+	summary := &ClusterStatusSummary{
+		MatchingClusters:   len(s.Classifier.Status.MachingClusterStatuses),
+		PendingTransitions: len(s.pendingTransitions),
+	}
+	for i := range s.Classifier.Status.MachingClusterStatuses {
+		if len(s.Classifier.Status.MachingClusterStatuses[i].UnManagedLabels) != 0 {
+			summary.ConflictingClusters++
+		}
+	}
+	for i := range s.Classifier.Status.ClusterInfo {
+		switch s.Classifier.Status.ClusterInfo[i].Status {
+		case libsveltosv1beta1.SveltosStatusProvisioned:
+			summary.ProvisionedClusters++
+		case libsveltosv1beta1.SveltosStatusProvisioning:
+			summary.ProvisioningClusters++
+		case libsveltosv1beta1.SveltosStatusRemoving:
+			summary.RemovingClusters++
+		case libsveltosv1beta1.SveltosStatusFailed:
+			summary.FailedClusters++
+		}
+	}
+
+	raw, err := json.Marshal(s.Classifier.Status)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) <= MaxClusterStatusSize {
+		return summary, nil
+	}
+
+	summary.Truncated = true
+	s.Logger.V(logs.LogInfo).Info(fmt.Sprintf("per-cluster status (%d bytes) exceeds %d bytes. Truncating it",
+		len(raw), MaxClusterStatusSize))
+
+	clusterInfo := make([]libsveltosv1beta1.ClusterInfo, len(s.Classifier.Status.ClusterInfo))
+	copy(clusterInfo, s.Classifier.Status.ClusterInfo)
+	sort.SliceStable(clusterInfo, func(i, j int) bool {
+		iFailed := clusterInfo[i].Status == libsveltosv1beta1.SveltosStatusFailed
+		jFailed := clusterInfo[j].Status == libsveltosv1beta1.SveltosStatusFailed
+		if iFailed != jFailed {
+			return iFailed
+		}
+		return clusterSortKey(&clusterInfo[i].Cluster) < clusterSortKey(&clusterInfo[j].Cluster)
+	})
+
+	// Each list gets half of the available size
+	s.Classifier.Status.ClusterInfo, err = truncateList(clusterInfo, MaxClusterStatusSize/2)
+	if err != nil {
+		return nil, err
+	}
+	s.Classifier.Status.MachingClusterStatuses, err = truncateList(
+		sortedMatchingClusterStatuses(s.Classifier.Status.MachingClusterStatuses), MaxClusterStatusSize/2)
+	if err != nil {
+		return nil, err
+	}
+
+	return summary, nil
+}
+
+// truncateList returns the longest prefix of entries whose JSON representation does not exceed maxSize
+func truncateList[T any](entries []T, maxSize int) ([]T, error) {
+	size := 0
+	for i := range entries {
+		raw, err := json.Marshal(&entries[i])
+		if err != nil {
+			return nil, err
+		}
+		size += len(raw) + 1
+		if size > maxSize {
+			return entries[:i], nil
+		}
+	}
+	return entries, nil
+}
+
+func listClusterStatusConfigMaps(ctx context.Context, c client.Client, classifierName string,
+) ([]corev1.ConfigMap, error) {
+
+	configMaps := &corev1.ConfigMapList{}
+	err := c.List(ctx, configMaps, client.InNamespace(ClusterStatusNamespace),
+		client.MatchingLabels{ClusterStatusClassifierLabel: classifierName})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list per-cluster status ConfigMaps")
+	}
+
+	// Keep a stable order
+	sort.Slice(configMaps.Items, func(i, j int) bool {
+		return configMaps.Items[i].Name < configMaps.Items[j].Name
+	})
+	return configMaps.Items, nil
+}
+
+// getClusterStatusConfigMapName returns the name of the ConfigMap containing the status of a
+// Classifier for a given cluster
+func getClusterStatusConfigMapName(classifierName string, cluster *corev1.ObjectReference) string {
+	h := sha256.Sum256([]byte(fmt.Sprintf("%s/%s", classifierName, clusterSortKey(cluster))))
+	return fmt.Sprintf("classifier-status-%x", h[:16])
+}
+
+// getClusterStatusSummaryName returns the name of the ConfigMap containing the summary of a Classifier
+// per-cluster status
+func getClusterStatusSummaryName(classifierName string) string {
+	h := sha256.Sum256([]byte(classifierName))
+	return fmt.Sprintf("classifier-status-summary-%x", h[:16])
+}
+
+func clusterSortKey(cluster *corev1.ObjectReference) string {
+	return fmt.Sprintf("%s:%s/%s", cluster.Kind, cluster.Namespace, cluster.Name)
+}
+
+func sortedMatchingClusterStatuses(statuses []libsveltosv1beta1.MachingClusterStatus,
+) []libsveltosv1beta1.MachingClusterStatus {
+
+	sorted := make([]libsveltosv1beta1.MachingClusterStatus, len(statuses))
+	copy(sorted, statuses)
+	sort.Slice(sorted, func(i, j int) bool {
+		return clusterSortKey(&sorted[i].ClusterRef) < clusterSortKey(&sorted[j].ClusterRef)
+	})
+	return sorted
+}
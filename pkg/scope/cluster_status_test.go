@@ -0,0 +1,224 @@
+/*
+Copyright 2022. projectsveltos.io. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package scope_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog/v2/textlogger"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/projectsveltos/classifier/pkg/scope"
+	libsveltosv1beta1 "github.com/projectsveltos/libsveltos/api/v1beta1"
+)
+
+var _ = Describe("ClassifierScope per-cluster status", func() {
+	var classifier *libsveltosv1beta1.Classifier
+	var c client.Client
+
+	getClusterReference := func(name string) corev1.ObjectReference {
+		return corev1.ObjectReference{
+			Namespace: "default", Name: name,
+			Kind: libsveltosv1beta1.SveltosClusterKind, APIVersion: libsveltosv1beta1.GroupVersion.String(),
+		}
+	}
+
+	BeforeEach(func() {
+		classifier = &libsveltosv1beta1.Classifier{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: classifierNamePrefix + randomString(),
+			},
+		}
+
+		scheme := setupScheme()
+		Expect(corev1.AddToScheme(scheme)).To(Succeed())
+		initObjects := []client.Object{classifier}
+		c = fake.NewClientBuilder().WithScheme(scheme).WithStatusSubresource(initObjects...).
+			WithObjects(initObjects...).Build()
+	})
+
+	It("Close stores per-cluster status in ConfigMaps and LoadClusterStatuses restores it", func() {
+		classifierScope, err := scope.NewClassifierScope(scope.ClassifierScopeParams{
+			Client:     c,
+			Classifier: classifier,
+			Logger:     textlogger.NewLogger(textlogger.NewConfig(textlogger.Verbosity(1))),
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(classifierScope.LoadClusterStatuses(context.TODO())).To(Succeed())
+
+		const clusters = 15
+		clusterInfo := make([]libsveltosv1beta1.ClusterInfo, clusters)
+		for i := 0; i < clusters; i++ {
+			failureMessage := randomString()
+			clusterInfo[i] = libsveltosv1beta1.ClusterInfo{
+				Cluster:        getClusterReference(fmt.Sprintf("cluster-%02d", i)),
+				Status:         libsveltosv1beta1.SveltosStatusFailed,
+				Hash:           []byte(randomString()),
+				FailureMessage: &failureMessage,
+			}
+		}
+		clusterInfo[0].Status = libsveltosv1beta1.SveltosStatusProvisioned
+		clusterInfo[0].FailureMessage = nil
+		classifierScope.SetClusterInfo(clusterInfo)
+		classifierScope.SetMachingClusterStatuses([]libsveltosv1beta1.MachingClusterStatus{
+			{ClusterRef: clusterInfo[0].Cluster, ManagedLabels: []string{randomString()}},
+		})
+
+		Expect(classifierScope.Close(context.TODO())).To(Succeed())
+
+		// One ConfigMap per cluster plus the summary
+		configMaps := &corev1.ConfigMapList{}
+		Expect(c.List(context.TODO(), configMaps, client.InNamespace(scope.ClusterStatusNamespace),
+			client.MatchingLabels{scope.ClusterStatusClassifierLabel: classifier.Name})).To(Succeed())
+		Expect(configMaps.Items).To(HaveLen(clusters + 1))
+
+		// Classifier Status is still fully populated
+		currentClassifier := &libsveltosv1beta1.Classifier{}
+		Expect(c.Get(context.TODO(), types.NamespacedName{Name: classifier.Name}, currentClassifier)).To(Succeed())
+		Expect(currentClassifier.Status.MachingClusterStatuses).To(HaveLen(1))
+		Expect(currentClassifier.Status.ClusterInfo).To(HaveLen(clusters))
+		Expect(currentClassifier.Annotations).To(BeEmpty())
+		summary, err := scope.GetClusterStatusSummary(context.TODO(), c, classifier.Name)
+		Expect(err).To(BeNil())
+		Expect(summary).ToNot(BeNil())
+		Expect(summary.MatchingClusters).To(Equal(1))
+		Expect(summary.ProvisionedClusters).To(Equal(1))
+		Expect(summary.FailedClusters).To(Equal(clusters - 1))
+		Expect(summary.Truncated).To(BeFalse())
+
+		classifierScope, err = scope.NewClassifierScope(scope.ClassifierScopeParams{
+			Client:     c,
+			Classifier: currentClassifier,
+			Logger:     textlogger.NewLogger(textlogger.NewConfig(textlogger.Verbosity(1))),
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(classifierScope.LoadClusterStatuses(context.TODO())).To(Succeed())
+		Expect(currentClassifier.Status.ClusterInfo).To(HaveLen(clusters))
+		Expect(currentClassifier.Status.MachingClusterStatuses).To(HaveLen(1))
+		Expect(currentClassifier.Status.MachingClusterStatuses[0].ClusterRef).To(Equal(clusterInfo[0].Cluster))
+
+		// ConfigMaps for clusters not listed anymore are removed
+		classifierScope.SetClusterInfo(clusterInfo[:1])
+		Expect(classifierScope.Close(context.TODO())).To(Succeed())
+		Expect(c.List(context.TODO(), configMaps, client.InNamespace(scope.ClusterStatusNamespace),
+			client.MatchingLabels{scope.ClusterStatusClassifierLabel: classifier.Name})).To(Succeed())
+		Expect(configMaps.Items).To(HaveLen(2))
+	})
+
+	It("Close truncates per-cluster status in Classifier only when too big", func() {
+		classifierScope, err := scope.NewClassifierScope(scope.ClassifierScopeParams{
+			Client:     c,
+			Classifier: classifier,
+			Logger:     textlogger.NewLogger(textlogger.NewConfig(textlogger.Verbosity(1))),
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(classifierScope.LoadClusterStatuses(context.TODO())).To(Succeed())
+
+		// Each entry is more than 1KiB
+		const clusters = scope.MaxClusterStatusSize / 1024
+		failureMessage := strings.Repeat("a", 1024)
+		clusterInfo := make([]libsveltosv1beta1.ClusterInfo, clusters)
+		for i := 0; i < clusters; i++ {
+			clusterInfo[i] = libsveltosv1beta1.ClusterInfo{
+				Cluster:        getClusterReference(fmt.Sprintf("cluster-%04d", i)),
+				Status:         libsveltosv1beta1.SveltosStatusProvisioned,
+				FailureMessage: &failureMessage,
+			}
+		}
+		clusterInfo[clusters-1].Status = libsveltosv1beta1.SveltosStatusFailed
+		classifierScope.SetClusterInfo(clusterInfo)
+		Expect(classifierScope.Close(context.TODO())).To(Succeed())
+
+		currentClassifier := &libsveltosv1beta1.Classifier{}
+		Expect(c.Get(context.TODO(), types.NamespacedName{Name: classifier.Name}, currentClassifier)).To(Succeed())
+		Expect(len(currentClassifier.Status.ClusterInfo)).To(BeNumerically("<", clusters))
+		// Failures are kept first
+		Expect(currentClassifier.Status.ClusterInfo[0].Cluster).To(Equal(clusterInfo[clusters-1].Cluster))
+		summary, err := scope.GetClusterStatusSummary(context.TODO(), c, classifier.Name)
+		Expect(err).To(BeNil())
+		Expect(summary.Truncated).To(BeTrue())
+		Expect(summary.ProvisionedClusters).To(Equal(clusters - 1))
+
+		// ConfigMaps contain all per-cluster status
+		Expect(scope.LoadClusterStatuses(context.TODO(), c, currentClassifier)).To(Succeed())
+		Expect(currentClassifier.Status.ClusterInfo).To(HaveLen(clusters))
+	})
+
+	It("Close stores pending transitions in ConfigMaps and LoadClusterStatuses restores them", func() {
+		classifierScope, err := scope.NewClassifierScope(scope.ClassifierScopeParams{
+			Client:     c,
+			Classifier: classifier,
+			Logger:     textlogger.NewLogger(textlogger.NewConfig(textlogger.Verbosity(1))),
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(classifierScope.LoadClusterStatuses(context.TODO())).To(Succeed())
+		Expect(classifierScope.GetPendingTransitions()).To(BeEmpty())
+
+		transitions := []scope.PendingTransition{
+			{ClusterRef: getClusterReference(randomString()), Match: true, Since: metav1.Now().Rfc3339Copy()},
+		}
+		classifierScope.SetPendingTransitions(transitions)
+		Expect(classifierScope.Close(context.TODO())).To(Succeed())
+
+		currentClassifier := &libsveltosv1beta1.Classifier{}
+		Expect(c.Get(context.TODO(), types.NamespacedName{Name: classifier.Name}, currentClassifier)).To(Succeed())
+		summary, err := scope.GetClusterStatusSummary(context.TODO(), c, classifier.Name)
+		Expect(err).To(BeNil())
+		Expect(summary).ToNot(BeNil())
+		Expect(summary.PendingTransitions).To(Equal(1))
+
+		classifierScope, err = scope.NewClassifierScope(scope.ClassifierScopeParams{
+			Client:     c,
+			Classifier: currentClassifier,
+			Logger:     textlogger.NewLogger(textlogger.NewConfig(textlogger.Verbosity(1))),
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(classifierScope.LoadClusterStatuses(context.TODO())).To(Succeed())
+		current := classifierScope.GetPendingTransitions()
+		Expect(current).To(HaveLen(1))
+		Expect(current[0].ClusterRef).To(Equal(transitions[0].ClusterRef))
+		Expect(current[0].Match).To(BeTrue())
+		Expect(current[0].Since.Equal(&transitions[0].Since)).To(BeTrue())
+
+		// ConfigMap is removed once the transition is acted upon
+		classifierScope.SetPendingTransitions(nil)
+		Expect(classifierScope.Close(context.TODO())).To(Succeed())
+		configMaps := &corev1.ConfigMapList{}
+		Expect(c.List(context.TODO(), configMaps, client.InNamespace(scope.ClusterStatusNamespace),
+			client.MatchingLabels{scope.ClusterStatusClassifierLabel: classifier.Name})).To(Succeed())
+		Expect(configMaps.Items).To(BeEmpty())
+		summary, err = scope.GetClusterStatusSummary(context.TODO(), c, classifier.Name)
+		Expect(err).To(BeNil())
+		Expect(summary).To(BeNil())
+	})
+
+	It("LoadClusterStatuses leaves status untouched for Classifiers not using ConfigMaps yet", func() {
+		classifier.Status.MachingClusterStatuses = []libsveltosv1beta1.MachingClusterStatus{
+			{ClusterRef: getClusterReference(randomString())},
+		}
+		Expect(scope.LoadClusterStatuses(context.TODO(), c, classifier)).To(Succeed())
+		Expect(classifier.Status.MachingClusterStatuses).To(HaveLen(1))
+	})
+})